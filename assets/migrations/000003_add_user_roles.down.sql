@@ -0,0 +1,6 @@
+-- Rollback migration: 000003_add_user_roles.down.sql
+-- Remove role column from users
+
+DROP INDEX IF EXISTS idx_users_role;
+
+ALTER TABLE users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,6 @@
+-- Migration: 000003_add_user_roles.up.sql
+-- Add role column to users for admin access control
+
+ALTER TABLE users ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'user';
+
+CREATE INDEX idx_users_role ON users(role);
@@ -0,0 +1,4 @@
+-- Rollback migration: 000004_add_user_allowed_networks.down.sql
+-- Remove allowed networks policy from users
+
+ALTER TABLE users DROP COLUMN IF EXISTS allowed_networks;
@@ -0,0 +1,4 @@
+-- Migration: 000004_add_user_allowed_networks.up.sql
+-- Add admin-managed allowed networks policy to users (NULL means full tunnel)
+
+ALTER TABLE users ADD COLUMN allowed_networks TEXT[];
@@ -0,0 +1,8 @@
+-- Rollback migration: 000005_add_user_key_usage.down.sql
+-- Remove data usage totals from user keys
+
+ALTER TABLE user_keys
+    DROP COLUMN IF EXISTS rx_bytes,
+    DROP COLUMN IF EXISTS tx_bytes,
+    DROP COLUMN IF EXISTS last_rx_bytes,
+    DROP COLUMN IF EXISTS last_tx_bytes;
@@ -0,0 +1,8 @@
+-- Migration: 000005_add_user_key_usage.up.sql
+-- Persist running data usage totals per user key, since device counters reset on restart
+
+ALTER TABLE user_keys
+    ADD COLUMN rx_bytes BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN tx_bytes BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN last_rx_bytes BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN last_tx_bytes BIGINT NOT NULL DEFAULT 0;
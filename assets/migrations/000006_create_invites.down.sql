@@ -0,0 +1,6 @@
+-- Rollback migration: 000006_create_invites.down.sql
+-- Remove invite codes
+
+DROP INDEX IF EXISTS idx_invites_used_at;
+
+DROP TABLE IF EXISTS invites;
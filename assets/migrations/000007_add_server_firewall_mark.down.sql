@@ -0,0 +1,5 @@
+-- Rollback migration: 000007_add_server_firewall_mark.down.sql
+-- Remove the WireGuard device firewall mark
+
+ALTER TABLE servers
+    DROP COLUMN IF EXISTS firewall_mark;
@@ -0,0 +1,5 @@
+-- Migration: 000007_add_server_firewall_mark.up.sql
+-- Optional firewall mark applied to the WireGuard device during reconciliation
+
+ALTER TABLE servers
+    ADD COLUMN firewall_mark INTEGER;
@@ -0,0 +1,7 @@
+-- Rollback migration: 000008_create_audit_log.down.sql
+-- Remove the audit log
+
+DROP INDEX IF EXISTS idx_audit_log_created_at;
+DROP INDEX IF EXISTS idx_audit_log_target_id;
+
+DROP TABLE IF EXISTS audit_log;
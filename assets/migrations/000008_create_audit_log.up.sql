@@ -0,0 +1,14 @@
+-- Migration: 000008_create_audit_log.up.sql
+-- Record of administrative actions
+
+CREATE TABLE audit_log (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(64) NOT NULL,
+    target_id UUID,
+    details JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_audit_log_target_id ON audit_log(target_id);
+CREATE INDEX idx_audit_log_created_at ON audit_log(created_at);
@@ -0,0 +1,5 @@
+-- Rollback migration: 000009_add_user_must_change_password.down.sql
+-- Remove the must-change-password flag
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS must_change_password;
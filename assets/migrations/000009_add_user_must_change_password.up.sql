@@ -0,0 +1,5 @@
+-- Migration: 000009_add_user_must_change_password.up.sql
+-- Flag users whose password was reset to a temporary one
+
+ALTER TABLE users
+    ADD COLUMN must_change_password BOOLEAN NOT NULL DEFAULT false;
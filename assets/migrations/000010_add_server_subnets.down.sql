@@ -0,0 +1,6 @@
+-- Rollback migration: 000010_add_server_subnets.down.sql
+-- Remove per-server client address pools
+
+ALTER TABLE servers
+    DROP COLUMN IF EXISTS subnet,
+    DROP COLUMN IF EXISTS subnet_v6;
@@ -0,0 +1,6 @@
+-- Migration: 000010_add_server_subnets.up.sql
+-- Per-server client address pools; a server with only subnet_v6 is IPv6-only
+
+ALTER TABLE servers
+    ADD COLUMN subnet VARCHAR(64) DEFAULT '10.0.0.0/24',
+    ADD COLUMN subnet_v6 VARCHAR(64);
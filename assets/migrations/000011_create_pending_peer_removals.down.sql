@@ -0,0 +1,6 @@
+-- Rollback migration: 000011_create_pending_peer_removals.down.sql
+-- Remove pending peer removals
+
+DROP INDEX IF EXISTS idx_pending_peer_removals_remove_after;
+
+DROP TABLE IF EXISTS pending_peer_removals;
@@ -0,0 +1,10 @@
+-- Migration: 000011_create_pending_peer_removals.up.sql
+-- Rotated-out peers kept on the device until their grace period ends
+
+CREATE TABLE pending_peer_removals (
+    public_key VARCHAR(255) PRIMARY KEY,
+    server_id UUID NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    remove_after TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_pending_peer_removals_remove_after ON pending_peer_removals(remove_after);
@@ -0,0 +1,4 @@
+-- Rollback migration: 000012_add_user_key_persistent_keepalive.down.sql
+-- Remove per-key keepalive override
+
+ALTER TABLE user_keys DROP COLUMN IF EXISTS persistent_keepalive;
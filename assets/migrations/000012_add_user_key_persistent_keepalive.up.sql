@@ -0,0 +1,4 @@
+-- Migration: 000012_add_user_key_persistent_keepalive.up.sql
+-- Per-key keepalive override in seconds; NULL uses the server default
+
+ALTER TABLE user_keys ADD COLUMN persistent_keepalive INTEGER;
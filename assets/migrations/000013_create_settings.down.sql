@@ -0,0 +1,4 @@
+-- Rollback migration: 000013_create_settings.down.sql
+-- Remove runtime settings
+
+DROP TABLE IF EXISTS settings;
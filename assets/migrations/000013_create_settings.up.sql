@@ -0,0 +1,8 @@
+-- Migration: 000013_create_settings.up.sql
+-- Runtime-mutable settings shared by all API replicas
+
+CREATE TABLE settings (
+    key VARCHAR(128) PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
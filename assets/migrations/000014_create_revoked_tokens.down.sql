@@ -0,0 +1,4 @@
+-- Rollback migration: 000014_create_revoked_tokens.down.sql
+-- Remove the revoked token denylist
+
+DROP TABLE IF EXISTS revoked_tokens;
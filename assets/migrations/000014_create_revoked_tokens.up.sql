@@ -0,0 +1,10 @@
+-- Migration: 000014_create_revoked_tokens.up.sql
+-- Denylist of revoked JWT IDs, kept until the token would have expired anyway
+
+CREATE TABLE revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);
@@ -0,0 +1,5 @@
+-- Rollback migration: 000015_add_server_dns_search.down.sql
+-- Remove per-server DNS search domains
+
+ALTER TABLE servers
+    DROP COLUMN IF EXISTS dns_search;
@@ -0,0 +1,5 @@
+-- Migration: 000015_add_server_dns_search.up.sql
+-- Optional comma-separated DNS search domains written into client configs for this server
+
+ALTER TABLE servers
+    ADD COLUMN dns_search VARCHAR(1024);
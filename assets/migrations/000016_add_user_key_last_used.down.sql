@@ -0,0 +1,5 @@
+-- Rollback migration: 000016_add_user_key_last_used.down.sql
+-- Remove the persisted last handshake time
+
+ALTER TABLE user_keys
+    DROP COLUMN IF EXISTS last_used_at;
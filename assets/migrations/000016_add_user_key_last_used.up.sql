@@ -0,0 +1,5 @@
+-- Migration: 000016_add_user_key_last_used.up.sql
+-- Last handshake seen for each key, persisted since device handshake times reset on restart
+
+ALTER TABLE user_keys
+    ADD COLUMN last_used_at TIMESTAMP WITH TIME ZONE;
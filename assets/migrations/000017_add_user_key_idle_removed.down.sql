@@ -0,0 +1,5 @@
+-- Rollback migration: 000017_add_user_key_idle_removed.down.sql
+-- Remove the idle disconnect marker
+
+ALTER TABLE user_keys
+    DROP COLUMN IF EXISTS idle_removed_at;
@@ -0,0 +1,5 @@
+-- Migration: 000017_add_user_key_idle_removed.up.sql
+-- When an active key's peer was taken off the device for being idle; cleared when it is re-added
+
+ALTER TABLE user_keys
+    ADD COLUMN idle_removed_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,4 @@
+-- Rollback migration: 000018_create_server_endpoints.down.sql
+-- Drop the alternative server endpoints
+
+DROP TABLE IF EXISTS server_endpoints;
@@ -0,0 +1,14 @@
+-- Migration: 000018_create_server_endpoints.up.sql
+-- Alternative endpoints of a server, handed to clients whose country, region or ASN matches
+
+CREATE TABLE server_endpoints (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    server_id UUID NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    endpoint VARCHAR(255) NOT NULL,
+    country VARCHAR(64),
+    region VARCHAR(255),
+    asn BIGINT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_server_endpoints_server_id ON server_endpoints(server_id);
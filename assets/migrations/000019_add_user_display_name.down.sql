@@ -0,0 +1,5 @@
+-- Rollback migration: 000019_add_user_display_name.down.sql
+-- Remove user display names
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS display_name;
@@ -0,0 +1,5 @@
+-- Migration: 000019_add_user_display_name.up.sql
+-- Optional friendly name shown by UIs in place of the email
+
+ALTER TABLE users
+    ADD COLUMN display_name VARCHAR(64);
@@ -0,0 +1,5 @@
+-- Rollback migration: 000020_add_user_tokens_valid_after.down.sql
+-- Remove the session revocation cutoff
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS tokens_valid_after;
@@ -0,0 +1,5 @@
+-- Migration: 000020_add_user_tokens_valid_after.up.sql
+-- Tokens issued before this time are rejected, so a user can sign out every session at once
+
+ALTER TABLE users
+    ADD COLUMN tokens_valid_after TIMESTAMP WITH TIME ZONE;
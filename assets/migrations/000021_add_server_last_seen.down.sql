@@ -0,0 +1,5 @@
+-- Rollback migration: 000021_add_server_last_seen.down.sql
+-- Remove the server last seen time
+
+ALTER TABLE servers
+    DROP COLUMN IF EXISTS last_seen_at;
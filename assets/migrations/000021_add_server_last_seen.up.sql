@@ -0,0 +1,5 @@
+-- Migration: 000021_add_server_last_seen.up.sql
+-- When the server's WireGuard device last answered a periodic check
+
+ALTER TABLE servers
+    ADD COLUMN last_seen_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,4 @@
+-- Rollback migration: 000022_create_ip_reservations.down.sql
+-- Drop the client address reservations
+
+DROP TABLE IF EXISTS ip_reservations;
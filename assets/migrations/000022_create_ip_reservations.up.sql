@@ -0,0 +1,10 @@
+-- Migration: 000022_create_ip_reservations.up.sql
+-- Client addresses held for peers provisioned outside the API, kept out of allocation
+
+CREATE TABLE ip_reservations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    server_id UUID NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    address VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(server_id, address)
+);
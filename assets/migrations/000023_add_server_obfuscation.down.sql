@@ -0,0 +1,5 @@
+-- Rollback migration: 000023_add_server_obfuscation.down.sql
+-- Remove the server obfuscation profile
+
+ALTER TABLE servers
+    DROP COLUMN IF EXISTS obfuscation;
@@ -0,0 +1,5 @@
+-- Migration: 000023_add_server_obfuscation.up.sql
+-- Optional AmneziaWG obfuscation parameters handed to clients that request an obfuscated config
+
+ALTER TABLE servers
+    ADD COLUMN obfuscation JSONB;
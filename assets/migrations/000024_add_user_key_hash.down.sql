@@ -0,0 +1,10 @@
+-- Rollback migration: 000024_add_user_key_hash.down.sql
+-- Remove public key hashes; keys kept only as a hash cannot be restored and are dropped
+
+DROP INDEX IF EXISTS idx_user_keys_key_lookup;
+
+DELETE FROM user_keys WHERE public_key IS NULL;
+
+ALTER TABLE user_keys
+    DROP COLUMN IF EXISTS public_key_hash,
+    ALTER COLUMN public_key SET NOT NULL;
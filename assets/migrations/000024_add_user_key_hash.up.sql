@@ -0,0 +1,8 @@
+-- Migration: 000024_add_user_key_hash.up.sql
+-- Keyed hash of client public keys so deactivated keys can be matched without keeping the raw key
+
+ALTER TABLE user_keys
+    ADD COLUMN public_key_hash VARCHAR(64),
+    ALTER COLUMN public_key DROP NOT NULL;
+
+CREATE INDEX idx_user_keys_key_lookup ON user_keys ((COALESCE(public_key_hash, public_key)));
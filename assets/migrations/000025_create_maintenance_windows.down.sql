@@ -0,0 +1,4 @@
+-- Rollback migration: 000025_create_maintenance_windows.down.sql
+-- Drop the server maintenance windows
+
+DROP TABLE IF EXISTS maintenance_windows;
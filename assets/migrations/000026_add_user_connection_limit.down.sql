@@ -0,0 +1,5 @@
+-- Rollback migration: 000026_add_user_connection_limit.down.sql
+-- Drop the per-user concurrent connection limit
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS max_concurrent_connections;
@@ -0,0 +1,5 @@
+-- Migration: 000026_add_user_connection_limit.up.sql
+-- Per-user override of how many peers may be connected at once; NULL uses the server-wide limit
+
+ALTER TABLE users
+    ADD COLUMN max_concurrent_connections INTEGER CHECK (max_concurrent_connections >= 0);
@@ -0,0 +1,4 @@
+-- Rollback migration: 000027_add_users_email_lower_index.down.sql
+-- Drop the case-insensitive email index
+
+DROP INDEX IF EXISTS idx_users_email_lower;
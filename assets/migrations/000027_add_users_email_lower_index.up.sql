@@ -0,0 +1,4 @@
+-- Migration: 000027_add_users_email_lower_index.up.sql
+-- Make emails unique regardless of case; accounts that differ only in email case must be merged first
+
+CREATE UNIQUE INDEX idx_users_email_lower ON users (LOWER(email));
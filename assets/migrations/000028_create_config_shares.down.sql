@@ -0,0 +1,4 @@
+-- Rollback migration: 000028_create_config_shares.down.sql
+-- Drop the shareable config links
+
+DROP TABLE IF EXISTS config_shares;
@@ -0,0 +1,5 @@
+-- Rollback migration: 000029_add_server_doh_template.down.sql
+-- Remove per-server DNS-over-HTTPS templates
+
+ALTER TABLE servers
+    DROP COLUMN IF EXISTS doh_template;
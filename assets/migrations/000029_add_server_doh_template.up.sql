@@ -0,0 +1,5 @@
+-- Migration: 000029_add_server_doh_template.up.sql
+-- Optional DNS-over-HTTPS template suggested in a comment of client configs that ask for it
+
+ALTER TABLE servers
+    ADD COLUMN doh_template VARCHAR(2048);
@@ -0,0 +1,7 @@
+-- Rollback migration: 000030_add_invite_user.down.sql
+-- Remove account invites
+
+DELETE FROM invites WHERE user_id IS NOT NULL;
+
+ALTER TABLE invites
+    DROP COLUMN IF EXISTS user_id;
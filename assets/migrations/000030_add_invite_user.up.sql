@@ -0,0 +1,5 @@
+-- Migration: 000030_add_invite_user.up.sql
+-- Invites issued for an account an admin created ahead of time, accepted by setting its password
+
+ALTER TABLE invites
+    ADD COLUMN user_id UUID REFERENCES users(id) ON DELETE CASCADE;
@@ -0,0 +1,4 @@
+-- Rollback migration: 000031_create_refresh_tokens.down.sql
+-- Remove refresh tokens
+
+DROP TABLE IF EXISTS refresh_tokens;
@@ -0,0 +1,6 @@
+-- Rollback migration: 000032_add_server_traffic_totals.down.sql
+-- Remove per-server traffic totals
+
+ALTER TABLE servers
+    DROP COLUMN IF EXISTS rx_bytes,
+    DROP COLUMN IF EXISTS tx_bytes;
@@ -0,0 +1,16 @@
+-- Migration: 000032_add_server_traffic_totals.up.sql
+-- Persist running traffic totals per server, which keep growing when keys are removed or devices restart
+
+ALTER TABLE servers
+    ADD COLUMN rx_bytes BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN tx_bytes BIGINT NOT NULL DEFAULT 0;
+
+-- Start from the traffic already recorded for the server's keys
+UPDATE servers
+SET rx_bytes = totals.rx_bytes, tx_bytes = totals.tx_bytes
+FROM (
+    SELECT server_id, SUM(rx_bytes) AS rx_bytes, SUM(tx_bytes) AS tx_bytes
+    FROM user_keys
+    GROUP BY server_id
+) totals
+WHERE totals.server_id = servers.id;
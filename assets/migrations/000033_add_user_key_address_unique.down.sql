@@ -0,0 +1,4 @@
+-- Rollback migration: 000033_add_user_key_address_unique.down.sql
+-- Remove the unique active address index; keys deactivated as duplicates stay inactive
+
+DROP INDEX IF EXISTS idx_user_keys_active_address;
@@ -0,0 +1,16 @@
+-- Migration: 000033_add_user_key_address_unique.up.sql
+-- At most one active key per address on a server, so concurrent provisioning cannot share an address
+
+-- The previous count-based allocator could hand an address to two keys. WireGuard routes a shared
+-- address to the peer configured last, so the most recently updated key keeps it and the others are
+-- deactivated, to be provisioned again with an address of their own.
+UPDATE user_keys k
+SET is_active = false, updated_at = NOW(),
+    public_key = CASE WHEN k.public_key_hash IS NULL THEN k.public_key END
+WHERE k.is_active = true AND EXISTS (
+    SELECT 1 FROM user_keys other
+    WHERE other.server_id = k.server_id AND other.allowed_ips = k.allowed_ips AND other.is_active = true
+        AND (COALESCE(other.updated_at, 'epoch'), other.id) > (COALESCE(k.updated_at, 'epoch'), k.id)
+);
+
+CREATE UNIQUE INDEX idx_user_keys_active_address ON user_keys (server_id, allowed_ips) WHERE is_active = true;
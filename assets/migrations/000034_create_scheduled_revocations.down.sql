@@ -0,0 +1,4 @@
+-- Rollback migration: 000034_create_scheduled_revocations.down.sql
+-- Drop the scheduled key revocations
+
+DROP TABLE IF EXISTS scheduled_revocations;
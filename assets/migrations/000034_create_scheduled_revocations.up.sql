@@ -0,0 +1,14 @@
+-- Migration: 000034_create_scheduled_revocations.up.sql
+-- Admin-scheduled revocation of all of a user's keys at a future time
+
+CREATE TABLE scheduled_revocations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    revoke_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    scheduled_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    executed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_scheduled_revocations_pending ON scheduled_revocations(revoke_at) WHERE executed_at IS NULL;
+CREATE INDEX idx_scheduled_revocations_user ON scheduled_revocations(user_id);
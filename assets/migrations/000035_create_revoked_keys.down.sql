@@ -0,0 +1,4 @@
+-- Rollback migration: 000035_create_revoked_keys.down.sql
+-- Drop the record of revoked keys
+
+DROP TABLE IF EXISTS revoked_keys;
@@ -0,0 +1,18 @@
+-- Migration: 000035_create_revoked_keys.up.sql
+-- Every key deactivated on a server, kept after its user_keys row is reused for a new key, so a
+-- revoked key can still be recognised when it is resubmitted
+
+CREATE TABLE revoked_keys (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    server_id UUID NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    -- The key's hash when keys are hashed, otherwise the key itself, as matched by COALESCE(public_key_hash, public_key)
+    key_lookup VARCHAR(255) NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, server_id, key_lookup)
+);
+
+INSERT INTO revoked_keys (user_id, server_id, key_lookup, revoked_at)
+SELECT user_id, server_id, COALESCE(public_key_hash, public_key), COALESCE(updated_at, NOW())
+FROM user_keys
+WHERE is_active = false AND COALESCE(public_key_hash, public_key) IS NOT NULL
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,4 @@
+-- Rollback migration: 000036_create_user_key_events.down.sql
+-- Drop the key history
+
+DROP TABLE IF EXISTS user_key_events;
@@ -0,0 +1,27 @@
+-- Migration: 000036_create_user_key_events.up.sql
+-- Append-only history of each user's keys: one row each time a key is added, rotated or revoked.
+-- user_keys holds one row per user and server that every new key overwrites, so it cannot keep it.
+
+CREATE TABLE user_key_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_key_id UUID NOT NULL REFERENCES user_keys(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    server_id UUID NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    event VARCHAR(16) NOT NULL CHECK (event IN ('added', 'rotated', 'revoked')),
+    -- Only the start of the key is kept, enough for its owner to recognise it
+    public_key_prefix VARCHAR(8) NOT NULL DEFAULT '',
+    allowed_ips TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_user_key_events_user ON user_key_events(user_id, created_at DESC);
+
+-- Seed the history with what user_keys still knows: each key's current value and its deactivation
+INSERT INTO user_key_events (user_key_id, user_id, server_id, event, public_key_prefix, allowed_ips, created_at)
+SELECT id, user_id, server_id, 'added', COALESCE(LEFT(public_key, 8), ''), allowed_ips, COALESCE(created_at, NOW())
+FROM user_keys;
+
+INSERT INTO user_key_events (user_key_id, user_id, server_id, event, public_key_prefix, allowed_ips, created_at)
+SELECT id, user_id, server_id, 'revoked', COALESCE(LEFT(public_key, 8), ''), allowed_ips, COALESCE(updated_at, NOW())
+FROM user_keys
+WHERE is_active = false;
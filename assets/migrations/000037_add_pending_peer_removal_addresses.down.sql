@@ -0,0 +1,4 @@
+-- Rollback migration: 000037_add_pending_peer_removal_addresses.down.sql
+-- Drop the addresses held by rotated-out peers
+
+ALTER TABLE pending_peer_removals DROP COLUMN IF EXISTS allowed_ips;
@@ -0,0 +1,5 @@
+-- Migration: 000037_add_pending_peer_removal_addresses.up.sql
+-- A rotated-out peer keeps its address until it is removed, so the allocator must treat it as taken.
+-- Rows scheduled before this migration handed their address to the new key and hold none.
+
+ALTER TABLE pending_peer_removals ADD COLUMN allowed_ips TEXT NOT NULL DEFAULT '';
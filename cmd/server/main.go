@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
@@ -11,35 +14,121 @@ import (
 	"github.com/denzelpenzel/vpn/internal/api"
 	"github.com/denzelpenzel/vpn/internal/config"
 	"github.com/denzelpenzel/vpn/internal/database"
+	"github.com/denzelpenzel/vpn/internal/lifecycle"
 	"github.com/denzelpenzel/vpn/internal/logger"
 	"github.com/denzelpenzel/vpn/internal/services"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
-func synchronizeKeys(serverService *services.ServerService, logger *zap.Logger) {
-	const keyFilePath = "/config/publickey"
-	const serverIDStr = "a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f"
+// localServerID is the ID of the server row backed by this host's WireGuard device
+var localServerID = uuid.MustParse("a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f")
 
-	serverID, err := uuid.Parse(serverIDStr)
-	if err != nil {
-		logger.Fatal("Failed to parse static server ID", zap.Error(err))
-	}
+// keyFilePath is where the wireguard container writes this host's public key
+const keyFilePath = "/config/publickey"
+
+// serverPrivateKeyPath is where the wireguard container reads this host's private key on startup
+const serverPrivateKeyPath = "/config/server/privatekey-server"
+
+// synchronizeKeys stores this host's public key at startup, telling operators when it replaced a
+// different one so clients know to re-provision
+func synchronizeKeys(serverService *services.ServerService, notifier *services.WebhookNotifier, logger *zap.Logger) {
+	serverID := localServerID
 
-	// Retry logic to wait for the key file to be created by the wireguard container
-	maxRetries := 10
+	// Retry with backoff while the key file is being created by the wireguard container
+	const maxRetries = 10
+	backoff := time.Second
 	for i := 0; i < maxRetries; i++ {
-		err := serverService.SyncServerPublicKey(context.Background(), keyFilePath, serverID)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		changed, err := serverService.SyncServerPublicKey(ctx, keyFilePath, serverID)
+		cancel()
 		if err == nil {
 			logger.Info("Successfully synchronized WireGuard public key.")
+			// A key regenerated while the service was down is as much a change as one seen by key-sync
+			if changed {
+				notifyCtx, cancelNotify := context.WithTimeout(context.Background(), 10*time.Second)
+				notifyServerKeyChanged(notifyCtx, notifier, logger)
+				cancelNotify()
+			}
 			return
 		}
-		logger.Warn("Failed to sync WireGuard public key, retrying in 5 seconds...", zap.Error(err), zap.Int("attempt", i+1))
-		time.Sleep(5 * time.Second)
+		if !errors.Is(err, services.ErrKeyFileNotReady) {
+			logger.Fatal("Failed to synchronize WireGuard public key", zap.Error(err))
+		}
+
+		logger.Warn("WireGuard public key file not ready, retrying...",
+			zap.Error(err),
+			zap.Int("attempt", i+1),
+			zap.Duration("backoff", backoff))
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
 	}
 	logger.Fatal("Failed to synchronize WireGuard public key after multiple retries. Please check the WireGuard container logs.")
 }
 
+// refreshServerKey re-reads the public key file so a key regenerated by the wireguard container
+// reaches the database, and tells operators when clients must re-provision
+func refreshServerKey(ctx context.Context, serverService *services.ServerService, notifier *services.WebhookNotifier, logger *zap.Logger) {
+	changed, err := serverService.SyncServerPublicKey(ctx, keyFilePath, localServerID)
+	if err != nil {
+		logger.Warn("Failed to refresh WireGuard public key", zap.Error(err))
+		return
+	}
+	if changed {
+		notifyServerKeyChanged(ctx, notifier, logger)
+	}
+}
+
+// notifyServerKeyChanged tells operators this host's key was replaced, so configs issued with the old
+// one no longer work
+func notifyServerKeyChanged(ctx context.Context, notifier *services.WebhookNotifier, logger *zap.Logger) {
+	event := map[string]string{"server_id": localServerID.String()}
+	if err := notifier.Notify(ctx, services.EventServerKeyChanged, event); err != nil {
+		logger.Error("Failed to send server key change notification", zap.Error(err))
+	}
+}
+
+// reloadServers re-reads server definitions into the cache and re-applies stored peers to the device
+func reloadServers(serverService *services.ServerService, wireguardService *services.WireguardService, logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	servers, err := serverService.ReloadServers(ctx)
+	if err != nil {
+		logger.Error("Failed to reload servers", zap.Error(err))
+		return
+	}
+
+	peerCount, err := wireguardService.ReconcilePeers(ctx, localServerID)
+	if err != nil {
+		logger.Error("Failed to reconcile WireGuard peers", zap.Error(err))
+		return
+	}
+
+	logger.Info("Reloaded server definitions",
+		zap.Int("server_count", len(servers)),
+		zap.Int("peer_count", peerCount))
+}
+
+// startWireGuard waits for the device and re-applies stored peers to it. A device that does not come
+// up in time is not fatal: the API starts degraded and peers are re-applied on the next reload.
+func startWireGuard(ctx context.Context, wireguardService *services.WireguardService, timeout time.Duration, logger *zap.Logger) {
+	if err := wireguardService.WaitForDevice(ctx, timeout); err != nil {
+		logger.Warn("WireGuard device not available, starting without reconciling peers", zap.Error(err))
+		return
+	}
+
+	reconcileCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	peerCount, err := wireguardService.ReconcilePeers(reconcileCtx, localServerID)
+	if err != nil {
+		logger.Error("Failed to reconcile WireGuard peers", zap.Error(err))
+		return
+	}
+	logger.Info("Reconciled WireGuard peers", zap.Int("peer_count", peerCount))
+}
+
 func main() {
 
 	// Initialize logger
@@ -54,39 +143,270 @@ func main() {
 	if err != nil {
 		zapLogger.Fatal("Failed to load configuration", zap.Error(err))
 	}
+	zapLogger.Info("Effective configuration",
+		zap.String("environment", cfg.Server.Environment),
+		zap.Any("config", cfg.Redacted()))
 
 	// Initialize database with automigrations enabled
 	db, err := database.NewConnection(cfg.Database, true, zapLogger)
 	if err != nil {
 		zapLogger.Fatal("Failed to connect to database", zap.Error(err))
 	}
-	defer db.Close()
 
 	// Initialize services
 	userService := services.NewUserService(db, zapLogger)
+	userService.SetPreserveEmailCase(cfg.Registration.PreserveEmailCase)
 	authService := services.NewAuthService(cfg.JWT.Secret, zapLogger)
+	authService.SetDB(db)
+	authService.SetMinimalClaims(cfg.JWT.MinimalClaims)
+	authService.SetTokenLifetimes(cfg.JWT.AccessTokenTTL, cfg.JWT.RefreshTokenTTL)
+	authService.SetPasswordAttemptLimit(cfg.Security.PasswordMaxFailures, cfg.Security.PasswordFailureWindow)
+	hashCost := cfg.PasswordHashCost()
+	passwordHasher, err := services.NewPasswordHasher(cfg.Security.PasswordHash, services.PasswordHashCost{
+		BCryptCost:   hashCost.BCryptCost,
+		Argon2Time:   uint32(hashCost.Argon2Time),
+		Argon2Memory: uint32(hashCost.Argon2Memory),
+	})
+	if err != nil {
+		zapLogger.Fatal("Failed to initialize password hasher", zap.Error(err))
+	}
+	authService.SetPasswordHasher(cfg.Security.PasswordHash, passwordHasher)
 	wireguardService, err := services.NewWireguardService(zapLogger)
 	if err != nil {
 		zapLogger.Fatal("Failed to initialize WireGuard service", zap.Error(err))
 	}
 	wireguardService.SetDB(db) // Set database connection
+	wireguardService.SetLocalServerID(localServerID)
+	wireguardService.SetRotationGrace(cfg.WireGuard.RotationGrace)
+	wireguardService.SetPersistentKeepalive(cfg.WireGuard.PersistentKeepalive)
+	wireguardService.SetProvisionCooldown(cfg.WireGuard.ProvisionCooldown)
+	wireguardService.SetRejectReusedKeys(cfg.WireGuard.RejectReusedKeys)
+	wireguardService.SetKeyPepper([]byte(cfg.WireGuard.KeyPepper))
+	wireguardService.SetSplitTunnelGateway(cfg.WireGuard.SplitTunnelGateway)
+	wireguardService.SetDeviceConcurrency(cfg.WireGuard.MaxConcurrentOps, cfg.WireGuard.ConcurrencyWait)
+	wireguardService.SetIdleTimeout(cfg.WireGuard.IdleTimeout)
+	wireguardService.SetConnectionLimit(cfg.WireGuard.ConnectionLimit)
+	wireguardService.SetServerKeyFile(serverPrivateKeyPath)
+	wireguardService.SetServerProvisionRate(cfg.WireGuard.ProvisionRate, cfg.WireGuard.ProvisionBurst)
+	if cfg.WireGuard.EnforceNetworks {
+		firewall, err := services.NewIPTablesFirewall("wg0", zapLogger)
+		if err != nil {
+			zapLogger.Fatal("Failed to set up allowed networks enforcement", zap.Error(err))
+		}
+		wireguardService.SetPeerFirewall(firewall)
+	}
 	serverService := services.NewServerService(db, zapLogger)
+	inviteService := services.NewInviteService(db, zapLogger)
+	auditService := services.NewAuditService(db, zapLogger)
+	settingsService := services.NewSettingsService(db, zapLogger)
+	notifier := services.NewWebhookNotifier(cfg.Notifications.WebhookURL, zapLogger)
+
+	// Seed the server row for this host on a fresh deployment
+	if cfg.DefaultServer.Endpoint != "" {
+		serverService.SetDefaultServer(services.DefaultServer{
+			ID:       localServerID,
+			Name:     cfg.DefaultServer.Name,
+			Location: cfg.DefaultServer.Location,
+			Endpoint: cfg.DefaultServer.Endpoint,
+			Port:     cfg.DefaultServer.Port,
+		})
+	}
+	seedCtx, cancelSeed := context.WithTimeout(context.Background(), 10*time.Second)
+	if _, err := serverService.InitializeDefaultServers(seedCtx); err != nil {
+		zapLogger.Fatal("Failed to seed default server", zap.Error(err))
+	}
+	cancelSeed()
+
+	// Stored hashes must follow the current pepper, or its absence, for lookups to find the keys
+	hashCtx, cancelHash := context.WithTimeout(context.Background(), 30*time.Second)
+	if _, err := wireguardService.HashStoredKeys(hashCtx); err != nil {
+		zapLogger.Fatal("Failed to hash stored public keys", zap.Error(err))
+	}
+	cancelHash()
+
+	// Create the first admin on a fresh deployment
+	if cfg.Bootstrap.AdminEmail != "" {
+		passwordHash, err := authService.HashPassword(cfg.Bootstrap.AdminPassword)
+		if err != nil {
+			zapLogger.Fatal("Failed to hash bootstrap admin password", zap.Error(err))
+		}
+		bootstrapCtx, cancelBootstrap := context.WithTimeout(context.Background(), 10*time.Second)
+		if _, err := userService.EnsureBootstrapAdmin(bootstrapCtx, cfg.Bootstrap.AdminEmail, passwordHash); err != nil {
+			zapLogger.Error("Failed to create bootstrap admin", zap.Error(err))
+		}
+		cancelBootstrap()
+	}
 
 	// Synchronize WireGuard public key with the database
 	// This is done in a retry loop to handle cases where the API starts before the key is generated
-	synchronizeKeys(serverService, zapLogger)
+	synchronizeKeys(serverService, notifier, zapLogger)
 
 	// Initialize API server
-	server := api.NewServer(cfg, zapLogger, userService, authService, wireguardService, serverService)
+	server := api.NewServer(cfg, zapLogger, userService, authService, wireguardService, serverService, inviteService, auditService, settingsService)
+	server.SetDB(db)
+	var dbHealth *database.Health
+	if cfg.Database.DegradedMode {
+		dbHealth = database.NewHealth(zapLogger)
+		authService.SetDatabaseHealth(dbHealth)
+		serverService.SetDatabaseHealth(dbHealth)
+		server.SetDatabaseHealth(dbHealth)
 
-	// Start server in goroutine
-	go func() {
-		zapLogger.Info("Starting VPN API server", zap.String("address", cfg.Server.Address))
+		// Tokens are checked against this snapshot of revocations should the database go down
+		snapshotCtx, cancelSnapshot := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := authService.RefreshRevocations(snapshotCtx); err != nil {
+			zapLogger.Warn("Failed to snapshot token revocations", zap.Error(err))
+		}
+		cancelSnapshot()
+	}
+	clientCompat, err := services.NewClientCompatibility(cfg.Clients.MinVersions)
+	if err != nil {
+		zapLogger.Fatal("Failed to load client versions", zap.Error(err))
+	}
+	server.SetClientCompatibility(clientCompat)
+	wireguardService.SetRateLimitObserver(server.ObserveRateLimit)
+	if cfg.WireGuard.LogRateLimits {
+		rateLimitLogger, err := logger.NewDebugLogger("ratelimit")
+		if err != nil {
+			zapLogger.Fatal("Failed to initialize rate limit logger", zap.Error(err))
+		}
+		server.SetRateLimitLogger(rateLimitLogger, cfg.WireGuard.RateLimitLogSample)
+	}
+	if cfg.Server.TLSEnabled() {
+		keyPair, err := tls.LoadX509KeyPair(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		if err != nil {
+			zapLogger.Fatal("Failed to load TLS certificate", zap.Error(err))
+		}
+		leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+		if err != nil {
+			zapLogger.Fatal("Failed to parse TLS certificate", zap.Error(err))
+		}
+		server.SetTLSCertificate(leaf)
+	}
+	if cfg.Server.GeoIPDatabase != "" {
+		geoLocator, err := services.NewCSVGeoLocator(cfg.Server.GeoIPDatabase)
+		if err != nil {
+			zapLogger.Fatal("Failed to load geo database", zap.Error(err))
+		}
+		server.SetGeoLocator(geoLocator)
+		wireguardService.SetGeoLocator(geoLocator)
+	}
+
+	// Register components; each stops before the components it depends on
+	registry := lifecycle.NewRegistry(zapLogger)
+	reload := make(chan os.Signal, 1)
+	components := []lifecycle.Component{
+		{
+			Name: "database",
+			Stop: func(ctx context.Context) error {
+				db.Close()
+				return nil
+			},
+		},
+		{
+			Name:      "wireguard",
+			DependsOn: []string{"database"},
+			Start: func(ctx context.Context) error {
+				startWireGuard(ctx, wireguardService, cfg.WireGuard.DeviceWaitTimeout, zapLogger)
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				return wireguardService.Close()
+			},
+		},
+		{
+			Name:      "reload",
+			DependsOn: []string{"database", "wireguard"},
+			Start: func(ctx context.Context) error {
+				// Reload server definitions on SIGHUP
+				signal.Notify(reload, syscall.SIGHUP)
+				go func() {
+					for range reload {
+						reloadServers(serverService, wireguardService, zapLogger)
+					}
+				}()
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				signal.Stop(reload)
+				close(reload)
+				return nil
+			},
+		},
+		lifecycle.Worker("usage-collector", cfg.Workers.UsageInterval, func(ctx context.Context) {
+			if err := wireguardService.CollectUsage(ctx, localServerID); err != nil {
+				zapLogger.Warn("Failed to collect peer usage", zap.Error(err))
+			}
+		}, "database", "wireguard"),
+		lifecycle.Worker("key-sync", cfg.Workers.KeySyncInterval, func(ctx context.Context) {
+			refreshServerKey(ctx, serverService, notifier, zapLogger)
+		}, "database"),
+		lifecycle.Worker("peer-expiry", cfg.Workers.PeerExpiryInterval, func(ctx context.Context) {
+			if _, err := wireguardService.RemoveExpiredPeers(ctx); err != nil {
+				zapLogger.Warn("Failed to remove expired peers", zap.Error(err))
+			}
+		}, "database", "wireguard"),
+		lifecycle.Worker("scheduled-revocation", cfg.Workers.PeerExpiryInterval, func(ctx context.Context) {
+			if _, err := wireguardService.ExecuteScheduledRevocations(ctx); err != nil {
+				zapLogger.Warn("Failed to execute scheduled revocations", zap.Error(err))
+			}
+		}, "database", "wireguard"),
+		lifecycle.Worker("idle-disconnect", cfg.Workers.IdleCheckInterval, func(ctx context.Context) {
+			if _, err := wireguardService.DisconnectIdlePeers(ctx, localServerID); err != nil {
+				zapLogger.Warn("Failed to disconnect idle peers", zap.Error(err))
+			}
+		}, "database", "wireguard"),
+		lifecycle.Worker("connection-limit", cfg.Workers.IdleCheckInterval, func(ctx context.Context) {
+			if _, err := wireguardService.EnforceConnectionLimits(ctx, localServerID); err != nil {
+				zapLogger.Warn("Failed to enforce connection limits", zap.Error(err))
+			}
+		}, "database", "wireguard"),
+		lifecycle.Worker("token-cleanup", cfg.Workers.TokenCleanupInterval, func(ctx context.Context) {
+			if _, err := authService.PurgeExpiredRevokedTokens(ctx); err != nil {
+				zapLogger.Warn("Failed to purge revoked tokens", zap.Error(err))
+			}
+			if _, err := authService.PurgeExpiredRefreshTokens(ctx); err != nil {
+				zapLogger.Warn("Failed to purge refresh tokens", zap.Error(err))
+			}
+			if _, err := wireguardService.PurgeConfigShares(ctx); err != nil {
+				zapLogger.Warn("Failed to purge config shares", zap.Error(err))
+			}
+		}, "database"),
+		{
+			Name:      "api",
+			DependsOn: []string{"database", "wireguard"},
+			Start: func(ctx context.Context) error {
+				go func() {
+					zapLogger.Info("Starting VPN API server", zap.String("address", cfg.Server.Address))
 
-		if err := server.Start(); err != nil {
-			zapLogger.Fatal("Failed to start server", zap.Error(err))
+					if err := server.Start(); err != nil {
+						zapLogger.Fatal("Failed to start server", zap.Error(err))
+					}
+				}()
+				return nil
+			},
+			Stop: server.Shutdown,
+		},
+	}
+	if dbHealth != nil {
+		components = append(components, lifecycle.Worker("db-health", cfg.Database.HealthInterval, func(ctx context.Context) {
+			dbHealth.Check(ctx, db.Ping)
+			if !dbHealth.Healthy() {
+				return
+			}
+			if err := authService.RefreshRevocations(ctx); err != nil {
+				zapLogger.Warn("Failed to snapshot token revocations", zap.Error(err))
+			}
+		}, "database"))
+	}
+	for _, component := range components {
+		if err := registry.Register(component); err != nil {
+			zapLogger.Fatal("Failed to register component", zap.Error(err))
 		}
-	}()
+	}
+
+	if err := registry.Start(context.Background()); err != nil {
+		zapLogger.Fatal("Failed to start components", zap.Error(err))
+	}
 
 	// Wait for interrupt signal to gracefully shutdown
 	quit := make(chan os.Signal, 1)
@@ -99,9 +419,9 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// Shutdown server
-	if err := server.Shutdown(ctx); err != nil {
-		zapLogger.Error("Server forced to shutdown", zap.Error(err))
+	// Stop components in reverse dependency order
+	if err := registry.Stop(ctx); err != nil {
+		zapLogger.Error("Shutdown completed with errors", zap.Error(err))
 	}
 
 	zapLogger.Info("Server exited")
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"github.com/valyala/fasthttp"
+)
+
+// ErrorCode is the stable, machine-readable identifier included in every error response
+type ErrorCode string
+
+// Error codes returned in the "code" field of error responses
+const (
+	ErrorCodeBadRequest      ErrorCode = "bad_request"
+	ErrorCodeUnauthorized    ErrorCode = "unauthorized"
+	ErrorCodeForbidden       ErrorCode = "forbidden"
+	ErrorCodeNotFound        ErrorCode = "not_found"
+	ErrorCodeConflict        ErrorCode = "conflict"
+	ErrorCodeTooManyRequests ErrorCode = "too_many_requests"
+	ErrorCodeInternalError   ErrorCode = "internal_error"
+	ErrorCodeUnavailable     ErrorCode = "unavailable"
+)
+
+// ErrorCodeInfo describes one entry of the error catalog
+type ErrorCodeInfo struct {
+	Code        ErrorCode `json:"code"`
+	Status      int       `json:"status"`
+	Description string    `json:"description"`
+}
+
+// errorCatalog is the single source of truth for error codes; writeErrorResponse and the
+// catalog endpoint both derive from it so the two never drift
+var errorCatalog = []ErrorCodeInfo{
+	{Code: ErrorCodeBadRequest, Status: fasthttp.StatusBadRequest, Description: "The request was malformed or failed validation."},
+	{Code: ErrorCodeUnauthorized, Status: fasthttp.StatusUnauthorized, Description: "Authentication is missing, invalid or expired."},
+	{Code: ErrorCodeForbidden, Status: fasthttp.StatusForbidden, Description: "The caller is authenticated but not allowed to perform the request."},
+	{Code: ErrorCodeNotFound, Status: fasthttp.StatusNotFound, Description: "The requested resource does not exist or is not visible to the caller."},
+	{Code: ErrorCodeConflict, Status: fasthttp.StatusConflict, Description: "The request conflicts with existing state, such as a duplicate resource."},
+	{Code: ErrorCodeTooManyRequests, Status: fasthttp.StatusTooManyRequests, Description: "The request was made too soon after a previous one; retry after the Retry-After interval."},
+	{Code: ErrorCodeInternalError, Status: fasthttp.StatusInternalServerError, Description: "The server failed to process a valid request."},
+	{Code: ErrorCodeUnavailable, Status: fasthttp.StatusServiceUnavailable, Description: "The server is temporarily overloaded; retry after the Retry-After interval."},
+}
+
+// lookupErrorCode returns the catalog entry for an HTTP status
+func lookupErrorCode(statusCode int) (ErrorCodeInfo, bool) {
+	for _, info := range errorCatalog {
+		if info.Status == statusCode {
+			return info, true
+		}
+	}
+	return ErrorCodeInfo{}, false
+}
+
+// errorCodeForStatus returns the error code for an HTTP status, falling back to the generic
+// client or server code for statuses without their own catalog entry
+func errorCodeForStatus(statusCode int) ErrorCode {
+	if info, ok := lookupErrorCode(statusCode); ok {
+		return info.Code
+	}
+	if statusCode >= fasthttp.StatusInternalServerError {
+		return ErrorCodeInternalError
+	}
+	return ErrorCodeBadRequest
+}
+
+// errorCatalogHandler lists every error code with its HTTP status and description
+func (s *Server) errorCatalogHandler(ctx *fasthttp.RequestCtx) {
+	s.sendSuccessResponse(ctx, errorCatalog)
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// errorHelpers are the response helpers whose second argument is the HTTP status
+var errorHelpers = map[string]bool{
+	"sendErrorResponse": true,
+	"sendServiceError":  true,
+}
+
+func TestErrorCatalogCoversHandlers(t *testing.T) {
+	paths, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatalf("Failed to list package files: %v", err)
+	}
+
+	fset := token.NewFileSet()
+	used := 0
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", path, err)
+		}
+
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) < 2 {
+				return true
+			}
+			fn, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || !errorHelpers[fn.Sel.Name] {
+				return true
+			}
+			status, ok := call.Args[1].(*ast.SelectorExpr)
+			if !ok {
+				t.Errorf("%s: %s status must be a fasthttp constant", fset.Position(call.Pos()), fn.Sel.Name)
+				return true
+			}
+
+			used++
+			code := statusFromName(status.Sel.Name)
+			if code == 0 {
+				t.Errorf("%s: unrecognised status %s", fset.Position(call.Pos()), status.Sel.Name)
+			} else if _, ok := lookupErrorCode(code); !ok {
+				t.Errorf("%s: status %s has no error catalog entry", fset.Position(call.Pos()), status.Sel.Name)
+			}
+			return true
+		})
+	}
+
+	if used == 0 {
+		t.Fatal("Expected to find error responses in handlers")
+	}
+}
+
+func TestErrorCatalogUnique(t *testing.T) {
+	codes := make(map[ErrorCode]bool)
+	statuses := make(map[int]bool)
+	for _, info := range errorCatalog {
+		if codes[info.Code] || statuses[info.Status] {
+			t.Errorf("Duplicate catalog entry %s (%d)", info.Code, info.Status)
+		}
+		codes[info.Code] = true
+		statuses[info.Status] = true
+
+		if info.Description == "" {
+			t.Errorf("Catalog entry %s has no description", info.Code)
+		}
+	}
+}
+
+func TestErrorResponseIncludesCode(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "development"}},
+		logger: zap.NewNop(),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	server.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Invalid JSON response: %v", err)
+	}
+	if response["code"] != string(ErrorCodeNotFound) {
+		t.Errorf("Expected code %q, got %v", ErrorCodeNotFound, response["code"])
+	}
+
+	if got := errorCodeForStatus(fasthttp.StatusTeapot); got != ErrorCodeBadRequest {
+		t.Errorf("Expected uncatalogued 4xx to fall back to %q, got %q", ErrorCodeBadRequest, got)
+	}
+	if got := errorCodeForStatus(fasthttp.StatusBadGateway); got != ErrorCodeInternalError {
+		t.Errorf("Expected uncatalogued 5xx to fall back to %q, got %q", ErrorCodeInternalError, got)
+	}
+}
+
+// statusFromName resolves a fasthttp status constant name such as StatusBadRequest to its value
+func statusFromName(name string) int {
+	for code := 100; code < 600; code++ {
+		text := http.StatusText(code)
+		if text == "" {
+			continue
+		}
+		if name == "Status"+strings.NewReplacer(" ", "", "-", "", "'", "").Replace(text) {
+			return code
+		}
+	}
+	return 0
+}
@@ -1,17 +1,43 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/database"
 	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/denzelpenzel/vpn/internal/qrcode"
+	"github.com/denzelpenzel/vpn/internal/services"
 	"github.com/google/uuid"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// configQRScale is the number of pixels per QR module in config bundles
+	configQRScale = 4
+	// temporaryPasswordLength is the length of passwords generated by an admin reset
+	temporaryPasswordLength = 16
 )
 
 // registerHandler handles user registration
 func (s *Server) registerHandler(ctx *fasthttp.RequestCtx) {
+	enabled, requireInvite := s.registrationPolicy(ctx)
+	if !enabled {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Registration disabled")
+		return
+	}
+
 	var req models.UserRegistration
 	if err := s.parseJSONBody(ctx, &req); err != nil {
 		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
@@ -24,11 +50,16 @@ func (s *Server) registerHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if requireInvite && req.InviteCode == "" {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Invite code required")
+		return
+	}
+
 	// Check if email already exists
 	exists, err := s.userService.EmailExists(ctx, req.Email)
 	if err != nil {
 		s.logger.Error("Failed to check email existence", zap.Error(err))
-		s.sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "Internal server error")
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
 		return
 	}
 
@@ -41,30 +72,42 @@ func (s *Server) registerHandler(ctx *fasthttp.RequestCtx) {
 	passwordHash, err := s.authService.HashPassword(req.Password)
 	if err != nil {
 		s.logger.Error("Failed to hash password", zap.Error(err))
-		s.sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "Internal server error")
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
 		return
 	}
 
-	// Create user
-	user, err := s.userService.CreateUser(ctx, req.Email, passwordHash)
+	// Create user, consuming the invite code when registration is invite-only
+	var user *models.User
+	if requireInvite {
+		user, err = s.userService.CreateUserWithInvite(ctx, req.Email, passwordHash, req.DisplayName, req.InviteCode)
+	} else {
+		user, err = s.userService.CreateUserWithDisplayName(ctx, req.Email, passwordHash, req.DisplayName)
+	}
+	if errors.Is(err, services.ErrInvalidInvite) {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Invalid invite code")
+		return
+	}
+	if errors.Is(err, services.ErrEmailTaken) {
+		s.sendErrorResponse(ctx, fasthttp.StatusConflict, "Email already registered")
+		return
+	}
 	if err != nil {
 		s.logger.Error("Failed to create user", zap.Error(err))
-		s.sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "Failed to create user")
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to create user", err)
 		return
 	}
 
-	// Generate JWT token
-	token, err := s.authService.GenerateToken(user.ID, user.Email)
+	// Sign the new user in
+	response, err := s.sessionResponse(ctx, user)
 	if err != nil {
 		s.logger.Error("Failed to generate token", zap.Error(err))
-		s.sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "Internal server error")
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
 		return
 	}
 
-	// Return user data and token
-	response := map[string]interface{}{
-		"user":  s.userService.ToUserResponse(user),
-		"token": token,
+	// The account exists either way, so an audit failure is logged rather than reported
+	if s.auditService != nil {
+		_ = s.auditService.Record(ctx, user.ID, services.AuditActionRegistered, user.ID, nil)
 	}
 
 	s.sendSuccessResponse(ctx, response)
@@ -92,29 +135,175 @@ func (s *Server) loginHandler(ctx *fasthttp.RequestCtx) {
 	}
 
 	// Verify password
-	if err := s.authService.VerifyPassword(req.Password, user.PasswordHash); err != nil {
+	err = s.authService.CheckPassword(user.ID, req.Password, user.PasswordHash)
+	if errors.Is(err, services.ErrTooManyPasswordAttempts) {
+		s.sendServiceError(ctx, fasthttp.StatusTooManyRequests, "Too many failed password attempts", err)
+		return
+	}
+	if err != nil {
 		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 
-	// Generate JWT token
-	token, err := s.authService.GenerateToken(user.ID, user.Email)
+	// Move hashes made with a previous algorithm to the configured one while the password is known
+	if s.authService.NeedsRehash(user.PasswordHash) {
+		s.rehashPassword(ctx, user.ID, req.Password)
+	}
+
+	response, err := s.sessionResponse(ctx, user)
 	if err != nil {
 		s.logger.Error("Failed to generate token", zap.Error(err))
-		s.sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "Internal server error")
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
 		return
 	}
 
-	// Return user data and token
+	if s.auditService != nil {
+		_ = s.auditService.Record(ctx, user.ID, services.AuditActionLogin, user.ID, nil)
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// sessionResponse signs a user in: it returns the user with a short-lived access token and, when
+// refresh tokens are enabled, a refresh token starting a new family to renew it with
+func (s *Server) sessionResponse(ctx *fasthttp.RequestCtx, user *models.User) (map[string]interface{}, error) {
+	token, err := s.authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		return nil, err
+	}
+
 	response := map[string]interface{}{
-		"user":  s.userService.ToUserResponse(user),
-		"token": token,
+		"user":       s.userService.ToUserResponse(user),
+		"token":      token,
+		"expires_in": int(s.authService.AccessTokenTTL().Seconds()),
+	}
+	if s.authService.RefreshTokensEnabled() {
+		refresh, err := s.authService.IssueRefreshToken(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		response["refresh_token"] = refresh.Token
+		response["refresh_expires_at"] = refresh.ExpiresAt
+	}
+
+	return response, nil
+}
+
+// refreshHandler exchanges a refresh token for a new access token and a replacement refresh token.
+// The presented token stops working, and presenting it again revokes every token rotated from the
+// same sign-in, since only a stolen copy would be replayed.
+func (s *Server) refreshHandler(ctx *fasthttp.RequestCtx) {
+	var req models.RefreshRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.RefreshToken == "" {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "refresh_token is required")
+		return
+	}
+
+	refresh, err := s.authService.RotateRefreshToken(ctx, req.RefreshToken)
+	if errors.Is(err, services.ErrInvalidToken) {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to rotate refresh token", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to refresh session", err)
+		return
+	}
+
+	// The role may have changed since sign-in, so the new token is built from the current user
+	user, err := s.userService.GetUserByID(ctx, refresh.UserID)
+	if err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to refresh session")
+		return
+	}
+
+	token, err := s.authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		s.logger.Error("Failed to generate token", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	s.sendSuccessResponse(ctx, &models.RefreshResponse{
+		Token:            token,
+		ExpiresIn:        int(s.authService.AccessTokenTTL().Seconds()),
+		RefreshToken:     refresh.Token,
+		RefreshExpiresAt: refresh.ExpiresAt,
+	})
+}
+
+// rehashPassword stores a password rehashed with the configured algorithm. Failures are only
+// logged: the old hash still verifies and the next login retries.
+func (s *Server) rehashPassword(ctx *fasthttp.RequestCtx, userID uuid.UUID, password string) {
+	passwordHash, err := s.authService.HashPassword(password)
+	if err != nil {
+		s.logger.Error("Failed to rehash password", zap.Error(err))
+		return
+	}
+
+	if err := s.userService.UpdatePasswordHash(ctx, userID, passwordHash); err != nil {
+		s.logger.Error("Failed to store rehashed password", zap.Error(err))
+		return
+	}
+
+	s.logger.Info("Password rehashed with configured algorithm", zap.String("user_id", userID.String()))
+}
+
+// introspectHandler reports whether a token is active without consuming it. Invalid, expired and
+// revoked tokens are reported as inactive rather than rejected, so callers can tell them apart from
+// a failed introspection.
+func (s *Server) introspectHandler(ctx *fasthttp.RequestCtx) {
+	var req models.IntrospectionRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.Token == "" {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "token is required")
+		return
+	}
+
+	claims, err := s.authService.ValidateToken(ctx, req.Token)
+	if errors.Is(err, services.ErrInvalidToken) {
+		s.sendSuccessResponse(ctx, models.IntrospectionResponse{Active: false})
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to validate token", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to introspect token", err)
+		return
+	}
+
+	// Tokens issued with minimal claims carry no email, so it comes from the user record
+	email := claims.Email
+	if email == "" && s.userService != nil {
+		email, err = s.userService.GetUserEmail(ctx, claims.UserID)
+		if err != nil && !errors.Is(err, services.ErrUserNotFound) {
+			s.logger.Error("Failed to look up token email", zap.Error(err))
+			s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to introspect token", err)
+			return
+		}
 	}
 
+	response := models.IntrospectionResponse{
+		Active: true,
+		UserID: &claims.UserID,
+		Email:  email,
+	}
+	if claims.ExpiresAt != nil {
+		response.Exp = claims.ExpiresAt.Unix()
+	}
+	response.Act = claims.Act
 	s.sendSuccessResponse(ctx, response)
 }
 
-// getConfigHandler handles WireGuard config generation
+// getConfigHandler handles WireGuard config generation. With ?minimal=true it returns only the
+// essential config lines as plain text for constrained clients instead of the JSON config.
 func (s *Server) getConfigHandler(ctx *fasthttp.RequestCtx) {
 	// Get user ID from context (set by auth middleware)
 	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
@@ -123,6 +312,12 @@ func (s *Server) getConfigHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	minimal, err := queryBool(ctx, "minimal")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "minimal must be true or false")
+		return
+	}
+
 	// Parse request body for config request
 	var req models.ConfigRequest
 	if err := s.parseJSONBody(ctx, &req); err != nil {
@@ -130,6 +325,12 @@ func (s *Server) getConfigHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	// A minimal config has no lines to carry these, so refuse rather than silently drop them
+	if minimal && (req.LeakProtection != nil || req.PersistentKeepalive != nil || req.DNSSearch != "" || req.DoHHint) {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Minimal configs do not support leak_protection, persistent_keepalive, dns_search or doh_hint")
+		return
+	}
+
 	// Validate public key
 	if err := s.wireguardService.ValidatePublicKey(req.PublicKey); err != nil {
 		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid public key: %v", err))
@@ -143,106 +344,2657 @@ func (s *Server) getConfigHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if err := services.ValidatePersistentKeepalive(req.PersistentKeepalive); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Reject bad options before provisioning anything
+	opts, ok := s.configOptions(ctx, userID, req.ConfigOptionsRequest, "Failed to configure VPN")
+	if !ok {
+		return
+	}
+
+	// Get server information before provisioning so a server that cannot serve configs yet is not provisioned
+	server, err := s.serverService.GetServerByID(ctx, serverID)
+	if err != nil {
+		s.logger.Error("Failed to get server", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusNotFound, "Server not found", err)
+		return
+	}
+	if err := services.CheckServerReady(server); err != nil {
+		s.sendServiceError(ctx, fasthttp.StatusServiceUnavailable, "Server not ready, retry later", err)
+		return
+	}
+
+	var steering *models.ServerSteering
+	if softMax := s.config.WireGuard.SoftMaxKeys; softMax > 0 {
+		alternative, err := s.steerNewUser(ctx, userID, server, softMax, req.Obfuscated)
+		if err != nil {
+			s.logger.Error("Failed to check server load", zap.Error(err))
+			s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+			return
+		}
+		if alternative != nil {
+			steering = &models.ServerSteering{
+				RequestedServerID: serverID,
+				ServerID:          alternative.ID,
+				Name:              alternative.Name,
+				Location:          alternative.Location,
+			}
+			server, serverID = alternative, alternative.ID
+		}
+	}
+
+	if opts.Obfuscation, ok = s.configObfuscation(ctx, server, req.Obfuscated); !ok {
+		return
+	}
+
 	// Add user key to server
-	userKey, err := s.wireguardService.AddUserKey(ctx, userID, serverID, req.PublicKey)
+	userKey, err := s.wireguardService.AddUserKeyWithKeepalive(ctx, userID, serverID, req.PublicKey, req.PersistentKeepalive)
 	if err != nil {
 		s.logger.Error("Failed to add user key", zap.Error(err))
-		s.sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN")
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+		return
+	}
+
+	config := s.wireguardService.GenerateConfig(userKey, server, opts)
+
+	if minimal {
+		s.setCORSHeaders(ctx)
+		ctx.SetContentType("text/plain; charset=utf-8")
+		ctx.Response.Header.Set("Cache-Control", "no-store")
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		ctx.SetBodyString(services.RenderMinimalConfig(config))
+		return
+	}
+
+	config.ClientWarning = s.clientWarning(ctx)
+	config.Steering = steering
+
+	s.sendSuccessResponse(ctx, config)
+}
+
+// steerNewUser returns the server to provision a user on instead of server once server holds softMax
+// active keys, or nil to provision where asked. Users already on the server keep their place, users
+// with a key on another server are steered there first, and with no alternative that has room the
+// soft maximum gives way rather than failing the request.
+func (s *Server) steerNewUser(ctx *fasthttp.RequestCtx, userID uuid.UUID, server *models.Server, softMax int, obfuscated bool) (*models.Server, error) {
+	keys, err := s.wireguardService.ListUserKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[uuid.UUID]bool, len(keys))
+	for _, key := range keys {
+		held[key.ServerID] = true
+	}
+	if held[server.ID] {
+		return nil, nil
+	}
+
+	load, err := s.serverService.GetServerLoad(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if load[server.ID] < softMax {
+		return nil, nil
+	}
+
+	servers, err := s.serverService.GetActiveServers(ctx, models.ServerListOptions{SortBy: services.ServerSortLoad})
+	if err != nil {
+		return nil, err
+	}
+	alternativeID, err := services.RecommendServer(servers, load, held, server.ID, softMax)
+	if errors.Is(err, services.ErrNoAlternativeServer) {
+		s.logger.Warn("Server past its soft maximum with no alternative, provisioning anyway",
+			zap.String("server_id", server.ID.String()),
+			zap.Int("active_keys", load[server.ID]))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	alternative, err := s.serverService.GetServerByID(ctx, alternativeID)
+	if err != nil || (obfuscated && alternative.Obfuscation == nil) {
+		return nil, nil
+	}
+
+	s.logger.Info("Steering new user away from a server past its soft maximum",
+		zap.String("user_id", userID.String()),
+		zap.String("server_id", server.ID.String()),
+		zap.String("alternative_server_id", alternative.ID.String()))
+
+	return alternative, nil
+}
+
+// regenerateConfigHandler generates a fresh keypair server-side, rotates the user's peer to it and
+// returns the full config including the new private key. The private key is never stored.
+func (s *Server) regenerateConfigHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	// The private key travels in the response, so refuse to send it over plain HTTP
+	if !s.isSecureRequest(ctx) {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "HTTPS required")
+		return
+	}
+
+	var req models.RegenerateConfigRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	serverID, err := uuid.Parse(req.ServerID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
 		return
 	}
 
-	// Get server information for response
 	server, err := s.serverService.GetServerByID(ctx, serverID)
 	if err != nil {
-		s.logger.Error("Failed to get server", zap.Error(err))
 		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
 		return
 	}
+	if err := services.CheckServerReady(server); err != nil {
+		s.sendServiceError(ctx, fasthttp.StatusServiceUnavailable, "Server not ready, retry later", err)
+		return
+	}
 
-	// Create config response
-	config := models.WireGuardConfig{
-		Interface: models.WireGuardInterface{
-			PrivateKey: "[CLIENT_PRIVATE_KEY]", // Client should replace this
-			Address:    userKey.AllowedIPs,
-			DNS:        "1.1.1.1, 8.8.8.8",
-		},
-		Peer: models.WireGuardPeer{
-			PublicKey:  server.PublicKey,
-			Endpoint:   fmt.Sprintf("%s:%d", server.Endpoint, server.Port),
-			AllowedIPs: "0.0.0.0/0, ::/0",
-		},
+	privateKey, publicKey, err := s.wireguardService.GenerateKeyPair()
+	if err != nil {
+		s.logger.Error("Failed to generate key pair", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
 	}
 
-	s.sendSuccessResponse(ctx, config)
-}
+	userKey, err := s.wireguardService.RotateUserKey(ctx, userID, serverID, publicKey)
+	if errors.Is(err, services.ErrUserKeyNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "No active configuration for this server")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to rotate user key", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+		return
+	}
 
-// getServersHandler handles server locations listing
-func (s *Server) getServersHandler(ctx *fasthttp.RequestCtx) {
-	// Get active servers
-	servers, err := s.serverService.GetActiveServers(ctx)
+	allowedNetworks, err := s.userService.GetAllowedNetworks(ctx, userID)
 	if err != nil {
-		s.logger.Error("Failed to get servers", zap.Error(err))
-		s.sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "Failed to get servers")
+		s.sendUserLookupError(ctx, err, "Failed to configure VPN")
 		return
 	}
 
-	s.sendSuccessResponse(ctx, servers)
+	config := s.wireguardService.GenerateConfig(userKey, server, services.ConfigOptions{
+		PrivateKey:      privateKey,
+		AllowedNetworks: allowedNetworks,
+		ClientAddr:      clientIP(ctx, s.trustedProxies),
+	})
+	config.ClientWarning = s.clientWarning(ctx)
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	s.sendSuccessResponse(ctx, config)
 }
 
-// validateRegistration validates user registration input
-func (s *Server) validateRegistration(req *models.UserRegistration) error {
-	if req.Email == "" {
-		return fmt.Errorf("email is required")
+// syncAllConfigsHandler rotates the user's key to a new public key on every server they have an
+// active allocation on, keeping each allocation. Servers are rotated independently, so one failing
+// does not stop the rest; each server's outcome is reported.
+func (s *Server) syncAllConfigsHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
 	}
 
-	if !s.isValidEmail(req.Email) {
-		return fmt.Errorf("invalid email format")
+	var req models.SyncAllConfigsRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
 	}
 
-	if req.Password == "" {
-		return fmt.Errorf("password is required")
+	if err := s.wireguardService.ValidatePublicKey(req.PublicKey); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid public key: %v", err))
+		return
 	}
 
-	if len(req.Password) < 8 {
-		return fmt.Errorf("password must be at least 8 characters")
+	keys, err := s.wireguardService.ListUserKeys(ctx, userID)
+	if err != nil {
+		s.logger.Error("Failed to list user keys", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+		return
+	}
+	if len(keys) == 0 {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "No active configurations")
+		return
 	}
 
-	// Additional password strength validation
-	if !s.isStrongPassword(req.Password) {
-		return fmt.Errorf("password must contain at least one uppercase letter, one lowercase letter, and one number")
+	allowedNetworks, err := s.userService.GetAllowedNetworks(ctx, userID)
+	if err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to configure VPN")
+		return
 	}
 
-	return nil
+	clientAddr := clientIP(ctx, s.trustedProxies)
+	response := &models.SyncAllConfigsResponse{
+		Results:       make([]*models.ServerSyncResult, 0, len(keys)),
+		ClientWarning: s.clientWarning(ctx),
+	}
+	for _, key := range keys {
+		result := &models.ServerSyncResult{ServerID: key.ServerID}
+		response.Results = append(response.Results, result)
+
+		server, err := s.serverService.GetServerByID(ctx, key.ServerID)
+		if err != nil {
+			s.logger.Warn("Skipping key sync for unavailable server", zap.String("server_id", key.ServerID.String()), zap.Error(err))
+			result.Error = "Server not found"
+			response.Failed++
+			continue
+		}
+		if err := services.CheckServerReady(server); err != nil {
+			result.Error = "Server not ready, retry later"
+			response.Failed++
+			continue
+		}
+
+		userKey, err := s.wireguardService.RotateUserKey(ctx, userID, key.ServerID, req.PublicKey)
+		switch {
+		case errors.Is(err, services.ErrProvisioningCooldown):
+			result.Error = "Configuration changed too recently, retry later"
+		case errors.Is(err, services.ErrKeyReused):
+			result.Error = "Public key was previously revoked, generate a new key pair"
+		case errors.Is(err, services.ErrServerMaintenance):
+			result.Error = "Server is under maintenance, retry later"
+		case errors.Is(err, services.ErrServerRateLimited):
+			result.Error = "Server is busy, retry later"
+		}
+		if result.Error != "" {
+			response.Failed++
+			continue
+		}
+		if err != nil {
+			s.logger.Error("Failed to rotate user key", zap.String("server_id", key.ServerID.String()), zap.Error(err))
+			result.Error = "Failed to rotate key"
+			response.Failed++
+			continue
+		}
+
+		result.Success = true
+		result.Config = s.wireguardService.GenerateConfig(userKey, server, services.ConfigOptions{
+			AllowedNetworks: allowedNetworks,
+			ClientAddr:      clientAddr,
+		})
+		response.Succeeded++
+	}
+
+	s.sendSuccessResponse(ctx, response)
 }
 
-// validateLogin validates user login input
-func (s *Server) validateLogin(req *models.UserLogin) error {
-	if req.Email == "" {
-		return fmt.Errorf("email is required")
+// createConfigBundleHandler provisions a server-generated keypair and returns the config text, a QR
+// code and a deeplink for it in one response. Like regenerate, the private key is never stored, and
+// only the config text and QR code carry it. A user who already has a key on the server must pass
+// replace=true, since replacing the key disconnects the device using it; the handler is only routed
+// for POST so a prefetched or retried GET cannot do so either.
+func (s *Server) createConfigBundleHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
 	}
 
-	if !s.isValidEmail(req.Email) {
-		return fmt.Errorf("invalid email format")
+	// The private key travels in the response, so refuse to send it over plain HTTP
+	if !s.isSecureRequest(ctx) {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "HTTPS required")
+		return
 	}
 
-	if req.Password == "" {
-		return fmt.Errorf("password is required")
+	serverID, err := uuid.ParseBytes(ctx.QueryArgs().Peek("server_id"))
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
 	}
 
-	return nil
-}
+	replace, err := queryBool(ctx, "replace")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "replace must be true or false")
+		return
+	}
 
-// isValidEmail validates email format
-func (s *Server) isValidEmail(email string) bool {
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	return emailRegex.MatchString(email)
-}
+	server, err := s.serverService.GetServerByID(ctx, serverID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+	if err := services.CheckServerReady(server); err != nil {
+		s.sendServiceError(ctx, fasthttp.StatusServiceUnavailable, "Server not ready, retry later", err)
+		return
+	}
+
+	_, err = s.wireguardService.GetUserKey(ctx, userID, serverID)
+	hasKey := err == nil
+	if err != nil && !errors.Is(err, services.ErrUserKeyNotFound) {
+		s.logger.Error("Failed to get user key", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+		return
+	}
+	if hasKey && !replace {
+		s.sendErrorResponse(ctx, fasthttp.StatusConflict, "Server already has an active configuration; pass replace=true to replace its key")
+		return
+	}
+
+	privateKey, publicKey, err := s.wireguardService.GenerateKeyPair()
+	if err != nil {
+		s.logger.Error("Failed to generate key pair", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+
+	// A replaced key is rotated in place so the user keeps their address
+	var userKey *models.UserKey
+	if hasKey {
+		userKey, err = s.wireguardService.RotateUserKey(ctx, userID, serverID, publicKey)
+	} else {
+		userKey, err = s.wireguardService.AddUserKey(ctx, userID, serverID, publicKey)
+	}
+	if err != nil {
+		s.logger.Error("Failed to provision user key", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+		return
+	}
+
+	allowedNetworks, err := s.userService.GetAllowedNetworks(ctx, userID)
+	if err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to configure VPN")
+		return
+	}
+
+	config := services.RenderConfig(s.wireguardService.GenerateConfig(userKey, server, services.ConfigOptions{
+		PrivateKey:      privateKey,
+		AllowedNetworks: allowedNetworks,
+		ClientAddr:      clientIP(ctx, s.trustedProxies),
+	}))
+
+	share, err := s.wireguardService.CreateConfigShare(ctx, userID, serverID)
+	if err != nil {
+		s.logger.Error("Failed to create config share", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+
+	bundle, err := s.newConfigBundle(config, share)
+	if err != nil {
+		s.logger.Error("Failed to build config bundle", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+	bundle.ClientWarning = s.clientWarning(ctx)
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	s.sendSuccessResponse(ctx, bundle)
+}
+
+// bootstrapScriptHandler returns a shell script that generates a keypair on the client, provisions
+// its public key on the server and writes the config. Nothing secret is put in the script: the key is
+// generated where it is used and the script reads the access token from the environment.
+func (s *Server) bootstrapScriptHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := uuid.ParseBytes(ctx.QueryArgs().Peek("server_id"))
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	if _, err := s.serverService.GetServerByID(ctx, serverID); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+
+	scheme := "http"
+	if s.isSecureRequest(ctx) {
+		scheme = "https"
+	}
+	apiURL := scheme + "://" + string(ctx.Host())
+
+	s.setCORSHeaders(ctx)
+	ctx.SetContentType("text/x-shellscript; charset=utf-8")
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBodyString(services.RenderBootstrapScript(apiURL, serverID))
+}
+
+// configFileHandler returns the user's config for a server as a wg-quick .conf download. A GET takes
+// server_id from the query and leaves a commented placeholder for the private key; a POST may carry
+// the device's private key in the body, which must derive the active key and is not stored.
+func (s *Server) configFileHandler(ctx *fasthttp.RequestCtx) {
+	userKey, server, opts, ok := s.activeConfig(ctx)
+	if !ok {
+		return
+	}
+
+	config := services.RenderConfigFile(s.wireguardService.GenerateConfig(userKey, server, opts))
+
+	s.setCORSHeaders(ctx)
+	ctx.SetContentType("text/plain; charset=utf-8")
+	ctx.Response.Header.Set("Content-Disposition", `attachment; filename="wg0.conf"`)
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBodyString(config)
+}
+
+// configQRHandler returns the user's config for a server as a PNG QR code for mobile apps to scan,
+// taking the server and private key like a POST to configFileHandler. The private key is required: a
+// scanned tunnel is imported as is, with no chance to fill in a placeholder. ?size= sets the largest
+// image side in pixels, up to services.MaxConfigQRSize; a size too small for the config is refused.
+func (s *Server) configQRHandler(ctx *fasthttp.RequestCtx) {
+	size, err := queryInt(ctx, "size", services.DefaultConfigQRSize)
+	if err != nil || size < 1 || size > services.MaxConfigQRSize {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("size must be between 1 and %d", services.MaxConfigQRSize))
+		return
+	}
+
+	userKey, server, opts, ok := s.activeConfig(ctx)
+	if !ok {
+		return
+	}
+	if opts.PrivateKey == "" {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "private_key is required for a QR code")
+		return
+	}
+
+	image, err := s.wireguardService.GenerateConfigQR(userKey, server, opts, size)
+	if errors.Is(err, services.ErrConfigQRTooSmall) {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to render config QR code", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get configuration", err)
+		return
+	}
+
+	s.setCORSHeaders(ctx)
+	ctx.SetContentType("image/png")
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBody(image)
+}
+
+// activeConfig resolves a config download request to the caller's active key on the server and the
+// options to render its config with. A GET takes server_id from the query; a POST may also carry the
+// device's private key, which must derive the active key, and the rendering options getConfigHandler
+// takes. It reports false once it has responded.
+func (s *Server) activeConfig(ctx *fasthttp.RequestCtx) (*models.UserKey, *models.Server, services.ConfigOptions, bool) {
+	var opts services.ConfigOptions
+
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return nil, nil, opts, false
+	}
+
+	req := models.ConfigFileRequest{ServerID: string(ctx.QueryArgs().Peek("server_id"))}
+	if ctx.IsPost() {
+		if err := s.parseJSONBody(ctx, &req); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return nil, nil, opts, false
+		}
+	}
+
+	serverID, err := uuid.Parse(req.ServerID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return nil, nil, opts, false
+	}
+
+	var derivedKey string
+	if req.PrivateKey != "" {
+		// The private key travels back in the response, so refuse to send it over plain HTTP
+		if !s.isSecureRequest(ctx) {
+			s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "HTTPS required")
+			return nil, nil, opts, false
+		}
+		derivedKey, err = services.PublicKeyFromPrivate(req.PrivateKey)
+		if err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid private key: %v", err))
+			return nil, nil, opts, false
+		}
+	}
+
+	server, err := s.serverService.GetServerByID(ctx, serverID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return nil, nil, opts, false
+	}
+
+	userKey, err := s.wireguardService.GetUserKey(ctx, userID, serverID)
+	if errors.Is(err, services.ErrUserKeyNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "No active configuration for this server")
+		return nil, nil, opts, false
+	}
+	if err != nil {
+		s.logger.Error("Failed to get user key", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get configuration", err)
+		return nil, nil, opts, false
+	}
+
+	// A key for another device would produce a config that never completes a handshake
+	if derivedKey != "" && derivedKey != userKey.PublicKey {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Private key does not match the active key for this server")
+		return nil, nil, opts, false
+	}
+
+	opts, ok = s.configOptions(ctx, userID, req.ConfigOptionsRequest, "Failed to get configuration")
+	if !ok {
+		return nil, nil, opts, false
+	}
+	if opts.Obfuscation, ok = s.configObfuscation(ctx, server, req.Obfuscated); !ok {
+		return nil, nil, opts, false
+	}
+	opts.PrivateKey = req.PrivateKey
+
+	return userKey, server, opts, true
+}
+
+// configOptions checks the rendering options a config request asks for and builds the options for
+// the user's config from them, restricting routes to the user's allowed networks policy. Every
+// handler rendering a config the user asked for builds its options here, so none drops one; the
+// obfuscation profile depends on the server and comes from configObfuscation. It reports false once
+// it has responded.
+func (s *Server) configOptions(ctx *fasthttp.RequestCtx, userID uuid.UUID, req models.ConfigOptionsRequest, failure string) (services.ConfigOptions, bool) {
+	dnsSearch, err := services.NormalizeDNSSearch(req.DNSSearch)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return services.ConfigOptions{}, false
+	}
+
+	allowedNetworks, err := s.userService.GetAllowedNetworks(ctx, userID)
+	if err != nil {
+		s.sendUserLookupError(ctx, err, failure)
+		return services.ConfigOptions{}, false
+	}
+
+	// Reject contradictory leak protection directives rather than render a config that leaks
+	if err := services.ValidateLeakProtection(req.LeakProtection, allowedNetworks); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid leak protection: %v", err))
+		return services.ConfigOptions{}, false
+	}
+
+	return services.ConfigOptions{
+		AllowedNetworks: allowedNetworks,
+		LeakProtection:  req.LeakProtection,
+		DNSSearch:       dnsSearch,
+		ClientAddr:      clientIP(ctx, s.trustedProxies),
+		DoHHint:         req.DoHHint,
+	}, true
+}
+
+// configObfuscation returns the server's obfuscation profile for a config that asks to be obfuscated,
+// nil otherwise. A standard config would silently fall back to detectable traffic, so a server without
+// a profile is refused instead; it reports false once it has responded.
+func (s *Server) configObfuscation(ctx *fasthttp.RequestCtx, server *models.Server, obfuscated bool) (*models.ObfuscationProfile, bool) {
+	if !obfuscated {
+		return nil, true
+	}
+	if server.Obfuscation == nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Server does not support obfuscated configs")
+		return nil, false
+	}
+	return server.Obfuscation, true
+}
+
+// createConfigShareHandler creates a single-use, short-lived link to the user's config for a server,
+// for importing it on a device that is not signed in
+func (s *Server) createConfigShareHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	var req models.ConfigShareRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.ServerID == uuid.Nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	if _, err := s.serverService.GetServerByID(ctx, req.ServerID); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+
+	share, err := s.wireguardService.CreateConfigShare(ctx, userID, req.ServerID)
+	if errors.Is(err, services.ErrUserKeyNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "No active configuration for this server")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to create config share", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to create share link", err)
+		return
+	}
+
+	// The link is built from configuration only; request headers such as Host are client controlled
+	if s.config.Server.PublicBaseURL != "" {
+		share.URL = s.config.Server.PublicBaseURL + "/api/client/config/shared/" + share.Token
+	}
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	s.sendSuccessResponse(ctx, share)
+}
+
+// sharedConfigHandler redeems a config share link. The token is the only credential, so it is
+// consumed on first use and the config is always the one of the user who created the link. No
+// private key is sent, and no key is provisioned for the redeeming device: the config carries the
+// placeholder and the creator's address and peer key, so it only works on a device given the
+// creator's private key for that server by other means.
+func (s *Server) sharedConfigHandler(ctx *fasthttp.RequestCtx) {
+	token, _ := ctx.UserValue("token").(string)
+	if len(token) != 64 {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid share token")
+		return
+	}
+	if _, err := hex.DecodeString(token); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid share token")
+		return
+	}
+
+	userKey, err := s.wireguardService.RedeemConfigShare(ctx, token)
+	if errors.Is(err, services.ErrInvalidConfigShare) || errors.Is(err, services.ErrUserKeyNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Share link invalid, used or expired")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to redeem config share", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get configuration", err)
+		return
+	}
+
+	server, err := s.serverService.GetServerByID(ctx, userKey.ServerID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+
+	allowedNetworks, err := s.userService.GetAllowedNetworks(ctx, userKey.UserID)
+	if err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to get configuration")
+		return
+	}
+
+	config := services.RenderConfig(s.wireguardService.GenerateConfig(userKey, server, services.ConfigOptions{
+		AllowedNetworks: allowedNetworks,
+		ClientAddr:      clientIP(ctx, s.trustedProxies),
+	}))
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	s.sendSuccessResponse(ctx, &models.SharedConfigResponse{ServerID: server.ID, Config: config})
+}
+
+// newConfigBundle derives the QR code from a rendered config and the deeplink from a share of it. The
+// deeplink carries only the single-use share token, which an app redeems over HTTPS at
+// /api/client/config/shared/{token}; the private key never goes into a URL.
+func (s *Server) newConfigBundle(config string, share *models.ConfigShare) (*models.ConfigBundle, error) {
+	code, err := qrcode.Encode([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := code.PNG(configQRScale)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("server_id", share.ServerID.String())
+	query.Set("token", share.Token)
+
+	bundle := &models.ConfigBundle{
+		ServerID:  share.ServerID,
+		Config:    config,
+		QRCodePNG: base64.StdEncoding.EncodeToString(image),
+		Deeplink:  s.config.Server.DeeplinkBaseURL + "?" + query.Encode(),
+		ExpiresAt: share.ExpiresAt,
+	}
+
+	return bundle, nil
+}
+
+// verifyConfigHandler returns the device-side peer configuration for the user's key on a server
+func (s *Server) verifyConfigHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	serverID, err := uuid.ParseBytes(ctx.QueryArgs().Peek("server_id"))
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	userKey, err := s.wireguardService.GetUserKey(ctx, userID, serverID)
+	if errors.Is(err, services.ErrUserKeyNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "No active configuration for this server")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to get user key", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to verify configuration", err)
+		return
+	}
+
+	peer, err := s.wireguardService.GetPeer(userKey.PublicKey)
+	if errors.Is(err, services.ErrPeerNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Peer is not programmed on the server")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to get peer", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to verify configuration", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, s.wireguardService.ToPeerResponse(*peer))
+}
+
+// diagnosticsHandler diagnoses a client's connection to a server from what the client reports and
+// what the server sees of the user's key and peer
+func (s *Server) diagnosticsHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	var req models.DiagnosticsRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	serverID, err := uuid.Parse(req.ServerID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	response := &models.DiagnosticsResponse{ServerID: serverID}
+	if s.clientCompat != nil {
+		response.ClientWarning = s.clientCompat.CheckClient(req.Platform, req.ClientVersion)
+	}
+
+	// Having no active key on the server is itself a diagnosis rather than an error
+	userKey, err := s.wireguardService.GetUserKey(ctx, userID, serverID)
+	if err != nil && !errors.Is(err, services.ErrUserKeyNotFound) {
+		s.logger.Error("Failed to get user key", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to diagnose connection", err)
+		return
+	}
+
+	var peer *wgtypes.Peer
+	if userKey != nil && userKey.IdleRemovedAt == nil {
+		peer, err = s.wireguardService.GetPeer(userKey.PublicKey)
+		if err != nil && !errors.Is(err, services.ErrPeerNotFound) {
+			s.logger.Error("Failed to get peer", zap.Error(err))
+			s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to diagnose connection", err)
+			return
+		}
+	}
+	if peer != nil {
+		response.PeerProgrammed = true
+		if !peer.LastHandshakeTime.IsZero() {
+			handshake := peer.LastHandshakeTime
+			response.ServerLastHandshake = &handshake
+		}
+	}
+
+	response.Diagnosis = services.Diagnose(userKey, peer, req.LastHandshake, time.Now())
+	s.sendSuccessResponse(ctx, response)
+}
+
+// keyStatusHandler reports whether a public key is active for the requesting user and on which server.
+// Keys owned by other users are reported as unregistered.
+func (s *Server) keyStatusHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	publicKey := string(ctx.QueryArgs().Peek("public_key"))
+	if err := s.wireguardService.ValidatePublicKey(publicKey); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid public key")
+		return
+	}
+
+	response := &models.KeyStatusResponse{PublicKey: publicKey}
+
+	userKey, err := s.wireguardService.GetUserKeyByPublicKey(ctx, userID, publicKey)
+	if err != nil && !errors.Is(err, services.ErrUserKeyNotFound) {
+		s.logger.Error("Failed to get key status", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get key status", err)
+		return
+	}
+	if userKey != nil {
+		response.Registered = true
+		response.ServerID = &userKey.ServerID
+		response.IdleRemoved = userKey.IdleRemovedAt != nil
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// revokeDeviceHandler revokes one of the user's own devices by its public key
+func (s *Server) revokeDeviceHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	publicKey := string(ctx.QueryArgs().Peek("public_key"))
+	if err := s.wireguardService.ValidatePublicKey(publicKey); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid public key")
+		return
+	}
+
+	// The body is optional and only carries the password for step-up
+	var req models.StepUpRequest
+	if len(ctx.PostBody()) > 0 {
+		if err := s.parseJSONBody(ctx, &req); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+	}
+	if !s.requireStepUp(ctx, config.StepUpRevokeDevice, req.CurrentPassword) {
+		return
+	}
+
+	err := s.wireguardService.RevokeUserKeyByPublicKey(ctx, userID, publicKey)
+	if errors.Is(err, services.ErrUserKeyNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Device not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to revoke device", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to revoke device", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"public_key": publicKey,
+		"revoked":    true,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// deleteConfigHandler removes the user's config on a server, taking its peer off the device and
+// deactivating the key. The server is named by server_id in the query or the body. Being a device
+// revocation, it needs step-up when revoke_device does.
+func (s *Server) deleteConfigHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	var req models.DeleteConfigRequest
+	if len(ctx.PostBody()) > 0 {
+		if err := s.parseJSONBody(ctx, &req); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+	}
+	if query := ctx.QueryArgs().Peek("server_id"); len(query) > 0 {
+		req.ServerID = string(query)
+	}
+	serverID, err := uuid.Parse(req.ServerID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+	if !s.requireStepUp(ctx, config.StepUpRevokeDevice, req.CurrentPassword) {
+		return
+	}
+
+	err = s.wireguardService.RemoveUserKey(ctx, userID, serverID)
+	if errors.Is(err, services.ErrUserKeyNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "No active config on this server")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to remove config", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to remove config", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"server_id": serverID,
+		"removed":   true,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// getPermissionsHandler returns the role carried by the caller's token and the permissions it grants
+func (s *Server) getPermissionsHandler(ctx *fasthttp.RequestCtx) {
+	role, _ := ctx.UserValue("user_role").(string)
+
+	s.sendSuccessResponse(ctx, models.PermissionsResponse{
+		Role:        role,
+		Permissions: models.PermissionsForRole(role),
+	})
+}
+
+// changePasswordHandler replaces the caller's password after checking the current one. It is the only
+// request a user holding a temporary password from an admin reset may make, and it lifts that limit.
+func (s *Server) changePasswordHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.CurrentPassword == "" {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "current_password is required")
+		return
+	}
+	if err := s.validatePassword(req.NewPassword); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "new_password must differ from the current password")
+		return
+	}
+
+	user, err := s.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to change password")
+		return
+	}
+
+	// Wrong passwords count against the sign-in limit, so a stolen token cannot be used to guess it
+	err = s.authService.CheckPassword(userID, req.CurrentPassword, user.PasswordHash)
+	if errors.Is(err, services.ErrTooManyPasswordAttempts) {
+		s.sendServiceError(ctx, fasthttp.StatusTooManyRequests, "Too many failed password attempts", err)
+		return
+	}
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Current password is incorrect")
+		return
+	}
+
+	passwordHash, err := s.authService.HashPassword(req.NewPassword)
+	if err != nil {
+		s.logger.Error("Failed to hash password", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+
+	if err := s.userService.ChangePassword(ctx, userID, passwordHash); err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to change password")
+		return
+	}
+
+	// The password has already changed, so an audit failure is logged rather than reported
+	if s.auditService != nil {
+		_ = s.auditService.Record(ctx, userID, services.AuditActionPasswordChanged, userID, nil)
+	}
+
+	user.MustChangePassword = false
+	s.sendSuccessResponse(ctx, s.userService.ToUserResponse(user))
+}
+
+// revokeSessionsHandler signs the user out everywhere by rejecting every token issued so far,
+// optionally issuing the caller a fresh token to stay signed in
+func (s *Server) revokeSessionsHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	// The body is optional; without one every session is revoked
+	var req models.RevokeSessionsRequest
+	if len(ctx.PostBody()) > 0 {
+		if err := s.parseJSONBody(ctx, &req); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+	}
+	if !s.requireStepUp(ctx, config.StepUpRevokeSessions, req.CurrentPassword) {
+		return
+	}
+
+	cutoff, err := s.authService.RevokeSessions(ctx, userID)
+	if err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to revoke sessions")
+		return
+	}
+
+	response := models.RevokeSessionsResponse{RevokedBefore: cutoff}
+	if req.KeepCurrent {
+		email, _ := ctx.UserValue("user_email").(string)
+		role, _ := ctx.UserValue("user_role").(string)
+		response.Token, err = s.authService.GenerateTokenAfter(userID, email, role, cutoff)
+		if err != nil {
+			s.logger.Error("Failed to generate token", zap.Error(err))
+			s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+			return
+		}
+		// The session's refresh token was revoked with the rest
+		if s.authService.RefreshTokensEnabled() {
+			response.RefreshToken, err = s.authService.IssueRefreshToken(ctx, userID)
+			if err != nil {
+				s.logger.Error("Failed to issue refresh token", zap.Error(err))
+				s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+				return
+			}
+		}
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// requireStepUp re-authenticates the caller for an operation configured to need the current password
+// as well as a token, reporting whether the handler may go on. A missing or wrong password is
+// answered with 403, leaving the token itself valid. Wrong passwords count against the same failed
+// attempt limit as sign-in, so a stolen token cannot be used to guess the password faster.
+func (s *Server) requireStepUp(ctx *fasthttp.RequestCtx, operation, currentPassword string) bool {
+	if !slices.Contains(s.config.Security.StepUpOperations, operation) {
+		return true
+	}
+
+	if currentPassword != "" {
+		userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+		if !ok {
+			s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+			return false
+		}
+		user, err := s.userService.GetUserByID(ctx, userID)
+		if err != nil {
+			s.sendUserLookupError(ctx, err, "Failed to verify password")
+			return false
+		}
+		err = s.authService.CheckPassword(userID, currentPassword, user.PasswordHash)
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, services.ErrTooManyPasswordAttempts) {
+			s.sendServiceError(ctx, fasthttp.StatusTooManyRequests, "Too many failed password attempts", err)
+			return false
+		}
+	}
+
+	s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "re-authentication required")
+	return false
+}
+
+// logoutHandler revokes the token used for the request and, when the body carries the session's
+// refresh_token, that token's whole family so it cannot renew the session; the user's other sessions
+// stay signed in
+func (s *Server) logoutHandler(ctx *fasthttp.RequestCtx) {
+	claims, ok := ctx.UserValue("token_claims").(*services.Claims)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+	if claims.ID == "" {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Token has no ID; revoke all sessions instead")
+		return
+	}
+
+	// The body is optional for clients without refresh tokens
+	var req models.LogoutRequest
+	if len(ctx.PostBody()) > 0 {
+		if err := s.parseJSONBody(ctx, &req); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+	}
+
+	if req.RefreshToken != "" {
+		err := s.authService.RevokeRefreshToken(ctx, claims.UserID, req.RefreshToken)
+		if errors.Is(err, services.ErrInvalidToken) {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid refresh token")
+			return
+		}
+		if err != nil {
+			s.logger.Error("Failed to revoke refresh token", zap.Error(err))
+			s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to log out", err)
+			return
+		}
+	}
+
+	if err := s.authService.RevokeToken(ctx, claims); err != nil {
+		s.logger.Error("Failed to revoke token", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to log out", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, models.LogoutResponse{
+		TokenID:             claims.ID,
+		ExpiresAt:           claims.ExpiresAt.Time,
+		RefreshTokenRevoked: req.RefreshToken != "",
+	})
+}
+
+// compatibilityHandler lists the supported client platforms and the minimum version of each
+func (s *Server) compatibilityHandler(ctx *fasthttp.RequestCtx) {
+	response := models.CompatibilityResponse{Platforms: []models.PlatformSupport{}}
+	if s.clientCompat != nil {
+		response.Platforms = s.clientCompat.Platforms()
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// clientWarning checks the platform and version a client reports in the X-Client-Platform and
+// X-Client-Version headers, returning a warning to include in provisioning responses when it should update
+func (s *Server) clientWarning(ctx *fasthttp.RequestCtx) string {
+	if s.clientCompat == nil {
+		return ""
+	}
+	return s.clientCompat.CheckClient(
+		string(ctx.Request.Header.Peek("X-Client-Platform")),
+		string(ctx.Request.Header.Peek("X-Client-Version")),
+	)
+}
+
+// whoamiHandler reports the caller's observed source address and, when a geo database is configured,
+// its coarse location. Nothing about the caller is logged.
+func (s *Server) whoamiHandler(ctx *fasthttp.RequestCtx) {
+	addr := clientIP(ctx, s.trustedProxies)
+	response := models.ConnectionInfo{IP: addr.String()}
+
+	if s.geoLocator != nil && addr.IsValid() {
+		// A failed lookup only drops the location; the address alone is still useful
+		if location, err := s.geoLocator.Locate(addr); err == nil {
+			response.Location = location
+		}
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// vpnInfoHandler publishes the fingerprints of the API's TLS certificate and of every active server's
+// WireGuard key so clients can pin both. Everything returned is already public.
+func (s *Server) vpnInfoHandler(ctx *fasthttp.RequestCtx) {
+	servers, err := s.serverService.GetActiveServers(ctx, models.ServerListOptions{})
+	if err != nil {
+		s.logger.Error("Failed to get servers", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get servers", err)
+		return
+	}
+
+	info := models.VPNInfo{Servers: make([]models.ServerKeyFingerprint, 0, len(servers))}
+	if s.tlsCert != nil {
+		info.TLS = services.CertificateFingerprint(s.tlsCert)
+	}
+
+	for _, server := range servers {
+		fingerprint, err := services.KeyFingerprint(server.PublicKey)
+		if err != nil {
+			// A server whose key has not been synchronized yet has nothing to pin
+			continue
+		}
+		info.Servers = append(info.Servers, models.ServerKeyFingerprint{
+			ServerID:    server.ID,
+			Name:        server.Name,
+			PublicKey:   server.PublicKey,
+			Fingerprint: fingerprint,
+		})
+	}
+
+	s.sendSuccessResponse(ctx, info)
+}
+
+// getUsageHandler returns the user's data usage across all servers with an active key
+func (s *Server) getUsageHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	usage, err := s.wireguardService.UserUsage(ctx, userID)
+	if err != nil {
+		s.logger.Error("Failed to get usage", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get usage", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, usage)
+}
+
+// dashboardHandler returns every server the user has a key on with its allocated address, whether
+// the peer is currently connected and its data usage
+func (s *Server) dashboardHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	keys, err := s.wireguardService.ListUserKeys(ctx, userID)
+	if err != nil {
+		s.logger.Error("Failed to list user keys", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get dashboard", err)
+		return
+	}
+
+	usage, err := s.wireguardService.UserUsage(ctx, userID)
+	if err != nil {
+		s.logger.Error("Failed to get usage", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get dashboard", err)
+		return
+	}
+	usageByServer := make(map[uuid.UUID]*models.ServerUsage, len(usage.Servers))
+	for _, serverUsage := range usage.Servers {
+		usageByServer[serverUsage.ServerID] = serverUsage
+	}
+
+	// An unreadable device leaves every server shown as not connected rather than failing the page
+	peersByKey := make(map[string]wgtypes.Peer)
+	peers, err := s.wireguardService.CachedPeers()
+	if err != nil {
+		s.logger.Warn("Failed to read WireGuard peers for dashboard", zap.Error(err))
+	}
+	for _, peer := range peers {
+		peersByKey[peer.PublicKey.String()] = peer
+	}
+
+	now := time.Now()
+	response := &models.DashboardResponse{Servers: make([]*models.DashboardServer, 0, len(keys))}
+	for _, key := range keys {
+		entry := &models.DashboardServer{
+			ServerID:   key.ServerID,
+			PublicKey:  key.PublicKey,
+			AllowedIPs: key.AllowedIPs,
+		}
+		if serverUsage, ok := usageByServer[key.ServerID]; ok {
+			entry.ServerName = serverUsage.ServerName
+			entry.ReceiveBytes = serverUsage.ReceiveBytes
+			entry.TransmitBytes = serverUsage.TransmitBytes
+		}
+		if peer, ok := peersByKey[key.PublicKey]; ok {
+			entry.Connected = services.IsConnected(peer, now)
+			if entry.Connected {
+				response.ConnectedDevices++
+			}
+			if !peer.LastHandshakeTime.IsZero() {
+				handshake := peer.LastHandshakeTime
+				entry.LastHandshake = &handshake
+			}
+		}
+
+		response.Servers = append(response.Servers, entry)
+	}
+	response.Devices = len(response.Servers)
+	response.TotalReceiveBytes = usage.TotalReceiveBytes
+	response.TotalTransmitBytes = usage.TotalTransmitBytes
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// keyHistoryHandler lists the history of the user's keys, optionally only on one server
+func (s *Server) keyHistoryHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	var serverID *uuid.UUID
+	if raw := ctx.QueryArgs().Peek("server_id"); len(raw) > 0 {
+		parsed, err := uuid.ParseBytes(raw)
+		if err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+			return
+		}
+		serverID = &parsed
+	}
+
+	history, err := s.wireguardService.ListUserKeyHistory(ctx, userID, serverID)
+	if err != nil {
+		s.logger.Error("Failed to list key history", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get key history", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, history)
+}
+
+// getServersHandler handles server locations listing
+func (s *Server) getServersHandler(ctx *fasthttp.RequestCtx) {
+	limit, err := queryInt(ctx, "limit", 0)
+	if err != nil || limit < 0 {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "invalid limit")
+		return
+	}
+
+	opts := models.ServerListOptions{
+		Limit:  min(limit, maxPageLimit),
+		SortBy: string(ctx.QueryArgs().Peek("by")),
+	}
+	if err := services.ValidateServerListOptions(opts); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Get active servers
+	servers, err := s.serverService.GetActiveServers(ctx, opts)
+	if err != nil {
+		s.logger.Error("Failed to get servers", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get servers", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, servers)
+}
+
+// getPeersHandler handles paginated listing of peers on the WireGuard device (admin only)
+func (s *Server) getPeersHandler(ctx *fasthttp.RequestCtx) {
+	limit, offset, err := parsePagination(ctx)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+
+	peers, total, err := s.wireguardService.ListAuthorizedPeersPage(limit, offset)
+	if err != nil {
+		s.logger.Error("Failed to list peers", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to list peers", err)
+		return
+	}
+
+	response := &models.PeerListResponse{
+		Peers: make([]*models.PeerResponse, 0, len(peers)),
+		Pagination: models.Pagination{
+			Limit:  limit,
+			Offset: offset,
+			Total:  total,
+		},
+	}
+	for _, peer := range peers {
+		response.Peers = append(response.Peers, s.wireguardService.ToPeerResponse(peer))
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// getStatsHandler returns operational statistics (admin only)
+func (s *Server) getStatsHandler(ctx *fasthttp.RequestCtx) {
+	response := map[string]interface{}{
+		"provisioning": s.wireguardService.ProvisioningStats(),
+	}
+	if s.db != nil {
+		response["database"] = database.PoolStats(s.db)
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// defaultTrendRange is how far back trends go when the request gives no start
+const defaultTrendRange = 30 * 24 * time.Hour
+
+// trendsHandler returns registration and login counts over a time range in hour, day, week or
+// month buckets (admin only). from and to accept RFC 3339 times or dates and default to the last
+// 30 days; bucket defaults to day.
+func (s *Server) trendsHandler(ctx *fasthttp.RequestCtx) {
+	to := time.Now().UTC()
+	if raw := ctx.QueryArgs().Peek("to"); len(raw) > 0 {
+		parsed, err := parseTrendTime(string(raw))
+		if err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid to: use an RFC 3339 time or a YYYY-MM-DD date")
+			return
+		}
+		to = parsed
+	}
+
+	from := to.Add(-defaultTrendRange)
+	if raw := ctx.QueryArgs().Peek("from"); len(raw) > 0 {
+		parsed, err := parseTrendTime(string(raw))
+		if err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid from: use an RFC 3339 time or a YYYY-MM-DD date")
+			return
+		}
+		from = parsed
+	}
+
+	bucket := "day"
+	if raw := ctx.QueryArgs().Peek("bucket"); len(raw) > 0 {
+		bucket = string(raw)
+	}
+
+	if err := services.ValidateTrendRange(from, to, bucket); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Trends are counted from the audit log, so there is nothing to report without it
+	if s.auditService == nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusServiceUnavailable, "Trends require audit logging")
+		return
+	}
+
+	series, err := s.auditService.Trends(ctx, from, to, bucket)
+	if err != nil {
+		s.logger.Error("Failed to get trends", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get trends", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, &models.TrendsResponse{
+		From:   from,
+		To:     to,
+		Bucket: bucket,
+		Series: series,
+	})
+}
+
+// parseTrendTime parses an RFC 3339 time or a YYYY-MM-DD date, taken as midnight UTC
+func parseTrendTime(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(time.DateOnly, raw)
+}
+
+// setAllowedNetworksHandler sets a user's allowed networks policy (admin only). The policy narrows
+// the routes in configs generated for the user and is enforced on the user's peers at once.
+func (s *Server) setAllowedNetworksHandler(ctx *fasthttp.RequestCtx) {
+	userID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req models.AllowedNetworksRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	if _, err := services.NormalizeNetworks(req.AllowedNetworks); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+
+	networks, err := s.userService.SetAllowedNetworks(ctx, userID, req.AllowedNetworks)
+	if err != nil {
+		if errors.Is(err, services.ErrUserNotFound) {
+			s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "User not found")
+			return
+		}
+		s.logger.Error("Failed to set allowed networks", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to set allowed networks", err)
+		return
+	}
+
+	// The stored policy is applied again whenever peers are reconciled, such as on a reload
+	if _, err := s.wireguardService.ApplyNetworkPolicy(ctx, userID); err != nil {
+		s.logger.Error("Failed to enforce allowed networks", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to enforce allowed networks", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"user_id":          userID,
+		"allowed_networks": networks,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// setConnectionLimitHandler sets how many of a user's peers may be connected at once (admin only)
+func (s *Server) setConnectionLimitHandler(ctx *fasthttp.RequestCtx) {
+	userID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req models.ConnectionLimitRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	if req.MaxConcurrentConnections != nil && *req.MaxConcurrentConnections < 0 {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "max_concurrent_connections must not be negative")
+		return
+	}
+
+	if err := s.userService.SetUserConnectionLimit(ctx, userID, req.MaxConcurrentConnections); err != nil {
+		if errors.Is(err, services.ErrUserNotFound) {
+			s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "User not found")
+			return
+		}
+		s.logger.Error("Failed to set connection limit", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to set connection limit", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"user_id":                    userID,
+		"max_concurrent_connections": req.MaxConcurrentConnections,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// provisionStaticHandler provisions a user's key at an admin-chosen address instead of an
+// auto-allocated one (admin only)
+func (s *Server) provisionStaticHandler(ctx *fasthttp.RequestCtx) {
+	var req models.StaticProvisionRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	userID, err := uuid.Parse(req.UserID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	serverID, err := uuid.Parse(req.ServerID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	if err := s.wireguardService.ValidatePublicKey(req.PublicKey); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid public key: %v", err))
+		return
+	}
+
+	if req.AllowedIPs == "" {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "allowed_ips is required")
+		return
+	}
+
+	if err := services.ValidatePersistentKeepalive(req.PersistentKeepalive); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := s.userService.GetUserByID(ctx, userID); err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to provision static IP")
+		return
+	}
+
+	server, err := s.serverService.GetServerByID(ctx, serverID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+	if err := services.CheckServerReady(server); err != nil {
+		s.sendServiceError(ctx, fasthttp.StatusServiceUnavailable, "Server not ready, retry later", err)
+		return
+	}
+
+	userKey, err := s.wireguardService.AddUserKeyWithStaticIP(ctx, userID, server.ID, req.PublicKey, req.AllowedIPs, req.PersistentKeepalive)
+	switch {
+	case errors.Is(err, services.ErrInvalidStaticIP):
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, services.ErrConflict):
+		s.sendErrorResponse(ctx, fasthttp.StatusConflict, err.Error())
+		return
+	case err != nil:
+		s.logger.Error("Failed to provision static IP", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to provision static IP", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, userKey)
+}
+
+// cleanupKeysHandler deactivates keys that have not been used within max_age, optionally on one server
+func (s *Server) cleanupKeysHandler(ctx *fasthttp.RequestCtx) {
+	var req models.KeyCleanupRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	maxAge, err := time.ParseDuration(req.MaxAge)
+	if err != nil || maxAge <= 0 {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "max_age must be a positive duration such as 720h")
+		return
+	}
+
+	var serverID *uuid.UUID
+	if req.ServerID != "" {
+		parsed, err := uuid.Parse(req.ServerID)
+		if err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+			return
+		}
+		serverID = &parsed
+	}
+
+	result, err := s.wireguardService.CleanupStaleKeys(ctx, maxAge, serverID)
+	if err != nil {
+		s.logger.Error("Failed to clean up stale keys", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to clean up keys", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, result)
+}
+
+// reconcileServerHandler forces a full reconciliation of the device with the active keys of the server
+// it carries (admin only); any other server is reported as not found
+func (s *Server) reconcileServerHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	result, err := s.wireguardService.FullReconcile(ctx, serverID)
+	switch {
+	case errors.Is(err, services.ErrServerNotFound):
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	case errors.Is(err, services.ErrReconcileInProgress):
+		s.sendErrorResponse(ctx, fasthttp.StatusConflict, "Reconciliation already in progress")
+		return
+	case err != nil:
+		s.logger.Error("Failed to reconcile server", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to reconcile server", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, result)
+}
+
+// serverInfoHandler reports when a server was last seen and last updated, its key fingerprint, its
+// load and how full its address pool is (admin only)
+func (s *Server) serverInfoHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	server, err := s.serverService.GetServerByID(ctx, serverID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+
+	info := &models.ServerInfo{
+		ID:          server.ID,
+		Name:        server.Name,
+		LastSeen:    server.LastSeenAt,
+		UpdatedAt:   server.UpdatedAt,
+		Maintenance: server.Maintenance,
+	}
+
+	// A server whose key has not been synced yet has no fingerprint
+	if fingerprint, err := services.KeyFingerprint(server.PublicKey); err == nil {
+		info.PublicKeyFingerprint = fingerprint
+	}
+
+	if info.ActiveKeys, err = s.wireguardService.ActiveKeyCount(ctx, serverID); err != nil {
+		s.logger.Error("Failed to count active keys", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to load server info", err)
+		return
+	}
+
+	if info.Pool, err = s.wireguardService.PoolUtilization(ctx, serverID); err != nil {
+		s.logger.Error("Failed to load pool utilization", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to load server info", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, info)
+}
+
+// deviceInfoHandler returns the settings of the named WireGuard device for debugging (admin only).
+// Only the device this server manages is served; its private key is never returned.
+func (s *Server) deviceInfoHandler(ctx *fasthttp.RequestCtx) {
+	name, _ := ctx.UserValue("name").(string)
+	if !isValidInterfaceName(name) {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid device name")
+		return
+	}
+
+	info, err := s.wireguardService.DeviceInfo(name)
+	if errors.Is(err, services.ErrUnknownDevice) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Device not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to read WireGuard device", zap.String("device", name), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusServiceUnavailable, "WireGuard device unavailable", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, info)
+}
+
+// isValidInterfaceName reports whether name could be a Linux network interface name: at most 15
+// characters, none of them a slash, whitespace or colon
+func isValidInterfaceName(name string) bool {
+	if name == "" || len(name) > 15 || name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if r == '/' || r == ':' || r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// selfTestHandler checks the server's WireGuard device and, when asked, probes an upstream through
+// the tunnel path (admin only). Failed checks are reported in the body rather than as an error status.
+// Only the local server can be tested; any other is 404.
+func (s *Server) selfTestHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	// The body is optional; without one no probe is sent
+	var req models.SelfTestRequest
+	if len(ctx.PostBody()) > 0 {
+		if err := s.parseJSONBody(ctx, &req); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+	}
+	if req.Probe != "" {
+		if _, _, err := net.SplitHostPort(req.Probe); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "probe must be a host:port")
+			return
+		}
+	}
+
+	server, err := s.serverService.GetServerByID(ctx, serverID)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+
+	report, err := s.wireguardService.SelfTest(ctx, server, req.Probe)
+	if errors.Is(err, services.ErrServerNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to run self-test", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to run self-test", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, report)
+}
+
+// reserveIPsHandler reserves a block of addresses in a server's subnet for peers provisioned
+// outside the API (admin only)
+func (s *Server) reserveIPsHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	var req models.IPReservationRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.Count < 1 || req.Count > services.MaxIPReservation {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("count must be between 1 and %d", services.MaxIPReservation))
+		return
+	}
+
+	if _, err := s.serverService.GetServerByID(ctx, serverID); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+
+	addresses, err := s.wireguardService.ReserveIPs(ctx, serverID, req.Count)
+	switch {
+	case errors.Is(err, services.ErrAddressPoolExhausted):
+		s.sendErrorResponse(ctx, fasthttp.StatusConflict, "Not enough free addresses")
+		return
+	case errors.Is(err, services.ErrConflict):
+		s.sendErrorResponse(ctx, fasthttp.StatusConflict, "Addresses were taken concurrently, retry")
+		return
+	case err != nil:
+		s.logger.Error("Failed to reserve addresses", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to reserve addresses", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, &models.IPReservationResponse{Addresses: addresses})
+}
+
+// releaseIPsHandler frees addresses reserved on a server (admin only)
+func (s *Server) releaseIPsHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	var req models.IPReleaseRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if len(req.Addresses) == 0 {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "addresses is required")
+		return
+	}
+
+	released, err := s.wireguardService.ReleaseIPs(ctx, serverID, req.Addresses)
+	if errors.Is(err, services.ErrInvalidAddress) {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to release addresses", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to release addresses", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, &models.IPReleaseResponse{Released: released})
+}
+
+// serverAllocationsHandler lists the addresses allocated on a server, sorted by address, with their
+// owners masked (admin only)
+func (s *Server) serverAllocationsHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	limit, offset, err := parsePagination(ctx)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := s.serverService.GetServerByID(ctx, serverID); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+
+	allocations, total, err := s.wireguardService.ListAllocations(ctx, serverID, limit, offset)
+	if err != nil {
+		s.logger.Error("Failed to list allocations", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to list allocations", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, &models.IPAllocationListResponse{
+		Allocations: allocations,
+		Pagination: models.Pagination{
+			Limit:  limit,
+			Offset: offset,
+			Total:  total,
+		},
+	})
+}
+
+// createMaintenanceHandler schedules a maintenance window on a server, during which it provisions no
+// new keys (admin only)
+func (s *Server) createMaintenanceHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	var req models.MaintenanceWindowRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if err := services.ValidateMaintenanceWindow(&req, time.Now()); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid maintenance window: %v", err))
+		return
+	}
+
+	window, err := s.serverService.CreateMaintenanceWindow(ctx, serverID, &req)
+	if errors.Is(err, services.ErrServerNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to create maintenance window", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to create maintenance window", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, window)
+}
+
+// listMaintenanceHandler lists a server's active and upcoming maintenance windows (admin only)
+func (s *Server) listMaintenanceHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	windows, err := s.serverService.ListMaintenanceWindows(ctx, serverID)
+	if err != nil {
+		s.logger.Error("Failed to list maintenance windows", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to list maintenance windows", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, windows)
+}
+
+// cancelMaintenanceHandler cancels one of a server's maintenance windows (admin only)
+func (s *Server) cancelMaintenanceHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+	windowID, err := pathUUID(ctx, "window_id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid maintenance window ID")
+		return
+	}
+
+	err = s.serverService.CancelMaintenanceWindow(ctx, serverID, windowID)
+	if errors.Is(err, services.ErrMaintenanceWindowNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Maintenance window not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to cancel maintenance window", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to cancel maintenance window", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"server_id": serverID,
+		"window_id": windowID,
+		"cancelled": true,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// setObfuscationHandler sets or, with a null profile, removes the AmneziaWG profile a server hands to
+// clients requesting obfuscated configs (admin only)
+func (s *Server) setObfuscationHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	var req models.ObfuscationRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if err := services.ValidateObfuscationProfile(req.Profile); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid obfuscation profile: %v", err))
+		return
+	}
+
+	err = s.serverService.SetObfuscationProfile(ctx, serverID, req.Profile)
+	if errors.Is(err, services.ErrServerNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to set obfuscation profile", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to set obfuscation profile", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"server_id":   serverID,
+		"obfuscation": req.Profile,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// setDoHTemplateHandler sets or, with an empty template, removes the DNS-over-HTTPS URL a server
+// suggests to clients asking for a DoH hint (admin only)
+func (s *Server) setDoHTemplateHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	var req models.DoHTemplateRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.Template != "" {
+		if err := services.ValidateDoHTemplate(req.Template); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	err = s.serverService.SetDoHTemplate(ctx, serverID, req.Template)
+	if errors.Is(err, services.ErrServerNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to set DoH template", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to set DoH template", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"server_id":    serverID,
+		"doh_template": req.Template,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// importServerKeyHandler applies an existing private key to the local server's device, for servers
+// migrated from another host (admin only)
+func (s *Server) importServerKeyHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	var req models.ImportServerKeyRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	// Refuse a server identity that has already crossed the network in the clear
+	if !s.isSecureRequest(ctx) {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "HTTPS required")
+		return
+	}
+	publicKey, err := services.PublicKeyFromPrivate(req.PrivateKey)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid private key: %v", err))
+		return
+	}
+
+	err = s.wireguardService.ImportServerKey(ctx, serverID, req.PrivateKey)
+	switch {
+	case errors.Is(err, services.ErrServerNotFound):
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	case errors.Is(err, services.ErrServerKeyMismatch):
+		s.sendErrorResponse(ctx, fasthttp.StatusConflict, "Private key does not match the server's public key")
+		return
+	case err != nil:
+		s.logger.Error("Failed to import server key", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to import server key", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"server_id":  serverID,
+		"public_key": publicKey,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// peerStatusHandler reports the device status of a batch of public keys on a server (admin only)
+func (s *Server) peerStatusHandler(ctx *fasthttp.RequestCtx) {
+	serverID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid server ID")
+		return
+	}
+
+	var req models.PeerStatusRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if len(req.PublicKeys) == 0 {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "public_keys is required")
+		return
+	}
+	if len(req.PublicKeys) > services.MaxPeerStatusKeys {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest,
+			fmt.Sprintf("At most %d public keys may be queried at once", services.MaxPeerStatusKeys))
+		return
+	}
+
+	if _, err := s.serverService.GetServerByID(ctx, serverID); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Server not found")
+		return
+	}
+
+	statuses, err := s.wireguardService.PeerStatuses(req.PublicKeys)
+	if err != nil {
+		s.logger.Error("Failed to read peer status", zap.String("server_id", serverID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to read peer status", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, &models.PeerStatusResponse{Peers: statuses})
+}
+
+// registrationPolicy returns whether registration is open and whether it needs an invite. Runtime
+// settings take precedence over the configured policy, which also applies if they cannot be read.
+func (s *Server) registrationPolicy(ctx *fasthttp.RequestCtx) (enabled, requireInvite bool) {
+	enabled = !s.config.Registration.Disabled
+	requireInvite = s.config.Registration.RequireInvite
+	if s.settingsService == nil {
+		return enabled, requireInvite
+	}
+
+	var err error
+	if enabled, err = s.settingsService.GetBool(ctx, services.SettingRegistrationEnabled, enabled); err != nil {
+		s.logger.Error("Failed to read registration setting", zap.Error(err))
+	}
+	if requireInvite, err = s.settingsService.GetBool(ctx, services.SettingRegistrationRequireInvite, requireInvite); err != nil {
+		s.logger.Error("Failed to read registration setting", zap.Error(err))
+	}
+
+	return enabled, requireInvite
+}
+
+// setSettingHandler changes a runtime setting for every replica (admin only)
+func (s *Server) setSettingHandler(ctx *fasthttp.RequestCtx) {
+	var req models.SettingRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	value, err := services.ParseSettingValue(req.Key, req.Value)
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	req.Value = value
+
+	if err := s.settingsService.Set(ctx, req.Key, value); err != nil {
+		s.logger.Error("Failed to update setting", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to update setting", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, req)
+}
+
+// createInviteHandler creates a single-use registration invite code (admin only)
+func (s *Server) createInviteHandler(ctx *fasthttp.RequestCtx) {
+	userID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	var req models.InviteRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	if req.ExpiresInHours < 0 {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "expires_in_hours must not be negative")
+		return
+	}
+
+	invite, err := s.inviteService.CreateInvite(ctx, userID, time.Duration(req.ExpiresInHours)*time.Hour)
+	if err != nil {
+		s.logger.Error("Failed to create invite", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to create invite", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, invite)
+}
+
+// batchCreateUsersHandler creates accounts without passwords for a list of emails (admin only). Each
+// entry succeeds or fails on its own; with send_invite its result carries an invite code, shown once,
+// that sets the account's password through the accept-invite endpoint.
+func (s *Server) batchCreateUsersHandler(ctx *fasthttp.RequestCtx) {
+	adminID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	var req models.BatchUserRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if len(req.Users) == 0 {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "users is required")
+		return
+	}
+	if len(req.Users) > services.MaxBatchUsers {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest,
+			fmt.Sprintf("At most %d users may be created at once", services.MaxBatchUsers))
+		return
+	}
+
+	response := &models.BatchUserResponse{Results: make([]*models.BatchUserResult, 0, len(req.Users))}
+	seen := make(map[string]bool, len(req.Users))
+	for _, entry := range req.Users {
+		result := &models.BatchUserResult{Email: entry.Email}
+		response.Results = append(response.Results, result)
+
+		role := entry.Role
+		if role == "" {
+			role = models.RoleUser
+		}
+
+		// Emails are unique whatever their case, so the batch is checked the same way
+		email := strings.ToLower(entry.Email)
+		switch {
+		case !s.isValidEmail(entry.Email):
+			result.Error = "invalid email format"
+		case role != models.RoleUser && role != models.RoleAdmin:
+			result.Error = "role must be user or admin"
+		case seen[email]:
+			result.Error = "duplicate email in batch"
+		}
+		if result.Error != "" {
+			continue
+		}
+		seen[email] = true
+
+		user, invite, err := s.userService.CreatePendingUser(ctx, entry.Email, role, adminID, entry.SendInvite, services.BatchInviteTTL)
+		if errors.Is(err, services.ErrEmailTaken) {
+			result.Error = "email already registered"
+			continue
+		}
+		if err != nil {
+			s.logger.Error("Failed to create batch user", zap.Error(err))
+			result.Error = "failed to create user"
+			continue
+		}
+
+		result.Email = user.Email
+		result.UserID = &user.ID
+		result.Role = user.Role
+		if invite != nil {
+			result.InviteCode = invite.Code
+			result.InviteExpiresAt = invite.ExpiresAt
+		}
+		response.Created++
+
+		// The account exists either way, so an audit failure is logged rather than reported
+		if s.auditService != nil {
+			_ = s.auditService.Record(ctx, adminID, services.AuditActionUserCreated, user.ID, map[string]interface{}{
+				"role":    user.Role,
+				"invited": invite != nil,
+			})
+		}
+	}
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	s.sendSuccessResponse(ctx, response)
+}
+
+// acceptInviteHandler sets the password of an account created in an admin batch from its invite
+// code and signs the user in
+func (s *Server) acceptInviteHandler(ctx *fasthttp.RequestCtx) {
+	var req models.AcceptInviteRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.InviteCode == "" {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "invite_code is required")
+		return
+	}
+	if err := s.validatePassword(req.Password); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+
+	passwordHash, err := s.authService.HashPassword(req.Password)
+	if err != nil {
+		s.logger.Error("Failed to hash password", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+
+	user, err := s.userService.AcceptInvite(ctx, req.InviteCode, passwordHash)
+	if errors.Is(err, services.ErrInvalidInvite) {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Invalid invite code")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to accept invite", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to accept invite", err)
+		return
+	}
+
+	response, err := s.sessionResponse(ctx, user)
+	if err != nil {
+		s.logger.Error("Failed to generate token", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+
+	// Accepting an invite completes the account's registration
+	if s.auditService != nil {
+		_ = s.auditService.Record(ctx, user.ID, services.AuditActionRegistered, user.ID, nil)
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// resetPasswordHandler sets a user's password (admin only). A provided password must meet the password
+// policy; without one a temporary password is generated, returned once and flagged as must-change.
+func (s *Server) resetPasswordHandler(ctx *fasthttp.RequestCtx) {
+	adminID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	userID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req models.ResetPasswordRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	response := &models.ResetPasswordResponse{UserID: userID}
+	password := req.Password
+	if password != "" {
+		if err := s.validatePassword(password); err != nil {
+			s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		password, err = s.authService.GenerateTemporaryPassword(temporaryPasswordLength)
+		if err != nil {
+			s.logger.Error("Failed to generate temporary password", zap.Error(err))
+			s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+			return
+		}
+		response.TemporaryPassword = password
+		response.MustChangePassword = true
+	}
+
+	passwordHash, err := s.authService.HashPassword(password)
+	if err != nil {
+		s.logger.Error("Failed to hash password", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+
+	err = s.userService.AdminResetPassword(ctx, userID, passwordHash, response.MustChangePassword)
+	if errors.Is(err, services.ErrUserNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to reset password", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to reset password", err)
+		return
+	}
+
+	// Sessions opened with the old password must not outlive it, as with revoke-sessions
+	if _, err := s.authService.RevokeSessions(ctx, userID); err != nil {
+		s.logger.Error("Failed to revoke sessions after password reset", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Password reset, but failed to revoke sessions", err)
+		return
+	}
+
+	// The reset has already happened, so an audit failure is logged rather than reported
+	if s.auditService != nil {
+		_ = s.auditService.Record(ctx, adminID, services.AuditActionPasswordReset, userID, map[string]interface{}{
+			"generated": response.MustChangePassword,
+		})
+	}
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	s.sendSuccessResponse(ctx, response)
+}
+
+// scheduleRevocationHandler schedules the revocation of a user's access at a future time, such as
+// the end of a contract (admin only)
+func (s *Server) scheduleRevocationHandler(ctx *fasthttp.RequestCtx) {
+	adminID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	userID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req models.ScheduleRevocationRequest
+	if err := s.parseJSONBody(ctx, &req); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if err := services.ValidateRevocationTime(req.RevokeAt, time.Now()); err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("Invalid revocation: %v", err))
+		return
+	}
+
+	revocation, err := s.wireguardService.ScheduleRevocation(ctx, userID, req.RevokeAt, adminID)
+	if errors.Is(err, services.ErrUserNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to schedule revocation", zap.String("user_id", userID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to schedule revocation", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, revocation)
+}
+
+// listScheduledRevocationsHandler lists a user's pending revocations (admin only)
+func (s *Server) listScheduledRevocationsHandler(ctx *fasthttp.RequestCtx) {
+	userID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	revocations, err := s.wireguardService.ListScheduledRevocations(ctx, userID)
+	if err != nil {
+		s.logger.Error("Failed to list scheduled revocations", zap.String("user_id", userID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to list scheduled revocations", err)
+		return
+	}
+
+	s.sendSuccessResponse(ctx, revocations)
+}
+
+// cancelScheduledRevocationHandler cancels one of a user's pending revocations (admin only)
+func (s *Server) cancelScheduledRevocationHandler(ctx *fasthttp.RequestCtx) {
+	userID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	revocationID, err := pathUUID(ctx, "revocation_id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid revocation ID")
+		return
+	}
+
+	err = s.wireguardService.CancelScheduledRevocation(ctx, userID, revocationID)
+	if errors.Is(err, services.ErrScheduledRevocationNotFound) {
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "Scheduled revocation not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to cancel scheduled revocation", zap.String("user_id", userID.String()), zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to cancel scheduled revocation", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"user_id":       userID,
+		"revocation_id": revocationID,
+		"cancelled":     true,
+	}
+
+	s.sendSuccessResponse(ctx, response)
+}
+
+// impersonateHandler issues an admin a short-lived token for viewing the API as a user (admin only).
+// The token only reaches read-only user endpoints and every request made with it is audited.
+func (s *Server) impersonateHandler(ctx *fasthttp.RequestCtx) {
+	adminID, ok := ctx.UserValue("user_id").(uuid.UUID)
+	if !ok {
+		s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid user context")
+		return
+	}
+
+	userID, err := pathUUID(ctx, "id")
+	if err != nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if userID == adminID {
+		s.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "Cannot impersonate yourself")
+		return
+	}
+
+	// The token could not be used without audit logging, so do not issue one
+	if s.auditService == nil {
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Impersonation requires audit logging")
+		return
+	}
+
+	user, err := s.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		s.sendUserLookupError(ctx, err, "Failed to impersonate user")
+		return
+	}
+
+	token, expiresAt, err := s.authService.GenerateImpersonationToken(adminID, user.ID, user.Role)
+	if err != nil {
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+		return
+	}
+
+	// Unlike a password reset nothing has happened yet, so an impersonation that cannot be audited is refused
+	err = s.auditService.Record(ctx, adminID, services.AuditActionImpersonationStart, user.ID, map[string]interface{}{
+		"expires_at": expiresAt.UTC(),
+	})
+	if err != nil {
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to impersonate user", err)
+		return
+	}
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	s.sendSuccessResponse(ctx, &models.ImpersonationResponse{Token: token, UserID: user.ID, ExpiresAt: expiresAt})
+}
+
+// validateRegistration validates user registration input, normalizing the display name in place
+func (s *Server) validateRegistration(req *models.UserRegistration) error {
+	if req.Email == "" {
+		return fmt.Errorf("email is required")
+	}
+
+	if !s.isValidEmail(req.Email) {
+		return fmt.Errorf("invalid email format")
+	}
+
+	displayName, err := services.NormalizeDisplayName(req.DisplayName)
+	if err != nil {
+		return err
+	}
+	req.DisplayName = displayName
+
+	return s.validatePassword(req.Password)
+}
+
+// validatePassword checks a password against the password policy
+func (s *Server) validatePassword(password string) error {
+	if password == "" {
+		return fmt.Errorf("password is required")
+	}
+
+	if len(password) < 8 {
+		return fmt.Errorf("password must be at least 8 characters")
+	}
+
+	// Additional password strength validation
+	if !s.isStrongPassword(password) {
+		return fmt.Errorf("password must contain at least one uppercase letter, one lowercase letter, and one number")
+	}
+
+	return nil
+}
+
+// validateLogin validates user login input
+func (s *Server) validateLogin(req *models.UserLogin) error {
+	if req.Email == "" {
+		return fmt.Errorf("email is required")
+	}
+
+	if !s.isValidEmail(req.Email) {
+		return fmt.Errorf("invalid email format")
+	}
+
+	if req.Password == "" {
+		return fmt.Errorf("password is required")
+	}
+
+	return nil
+}
+
+// isValidEmail validates email format
+func (s *Server) isValidEmail(email string) bool {
+	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+	return emailRegex.MatchString(email)
+}
+
+// isStrongPassword validates password strength
+func (s *Server) isStrongPassword(password string) bool {
+	hasUpper := regexp.MustCompile(`[A-Z]`).MatchString(password)
+	hasLower := regexp.MustCompile(`[a-z]`).MatchString(password)
+	hasNumber := regexp.MustCompile(`[0-9]`).MatchString(password)
 
-// isStrongPassword validates password strength
-func (s *Server) isStrongPassword(password string) bool {
-	hasUpper := regexp.MustCompile(`[A-Z]`).MatchString(password)
-	hasLower := regexp.MustCompile(`[a-z]`).MatchString(password)
-	hasNumber := regexp.MustCompile(`[0-9]`).MatchString(password)
-	
 	return hasUpper && hasLower && hasNumber
 }
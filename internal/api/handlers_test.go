@@ -1,13 +1,37 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/database"
 	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/denzelpenzel/vpn/internal/qrcode"
+	"github.com/denzelpenzel/vpn/internal/services"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // MockUserService for testing
@@ -44,10 +68,86 @@ func (m *MockAuthService) GenerateToken(userID, email string) (string, error) {
 	return "test-jwt-token", nil
 }
 
+// newTestDB connects to the database in TEST_DATABASE_DSN, skipping the test when it is not set
+func newTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	db, err := database.NewConnection(config.DatabaseConfig{DSN: dsn}, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func TestPoolExhaustionFailsFast(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	const acquireTimeout = 100 * time.Millisecond
+	db, err := database.NewConnection(config.DatabaseConfig{DSN: dsn, MaxConns: 1, AcquireTimeout: acquireTimeout}, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close()
+
+	// Hold the only connection so every request has to wait for it
+	conn, err := db.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	defer conn.Release()
+
+	server := &Server{
+		config:      &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger:      zap.NewNop(),
+		userService: services.NewUserService(db, zap.NewNop()),
+		db:          db,
+	}
+
+	const requests = 10
+	statuses := make(chan *fasthttp.RequestCtx, requests)
+	start := time.Now()
+	for i := 0; i < requests; i++ {
+		go func() {
+			ctx := newRegisterRequest(t, "")
+			server.registerHandler(ctx)
+			statuses <- ctx
+		}()
+	}
+
+	for i := 0; i < requests; i++ {
+		ctx := <-statuses
+		if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+			t.Errorf("Expected status 503, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+		if len(ctx.Response.Header.Peek("Retry-After")) == 0 {
+			t.Error("Expected Retry-After header")
+		}
+	}
+
+	// Requests wait concurrently, so all of them finish within a few timeouts rather than queueing
+	if elapsed := time.Since(start); elapsed > 10*acquireTimeout {
+		t.Errorf("Expected fast failure, took %v", elapsed)
+	}
+
+	if stats := database.PoolStats(db); stats.AcquireTimeouts != requests {
+		t.Errorf("Expected %d acquire timeouts, got %d", requests, stats.AcquireTimeouts)
+	}
+}
+
 func TestHealthHandler(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	cfg := &config.Config{}
-	
+
 	server := &Server{
 		config: cfg,
 		logger: logger,
@@ -73,12 +173,17 @@ func TestHealthHandler(t *testing.T) {
 func TestRegisterHandler(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	cfg := &config.Config{}
-	
+
+	db := newTestDB(t)
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE email = 'test@example.com'`)
+	})
+
 	server := &Server{
 		config:      cfg,
 		logger:      logger,
-		userService: &MockUserService{},
-		authService: &MockAuthService{},
+		userService: services.NewUserService(db, logger),
+		authService: services.NewAuthService("test-secret", logger),
 	}
 
 	// Test valid registration
@@ -86,9 +191,9 @@ func TestRegisterHandler(t *testing.T) {
 		Email:    "test@example.com",
 		Password: "SecurePass123",
 	}
-	
+
 	jsonBody, _ := json.Marshal(reqBody)
-	
+
 	ctx := &fasthttp.RequestCtx{}
 	ctx.Request.SetBody(jsonBody)
 	ctx.Request.Header.SetContentType("application/json")
@@ -101,6 +206,64 @@ func TestRegisterHandler(t *testing.T) {
 	}
 }
 
+func TestRegisterHandlerDisplayName(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: services.NewUserService(db, logger),
+		authService: services.NewAuthService("test-secret", logger),
+	}
+
+	register := func(displayName string) *fasthttp.RequestCtx {
+		body, _ := json.Marshal(models.UserRegistration{
+			Email:       fmt.Sprintf("display-%s@example.com", uuid.New()),
+			Password:    "SecurePass123",
+			DisplayName: displayName,
+		})
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetBody(body)
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.Header.SetMethod("POST")
+		server.registerHandler(ctx)
+		return ctx
+	}
+
+	ctx := register("  Ada   Lovelace ")
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	var response struct {
+		Data struct {
+			User models.UserResponse `json:"user"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, response.Data.User.ID)
+	})
+	if response.Data.User.DisplayName != "Ada Lovelace" {
+		t.Errorf("Expected display name %q in the response, got %q", "Ada Lovelace", response.Data.User.DisplayName)
+	}
+
+	user, err := server.userService.GetUserByID(t.Context(), response.Data.User.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+	if user.DisplayName != "Ada Lovelace" {
+		t.Errorf("Expected stored display name %q, got %q", "Ada Lovelace", user.DisplayName)
+	}
+
+	if ctx := register(strings.Repeat("x", 65)); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400 for an over-long display name, got %d", ctx.Response.StatusCode())
+	}
+}
+
 func TestValidateRegistration(t *testing.T) {
 	server := &Server{}
 
@@ -141,6 +304,33 @@ func TestValidateRegistration(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "with display name",
+			req: &models.UserRegistration{
+				Email:       "test@example.com",
+				Password:    "SecurePass123",
+				DisplayName: "Ada Lovelace",
+			},
+			wantErr: false,
+		},
+		{
+			name: "over-long display name",
+			req: &models.UserRegistration{
+				Email:       "test@example.com",
+				Password:    "SecurePass123",
+				DisplayName: strings.Repeat("a", 65),
+			},
+			wantErr: true,
+		},
+		{
+			name: "display name with markup",
+			req: &models.UserRegistration{
+				Email:       "test@example.com",
+				Password:    "SecurePass123",
+				DisplayName: "<script>alert(1)</script>",
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -152,3 +342,3955 @@ func TestValidateRegistration(t *testing.T) {
 		})
 	}
 }
+
+// fakeWGClient is an in-memory services.WGClient for testing
+type fakeWGClient struct {
+	device *wgtypes.Device
+}
+
+func (f *fakeWGClient) Device(name string) (*wgtypes.Device, error) {
+	if f.device == nil {
+		return nil, fmt.Errorf("device %q not found", name)
+	}
+	return f.device, nil
+}
+
+func (f *fakeWGClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	return nil
+}
+
+func (f *fakeWGClient) Close() error {
+	return nil
+}
+
+func TestGetPeersHandler(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+
+	var peers []wgtypes.Peer
+	for i := 0; i < 25; i++ {
+		key, _ := wgtypes.GeneratePrivateKey()
+		peers = append(peers, wgtypes.Peer{PublicKey: key.PublicKey()})
+	}
+
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Peers: peers}}),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/admin/peers?limit=10&offset=20")
+	server.getPeersHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+	}
+
+	var response struct {
+		Data models.PeerListResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if len(response.Data.Peers) != 5 {
+		t.Errorf("Expected 5 peers, got %d", len(response.Data.Peers))
+	}
+	if response.Data.Pagination != (models.Pagination{Limit: 10, Offset: 20, Total: 25}) {
+		t.Errorf("Unexpected pagination: %+v", response.Data.Pagination)
+	}
+
+	// Invalid paging parameters are rejected
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/admin/peers?offset=-1")
+	server.getPeersHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	server := &Server{config: &config.Config{}, logger: logger}
+
+	called := false
+	handler := server.adminMiddleware(func(ctx *fasthttp.RequestCtx) { called = true })
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_role", models.RoleUser)
+	handler(ctx)
+	if called || ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected non-admin to be rejected with 403, got %d", ctx.Response.StatusCode())
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_role", models.RoleAdmin)
+	handler(ctx)
+	if !called {
+		t.Error("Expected admin to reach handler")
+	}
+}
+
+func TestGetPermissionsHandler(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	server := &Server{config: &config.Config{}, logger: logger}
+
+	tests := []struct {
+		role      string
+		wantAdmin bool
+	}{
+		{role: models.RoleAdmin, wantAdmin: true},
+		{role: models.RoleUser, wantAdmin: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("user_role", tt.role)
+			server.getPermissionsHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+			}
+
+			var response struct {
+				Data models.PermissionsResponse `json:"data"`
+			}
+			if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+				t.Fatalf("Invalid JSON response: %v", err)
+			}
+			if response.Data.Role != tt.role {
+				t.Errorf("Expected role %q, got %q", tt.role, response.Data.Role)
+			}
+
+			hasAdmin := false
+			for _, p := range response.Data.Permissions {
+				if p == models.PermissionAdmin {
+					hasAdmin = true
+				}
+			}
+			if hasAdmin != tt.wantAdmin {
+				t.Errorf("Expected admin permission = %v, got permissions %v", tt.wantAdmin, response.Data.Permissions)
+			}
+
+			// The reported permissions must agree with what adminMiddleware enforces
+			called := false
+			ctx = &fasthttp.RequestCtx{}
+			ctx.SetUserValue("user_role", tt.role)
+			server.adminMiddleware(func(ctx *fasthttp.RequestCtx) { called = true })(ctx)
+			if called != tt.wantAdmin {
+				t.Errorf("adminMiddleware allowed = %v, want %v", called, tt.wantAdmin)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12"), netip.MustParsePrefix("::1/128")}
+
+	tests := []struct {
+		name         string
+		remote       string
+		forwardedFor string
+		want         string
+	}{
+		{name: "direct client", remote: "203.0.113.7", want: "203.0.113.7"},
+		{name: "untrusted peer cannot spoof", remote: "203.0.113.7", forwardedFor: "198.51.100.1", want: "203.0.113.7"},
+		{name: "trusted proxy", remote: "172.18.0.2", forwardedFor: "198.51.100.1", want: "198.51.100.1"},
+		{name: "client-supplied hop ignored", remote: "172.18.0.2", forwardedFor: "10.9.9.9, 198.51.100.1", want: "198.51.100.1"},
+		{name: "chained proxies", remote: "172.18.0.2", forwardedFor: "198.51.100.1, 172.18.0.3", want: "198.51.100.1"},
+		{name: "trusted proxy without header", remote: "172.18.0.2", want: "172.18.0.2"},
+		{name: "garbage header", remote: "172.18.0.2", forwardedFor: "not-an-ip", want: "172.18.0.2"},
+		{name: "IPv6 proxy", remote: "::1", forwardedFor: "2001:db8::1", want: "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 40000}, nil)
+			if tt.forwardedFor != "" {
+				ctx.Request.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+
+			if got := clientIP(ctx, trusted); got.String() != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// testProxies is the trusted proxy range used by handler tests that need an HTTPS request
+var testProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+// viaTLSProxy makes ctx look like a request forwarded by a TLS-terminating proxy in testProxies
+func viaTLSProxy(ctx *fasthttp.RequestCtx) {
+	ctx.SetRemoteAddr(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000})
+	ctx.Request.Header.Set("X-Forwarded-Proto", "https")
+}
+
+func TestIsSecureRequest(t *testing.T) {
+	server := &Server{trustedProxies: testProxies}
+
+	tests := []struct {
+		name           string
+		remote         string
+		forwardedProto string
+		want           bool
+	}{
+		{name: "plain HTTP", remote: "203.0.113.7", want: false},
+		{name: "untrusted peer cannot claim HTTPS", remote: "203.0.113.7", forwardedProto: "https", want: false},
+		{name: "trusted proxy over HTTPS", remote: "10.0.0.1", forwardedProto: "https", want: true},
+		{name: "trusted proxy over HTTP", remote: "10.0.0.1", forwardedProto: "http", want: false},
+		{name: "trusted proxy without header", remote: "10.0.0.1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 40000}, nil)
+			if tt.forwardedProto != "" {
+				ctx.Request.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+			}
+
+			if got := server.isSecureRequest(ctx); got != tt.want {
+				t.Errorf("isSecureRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeGeoLocator places every address in a single country
+type fakeGeoLocator struct{}
+
+func (fakeGeoLocator) Locate(netip.Addr) (*models.GeoLocation, error) {
+	return &models.GeoLocation{Country: "NL"}, nil
+}
+
+func TestWhoamiHandler(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	whoami := func() models.ConnectionInfo {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}, nil)
+		server.whoamiHandler(ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+		}
+		var response struct {
+			Data models.ConnectionInfo `json:"data"`
+		}
+		if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+			t.Fatalf("Invalid JSON response: %v", err)
+		}
+		return response.Data
+	}
+
+	// Without a geo database only the address is reported
+	info := whoami()
+	if info.IP != "203.0.113.7" || info.Location != nil {
+		t.Errorf("Expected address without location, got %+v", info)
+	}
+
+	server.SetGeoLocator(fakeGeoLocator{})
+	info = whoami()
+	if info.IP != "203.0.113.7" || info.Location == nil || info.Location.Country != "NL" {
+		t.Errorf("Expected address with location, got %+v", info)
+	}
+}
+
+func TestRegenerateConfigHandlerRequiresTLS(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	server := &Server{config: &config.Config{}, logger: logger}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody([]byte(`{"server_id":"a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f"}`))
+
+	server.regenerateConfigHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected status 403 over plain HTTP, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestRevokeDeviceHandlerRejectsInvalidKey(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.Request.Header.SetMethod("DELETE")
+	ctx.Request.SetRequestURI("/api/client/devices?public_key=not-a-key")
+
+	server.revokeDeviceHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestGetConfigHandlerRejectsInvalidDNSSearch(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody([]byte(`{"public_key":"YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY=","server_id":"a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f","dns_search":"corp internal"}`))
+
+	server.getConfigHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if !bytes.Contains(ctx.Response.Body(), []byte("search domain")) {
+		t.Errorf("Expected search domain error, got %s", ctx.Response.Body())
+	}
+}
+
+func TestGetConfigHandlerRejectsInvalidMinimal(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		body  string
+	}{
+		{name: "not a boolean", query: "minimal=yes", body: `{}`},
+		{name: "dns search", query: "minimal=true", body: `{"dns_search":"corp.example.com"}`},
+		{name: "keepalive", query: "minimal=true", body: `{"persistent_keepalive":25}`},
+		{name: "leak protection", query: "minimal=true", body: `{"leak_protection":{"table":"off"}}`},
+		{name: "doh hint", query: "minimal=true", body: `{"doh_hint":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("user_id", uuid.New())
+			ctx.Request.SetRequestURI("/api/client/config?" + tt.query)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+
+			server.getConfigHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+			}
+		})
+	}
+}
+
+func TestGetConfigHandlerMinimal(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	serverID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port, subnet) VALUES ($1, 'Minimal', 'Minimal Location', '192.0.2.1', $2, 51820, '10.91.0.0/24')`,
+		serverID, serverKey.PublicKey().String()); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("minimal-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+		serverService:    services.NewServerService(db, logger),
+	}
+
+	_, publicKey, _ := wireguardService.GenerateKeyPair()
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", user.ID)
+	ctx.Request.SetRequestURI("/api/client/config?minimal=true")
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody([]byte(fmt.Sprintf(`{"public_key":%q,"server_id":%q}`, publicKey, serverID)))
+	server.getConfigHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if got := string(ctx.Response.Header.ContentType()); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Expected a plain text config, got %q", got)
+	}
+	body := string(ctx.Response.Body())
+	for _, want := range []string{"Address = 10.91.0.2/32\n", "PublicKey = " + serverKey.PublicKey().String() + "\n", "Endpoint = 192.0.2.1:51820\n", "AllowedIPs = "} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in minimal config, got:\n%s", want, body)
+		}
+	}
+	for _, omitted := range []string{"DNS", "PersistentKeepalive", "#"} {
+		if strings.Contains(body, omitted) {
+			t.Errorf("Expected %q to be omitted from minimal config, got:\n%s", omitted, body)
+		}
+	}
+}
+
+func TestDeleteConfigHandlerRejectsInvalidServer(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name  string
+		query string
+		body  string
+	}{
+		{name: "no server"},
+		{name: "malformed query", query: "server_id=nope"},
+		{name: "malformed body", body: `{"server_id": "nope"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("user_id", uuid.New())
+			ctx.Request.SetRequestURI("/api/client/config?" + tt.query)
+			ctx.Request.Header.SetMethod("DELETE")
+			if tt.body != "" {
+				ctx.Request.Header.SetContentType("application/json")
+				ctx.Request.SetBodyString(tt.body)
+			}
+			server.deleteConfigHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+			}
+		})
+	}
+}
+
+func TestDeleteConfigRequiresStepUp(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Security.StepUpOperations = []string{config.StepUpRevokeDevice}
+	server := &Server{config: cfg, logger: zap.NewNop()}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.Request.SetRequestURI("/api/client/config?server_id=" + uuid.NewString())
+	ctx.Request.Header.SetMethod("DELETE")
+	server.deleteConfigHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden || !strings.Contains(string(ctx.Response.Body()), "re-authentication required") {
+		t.Errorf("Expected 403 re-authentication required, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func TestDeleteConfigHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+	defaultServerID := uuid.MustParse("a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f")
+
+	userService := services.NewUserService(db, logger)
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+	}
+
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("delconf-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	_, publicKey, _ := wireguardService.GenerateKeyPair()
+	if _, err := wireguardService.AddUserKey(t.Context(), user.ID, defaultServerID, publicKey); err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+
+	deleteConfig := func(query, body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", user.ID)
+		ctx.Request.SetRequestURI("/api/client/config?" + query)
+		ctx.Request.Header.SetMethod("DELETE")
+		if body != "" {
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(body)
+		}
+		server.deleteConfigHandler(ctx)
+		return ctx
+	}
+
+	ctx := deleteConfig("", fmt.Sprintf(`{"server_id": %q}`, defaultServerID))
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if _, err := wireguardService.GetUserKey(t.Context(), user.ID, defaultServerID); !errors.Is(err, services.ErrUserKeyNotFound) {
+		t.Errorf("Expected the key to be deactivated, got %v", err)
+	}
+
+	// Nothing is left to remove
+	ctx = deleteConfig("server_id="+defaultServerID.String(), "")
+	if ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Errorf("Expected status 404, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func TestScheduleRevocationHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name string
+		id   string
+		body string
+	}{
+		{name: "malformed user", id: "nope", body: `{"revoke_at": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`},
+		{name: "missing time", id: uuid.NewString(), body: `{}`},
+		{name: "past time", id: uuid.NewString(), body: `{"revoke_at": "` + time.Now().Add(-time.Hour).Format(time.RFC3339) + `"}`},
+		{name: "malformed time", id: uuid.NewString(), body: `{"revoke_at": "tomorrow"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("user_id", uuid.New())
+			ctx.SetUserValue("id", tt.id)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.scheduleRevocationHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+			}
+		})
+	}
+}
+
+func TestGetConfigHandlerServerNotReady(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	// A server whose public key the wireguard container has not written yet
+	serverID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Unsynced', 'Unsynced Location', '192.0.2.1', NULL, 51820)`,
+		serverID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("unsynced-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+		serverService:    services.NewServerService(db, logger),
+	}
+
+	_, publicKey, err := wireguardService.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	getConfig := func() *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", user.ID)
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody([]byte(fmt.Sprintf(`{"public_key":%q,"server_id":%q}`, publicKey, serverID)))
+		server.getConfigHandler(ctx)
+		return ctx
+	}
+
+	ctx := getConfig()
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if len(ctx.Response.Header.Peek("Retry-After")) == 0 {
+		t.Error("Expected Retry-After header")
+	}
+	if _, err := wireguardService.GetUserKey(t.Context(), user.ID, serverID); !errors.Is(err, services.ErrUserKeyNotFound) {
+		t.Errorf("Expected nothing provisioned on a server that is not ready, got %v", err)
+	}
+
+	// Once the key is synchronized the same request provisions the user
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKey() error = %v", err)
+	}
+	if _, err := db.Exec(t.Context(), `UPDATE servers SET public_key = $2 WHERE id = $1`, serverID, serverKey.PublicKey().String()); err != nil {
+		t.Fatalf("Failed to set server key: %v", err)
+	}
+
+	ctx = getConfig()
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var response struct {
+		Data models.WireGuardConfig `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Data.Peer.PublicKey != serverKey.PublicKey().String() {
+		t.Errorf("Expected server public key in config, got %q", response.Data.Peer.PublicKey)
+	}
+}
+
+func TestCompatibilityHandler(t *testing.T) {
+	compat, err := services.NewClientCompatibility([]string{"windows=1.2.0", "ios=1.4.0"})
+	if err != nil {
+		t.Fatalf("NewClientCompatibility() error = %v", err)
+	}
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+	server.SetClientCompatibility(compat)
+
+	ctx := &fasthttp.RequestCtx{}
+	server.compatibilityHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+	}
+	var response struct {
+		Data models.CompatibilityResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	want := []models.PlatformSupport{{Platform: "ios", MinVersion: "1.4.0"}, {Platform: "windows", MinVersion: "1.2.0"}}
+	if !reflect.DeepEqual(response.Data.Platforms, want) {
+		t.Errorf("Expected platforms %+v, got %+v", want, response.Data.Platforms)
+	}
+
+	// Clients report themselves in headers; provisioning responses carry the resulting warning
+	tests := []struct {
+		platform, version string
+		wantWarning       bool
+	}{
+		{platform: "ios", version: "1.4.0"},
+		{platform: "ios", version: "1.3.0", wantWarning: true},
+		{platform: "blackberry", version: "9.0", wantWarning: true},
+		{},
+	}
+	for _, tt := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		if tt.platform != "" {
+			ctx.Request.Header.Set("X-Client-Platform", tt.platform)
+			ctx.Request.Header.Set("X-Client-Version", tt.version)
+		}
+		if warning := server.clientWarning(ctx); (warning != "") != tt.wantWarning {
+			t.Errorf("%s %s: expected warning %v, got %q", tt.platform, tt.version, tt.wantWarning, warning)
+		}
+	}
+}
+
+func TestReconcileServerHandlerRejectsInvalidID(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("id", "not-a-uuid")
+
+	server.reconcileServerHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestCleanupKeysHandlerRejectsInvalidRequest(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	for _, body := range []string{
+		`{}`,
+		`{"max_age":"forever"}`,
+		`{"max_age":"-1h"}`,
+		`{"max_age":"720h","server_id":"not-a-uuid"}`,
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody([]byte(body))
+
+		server.cleanupKeysHandler(ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, ctx.Response.StatusCode())
+		}
+	}
+}
+
+func TestKeyHistoryHandlerRejectsInvalidServerID(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.Request.SetRequestURI("/api/client/configs/history?server_id=not-a-uuid")
+
+	server.keyHistoryHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestGetConfigHandlerRejectsInvalidKeepalive(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody([]byte(`{"public_key":"YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY=","server_id":"a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f","persistent_keepalive":121}`))
+
+	server.getConfigHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if !bytes.Contains(ctx.Response.Body(), []byte("persistent keepalive")) {
+		t.Errorf("Expected keepalive error, got %s", ctx.Response.Body())
+	}
+}
+
+func TestSetSettingHandlerRejectsInvalidSettings(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	for _, body := range []string{
+		`{"key":"unknown.setting","value":"true"}`,
+		`{"key":"registration.enabled","value":"maybe"}`,
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody([]byte(body))
+
+		server.setSettingHandler(ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, ctx.Response.StatusCode())
+		}
+	}
+}
+
+func TestNewConfigBundle(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{DeeplinkBaseURL: "vpn://import"}},
+		logger: zap.NewNop(),
+	}
+
+	serverID := uuid.New()
+	conf := services.RenderConfig(&models.WireGuardConfig{
+		Interface: models.WireGuardInterface{PrivateKey: "cHJpdmF0ZQ==", Address: "10.0.0.2/32", DNS: services.DefaultClientDNS},
+		Peer:      models.WireGuardPeer{PublicKey: "cHVibGlj", Endpoint: "vpn.example.com:51820", AllowedIPs: services.DefaultClientAllowedIPs},
+	})
+	share := &models.ConfigShare{Token: strings.Repeat("ab", 32), ServerID: serverID, ExpiresAt: time.Now().Add(services.ConfigShareTTL)}
+
+	bundle, err := server.newConfigBundle(conf, share)
+	if err != nil {
+		t.Fatalf("newConfigBundle() error = %v", err)
+	}
+
+	if bundle.ServerID != serverID || bundle.Config != conf || !bundle.ExpiresAt.Equal(share.ExpiresAt) {
+		t.Errorf("Unexpected bundle %+v", bundle)
+	}
+
+	// The QR code encodes exactly the config text
+	code, err := qrcode.Encode([]byte(conf))
+	if err != nil {
+		t.Fatalf("qrcode.Encode() error = %v", err)
+	}
+	image, _ := code.PNG(configQRScale)
+	if bundle.QRCodePNG != base64.StdEncoding.EncodeToString(image) {
+		t.Error("Expected QR code to encode the config text")
+	}
+
+	// The deeplink carries the share token rather than the config and its private key
+	if want := "vpn://import?server_id=" + serverID.String() + "&token=" + share.Token; bundle.Deeplink != want {
+		t.Errorf("Deeplink = %q, want %q", bundle.Deeplink, want)
+	}
+}
+
+func TestCreateConfigBundleHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	server := &Server{
+		trustedProxies:   testProxies,
+		config:           &config.Config{Server: config.ServerConfig{DeeplinkBaseURL: "vpn://import"}},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+		serverService:    services.NewServerService(db, logger),
+	}
+
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("bundle-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	serverID := uuid.MustParse("a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f")
+
+	request := func(query string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", user.ID)
+		ctx.Request.Header.SetMethod("POST")
+		viaTLSProxy(ctx)
+		ctx.Request.SetRequestURI("/api/client/config/bundle?server_id=" + serverID.String() + query)
+		server.createConfigBundleHandler(ctx)
+		return ctx
+	}
+
+	ctx := request("")
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	var response struct {
+		Data models.ConfigBundle `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	bundle := response.Data
+	if bundle.Config == "" || bundle.QRCodePNG == "" || bundle.Deeplink == "" {
+		t.Fatalf("Expected config, QR code and deeplink, got %+v", bundle)
+	}
+
+	// The deeplink's token redeems, once, to the key the config was provisioned for
+	link, err := url.Parse(bundle.Deeplink)
+	if err != nil {
+		t.Fatalf("Invalid deeplink %q: %v", bundle.Deeplink, err)
+	}
+	if strings.Contains(bundle.Deeplink, "PrivateKey") || link.Query().Has("config") {
+		t.Errorf("Expected the deeplink to carry no config, got %q", bundle.Deeplink)
+	}
+	shared, err := wireguardService.RedeemConfigShare(t.Context(), link.Query().Get("token"))
+	if err != nil {
+		t.Fatalf("RedeemConfigShare() error = %v", err)
+	}
+	if !strings.Contains(bundle.Config, "Address = "+shared.AllowedIPs) {
+		t.Errorf("Expected the deeplink to redeem to the bundled key, got %+v", shared)
+	}
+	if _, err := wireguardService.RedeemConfigShare(t.Context(), link.Query().Get("token")); !errors.Is(err, services.ErrInvalidConfigShare) {
+		t.Errorf("Expected the deeplink to be single-use, got %v", err)
+	}
+
+	image, err := base64.StdEncoding.DecodeString(bundle.QRCodePNG)
+	if err != nil {
+		t.Fatalf("Invalid QR code encoding: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(image)); err != nil {
+		t.Errorf("Invalid QR code PNG: %v", err)
+	}
+
+	// An existing key is only replaced when asked to, since that disconnects the device using it
+	if ctx := request(""); ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Errorf("Expected status 409 without replace, got %d", ctx.Response.StatusCode())
+	}
+	current, err := wireguardService.GetUserKey(t.Context(), user.ID, serverID)
+	if err != nil || current.PublicKey != shared.PublicKey {
+		t.Errorf("Expected the key to be kept, got %+v (%v)", current, err)
+	}
+	if ctx := request("&replace=true"); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200 with replace, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	replaced, err := wireguardService.GetUserKey(t.Context(), user.ID, serverID)
+	if err != nil || replaced.PublicKey == shared.PublicKey || replaced.AllowedIPs != shared.AllowedIPs {
+		t.Errorf("Expected the key replaced in place, got %+v (%v)", replaced, err)
+	}
+}
+
+func TestKeyStatusHandler(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	newRequest := func(userID uuid.UUID, publicKey string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", userID)
+		ctx.Request.SetRequestURI("/api/client/config/key-status?public_key=" + url.QueryEscape(publicKey))
+		return ctx
+	}
+
+	// Malformed keys are rejected before touching the database
+	ctx := newRequest(uuid.New(), "not-a-key")
+	server.keyStatusHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("malformed key: expected status 400, got %d", ctx.Response.StatusCode())
+	}
+
+	db := newTestDB(t)
+	server.wireguardService.SetDB(db)
+	userService := services.NewUserService(db, logger)
+
+	owner, err := userService.CreateUser(t.Context(), fmt.Sprintf("owner-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	other, err := userService.CreateUser(t.Context(), fmt.Sprintf("other-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	_, publicKey, _ := server.wireguardService.GenerateKeyPair()
+	serverID := uuid.MustParse("a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f")
+	if _, err := server.wireguardService.AddUserKey(t.Context(), owner.ID, serverID, publicKey); err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+	_, unknownKey, _ := server.wireguardService.GenerateKeyPair()
+
+	tests := []struct {
+		name           string
+		userID         uuid.UUID
+		publicKey      string
+		wantRegistered bool
+	}{
+		{name: "own key", userID: owner.ID, publicKey: publicKey, wantRegistered: true},
+		{name: "unknown key", userID: owner.ID, publicKey: unknownKey, wantRegistered: false},
+		{name: "another user's key", userID: other.ID, publicKey: publicKey, wantRegistered: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newRequest(tt.userID, tt.publicKey)
+			server.keyStatusHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+			}
+
+			var response struct {
+				Data models.KeyStatusResponse `json:"data"`
+			}
+			if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+
+			if response.Data.Registered != tt.wantRegistered {
+				t.Errorf("Registered = %v, want %v", response.Data.Registered, tt.wantRegistered)
+			}
+			if tt.wantRegistered && (response.Data.ServerID == nil || *response.Data.ServerID != serverID) {
+				t.Errorf("Expected server ID %s, got %v", serverID, response.Data.ServerID)
+			}
+			if !tt.wantRegistered && response.Data.ServerID != nil {
+				t.Errorf("Expected no server ID, got %v", response.Data.ServerID)
+			}
+		})
+	}
+}
+
+func TestGetServersHandlerRejectsInvalidOptions(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	for _, query := range []string{"by=endpoint", "limit=-1", "limit=abc"} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/api/servers/locations?" + query)
+
+		server.getServersHandler(ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, ctx.Response.StatusCode())
+		}
+	}
+}
+
+// newResetPasswordRequest builds an admin password reset request for a user
+func newResetPasswordRequest(userID uuid.UUID, body string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.SetUserValue("id", userID.String())
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody([]byte(body))
+	return ctx
+}
+
+func TestAdminHandlersRequireUserContext(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	handlers := map[string]fasthttp.RequestHandler{
+		"create invite":  server.createInviteHandler,
+		"batch create":   server.batchCreateUsersHandler,
+		"reset password": server.resetPasswordHandler,
+		"impersonate":    server.impersonateHandler,
+	}
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.SetMethod("POST")
+			handler(ctx)
+			if ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+				t.Errorf("Expected status 401 without a user in the context, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestResetPasswordHandlerRejectsWeakPassword(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	ctx := newResetPasswordRequest(uuid.New(), `{"password":"password"}`)
+	server.resetPasswordHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestResetPasswordHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	authService := services.NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	server := &Server{
+		config:       &config.Config{},
+		logger:       logger,
+		userService:  userService,
+		authService:  authService,
+		auditService: services.NewAuditService(db, logger),
+	}
+
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("reset-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		body          string
+		wantGenerated bool
+	}{
+		{name: "provided password", body: `{"password":"NewSecure123"}`, wantGenerated: false},
+		{name: "generated password", body: `{}`, wantGenerated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := authService.GenerateToken(user.ID, user.Email, "user")
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+			refresh, err := authService.IssueRefreshToken(t.Context(), user.ID)
+			if err != nil {
+				t.Fatalf("IssueRefreshToken() error = %v", err)
+			}
+
+			ctx := newResetPasswordRequest(user.ID, tt.body)
+			server.resetPasswordHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+			}
+
+			var response struct {
+				Data models.ResetPasswordResponse `json:"data"`
+			}
+			if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+
+			password := "NewSecure123"
+			if tt.wantGenerated {
+				password = response.Data.TemporaryPassword
+				if password == "" {
+					t.Fatal("Expected a temporary password")
+				}
+			} else if response.Data.TemporaryPassword != "" {
+				t.Error("Expected no temporary password for a provided password")
+			}
+
+			updated, err := userService.GetUserByID(t.Context(), user.ID)
+			if err != nil {
+				t.Fatalf("GetUserByID() error = %v", err)
+			}
+			if err := authService.VerifyPassword(password, updated.PasswordHash); err != nil {
+				t.Error("Expected new password to verify")
+			}
+			if updated.MustChangePassword != tt.wantGenerated {
+				t.Errorf("MustChangePassword = %v, want %v", updated.MustChangePassword, tt.wantGenerated)
+			}
+
+			// Sessions from before the reset are signed out
+			if _, err := authService.ValidateToken(t.Context(), token); !errors.Is(err, services.ErrInvalidToken) {
+				t.Errorf("Expected a token from before the reset to be rejected, got %v", err)
+			}
+			if _, err := authService.RotateRefreshToken(t.Context(), refresh.Token); !errors.Is(err, services.ErrInvalidToken) {
+				t.Errorf("Expected a refresh token from before the reset to be rejected, got %v", err)
+			}
+		})
+	}
+
+	var audits int
+	if err := db.QueryRow(t.Context(), `SELECT COUNT(*) FROM audit_log WHERE target_id = $1 AND action = $2`,
+		user.ID, services.AuditActionPasswordReset).Scan(&audits); err != nil {
+		t.Fatalf("Failed to count audit entries: %v", err)
+	}
+	if audits != len(tests) {
+		t.Errorf("Expected %d audit entries, got %d", len(tests), audits)
+	}
+
+	// Without an audit service the reset still goes through
+	server.auditService = nil
+	ctx := newResetPasswordRequest(user.ID, `{}`)
+	server.resetPasswordHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("Expected status 200 without an audit service, got %d", ctx.Response.StatusCode())
+	}
+
+	// Unknown users are reported as not found
+	ctx = newResetPasswordRequest(uuid.New(), `{}`)
+	server.resetPasswordHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown user, got %d", ctx.Response.StatusCode())
+	}
+}
+
+// newRegisterRequest builds a registration request context for the given invite code
+func newRegisterRequest(t *testing.T, inviteCode string) *fasthttp.RequestCtx {
+	t.Helper()
+
+	jsonBody, _ := json.Marshal(models.UserRegistration{
+		Email:      fmt.Sprintf("test-%s@example.com", uuid.New()),
+		Password:   "SecurePass123",
+		InviteCode: inviteCode,
+	})
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetBody(jsonBody)
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.Header.SetMethod("POST")
+
+	return ctx
+}
+
+func TestRegisterHandlerRegistrationPolicy(t *testing.T) {
+	logger := zap.NewNop()
+
+	tests := []struct {
+		name         string
+		registration config.RegistrationConfig
+		inviteCode   string
+	}{
+		{name: "registration disabled", registration: config.RegistrationConfig{Disabled: true}},
+		{name: "invite missing", registration: config.RegistrationConfig{RequireInvite: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{
+				config: &config.Config{Registration: tt.registration},
+				logger: logger,
+			}
+
+			ctx := newRegisterRequest(t, tt.inviteCode)
+			server.registerHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+				t.Errorf("Expected status 403, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestRegisterHandlerWithInvite(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	inviteService := services.NewInviteService(db, logger)
+	server := &Server{
+		config:        &config.Config{Registration: config.RegistrationConfig{RequireInvite: true}},
+		logger:        logger,
+		userService:   services.NewUserService(db, logger),
+		authService:   services.NewAuthService("test-secret", logger),
+		inviteService: inviteService,
+	}
+
+	// Invites are created by an existing user
+	admin, err := server.userService.CreateUser(t.Context(), fmt.Sprintf("admin-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	invite, err := inviteService.CreateInvite(t.Context(), admin.ID, 0)
+	if err != nil {
+		t.Fatalf("CreateInvite() error = %v", err)
+	}
+
+	ctx := newRegisterRequest(t, invite.Code)
+	server.registerHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("valid invite: expected status 200, got %d", ctx.Response.StatusCode())
+	}
+
+	// The invite is consumed, so a second use is rejected
+	ctx = newRegisterRequest(t, invite.Code)
+	server.registerHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("used invite: expected status 403, got %d", ctx.Response.StatusCode())
+	}
+
+	ctx = newRegisterRequest(t, "not-a-real-code")
+	server.registerHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("invalid invite: expected status 403, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestRegisterHandlerRuntimeSetting(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM settings WHERE key = $1`, services.SettingRegistrationEnabled)
+	})
+
+	server := &Server{
+		config:          &config.Config{},
+		logger:          logger,
+		userService:     services.NewUserService(db, logger),
+		authService:     services.NewAuthService("test-secret", logger),
+		settingsService: services.NewSettingsService(db, logger),
+	}
+
+	// An admin closes registration at runtime, overriding the open configured policy
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody([]byte(`{"key":"registration.enabled","value":"false"}`))
+	server.setSettingHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	ctx = newRegisterRequest(t, "")
+	server.registerHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected status 403 with registration disabled, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestVPNInfoHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	// A server whose key is pinned alongside the default server
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKey() error = %v", err)
+	}
+	serverKey := privateKey.PublicKey().String()
+	serverID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Pinned', 'Pinned Location', '192.0.2.1', $2, 51820)`,
+		serverID, serverKey); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	serverService := services.NewServerService(db, logger)
+	if _, err := serverService.ReloadServers(t.Context()); err != nil {
+		t.Fatalf("ReloadServers() error = %v", err)
+	}
+
+	cert := &x509.Certificate{Raw: []byte("certificate"), RawSubjectPublicKeyInfo: []byte("spki")}
+	server := &Server{config: &config.Config{}, logger: logger, serverService: serverService}
+
+	vpnInfo := func() models.VPNInfo {
+		ctx := &fasthttp.RequestCtx{}
+		server.vpnInfoHandler(ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+		}
+		var response struct {
+			Data models.VPNInfo `json:"data"`
+		}
+		if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+			t.Fatalf("Invalid JSON response: %v", err)
+		}
+		return response.Data
+	}
+
+	// Behind the TLS proxy the API has no certificate of its own to publish
+	if info := vpnInfo(); info.TLS != nil {
+		t.Errorf("Expected no TLS fingerprint without a certificate, got %+v", info.TLS)
+	}
+
+	server.SetTLSCertificate(cert)
+	info := vpnInfo()
+
+	certSum := sha256.Sum256(cert.Raw)
+	if info.TLS == nil || info.TLS.SHA256 != hex.EncodeToString(certSum[:]) {
+		t.Errorf("Expected TLS fingerprint %x, got %+v", certSum, info.TLS)
+	}
+
+	keyBytes, _ := base64.StdEncoding.DecodeString(serverKey)
+	keySum := sha256.Sum256(keyBytes)
+	found := false
+	for _, s := range info.Servers {
+		if s.ServerID == serverID {
+			found = true
+			if s.PublicKey != serverKey || s.Fingerprint != hex.EncodeToString(keySum[:]) {
+				t.Errorf("Unexpected fingerprint for server: %+v", s)
+			}
+		}
+	}
+	if !found {
+		t.Error("Expected server key fingerprint in response")
+	}
+}
+
+// newStaticProvisionRequest builds an admin static provisioning request context
+func newStaticProvisionRequest(req models.StaticProvisionRequest) *fasthttp.RequestCtx {
+	body, _ := json.Marshal(req)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetBody(body)
+	return ctx
+}
+
+func TestProvisionStaticHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	// A dedicated server so the test owns every allocation in its subnet
+	serverID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port, subnet) VALUES ($1, 'Static', 'Static Location', '192.0.2.1', 'test-key', 51820, '10.77.0.0/24')`,
+		serverID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	userService := services.NewUserService(db, logger)
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+		serverService:    services.NewServerService(db, logger),
+	}
+
+	newUser := func() uuid.UUID {
+		user, err := userService.CreateUser(t.Context(), fmt.Sprintf("static-%s@example.com", uuid.New()), "hash")
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		t.Cleanup(func() {
+			db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+		})
+		return user.ID
+	}
+	newKey := func() string {
+		_, publicKey, err := wireguardService.GenerateKeyPair()
+		if err != nil {
+			t.Fatalf("GenerateKeyPair() error = %v", err)
+		}
+		return publicKey
+	}
+
+	first := newUser()
+	ctx := newStaticProvisionRequest(models.StaticProvisionRequest{
+		UserID: first.String(), ServerID: serverID.String(), PublicKey: newKey(), AllowedIPs: "10.77.0.50",
+	})
+	server.provisionStaticHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var response struct {
+		Data models.UserKey `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Data.AllowedIPs != "10.77.0.50/32" {
+		t.Errorf("Expected static address 10.77.0.50/32, got %s", response.Data.AllowedIPs)
+	}
+
+	tests := []struct {
+		name       string
+		allowedIPs string
+		wantStatus int
+	}{
+		{name: "outside subnet", allowedIPs: "10.78.0.50/32", wantStatus: fasthttp.StatusBadRequest},
+		{name: "server address", allowedIPs: "10.77.0.1", wantStatus: fasthttp.StatusBadRequest},
+		{name: "not a single host", allowedIPs: "10.77.0.0/30", wantStatus: fasthttp.StatusBadRequest},
+		{name: "already allocated", allowedIPs: "10.77.0.50/32", wantStatus: fasthttp.StatusConflict},
+	}
+
+	second := newUser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newStaticProvisionRequest(models.StaticProvisionRequest{
+				UserID: second.String(), ServerID: serverID.String(), PublicKey: newKey(), AllowedIPs: tt.allowedIPs,
+			})
+			server.provisionStaticHandler(ctx)
+
+			if ctx.Response.StatusCode() != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.wantStatus, ctx.Response.StatusCode(), ctx.Response.Body())
+			}
+		})
+	}
+
+	// Auto-allocation for normal users steps around the static address
+	for range 60 {
+		userKey, err := wireguardService.AddUserKey(t.Context(), newUser(), serverID, newKey())
+		if err != nil {
+			t.Fatalf("AddUserKey() error = %v", err)
+		}
+		if userKey.AllowedIPs == "10.77.0.50/32" {
+			t.Fatal("Expected auto-allocation to skip the static address")
+		}
+	}
+}
+
+func TestDashboardHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	// A second server alongside the default one
+	secondServerID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Dashboard', 'Dashboard Location', '192.0.2.1', 'test-key', 51820)`,
+		secondServerID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, secondServerID)
+	})
+	defaultServerID := uuid.MustParse("a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f")
+
+	connectedKey, _ := wgtypes.GeneratePrivateKey()
+	idleKey, _ := wgtypes.GeneratePrivateKey()
+	handshake := time.Now().Add(-30 * time.Second)
+	device := &wgtypes.Device{Name: "wg0", Peers: []wgtypes.Peer{
+		{PublicKey: connectedKey.PublicKey(), LastHandshakeTime: handshake},
+		{PublicKey: idleKey.PublicKey()},
+	}}
+
+	userService := services.NewUserService(db, logger)
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: device})
+	wireguardService.SetDB(db)
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+	}
+
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("dashboard-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	connected, err := wireguardService.AddUserKey(t.Context(), user.ID, defaultServerID, connectedKey.PublicKey().String())
+	if err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+	idle, err := wireguardService.AddUserKey(t.Context(), user.ID, secondServerID, idleKey.PublicKey().String())
+	if err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+	if _, err := db.Exec(t.Context(), `UPDATE user_keys SET rx_bytes = 100, tx_bytes = 50 WHERE id = $1`, connected.ID); err != nil {
+		t.Fatalf("Failed to set usage: %v", err)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", user.ID)
+	server.dashboardHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	var response struct {
+		Data models.DashboardResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if len(response.Data.Servers) != 2 {
+		t.Fatalf("Expected 2 servers, got %d", len(response.Data.Servers))
+	}
+	byServer := make(map[uuid.UUID]*models.DashboardServer)
+	for _, entry := range response.Data.Servers {
+		byServer[entry.ServerID] = entry
+	}
+
+	if entry := byServer[defaultServerID]; entry == nil || !entry.Connected || entry.LastHandshake == nil ||
+		entry.AllowedIPs != connected.AllowedIPs || entry.ReceiveBytes != 100 || entry.TransmitBytes != 50 {
+		t.Errorf("Unexpected connected server entry: %+v", entry)
+	}
+	if entry := byServer[secondServerID]; entry == nil || entry.Connected || entry.LastHandshake != nil ||
+		entry.AllowedIPs != idle.AllowedIPs || entry.ServerName != "Dashboard" {
+		t.Errorf("Unexpected idle server entry: %+v", entry)
+	}
+	if response.Data.TotalReceiveBytes != 100 || response.Data.TotalTransmitBytes != 50 {
+		t.Errorf("Unexpected totals: %+v", response.Data)
+	}
+	if response.Data.Devices != 2 || response.Data.ConnectedDevices != 1 {
+		t.Errorf("Expected 2 devices with 1 connected, got %d with %d", response.Data.Devices, response.Data.ConnectedDevices)
+	}
+}
+
+func TestSyncAllConfigsHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	secondServerID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Sync', 'Sync Location', '192.0.2.1', 'test-key', 51820)`,
+		secondServerID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, secondServerID)
+	})
+	defaultServerID := uuid.MustParse("a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f")
+
+	userService := services.NewUserService(db, logger)
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	serverService := services.NewServerService(db, logger)
+	if _, err := serverService.ReloadServers(t.Context()); err != nil {
+		t.Fatalf("ReloadServers() error = %v", err)
+	}
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+		serverService:    serverService,
+	}
+
+	// provision gives a fresh user a key on both servers
+	provision := func() (uuid.UUID, map[uuid.UUID]*models.UserKey) {
+		user, err := userService.CreateUser(t.Context(), fmt.Sprintf("sync-%s@example.com", uuid.New()), "hash")
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		t.Cleanup(func() {
+			db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+		})
+
+		keys := make(map[uuid.UUID]*models.UserKey)
+		for _, serverID := range []uuid.UUID{defaultServerID, secondServerID} {
+			_, publicKey, _ := wireguardService.GenerateKeyPair()
+			userKey, err := wireguardService.AddUserKey(t.Context(), user.ID, serverID, publicKey)
+			if err != nil {
+				t.Fatalf("AddUserKey() error = %v", err)
+			}
+			keys[serverID] = userKey
+		}
+		return user.ID, keys
+	}
+
+	syncAll := func(userID uuid.UUID, publicKey string) models.SyncAllConfigsResponse {
+		body, _ := json.Marshal(models.SyncAllConfigsRequest{PublicKey: publicKey})
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", userID)
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody(body)
+
+		server.syncAllConfigsHandler(ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+
+		var response struct {
+			Data models.SyncAllConfigsResponse `json:"data"`
+		}
+		if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return response.Data
+	}
+
+	t.Run("rotates every server", func(t *testing.T) {
+		userID, keys := provision()
+		_, newKey, _ := wireguardService.GenerateKeyPair()
+
+		result := syncAll(userID, newKey)
+		if result.Succeeded != 2 || result.Failed != 0 {
+			t.Fatalf("Expected 2 successes, got %+v", result)
+		}
+		for _, r := range result.Results {
+			if !r.Success || r.Config == nil || r.Config.Interface.Address != keys[r.ServerID].AllowedIPs {
+				t.Errorf("Expected rotated config keeping allocation for %s, got %+v", r.ServerID, r)
+			}
+
+			current, err := wireguardService.GetUserKey(t.Context(), userID, r.ServerID)
+			if err != nil || current.PublicKey != newKey {
+				t.Errorf("Expected new key on server %s, got %+v (%v)", r.ServerID, current, err)
+			}
+		}
+	})
+
+	t.Run("reports partial failure", func(t *testing.T) {
+		userID, keys := provision()
+
+		// An allocation the device cannot be programmed with makes that server's rotation fail
+		if _, err := db.Exec(t.Context(), `UPDATE user_keys SET allowed_ips = 'invalid' WHERE id = $1`, keys[secondServerID].ID); err != nil {
+			t.Fatalf("Failed to corrupt allocation: %v", err)
+		}
+		_, newKey, _ := wireguardService.GenerateKeyPair()
+
+		result := syncAll(userID, newKey)
+		if result.Succeeded != 1 || result.Failed != 1 {
+			t.Fatalf("Expected one success and one failure, got %+v", result)
+		}
+		for _, r := range result.Results {
+			wantSuccess := r.ServerID == defaultServerID
+			if r.Success != wantSuccess || (r.Error == "") == !wantSuccess {
+				t.Errorf("Unexpected result for %s: %+v", r.ServerID, r)
+			}
+		}
+
+		current, err := wireguardService.GetUserKey(t.Context(), userID, secondServerID)
+		if err != nil || current.PublicKey != keys[secondServerID].PublicKey {
+			t.Errorf("Expected failed server to keep its old key, got %+v (%v)", current, err)
+		}
+	})
+
+	t.Run("rejects a revoked key", func(t *testing.T) {
+		wireguardService.SetRejectReusedKeys(true)
+		t.Cleanup(func() { wireguardService.SetRejectReusedKeys(false) })
+		userID, keys := provision()
+
+		// Revoke the key on the default server and provision a fresh one in its place
+		revoked := keys[defaultServerID].PublicKey
+		if err := wireguardService.RemoveUserKey(t.Context(), userID, defaultServerID); err != nil {
+			t.Fatalf("RemoveUserKey() error = %v", err)
+		}
+		_, freshKey, _ := wireguardService.GenerateKeyPair()
+		if _, err := wireguardService.AddUserKey(t.Context(), userID, defaultServerID, freshKey); err != nil {
+			t.Fatalf("AddUserKey() error = %v", err)
+		}
+
+		// The key was only revoked on the default server, so the other one takes it
+		result := syncAll(userID, revoked)
+		if result.Succeeded != 1 || result.Failed != 1 {
+			t.Fatalf("Expected one success and one failure, got %+v", result)
+		}
+		for _, r := range result.Results {
+			if r.ServerID == defaultServerID && (r.Success || r.Error != "Public key was previously revoked, generate a new key pair") {
+				t.Errorf("Expected the revoked key to be rejected, got %+v", r)
+			}
+		}
+
+		current, err := wireguardService.GetUserKey(t.Context(), userID, defaultServerID)
+		if err != nil || current.PublicKey != freshKey {
+			t.Errorf("Expected the default server to keep the fresh key, got %+v (%v)", current, err)
+		}
+	})
+}
+
+func TestLoginHandlerRehashesPassword(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	authService := services.NewAuthService("a-sufficiently-long-secret-for-testing-purposes", logger)
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: userService,
+		authService: authService,
+	}
+
+	// The user registered while bcrypt was configured
+	bcryptHash, err := authService.HashPassword("SecurePass123")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	email := fmt.Sprintf("rehash-%s@example.com", uuid.New())
+	user, err := userService.CreateUser(t.Context(), email, bcryptHash)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	authService.SetPasswordHasher(services.PasswordHashArgon2id, services.NewArgon2idHasher())
+
+	login := func() int {
+		body, _ := json.Marshal(models.UserLogin{Email: email, Password: "SecurePass123"})
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody(body)
+		server.loginHandler(ctx)
+		return ctx.Response.StatusCode()
+	}
+
+	if status := login(); status != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+
+	updated, err := userService.GetUserByID(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+	if !strings.HasPrefix(updated.PasswordHash, "$argon2id$") {
+		t.Errorf("Expected password to be rehashed with argon2id, got %q", updated.PasswordHash[:7])
+	}
+
+	// The rehashed password still logs in
+	if status := login(); status != fasthttp.StatusOK {
+		t.Errorf("Expected login with rehashed password to succeed, got %d", status)
+	}
+}
+
+func TestRegisterAndLoginIgnoreEmailCase(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: userService,
+		authService: services.NewAuthService("a-sufficiently-long-secret-for-testing-purposes", logger),
+	}
+
+	send := func(handler fasthttp.RequestHandler, body interface{}) int {
+		raw, _ := json.Marshal(body)
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody(raw)
+		handler(ctx)
+		return ctx.Response.StatusCode()
+	}
+
+	email := fmt.Sprintf("Casing-%s@Example.com", uuid.New())
+	if status := send(server.registerHandler, models.UserRegistration{Email: email, Password: "SecurePass123"}); status != fasthttp.StatusOK {
+		t.Fatalf("Expected registration to succeed, got %d", status)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE LOWER(email) = LOWER($1)`, email)
+	})
+
+	upper := strings.ToUpper(email)
+	if status := send(server.registerHandler, models.UserRegistration{Email: upper, Password: "SecurePass123"}); status != fasthttp.StatusConflict {
+		t.Errorf("Expected a differently-cased duplicate to be rejected with 409, got %d", status)
+	}
+
+	for _, login := range []string{email, upper, strings.ToLower(email)} {
+		if status := send(server.loginHandler, models.UserLogin{Email: login, Password: "SecurePass123"}); status != fasthttp.StatusOK {
+			t.Errorf("Expected login as %q to succeed, got %d", login, status)
+		}
+	}
+}
+
+const testIntrospectionKey = "an-introspection-key-long-enough-for-testing"
+
+// introspect calls the introspection handler through its API key middleware
+func introspect(t *testing.T, server *Server, apiKey, token string) (int, models.IntrospectionResponse) {
+	t.Helper()
+
+	body, _ := json.Marshal(models.IntrospectionRequest{Token: token})
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.Header.Set("X-API-Key", apiKey)
+	ctx.Request.SetBody(body)
+	server.internalAPIKeyMiddleware(server.introspectHandler)(ctx)
+
+	var response struct {
+		Data models.IntrospectionResponse `json:"data"`
+	}
+	if ctx.Response.StatusCode() == fasthttp.StatusOK {
+		if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+			t.Fatalf("Invalid JSON response: %v", err)
+		}
+	}
+	return ctx.Response.StatusCode(), response.Data
+}
+
+func TestIntrospectHandler(t *testing.T) {
+	const secret = "a-sufficiently-long-secret-for-testing-purposes"
+	authService := services.NewAuthService(secret, zap.NewNop())
+	server := &Server{
+		config:      &config.Config{JWT: config.JWTConfig{Secret: secret, IntrospectionKey: testIntrospectionKey}},
+		logger:      zap.NewNop(),
+		authService: authService,
+	}
+
+	userID := uuid.New()
+	token, err := authService.GenerateToken(userID, "introspect@example.com", models.RoleUser)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// Only callers with the API key may introspect
+	if status, _ := introspect(t, server, "", token); status != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected 401 without API key, got %d", status)
+	}
+	if status, _ := introspect(t, server, "wrong-key", token); status != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong API key, got %d", status)
+	}
+
+	status, response := introspect(t, server, testIntrospectionKey, token)
+	if status != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if !response.Active || response.UserID == nil || *response.UserID != userID || response.Email != "introspect@example.com" {
+		t.Errorf("Expected active token for the user, got %+v", response)
+	}
+	if response.Exp <= time.Now().Unix() {
+		t.Errorf("Expected expiry in the future, got %d", response.Exp)
+	}
+
+	expired := jwt.NewWithClaims(jwt.SigningMethodHS256, &services.Claims{
+		UserID: userID,
+		Email:  "introspect@example.com",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(-25 * time.Hour)),
+		},
+	})
+	expiredToken, err := expired.SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("Failed to sign expired token: %v", err)
+	}
+
+	for name, token := range map[string]string{"expired": expiredToken, "malformed": "not-a-token"} {
+		status, response := introspect(t, server, testIntrospectionKey, token)
+		if status != fasthttp.StatusOK {
+			t.Errorf("%s token: expected status 200, got %d", name, status)
+		}
+		if response != (models.IntrospectionResponse{Active: false}) {
+			t.Errorf("%s token: expected only active=false, got %+v", name, response)
+		}
+	}
+
+	// Without a configured key introspection is disabled
+	server.config.JWT.IntrospectionKey = ""
+	if status, _ := introspect(t, server, "", token); status != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected 401 when introspection is disabled, got %d", status)
+	}
+}
+
+func TestIntrospectHandlerMinimalClaims(t *testing.T) {
+	db := newTestDB(t)
+	logger := zap.NewNop()
+
+	authService := services.NewAuthService("a-sufficiently-long-secret-for-testing-purposes", logger)
+	authService.SetMinimalClaims(true)
+	userService := services.NewUserService(db, logger)
+	server := &Server{
+		config:      &config.Config{JWT: config.JWTConfig{IntrospectionKey: testIntrospectionKey}},
+		logger:      logger,
+		authService: authService,
+		userService: userService,
+	}
+
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("minimal-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	token, err := authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	// The token itself carries no email, but introspection still reports it
+	_, response := introspect(t, server, testIntrospectionKey, token)
+	if !response.Active || response.UserID == nil || *response.UserID != user.ID || response.Email != user.Email {
+		t.Errorf("Expected active token with the user's email, got %+v", response)
+	}
+}
+
+func TestIntrospectHandlerRevokedToken(t *testing.T) {
+	db := newTestDB(t)
+
+	authService := services.NewAuthService("a-sufficiently-long-secret-for-testing-purposes", zap.NewNop())
+	authService.SetDB(db)
+	server := &Server{
+		config:      &config.Config{JWT: config.JWTConfig{IntrospectionKey: testIntrospectionKey}},
+		logger:      zap.NewNop(),
+		authService: authService,
+	}
+
+	token, err := authService.GenerateToken(uuid.New(), "revoked@example.com", models.RoleUser)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	claims, err := authService.ValidateToken(t.Context(), token)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM revoked_tokens WHERE jti = $1`, claims.ID)
+	})
+
+	if _, response := introspect(t, server, testIntrospectionKey, token); !response.Active {
+		t.Fatalf("Expected token to be active before revocation, got %+v", response)
+	}
+
+	if err := authService.RevokeToken(t.Context(), claims); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+
+	status, response := introspect(t, server, testIntrospectionKey, token)
+	if status != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if response != (models.IntrospectionResponse{Active: false}) {
+		t.Errorf("Expected revoked token to be inactive, got %+v", response)
+	}
+}
+
+func TestBootstrapScriptHandlerRejectsInvalidServerID(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/client/bootstrap.sh?server_id=not-a-uuid")
+	server.bootstrapScriptHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestBootstrapScriptHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	serverID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Bootstrap', 'Bootstrap Location', '192.0.2.1', 'test-key', 51820)`,
+		serverID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	server := &Server{
+		trustedProxies: testProxies,
+		config:         &config.Config{},
+		logger:         logger,
+		serverService:  services.NewServerService(db, logger),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/client/bootstrap.sh?server_id=" + serverID.String())
+	ctx.Request.Header.SetHost("vpn.example.com")
+	viaTLSProxy(ctx)
+	server.bootstrapScriptHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if got := string(ctx.Response.Header.Peek("Cache-Control")); got != "no-store" {
+		t.Errorf("Expected Cache-Control no-store, got %q", got)
+	}
+
+	script := string(ctx.Response.Body())
+	if !strings.Contains(script, "API_URL='https://vpn.example.com'\n") {
+		t.Errorf("Expected the script to target the API it was fetched from, got:\n%s", script)
+	}
+	if !strings.Contains(script, "SERVER_ID='"+serverID.String()+"'") {
+		t.Errorf("Expected the script to provision server %s", serverID)
+	}
+	if strings.Contains(script, services.ClientPrivateKeyPlaceholder) {
+		t.Error("Expected no server-side private key in the script")
+	}
+}
+
+func TestDiagnosticsHandlerRejectsInvalidServerID(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBodyString(`{"server_id": "not-a-uuid"}`)
+	server.diagnosticsHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestDiagnosticsHandlerReportsKeyLookupFailure(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	server := &Server{config: &config.Config{}, logger: logger, wireguardService: wireguardService}
+
+	// A failed lookup must not be diagnosed as having no key
+	db.Close()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBodyString(fmt.Sprintf(`{"server_id": %q}`, uuid.New()))
+	server.diagnosticsHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	serverID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Diagnostics', 'Diagnostics Location', '192.0.2.1', 'test-key', 51820)`,
+		serverID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("diagnostics-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO user_keys (user_id, server_id, public_key, allowed_ips) VALUES ($1, $2, $3, '10.0.0.2/32')`,
+		user.ID, serverID, key.PublicKey().String()); err != nil {
+		t.Fatalf("Failed to insert user key: %v", err)
+	}
+
+	client := &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}}
+	wireguardService := services.NewWireguardServiceWithClient(logger, client)
+	wireguardService.SetDB(db)
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: wireguardService,
+	}
+
+	diagnose := func() models.DiagnosticsResponse {
+		t.Helper()
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", user.ID)
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBodyString(fmt.Sprintf(`{"server_id": %q, "platform": "linux", "client_version": "1.0.0"}`, serverID))
+		server.diagnosticsHandler(ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+		var response struct {
+			Data models.DiagnosticsResponse `json:"data"`
+		}
+		if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return response.Data
+	}
+
+	// The key is registered but its peer was never programmed on the device
+	got := diagnose()
+	if got.Diagnosis.Code != services.DiagnosisPeerMissing || got.PeerProgrammed {
+		t.Errorf("Expected %s with no peer programmed, got %+v", services.DiagnosisPeerMissing, got)
+	}
+
+	client.device.Peers = []wgtypes.Peer{{PublicKey: key.PublicKey(), LastHandshakeTime: time.Now().Add(-time.Hour)}}
+	got = diagnose()
+	if got.Diagnosis.Code != services.DiagnosisHandshakeStale || !got.PeerProgrammed || got.ServerLastHandshake == nil {
+		t.Errorf("Expected %s with the server's last handshake, got %+v", services.DiagnosisHandshakeStale, got)
+	}
+}
+
+func TestAuthMiddlewareRejectsRevokedSessions(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("sessions-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	authService := services.NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: userService,
+		authService: authService,
+	}
+
+	oldToken, err := authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	request := func(method, token, body string, handler fasthttp.RequestHandler) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+		if body != "" {
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(body)
+		}
+		server.authMiddleware(handler)(ctx)
+		return ctx
+	}
+
+	ctx := request("POST", oldToken, `{"keep_current": true}`, server.revokeSessionsHandler)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var response struct {
+		Data models.RevokeSessionsResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Data.Token == "" {
+		t.Fatal("Expected a replacement token for the current session")
+	}
+
+	if ctx := request("GET", oldToken, "", server.getPermissionsHandler); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected the revoked token to get 401, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := request("GET", response.Data.Token, "", server.getPermissionsHandler); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("Expected the replacement token to be accepted, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestMustChangePasswordOnlyAllowsPasswordChange(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	authService := services.NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	hash, err := authService.HashPassword("Temporary1pass")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("must-change-%s@example.com", uuid.New()), hash)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	if err := userService.AdminResetPassword(t.Context(), user.ID, hash, true); err != nil {
+		t.Fatalf("AdminResetPassword() error = %v", err)
+	}
+
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: userService,
+		authService: authService,
+	}
+	token, err := authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	request := func(auth middleware, handler fasthttp.RequestHandler, body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBodyString(body)
+		auth(handler)(ctx)
+		return ctx
+	}
+
+	if ctx := request(server.authMiddleware, server.getPermissionsHandler, ""); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("Expected status 403 before the password change, got %d", ctx.Response.StatusCode())
+	}
+
+	change := func(body string) *fasthttp.RequestCtx {
+		return request(server.passwordChangeAuthMiddleware, server.changePasswordHandler, body)
+	}
+	if ctx := change(`{"current_password": "Wrong1password", "new_password": "Chosen1password"}`); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected status 403 for a wrong current password, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := change(`{"current_password": "Temporary1pass", "new_password": "Temporary1pass"}`); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unchanged password, got %d", ctx.Response.StatusCode())
+	}
+	ctx := change(`{"current_password": "Temporary1pass", "new_password": "Chosen1password"}`)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	// The same token is accepted everywhere once the password has been changed
+	if ctx := request(server.authMiddleware, server.getPermissionsHandler, ""); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("Expected status 200 after the password change, got %d", ctx.Response.StatusCode())
+	}
+	changed, err := userService.GetUserByID(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+	if changed.MustChangePassword || authService.VerifyPassword("Chosen1password", changed.PasswordHash) != nil {
+		t.Errorf("Expected the chosen password with the flag cleared, got must_change_password = %v", changed.MustChangePassword)
+	}
+}
+
+func TestRequireStepUpWithoutPassword(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	// Operations not listed need only the token
+	ctx := &fasthttp.RequestCtx{}
+	if !server.requireStepUp(ctx, config.StepUpRevokeSessions, "") {
+		t.Errorf("Expected an unlisted operation to proceed, got %d", ctx.Response.StatusCode())
+	}
+
+	server.config.Security.StepUpOperations = []string{config.StepUpRevokeSessions}
+	ctx = &fasthttp.RequestCtx{}
+	if server.requireStepUp(ctx, config.StepUpRevokeSessions, "") {
+		t.Fatal("Expected a listed operation without a password to be refused")
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden || !strings.Contains(string(ctx.Response.Body()), "re-authentication required") {
+		t.Errorf("Expected 403 re-authentication required, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func TestRevokeSessionsRequiresStepUp(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	authService := services.NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	hash, err := authService.HashPassword("correct horse battery")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("stepup-%s@example.com", uuid.New()), hash)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	cfg := &config.Config{}
+	cfg.Security.StepUpOperations = []string{config.StepUpRevokeSessions}
+	server := &Server{
+		config:      cfg,
+		logger:      logger,
+		userService: userService,
+		authService: authService,
+	}
+
+	revoke := func(body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", user.ID)
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBodyString(body)
+		server.revokeSessionsHandler(ctx)
+		return ctx
+	}
+
+	for _, body := range []string{`{}`, `{"current_password": "wrong password"}`} {
+		if ctx := revoke(body); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+			t.Errorf("Expected %s to be refused with 403, got %d", body, ctx.Response.StatusCode())
+		}
+	}
+
+	var validAfter *time.Time
+	db.QueryRow(t.Context(), `SELECT tokens_valid_after FROM users WHERE id = $1`, user.ID).Scan(&validAfter)
+	if validAfter != nil {
+		t.Fatal("Expected sessions to stay valid after a refused step-up")
+	}
+
+	if ctx := revoke(`{"current_password": "correct horse battery"}`); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("Expected the current password to allow revocation, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	// Wrong passwords count against the failed attempt limit, after which even the right one waits
+	authService.SetPasswordAttemptLimit(2, time.Hour)
+	for i := 0; i < 2; i++ {
+		if ctx := revoke(`{"current_password": "wrong password"}`); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+			t.Fatalf("Expected wrong password %d to be refused with 403, got %d", i+1, ctx.Response.StatusCode())
+		}
+	}
+	ctx := revoke(`{"current_password": "correct horse battery"}`)
+	if ctx.Response.StatusCode() != fasthttp.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the limit is reached, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if ctx.Response.Header.Peek("Retry-After") == nil {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+func TestPeerStatusHandlerRejectsInvalidRequests(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{}}),
+	}
+
+	tooMany := make([]string, services.MaxPeerStatusKeys+1)
+	for i := range tooMany {
+		tooMany[i] = "key"
+	}
+	tooManyBody, _ := json.Marshal(models.PeerStatusRequest{PublicKeys: tooMany})
+
+	tests := []struct {
+		name     string
+		serverID string
+		body     string
+	}{
+		{name: "invalid server ID", serverID: "not-a-uuid", body: `{"public_keys": ["key"]}`},
+		{name: "no keys", serverID: uuid.NewString(), body: `{"public_keys": []}`},
+		{name: "too many keys", serverID: uuid.NewString(), body: string(tooManyBody)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.serverID)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.peerStatusHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestPeerStatusHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	serverID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Peer Status', 'Peer Status Location', '192.0.2.1', 'test-key', 51820)`,
+		serverID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	present, _ := wgtypes.GeneratePrivateKey()
+	absent, _ := wgtypes.GeneratePrivateKey()
+	client := &fakeWGClient{device: &wgtypes.Device{Name: "wg0", Peers: []wgtypes.Peer{
+		{PublicKey: present.PublicKey(), LastHandshakeTime: time.Now()},
+	}}}
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		serverService:    services.NewServerService(db, logger),
+		wireguardService: services.NewWireguardServiceWithClient(logger, client),
+	}
+
+	query := func(serverID uuid.UUID) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("id", serverID.String())
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBodyString(fmt.Sprintf(`{"public_keys": [%q, %q, "bad"]}`, present.PublicKey(), absent.PublicKey()))
+		server.peerStatusHandler(ctx)
+		return ctx
+	}
+
+	ctx := query(serverID)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	var response struct {
+		Data models.PeerStatusResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	peers := response.Data.Peers
+	if len(peers) != 3 {
+		t.Fatalf("Expected 3 statuses, got %d", len(peers))
+	}
+	if !peers[0].Programmed || !peers[0].Connected || peers[0].LastHandshake == nil {
+		t.Errorf("Expected the present key to be connected, got %+v", peers[0])
+	}
+	if peers[1].Programmed || peers[1].Error != "" {
+		t.Errorf("Expected the absent key to be unprogrammed, got %+v", peers[1])
+	}
+	if peers[2].Error == "" {
+		t.Errorf("Expected the malformed key to carry an error, got %+v", peers[2])
+	}
+
+	// An unknown server is a 404
+	if ctx := query(uuid.New()); ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestServerInfoHandlerRejectsInvalidID(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("id", "not-a-uuid")
+	server.serverInfoHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestServerInfoHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	lastSeen := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	serverID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port, subnet, last_seen_at)
+		 VALUES ($1, 'Info', 'Info Location', '192.0.2.1', $2, 51820, '10.9.0.0/29', $3)`,
+		serverID, serverKey.PublicKey().String(), lastSeen); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	userService := services.NewUserService(db, logger)
+	for i, allowedIPs := range []string{"10.9.0.2/32", "10.9.0.3/32, fd00::3/128"} {
+		user, err := userService.CreateUser(t.Context(), fmt.Sprintf("info-%s@example.com", uuid.New()), "hash")
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		t.Cleanup(func() {
+			db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+		})
+		key, _ := wgtypes.GeneratePrivateKey()
+		if _, err := db.Exec(t.Context(),
+			`INSERT INTO user_keys (user_id, server_id, public_key, allowed_ips) VALUES ($1, $2, $3, $4)`,
+			user.ID, serverID, key.PublicKey().String(), allowedIPs); err != nil {
+			t.Fatalf("Failed to insert user key %d: %v", i, err)
+		}
+	}
+
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{}})
+	wireguardService.SetDB(db)
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		serverService:    services.NewServerService(db, logger),
+		wireguardService: wireguardService,
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("id", serverID.String())
+	server.serverInfoHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	var response struct {
+		Data models.ServerInfo `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	info := response.Data
+
+	wantFingerprint, _ := services.KeyFingerprint(serverKey.PublicKey().String())
+	if info.ID != serverID || info.Name != "Info" {
+		t.Errorf("Unexpected server identity: %+v", info)
+	}
+	if info.LastSeen == nil || !info.LastSeen.Equal(lastSeen) {
+		t.Errorf("Expected last_seen %s, got %v", lastSeen, info.LastSeen)
+	}
+	if info.UpdatedAt.IsZero() {
+		t.Error("Expected updated_at to be set")
+	}
+	if info.PublicKeyFingerprint != wantFingerprint {
+		t.Errorf("Expected fingerprint %s, got %s", wantFingerprint, info.PublicKeyFingerprint)
+	}
+	if info.ActiveKeys != 2 {
+		t.Errorf("Expected 2 active keys, got %d", info.ActiveKeys)
+	}
+
+	// A /29 holds 5 client addresses; the IPv6 half of the dual-stack key is not from this pool
+	want := models.PoolUtilization{Subnet: "10.9.0.0/29", Size: 5, Allocated: 2, Utilization: 0.4}
+	if info.Pool == nil || *info.Pool != want {
+		t.Errorf("Expected pool %+v, got %+v", want, info.Pool)
+	}
+
+	// An unknown server is a 404
+	ctx = &fasthttp.RequestCtx{}
+	ctx.SetUserValue("id", uuid.NewString())
+	server.serverInfoHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestReserveIPsHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name     string
+		serverID string
+		body     string
+	}{
+		{name: "invalid server ID", serverID: "not-a-uuid", body: `{"count": 1}`},
+		{name: "no count", serverID: uuid.NewString(), body: `{}`},
+		{name: "too many", serverID: uuid.NewString(), body: fmt.Sprintf(`{"count": %d}`, services.MaxIPReservation+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.serverID)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.reserveIPsHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestReleaseIPsHandlerRejectsInvalidRequests(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "no addresses", body: `{"addresses": []}`},
+		{name: "malformed address", body: `{"addresses": ["10.0.0.0/24"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", uuid.NewString())
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.releaseIPsHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestServerAllocationsHandlerRejectsInvalidRequests(t *testing.T) {
+	logger := zap.NewNop()
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{}),
+	}
+
+	tests := []struct {
+		name  string
+		id    string
+		query string
+	}{
+		{name: "invalid server ID", id: "not-a-uuid"},
+		{name: "invalid limit", id: uuid.NewString(), query: "limit=0"},
+		{name: "invalid offset", id: uuid.NewString(), query: "offset=-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.id)
+			ctx.Request.SetRequestURI("/api/admin/servers/" + tt.id + "/allocations?" + tt.query)
+			server.serverAllocationsHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestSetObfuscationHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name     string
+		serverID string
+		body     string
+	}{
+		{name: "invalid server ID", serverID: "not-a-uuid", body: `{"profile": null}`},
+		{name: "malformed body", serverID: uuid.NewString(), body: `{"profile": "on"}`},
+		{
+			name:     "out of range",
+			serverID: uuid.NewString(),
+			body:     `{"profile": {"jc": 0, "jmin": 50, "jmax": 1000, "s1": 15, "s2": 25, "h1": 5, "h2": 6, "h3": 7, "h4": 8}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.serverID)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.setObfuscationHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestSetDoHTemplateHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name     string
+		serverID string
+		body     string
+	}{
+		{name: "invalid server ID", serverID: "not-a-uuid", body: `{"doh_template": ""}`},
+		{name: "malformed body", serverID: uuid.NewString(), body: `{"doh_template": 1}`},
+		{name: "plain http", serverID: uuid.NewString(), body: `{"doh_template": "http://dns.example.com/dns-query"}`},
+		{name: "breaks out of the comment", serverID: uuid.NewString(), body: `{"doh_template": "https://dns.example.com/\nPostUp = id"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.serverID)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.setDoHTemplateHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestCreateMaintenanceHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+	starts := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	ends := time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name     string
+		serverID string
+		body     string
+	}{
+		{name: "invalid server ID", serverID: "not-a-uuid", body: fmt.Sprintf(`{"starts_at": %q, "ends_at": %q}`, starts, ends)},
+		{name: "missing times", serverID: uuid.NewString(), body: `{"message": "soon"}`},
+		{name: "ends before start", serverID: uuid.NewString(), body: fmt.Sprintf(`{"starts_at": %q, "ends_at": %q}`, ends, starts)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.serverID)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.createMaintenanceHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestSetConnectionLimitHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name   string
+		userID string
+		body   string
+	}{
+		{name: "invalid user ID", userID: "not-a-uuid", body: `{"max_concurrent_connections": 3}`},
+		{name: "negative limit", userID: uuid.NewString(), body: `{"max_concurrent_connections": -1}`},
+		{name: "malformed body", userID: uuid.NewString(), body: `{"max_concurrent_connections": "three"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.userID)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.setConnectionLimitHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestTrendsHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "unknown bucket", query: "bucket=minute"},
+		{name: "malformed from", query: "from=yesterday"},
+		{name: "malformed to", query: "to=2026-13-01"},
+		{name: "reversed range", query: "from=2026-03-02&to=2026-03-01"},
+		{name: "too many buckets", query: "from=2020-01-01&to=2026-01-01&bucket=hour"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI("/api/admin/stats/trends?" + tt.query)
+			server.trendsHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestTrendsHandlerRequiresAuditLogging(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/admin/stats/trends")
+	server.trendsHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestParseTrendTime(t *testing.T) {
+	want := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, raw := range []string{"2026-03-01", "2026-03-01T00:00:00Z", "2026-03-01T02:00:00+02:00"} {
+		got, err := parseTrendTime(raw)
+		if err != nil || !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("parseTrendTime(%q) = %v, %v; want %v", raw, got, err, want)
+		}
+	}
+}
+
+func TestSelfTestHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name     string
+		serverID string
+		body     string
+	}{
+		{name: "invalid server ID", serverID: "not-a-uuid"},
+		{name: "malformed body", serverID: uuid.NewString(), body: `{"probe": 443}`},
+		{name: "probe without a port", serverID: uuid.NewString(), body: `{"probe": "1.1.1.1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.serverID)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			server.selfTestHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestConfigShareHandlersRejectInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	t.Run("share without a server", func(t *testing.T) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", uuid.New())
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBodyString(`{}`)
+		server.createConfigShareHandler(ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+		}
+	})
+
+	for _, token := range []string{"", "short", strings.Repeat("z", 64)} {
+		t.Run("malformed token "+token, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("token", token)
+			server.sharedConfigHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestSharedConfigHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+	defaultServerID := uuid.MustParse("a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f")
+
+	userService := services.NewUserService(db, logger)
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	serverService := services.NewServerService(db, logger)
+	if _, err := serverService.ReloadServers(t.Context()); err != nil {
+		t.Fatalf("ReloadServers() error = %v", err)
+	}
+	server := &Server{
+		config:           &config.Config{Server: config.ServerConfig{PublicBaseURL: "https://vpn.example.com"}},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+		serverService:    serverService,
+	}
+
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("share-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	_, publicKey, _ := wireguardService.GenerateKeyPair()
+	userKey, err := wireguardService.AddUserKey(t.Context(), user.ID, defaultServerID, publicKey)
+	if err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+
+	body, _ := json.Marshal(models.ConfigShareRequest{ServerID: defaultServerID})
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", user.ID)
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody(body)
+	// A forged Host header must not end up in the link
+	ctx.Request.Header.SetHost("attacker.example.com")
+	server.createConfigShareHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var created struct {
+		Data models.ConfigShare `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &created); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if want := "https://vpn.example.com/api/client/config/shared/" + created.Data.Token; created.Data.URL != want {
+		t.Errorf("Expected the share URL %q from the public base URL, got %q", want, created.Data.URL)
+	}
+
+	fetch := func() *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("token", created.Data.Token)
+		server.sharedConfigHandler(ctx)
+		return ctx
+	}
+
+	first := fetch()
+	if first.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", first.Response.StatusCode(), first.Response.Body())
+	}
+	var shared struct {
+		Data models.SharedConfigResponse `json:"data"`
+	}
+	if err := json.Unmarshal(first.Response.Body(), &shared); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if !strings.Contains(shared.Data.Config, services.ClientPrivateKeyPlaceholder) {
+		t.Error("A shared config must carry the private key placeholder, not a key")
+	}
+	if !strings.Contains(shared.Data.Config, userKey.AllowedIPs) {
+		t.Errorf("Expected the shared config to use the user's address %s", userKey.AllowedIPs)
+	}
+	if string(first.Response.Header.Peek("Cache-Control")) != "no-store" {
+		t.Error("A shared config must not be cached")
+	}
+
+	if second := fetch(); second.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Errorf("Expected a used link to return 404, got %d", second.Response.StatusCode())
+	}
+}
+
+func TestConfigFileHandlerRejectsInvalidRequests(t *testing.T) {
+	server := &Server{config: &config.Config{}, trustedProxies: testProxies, logger: zap.NewNop()}
+
+	tests := []struct {
+		name   string
+		query  string
+		body   string
+		status int
+	}{
+		{name: "no server", status: fasthttp.StatusBadRequest},
+		{name: "malformed server", query: "server_id=nope", status: fasthttp.StatusBadRequest},
+		{name: "malformed private key", body: `{"server_id": "` + uuid.NewString() + `", "private_key": "c2hvcnQ="}`, status: fasthttp.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("user_id", uuid.New())
+			ctx.Request.SetRequestURI("/api/client/config/file?" + tt.query)
+			viaTLSProxy(ctx)
+			if tt.body != "" {
+				ctx.Request.Header.SetMethod("POST")
+				ctx.Request.Header.SetContentType("application/json")
+				ctx.Request.SetBodyString(tt.body)
+			}
+			server.configFileHandler(ctx)
+
+			if ctx.Response.StatusCode() != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestImportServerKeyHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	serverService := services.NewServerService(db, logger)
+	created, err := serverService.CreateServer(t.Context(), "Imported", "Import Location", "import.example.com", key.PublicKey().String(), "10.90.0.0/24", "", 51820)
+	if err != nil {
+		t.Fatalf("CreateServer() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, created.ID)
+	})
+
+	remoteKey, _ := wgtypes.GeneratePrivateKey()
+	remote, err := serverService.CreateServer(t.Context(), "Imported Remote", "Import Location", "remote.example.com", remoteKey.PublicKey().String(), "10.91.0.0/24", "", 51820)
+	if err != nil {
+		t.Fatalf("CreateServer() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, remote.ID)
+	})
+
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	wireguardService.SetLocalServerID(created.ID)
+	server := &Server{config: &config.Config{}, trustedProxies: testProxies, logger: logger, wireguardService: wireguardService}
+
+	other, _ := wgtypes.GeneratePrivateKey()
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		https  bool
+		status int
+	}{
+		{name: "malformed server", id: "nope", body: `{"private_key": "` + key.String() + `"}`, https: true, status: fasthttp.StatusBadRequest},
+		{name: "plain HTTP", id: created.ID.String(), body: `{"private_key": "` + key.String() + `"}`, status: fasthttp.StatusForbidden},
+		{name: "malformed key", id: created.ID.String(), body: `{"private_key": "c2hvcnQ="}`, https: true, status: fasthttp.StatusBadRequest},
+		{name: "unknown server", id: uuid.NewString(), body: `{"private_key": "` + key.String() + `"}`, https: true, status: fasthttp.StatusNotFound},
+		{name: "remote server", id: remote.ID.String(), body: `{"private_key": "` + remoteKey.String() + `"}`, https: true, status: fasthttp.StatusNotFound},
+		{name: "mismatched key", id: created.ID.String(), body: `{"private_key": "` + other.String() + `"}`, https: true, status: fasthttp.StatusConflict},
+		{name: "matching key", id: created.ID.String(), body: `{"private_key": "` + key.String() + `"}`, https: true, status: fasthttp.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("id", tt.id)
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+			if tt.https {
+				viaTLSProxy(ctx)
+			}
+			server.importServerKeyHandler(ctx)
+
+			if ctx.Response.StatusCode() != tt.status {
+				t.Errorf("Expected status %d, got %d: %s", tt.status, ctx.Response.StatusCode(), ctx.Response.Body())
+			}
+		})
+	}
+}
+
+func TestConfigQRHandlerRejectsInvalidSize(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	for _, size := range []string{"0", "abc", strconv.Itoa(services.MaxConfigQRSize + 1)} {
+		t.Run(size, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetUserValue("user_id", uuid.New())
+			ctx.Request.SetRequestURI("/api/client/config/qr?size=" + size)
+			ctx.Request.Header.SetMethod("POST")
+			server.configQRHandler(ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestConfigFileHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+	defaultServerID := uuid.MustParse("a7f4c3d6-1b3c-4e8b-9f0e-1d2c3b4a5e6f")
+
+	userService := services.NewUserService(db, logger)
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	serverService := services.NewServerService(db, logger)
+	if _, err := serverService.ReloadServers(t.Context()); err != nil {
+		t.Fatalf("ReloadServers() error = %v", err)
+	}
+	server := &Server{
+		trustedProxies:   testProxies,
+		config:           &config.Config{},
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+		serverService:    serverService,
+	}
+
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("conffile-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	privateKey, publicKey, _ := wireguardService.GenerateKeyPair()
+	userKey, err := wireguardService.AddUserKey(t.Context(), user.ID, defaultServerID, publicKey)
+	if err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+
+	download := func(privateKey string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", user.ID)
+		viaTLSProxy(ctx)
+		if privateKey == "" {
+			ctx.Request.SetRequestURI("/api/client/config/file?server_id=" + defaultServerID.String())
+		} else {
+			body, _ := json.Marshal(models.ConfigFileRequest{ServerID: defaultServerID.String(), PrivateKey: privateKey})
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBody(body)
+		}
+		server.configFileHandler(ctx)
+		return ctx
+	}
+
+	// Without a private key the file keeps the placeholder, flagged by a comment
+	ctx := download("")
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if got := string(ctx.Response.Header.Peek("Content-Disposition")); got != `attachment; filename="wg0.conf"` {
+		t.Errorf("Expected a wg0.conf attachment, got %q", got)
+	}
+	if got := string(ctx.Response.Header.ContentType()); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Expected a text/plain body, got %q", got)
+	}
+	conf := string(ctx.Response.Body())
+	if !strings.HasPrefix(conf, "# Replace "+services.ClientPrivateKeyPlaceholder) {
+		t.Errorf("Expected the placeholder to be commented, got:\n%s", conf)
+	}
+	// The file must match what GenerateConfig produces for the JSON endpoint
+	for _, line := range []string{
+		"PrivateKey = " + services.ClientPrivateKeyPlaceholder,
+		"Address = " + userKey.AllowedIPs,
+		"DNS = " + services.DefaultClientDNS,
+		"AllowedIPs = " + services.DefaultClientAllowedIPs,
+	} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("Expected the file to contain %q, got:\n%s", line, conf)
+		}
+	}
+
+	// The device's own private key is written in, with no placeholder left
+	ctx = download(privateKey)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	conf = string(ctx.Response.Body())
+	if !strings.HasPrefix(conf, "[Interface]\nPrivateKey = "+privateKey+"\n") || strings.Contains(conf, services.ClientPrivateKeyPlaceholder) {
+		t.Errorf("Expected the private key in the file, got:\n%s", conf)
+	}
+
+	// A private key for another device is refused
+	otherKey, _, _ := wireguardService.GenerateKeyPair()
+	if ctx := download(otherKey); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected a mismatched private key to be refused, got %d", ctx.Response.StatusCode())
+	}
+
+	// The rendering options are honoured as they are by the JSON endpoint
+	withOptions := func(options models.ConfigOptionsRequest) *fasthttp.RequestCtx {
+		body, _ := json.Marshal(models.ConfigFileRequest{ServerID: defaultServerID.String(), ConfigOptionsRequest: options})
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", user.ID)
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody(body)
+		server.configFileHandler(ctx)
+		return ctx
+	}
+	ctx = withOptions(models.ConfigOptionsRequest{DNSSearch: "corp.example.com", LeakProtection: &models.LeakProtection{Table: "1234"}})
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	conf = string(ctx.Response.Body())
+	for _, line := range []string{"DNS = " + services.DefaultClientDNS + ", corp.example.com", "Table = 1234"} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("Expected the file to contain %q, got:\n%s", line, conf)
+		}
+	}
+	if ctx := withOptions(models.ConfigOptionsRequest{Obfuscated: true}); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected an obfuscated config from a server without a profile to be refused, got %d", ctx.Response.StatusCode())
+	}
+
+	// The same config is served as a QR code sized as asked, only with the private key written in
+	qr := func(size, privateKey string) *fasthttp.RequestCtx {
+		body, _ := json.Marshal(models.ConfigFileRequest{ServerID: defaultServerID.String(), PrivateKey: privateKey})
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", user.ID)
+		viaTLSProxy(ctx)
+		ctx.Request.SetRequestURI("/api/client/config/qr?size=" + size)
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody(body)
+		server.configQRHandler(ctx)
+		return ctx
+	}
+	if ctx := qr("300", ""); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected a QR code without the private key to be refused, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := qr("20", privateKey); ctx.Response.StatusCode() != fasthttp.StatusBadRequest || !strings.Contains(string(ctx.Response.Body()), "at least") {
+		t.Errorf("Expected a size too small for the config to be refused, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	ctx = qr("300", privateKey)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if got := string(ctx.Response.Header.ContentType()); got != "image/png" {
+		t.Errorf("Expected image/png, got %q", got)
+	}
+	img, err := png.Decode(bytes.NewReader(ctx.Response.Body()))
+	if err != nil {
+		t.Fatalf("png.Decode() error = %v", err)
+	}
+	if side := img.Bounds().Dx(); side > 300 {
+		t.Errorf("Expected the QR code to fit in 300 pixels, got %d", side)
+	}
+}
+
+func TestImpersonationTokenScope(t *testing.T) {
+	authService := services.NewAuthService("test-secret", zap.NewNop())
+	server := &Server{config: &config.Config{}, logger: zap.NewNop(), authService: authService}
+
+	// Even an admin's impersonation token must not reach admin routes
+	token, _, err := authService.GenerateImpersonationToken(uuid.New(), uuid.New(), models.RoleAdmin)
+	if err != nil {
+		t.Fatalf("GenerateImpersonationToken() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		chain  []middleware
+	}{
+		{name: "admin route", method: "GET", chain: []middleware{server.authMiddleware, server.adminMiddleware}},
+		{name: "user route outside the read-only scope", method: "GET", chain: []middleware{server.authMiddleware}},
+		{name: "write to a viewable route", method: "POST", chain: []middleware{server.impersonableAuthMiddleware}},
+		{name: "viewable route without audit logging", method: "GET", chain: []middleware{server.impersonableAuthMiddleware}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.SetMethod(tt.method)
+			ctx.Request.Header.Set("Authorization", "Bearer "+token)
+			chain(func(ctx *fasthttp.RequestCtx) { called = true }, tt.chain...)(ctx)
+
+			if called || ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+				t.Errorf("Expected status 403 without reaching the handler, got %d (called %v)", ctx.Response.StatusCode(), called)
+			}
+		})
+	}
+}
+
+func TestImpersonateHandlerRejectsSelf(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+	adminID := uuid.New()
+
+	for _, id := range []string{"not-a-uuid", adminID.String()} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", adminID)
+		ctx.SetUserValue("id", id)
+		ctx.Request.Header.SetMethod("POST")
+		server.impersonateHandler(ctx)
+
+		if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("Impersonating %q: expected status 400, got %d", id, ctx.Response.StatusCode())
+		}
+	}
+}
+
+func TestImpersonateHandlerRequiresAuditLogging(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", uuid.New())
+	ctx.SetUserValue("id", uuid.New().String())
+	ctx.Request.Header.SetMethod("POST")
+	server.impersonateHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestImpersonateHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	authService := services.NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	server := &Server{
+		config:       &config.Config{},
+		logger:       logger,
+		userService:  userService,
+		authService:  authService,
+		auditService: services.NewAuditService(db, logger),
+	}
+
+	var users [2]uuid.UUID
+	for i := range users {
+		user, err := userService.CreateUser(t.Context(), fmt.Sprintf("impersonate-%s@example.com", uuid.New()), "hash")
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		t.Cleanup(func() {
+			db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+		})
+		users[i] = user.ID
+	}
+	adminID, userID := users[0], users[1]
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", adminID)
+	ctx.SetUserValue("id", userID.String())
+	ctx.Request.Header.SetMethod("POST")
+	server.impersonateHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var response struct {
+		Data models.ImpersonationResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if time.Until(response.Data.ExpiresAt) > services.ImpersonationTokenTTL {
+		t.Errorf("Impersonation token expires at %s, want within %s", response.Data.ExpiresAt, services.ImpersonationTokenTTL)
+	}
+
+	var seenUser, seenAdmin uuid.UUID
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("GET")
+	ctx.Request.SetRequestURI("/api/client/dashboard")
+	ctx.Request.Header.Set("Authorization", "Bearer "+response.Data.Token)
+	server.impersonableAuthMiddleware(func(ctx *fasthttp.RequestCtx) {
+		seenUser, _ = ctx.UserValue("user_id").(uuid.UUID)
+		seenAdmin, _ = ctx.UserValue("impersonator_id").(uuid.UUID)
+	})(ctx)
+	if seenUser != userID || seenAdmin != adminID {
+		t.Errorf("Impersonated request saw user %s acted on by %s, want %s by %s", seenUser, seenAdmin, userID, adminID)
+	}
+
+	for _, action := range []string{services.AuditActionImpersonationStart, services.AuditActionImpersonatedRequest} {
+		var audits int
+		if err := db.QueryRow(t.Context(), `SELECT COUNT(*) FROM audit_log WHERE actor_id = $1 AND target_id = $2 AND action = $3`,
+			adminID, userID, action).Scan(&audits); err != nil {
+			t.Fatalf("Failed to count audit entries: %v", err)
+		}
+		if audits != 1 {
+			t.Errorf("Expected one %s audit entry with both identities, got %d", action, audits)
+		}
+	}
+}
+
+func TestGetConfigHandlerSteersPastSoftMax(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	fullServerID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Full', 'Full Location', '192.0.2.1', 'test-key', 51820)`,
+		fullServerID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, fullServerID)
+	})
+
+	userService := services.NewUserService(db, logger)
+	wireguardService := services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+	cfg := &config.Config{}
+	cfg.WireGuard.SoftMaxKeys = 1
+	server := &Server{
+		config:           cfg,
+		logger:           logger,
+		userService:      userService,
+		wireguardService: wireguardService,
+		serverService:    services.NewServerService(db, logger),
+	}
+
+	newUser := func() uuid.UUID {
+		user, err := userService.CreateUser(t.Context(), fmt.Sprintf("steer-%s@example.com", uuid.New()), "hash")
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		t.Cleanup(func() {
+			db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+		})
+		return user.ID
+	}
+	getConfig := func(userID uuid.UUID) models.WireGuardConfig {
+		_, publicKey, _ := wireguardService.GenerateKeyPair()
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("user_id", userID)
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody([]byte(fmt.Sprintf(`{"public_key":%q,"server_id":%q}`, publicKey, fullServerID)))
+		server.getConfigHandler(ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+
+		var response struct {
+			Data models.WireGuardConfig `json:"data"`
+		}
+		if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return response.Data
+	}
+
+	first := newUser()
+	if config := getConfig(first); config.Steering != nil {
+		t.Fatalf("A server below its soft maximum should not steer, got %+v", config.Steering)
+	}
+
+	second := newUser()
+	config := getConfig(second)
+	if config.Steering == nil || config.Steering.RequestedServerID != fullServerID || config.Steering.ServerID == fullServerID {
+		t.Fatalf("Expected a new user to be steered away from the full server, got %+v", config.Steering)
+	}
+	if _, err := wireguardService.GetUserKey(t.Context(), second, config.Steering.ServerID); err != nil {
+		t.Errorf("Expected the steered user to be provisioned on %s: %v", config.Steering.ServerID, err)
+	}
+	if _, err := wireguardService.GetUserKey(t.Context(), second, fullServerID); err == nil {
+		t.Error("A steered user must not be provisioned on the full server")
+	}
+
+	if config := getConfig(first); config.Steering != nil {
+		t.Errorf("A user already on the full server should keep it, got %+v", config.Steering)
+	}
+
+	// A user with a key elsewhere is steered back there, even when it is not the least loaded
+	heldServerID := uuid.New()
+	if _, err := db.Exec(t.Context(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Held', 'Held Location', '192.0.2.2', 'test-key', 51820)`,
+		heldServerID); err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, heldServerID)
+	})
+	third := newUser()
+	for _, userID := range []uuid.UUID{third, newUser()} {
+		_, publicKey, _ := wireguardService.GenerateKeyPair()
+		if _, err := wireguardService.AddUserKey(t.Context(), userID, heldServerID, publicKey); err != nil {
+			t.Fatalf("AddUserKey() error = %v", err)
+		}
+	}
+	config = getConfig(third)
+	if config.Steering == nil || config.Steering.ServerID != heldServerID {
+		t.Errorf("Expected a user with a key on %s to be steered there, got %+v", heldServerID, config.Steering)
+	}
+}
+
+func TestDeviceInfoHandler(t *testing.T) {
+	logger := zap.NewNop()
+	privateKey, _ := wgtypes.GeneratePrivateKey()
+	peerKey, _ := wgtypes.GeneratePrivateKey()
+	device := &wgtypes.Device{
+		Name:         "wg0",
+		Type:         wgtypes.LinuxKernel,
+		PrivateKey:   privateKey,
+		PublicKey:    privateKey.PublicKey(),
+		ListenPort:   51820,
+		FirewallMark: 42,
+		Peers:        []wgtypes.Peer{{PublicKey: peerKey.PublicKey()}},
+	}
+
+	request := func(client *fakeWGClient, name string) *fasthttp.RequestCtx {
+		server := &Server{
+			config:           &config.Config{},
+			logger:           logger,
+			wireguardService: services.NewWireguardServiceWithClient(logger, client),
+		}
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("name", name)
+		server.deviceInfoHandler(ctx)
+		return ctx
+	}
+
+	ctx := request(&fakeWGClient{device: device}, "wg0")
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var response struct {
+		Data models.DeviceInfo `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	want := models.DeviceInfo{
+		Name:         "wg0",
+		Type:         wgtypes.LinuxKernel.String(),
+		PublicKey:    privateKey.PublicKey().String(),
+		ListenPort:   51820,
+		FirewallMark: 42,
+		PeerCount:    1,
+	}
+	if response.Data != want {
+		t.Errorf("deviceInfoHandler() = %+v, want %+v", response.Data, want)
+	}
+	if strings.Contains(string(ctx.Response.Body()), privateKey.String()) {
+		t.Error("The device private key must never be returned")
+	}
+
+	tests := []struct {
+		name       string
+		client     *fakeWGClient
+		device     string
+		wantStatus int
+	}{
+		{name: "interface other than the managed device", client: &fakeWGClient{device: device}, device: "eth0", wantStatus: fasthttp.StatusNotFound},
+		{name: "managed device missing", client: &fakeWGClient{}, device: "wg0", wantStatus: fasthttp.StatusServiceUnavailable},
+		{name: "malformed name", client: &fakeWGClient{device: device}, device: "../wg0", wantStatus: fasthttp.StatusBadRequest},
+		{name: "name too long", client: &fakeWGClient{device: device}, device: strings.Repeat("w", 16), wantStatus: fasthttp.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ctx := request(tt.client, tt.device); ctx.Response.StatusCode() != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestDegradedMode(t *testing.T) {
+	logger := zap.NewNop()
+	health := database.NewHealth(logger)
+	health.Check(t.Context(), func(context.Context) error { return errors.New("connection refused") })
+
+	server := &Server{config: &config.Config{}, logger: logger, dbHealth: health}
+
+	called := false
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	chain(func(ctx *fasthttp.RequestCtx) { called = true }, server.requireDatabaseMiddleware)(ctx)
+	if called || ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected a write to get 503 without reaching the handler, got %d (called %v)", ctx.Response.StatusCode(), called)
+	}
+	if len(ctx.Response.Header.Peek("Retry-After")) == 0 {
+		t.Error("Expected Retry-After on a write refused in degraded mode")
+	}
+
+	// Failures of handlers that do get through are reported as the outage they are
+	ctx = &fasthttp.RequestCtx{}
+	server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to get user", errors.New("dial tcp: connection refused"))
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected a database failure in degraded mode to be reported as 503, got %d", ctx.Response.StatusCode())
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	server.healthHandler(ctx)
+	if !strings.Contains(string(ctx.Response.Body()), `"degraded"`) {
+		t.Errorf("Expected the health check to report degraded mode, got %s", ctx.Response.Body())
+	}
+}
+
+func TestDegradedModeServesCachedServers(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	serverService := services.NewServerService(db, logger)
+	if _, err := serverService.ReloadServers(t.Context()); err != nil {
+		t.Fatalf("ReloadServers() error = %v", err)
+	}
+	health := database.NewHealth(logger)
+	serverService.SetDatabaseHealth(health)
+	server := &Server{config: &config.Config{}, logger: logger, serverService: serverService, dbHealth: health}
+
+	// Take the database away entirely
+	db.Close()
+	health.Check(t.Context(), db.Ping)
+	if health.Healthy() {
+		t.Fatal("Expected the health check to find a closed pool down")
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/servers/locations?by=load&limit=1")
+	server.getServersHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected cached servers with status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	chain(func(ctx *fasthttp.RequestCtx) {}, server.requireDatabaseMiddleware)(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected provisioning to get 503, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestLogoutHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("logout-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	authService := services.NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: userService,
+		authService: authService,
+	}
+
+	loggedOut, err := authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	otherDevice, err := authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	request := func(method, token string, handler fasthttp.RequestHandler) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+		server.authMiddleware(handler)(ctx)
+		return ctx
+	}
+
+	ctx := request("POST", loggedOut, server.logoutHandler)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var response struct {
+		Data models.LogoutResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM revoked_tokens WHERE jti = $1`, response.Data.TokenID)
+	})
+	if response.Data.TokenID == "" {
+		t.Error("Expected the revoked token's ID")
+	}
+
+	if ctx := request("GET", loggedOut, server.getPermissionsHandler); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected the logged out token to get 401, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := request("POST", loggedOut, server.logoutHandler); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected a second logout to get 401, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := request("GET", otherDevice, server.getPermissionsHandler); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("Expected the user's other token to be accepted, got %d", ctx.Response.StatusCode())
+	}
+}
+
+// newBatchUsersRequest builds an admin batch user creation request
+func newBatchUsersRequest(adminID uuid.UUID, req models.BatchUserRequest) *fasthttp.RequestCtx {
+	body, _ := json.Marshal(req)
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("user_id", adminID)
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody(body)
+	return ctx
+}
+
+func TestBatchCreateUsersHandlerRejectsOverCap(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	req := models.BatchUserRequest{Users: make([]models.BatchUserEntry, services.MaxBatchUsers+1)}
+	for i := range req.Users {
+		req.Users[i].Email = fmt.Sprintf("user-%d@example.com", i)
+	}
+
+	ctx := newBatchUsersRequest(uuid.New(), req)
+	server.batchCreateUsersHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", ctx.Response.StatusCode())
+	}
+
+	ctx = newBatchUsersRequest(uuid.New(), models.BatchUserRequest{})
+	server.batchCreateUsersHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400 for an empty batch, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestBatchCreateUsersHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: userService,
+		authService: services.NewAuthService("test-secret", logger),
+	}
+
+	admin, err := userService.CreateUser(t.Context(), fmt.Sprintf("batch-admin-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	invited := fmt.Sprintf("batch-%s@example.com", uuid.New())
+	uninvited := fmt.Sprintf("batch-%s@example.com", uuid.New())
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE LOWER(email) IN ($1, $2) OR id = $3`, invited, uninvited, admin.ID)
+	})
+
+	ctx := newBatchUsersRequest(admin.ID, models.BatchUserRequest{Users: []models.BatchUserEntry{
+		{Email: invited, Role: models.RoleAdmin, SendInvite: true},
+		{Email: uninvited},
+		{Email: strings.ToUpper(invited), SendInvite: true},
+		{Email: "not-an-email"},
+	}})
+	server.batchCreateUsersHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	var response struct {
+		Data models.BatchUserResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Data.Created != 2 || len(response.Data.Results) != 4 {
+		t.Fatalf("Expected 2 of 4 entries created, got %+v", response.Data)
+	}
+
+	results := response.Data.Results
+	if results[0].UserID == nil || results[0].Role != models.RoleAdmin || results[0].InviteCode == "" || results[0].InviteExpiresAt == nil {
+		t.Errorf("Expected an invited admin, got %+v", results[0])
+	}
+	if results[1].UserID == nil || results[1].Role != models.RoleUser || results[1].InviteCode != "" {
+		t.Errorf("Expected an uninvited user, got %+v", results[1])
+	}
+	if results[2].Error != "duplicate email in batch" || results[2].UserID != nil {
+		t.Errorf("Expected the repeated email to be rejected as a duplicate, got %+v", results[2])
+	}
+	if results[3].Error != "invalid email format" {
+		t.Errorf("Expected the malformed email to be rejected, got %+v", results[3])
+	}
+
+	// An account invite cannot be used to register a different account
+	ctx = newRegisterRequest(t, results[0].InviteCode)
+	server.config.Registration.RequireInvite = true
+	server.registerHandler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected status 403 registering with an account invite, got %d", ctx.Response.StatusCode())
+	}
+
+	// The invite sets the pending account's password, once
+	if _, err := userService.AcceptInvite(t.Context(), results[0].InviteCode, "hash"); err != nil {
+		t.Fatalf("AcceptInvite() error = %v", err)
+	}
+	if _, err := userService.AcceptInvite(t.Context(), results[0].InviteCode, "hash"); !errors.Is(err, services.ErrInvalidInvite) {
+		t.Errorf("Expected a used invite to be rejected, got %v", err)
+	}
+}
+
+func TestLogoutHandlerRevokesRefreshToken(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("logout-refresh-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	authService := services.NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: userService,
+		authService: authService,
+	}
+
+	logout := func(body string) *fasthttp.RequestCtx {
+		token, err := authService.GenerateToken(user.ID, user.Email, user.Role)
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBodyString(body)
+		server.authMiddleware(server.logoutHandler)(ctx)
+		return ctx
+	}
+	refresh := func(token string) *fasthttp.RequestCtx {
+		body, _ := json.Marshal(models.RefreshRequest{RefreshToken: token})
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody(body)
+		server.refreshHandler(ctx)
+		return ctx
+	}
+
+	if ctx := logout(`{"refresh_token": "not-a-refresh-token"}`); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown refresh token, got %d", ctx.Response.StatusCode())
+	}
+
+	issued, err := authService.IssueRefreshToken(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("IssueRefreshToken() error = %v", err)
+	}
+	body, _ := json.Marshal(models.LogoutRequest{RefreshToken: issued.Token})
+	ctx := logout(string(body))
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var response struct {
+		Data models.LogoutResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM revoked_tokens WHERE jti = $1`, response.Data.TokenID)
+	})
+	if !response.Data.RefreshTokenRevoked {
+		t.Error("Expected the refresh token to be reported revoked")
+	}
+
+	if ctx := refresh(issued.Token); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected refresh after logout to get 401, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestRefreshHandler(t *testing.T) {
+	logger := zap.NewNop()
+	db := newTestDB(t)
+
+	userService := services.NewUserService(db, logger)
+	user, err := userService.CreateUser(t.Context(), fmt.Sprintf("refresh-%s@example.com", uuid.New()), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	authService := services.NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	server := &Server{
+		config:      &config.Config{},
+		logger:      logger,
+		userService: userService,
+		authService: authService,
+	}
+
+	refresh := func(token string) *fasthttp.RequestCtx {
+		body, _ := json.Marshal(models.RefreshRequest{RefreshToken: token})
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody(body)
+		server.refreshHandler(ctx)
+		return ctx
+	}
+
+	if ctx := refresh(""); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Expected status 400 without a refresh token, got %d", ctx.Response.StatusCode())
+	}
+
+	issued, err := authService.IssueRefreshToken(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("IssueRefreshToken() error = %v", err)
+	}
+
+	ctx := refresh(issued.Token)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var response struct {
+		Data models.RefreshResponse `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Data.RefreshToken == "" || response.Data.RefreshToken == issued.Token {
+		t.Errorf("Expected a replacement refresh token, got %q", response.Data.RefreshToken)
+	}
+	if response.Data.ExpiresIn != int(authService.AccessTokenTTL().Seconds()) {
+		t.Errorf("Expected expires_in %v, got %d", authService.AccessTokenTTL(), response.Data.ExpiresIn)
+	}
+	claims, err := authService.ValidateToken(t.Context(), response.Data.Token)
+	if err != nil || claims.UserID != user.ID {
+		t.Fatalf("Expected an access token for the user, got claims %+v err %v", claims, err)
+	}
+
+	// The presented token was consumed, and replaying it revokes its replacement too
+	if ctx := refresh(issued.Token); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected status 401 replaying a used refresh token, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := refresh(response.Data.RefreshToken); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a refresh token revoked by a replay, got %d", ctx.Response.StatusCode())
+	}
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/denzelpenzel/vpn/internal/database"
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// Metric types
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+)
+
+// requestCounter counts handled requests by response status; the zero value is ready to use
+type requestCounter struct {
+	mu       sync.Mutex
+	byStatus map[int]int64
+}
+
+// record counts one request that completed with status
+func (c *requestCounter) record(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byStatus == nil {
+		c.byStatus = make(map[int]int64)
+	}
+	c.byStatus[status]++
+}
+
+// samples returns one sample per status, sorted by status
+func (c *requestCounter) samples() []*models.MetricSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]int, 0, len(c.byStatus))
+	for status := range c.byStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+
+	samples := make([]*models.MetricSample, 0, len(statuses))
+	for _, status := range statuses {
+		samples = append(samples, &models.MetricSample{
+			Labels: map[string]string{"status": strconv.Itoa(status)},
+			Value:  float64(c.byStatus[status]),
+		})
+	}
+	return samples
+}
+
+// collectMetrics gathers every exported metric. Both metrics endpoints render its result so the
+// Prometheus and JSON formats always agree. Sources that are unavailable are left out.
+func (s *Server) collectMetrics(ctx *fasthttp.RequestCtx) []*models.MetricFamily {
+	single := func(value float64) []*models.MetricSample {
+		return []*models.MetricSample{{Value: value}}
+	}
+
+	families := []*models.MetricFamily{{
+		Name:    "vpn_http_requests_total",
+		Type:    metricCounter,
+		Help:    "HTTP requests handled, by response status.",
+		Samples: s.requests.samples(),
+	}}
+
+	if s.wireguardService != nil {
+		if peers, err := s.wireguardService.CachedPeers(); err != nil {
+			s.logger.Warn("Failed to read WireGuard peers for metrics", zap.Error(err))
+		} else {
+			families = append(families, &models.MetricFamily{
+				Name:    "vpn_active_peers",
+				Type:    metricGauge,
+				Help:    "Peers programmed on the WireGuard device.",
+				Samples: single(float64(len(peers))),
+			})
+		}
+
+		successes := &models.MetricFamily{Name: "vpn_provisioning_successes_total", Type: metricCounter, Help: "Successful key provisioning attempts, by server."}
+		failures := &models.MetricFamily{Name: "vpn_provisioning_failures_total", Type: metricCounter, Help: "Failed key provisioning attempts, by server."}
+		for _, stats := range s.wireguardService.ProvisioningStats() {
+			labels := map[string]string{"server_id": stats.ServerID.String()}
+			successes.Samples = append(successes.Samples, &models.MetricSample{Labels: labels, Value: float64(stats.Successes)})
+			failures.Samples = append(failures.Samples, &models.MetricSample{Labels: labels, Value: float64(stats.Failures)})
+		}
+		families = append(families, successes, failures)
+
+		// Labelled by server only, so traffic cannot be attributed to a user or key
+		received := &models.MetricFamily{Name: "vpn_server_received_bytes_total", Type: metricCounter, Help: "Bytes received from all peers, by server."}
+		transmitted := &models.MetricFamily{Name: "vpn_server_transmitted_bytes_total", Type: metricCounter, Help: "Bytes sent to all peers, by server."}
+		for _, traffic := range s.wireguardService.TrafficTotals() {
+			labels := map[string]string{"server_id": traffic.ServerID.String()}
+			received.Samples = append(received.Samples, &models.MetricSample{Labels: labels, Value: float64(traffic.ReceiveBytes)})
+			transmitted.Samples = append(transmitted.Samples, &models.MetricSample{Labels: labels, Value: float64(traffic.TransmitBytes)})
+		}
+		families = append(families, received, transmitted)
+	}
+
+	families = append(families, &models.MetricFamily{
+		Name:    "vpn_provision_rate_limit_denials_total",
+		Type:    metricCounter,
+		Help:    "Provisioning requests denied by the server provisioning rate or the provisioning cooldown, by route and limiter.",
+		Samples: s.rateLimitDenials.samples(),
+	})
+
+	if s.userService != nil {
+		if count, err := s.userService.CountUsers(ctx); err != nil {
+			s.logger.Warn("Failed to count users for metrics", zap.Error(err))
+		} else {
+			families = append(families, &models.MetricFamily{
+				Name:    "vpn_users",
+				Type:    metricGauge,
+				Help:    "Registered users.",
+				Samples: single(float64(count)),
+			})
+		}
+	}
+
+	if s.db != nil {
+		pool := database.PoolStats(s.db)
+		families = append(families,
+			&models.MetricFamily{Name: "vpn_db_pool_max_conns", Type: metricGauge, Help: "Maximum database pool connections.", Samples: single(float64(pool.MaxConns))},
+			&models.MetricFamily{Name: "vpn_db_pool_acquired_conns", Type: metricGauge, Help: "Database connections currently in use.", Samples: single(float64(pool.AcquiredConns))},
+			&models.MetricFamily{Name: "vpn_db_pool_idle_conns", Type: metricGauge, Help: "Idle database connections.", Samples: single(float64(pool.IdleConns))},
+			&models.MetricFamily{Name: "vpn_db_pool_acquire_total", Type: metricCounter, Help: "Database connection acquisitions.", Samples: single(float64(pool.AcquireCount))},
+			&models.MetricFamily{Name: "vpn_db_pool_acquire_timeouts_total", Type: metricCounter, Help: "Acquisitions that timed out waiting for a connection.", Samples: single(float64(pool.AcquireTimeouts))},
+		)
+	}
+
+	return families
+}
+
+// writePrometheus renders metric families in the Prometheus text exposition format
+func writePrometheus(w io.Writer, families []*models.MetricFamily) {
+	for _, family := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", family.Name, family.Help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.Name, family.Type)
+		for _, sample := range family.Samples {
+			fmt.Fprintf(w, "%s%s %s\n", family.Name, prometheusLabels(sample.Labels), strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		}
+	}
+}
+
+// prometheusLabels renders a label set as {name="value",...} in name order
+func prometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricsHandler exports metrics in the Prometheus text format (metrics token only)
+func (s *Server) metricsHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+	writePrometheus(ctx, s.collectMetrics(ctx))
+}
+
+// metricsJSONHandler exports the same metrics as metricsHandler as JSON (admin only)
+func (s *Server) metricsJSONHandler(ctx *fasthttp.RequestCtx) {
+	s.sendSuccessResponse(ctx, s.collectMetrics(ctx))
+}
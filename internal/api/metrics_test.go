@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/denzelpenzel/vpn/internal/services"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestMetricsJSONHandler(t *testing.T) {
+	logger := zap.NewNop()
+	peers := make([]wgtypes.Peer, 3)
+	for i := range peers {
+		key, _ := wgtypes.GeneratePrivateKey()
+		peers[i] = wgtypes.Peer{PublicKey: key.PublicKey()}
+	}
+	server := &Server{
+		config:           &config.Config{},
+		logger:           logger,
+		wireguardService: services.NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Peers: peers}}),
+	}
+
+	// Requests pass through the logging middleware, which counts them
+	handler := server.loggingMiddleware(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	})
+	for range 2 {
+		handler(&fasthttp.RequestCtx{})
+	}
+	server.loggingMiddleware(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	})(&fasthttp.RequestCtx{})
+
+	ctx := &fasthttp.RequestCtx{}
+	server.metricsJSONHandler(ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+	}
+
+	var response struct {
+		Data []*models.MetricFamily `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("Invalid JSON response: %v", err)
+	}
+
+	families := make(map[string]*models.MetricFamily)
+	for _, family := range response.Data {
+		families[family.Name] = family
+	}
+
+	activePeers := families["vpn_active_peers"]
+	if activePeers == nil || activePeers.Type != metricGauge || len(activePeers.Samples) != 1 || activePeers.Samples[0].Value != 3 {
+		t.Errorf("Expected active peer gauge of 3, got %+v", activePeers)
+	}
+
+	requests := families["vpn_http_requests_total"]
+	if requests == nil || requests.Type != metricCounter {
+		t.Fatalf("Expected request counter, got %+v", requests)
+	}
+	totals := make(map[string]float64)
+	for _, sample := range requests.Samples {
+		totals[sample.Labels["status"]] = sample.Value
+	}
+	if totals["200"] != 2 || totals["404"] != 1 {
+		t.Errorf("Expected 2 OK and 1 not found request, got %v", totals)
+	}
+}
+
+func TestMetricsHandlerMatchesJSON(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+	server.requests.record(fasthttp.StatusOK)
+
+	ctx := &fasthttp.RequestCtx{}
+	server.metricsHandler(ctx)
+
+	body := string(ctx.Response.Body())
+	for _, want := range []string{
+		"# TYPE vpn_http_requests_total counter\n",
+		`vpn_http_requests_total{status="200"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected Prometheus output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsTokenMiddleware(t *testing.T) {
+	const token = "scrape-token-of-at-least-32-characters"
+	handler := func(ctx *fasthttp.RequestCtx) { ctx.SetStatusCode(fasthttp.StatusOK) }
+
+	tests := []struct {
+		name          string
+		configured    string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "matching token", configured: token, authorization: "Bearer " + token, wantStatus: fasthttp.StatusOK},
+		{name: "wrong token", configured: token, authorization: "Bearer not-the-token", wantStatus: fasthttp.StatusUnauthorized},
+		{name: "token without bearer scheme", configured: token, authorization: token, wantStatus: fasthttp.StatusUnauthorized},
+		{name: "missing token", configured: token, wantStatus: fasthttp.StatusUnauthorized},
+		{name: "no token configured", authorization: "Bearer ", wantStatus: fasthttp.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Server.MetricsToken = tt.configured
+			server := &Server{config: cfg, logger: zap.NewNop()}
+
+			ctx := &fasthttp.RequestCtx{}
+			if tt.authorization != "" {
+				ctx.Request.Header.Set("Authorization", tt.authorization)
+			}
+			server.metricsTokenMiddleware(handler)(ctx)
+
+			if ctx.Response.StatusCode() != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, ctx.Response.StatusCode())
+			}
+		})
+	}
+}
@@ -1,11 +1,22 @@
 package api
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/database"
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/denzelpenzel/vpn/internal/services"
+	"github.com/google/uuid"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 )
@@ -19,6 +30,7 @@ func (s *Server) loggingMiddleware(next fasthttp.RequestHandler) fasthttp.Reques
 		next(ctx)
 
 		duration := time.Since(start)
+		s.requests.record(ctx.Response.StatusCode())
 		s.logger.Info("HTTP request",
 			zap.String("method", string(ctx.Method())),
 			zap.String("path", string(ctx.Path())),
@@ -47,16 +59,36 @@ func (s *Server) securityMiddleware(next fasthttp.RequestHandler) fasthttp.Reque
 	}
 }
 
-// rateLimitMiddleware implements basic rate limiting
-func (s *Server) rateLimitMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
-	// Simple in-memory rate limiter (in production, use Redis)
-	return func(ctx *fasthttp.RequestCtx) {
-		next(ctx)
+// compressMiddleware compresses responses for clients that accept it when config compression is
+// enabled. Bodies that are already encoded or not compressible, such as PNGs, are left alone.
+func (s *Server) compressMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if !s.config.Server.CompressConfigs {
+		return next
 	}
+	return fasthttp.CompressHandlerLevel(next, fasthttp.CompressDefaultCompression)
 }
 
-// authMiddleware validates JWT tokens
+// authMiddleware validates JWT tokens, refusing impersonation tokens and users who must change their
+// password
 func (s *Server) authMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return s.authenticate(next, false, false)
+}
+
+// impersonableAuthMiddleware validates JWT tokens like authMiddleware but also accepts impersonation
+// tokens for read-only requests, auditing each one with the admin and the impersonated user
+func (s *Server) impersonableAuthMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return s.authenticate(next, true, false)
+}
+
+// passwordChangeAuthMiddleware validates JWT tokens like authMiddleware but also accepts users who
+// must change their password, for the password change itself
+func (s *Server) passwordChangeAuthMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return s.authenticate(next, false, true)
+}
+
+// authenticate validates the request's bearer token and stores its user in the context. A user whose
+// password was reset to a temporary one is refused with 403 unless allowPasswordChange is set.
+func (s *Server) authenticate(next fasthttp.RequestHandler, allowImpersonation, allowPasswordChange bool) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		// Get Authorization header
 		authHeader := string(ctx.Request.Header.Peek("Authorization"))
@@ -79,33 +111,261 @@ func (s *Server) authMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHa
 		}
 
 		// Validate token
-		claims, err := s.authService.ValidateToken(token)
-		if err != nil {
+		claims, err := s.authService.ValidateToken(ctx, token)
+		if errors.Is(err, services.ErrInvalidToken) {
 			s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid token")
 			return
 		}
+		if err != nil {
+			s.logger.Error("Failed to validate token", zap.Error(err))
+			s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+			return
+		}
+
+		if claims.MustChangePassword && !allowPasswordChange {
+			s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Password change required")
+			return
+		}
+
+		if claims.IsImpersonation() {
+			if !allowImpersonation || !(ctx.IsGet() || ctx.IsHead()) {
+				s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Impersonation tokens are limited to read-only user endpoints")
+				return
+			}
+			// An impersonated request that cannot be audited is not served
+			if s.auditService == nil {
+				s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Impersonation requires audit logging")
+				return
+			}
+			err := s.auditService.Record(ctx, claims.Act.Subject, services.AuditActionImpersonatedRequest, claims.UserID, map[string]interface{}{
+				"method": string(ctx.Method()),
+				"path":   string(ctx.Path()),
+			})
+			if err != nil {
+				s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+				return
+			}
+			ctx.SetUserValue("impersonator_id", claims.Act.Subject)
+		}
 
 		// Store user info in context for handlers to use
 		ctx.SetUserValue("user_id", claims.UserID)
 		ctx.SetUserValue("user_email", claims.Email)
+		ctx.SetUserValue("user_role", claims.Role)
+		ctx.SetUserValue("token_claims", claims)
+
+		next(ctx)
+	}
+}
+
+// internalAPIKeyMiddleware restricts access to trusted services presenting the introspection API
+// key in X-API-Key; every request is rejected when no key is configured
+func (s *Server) internalAPIKeyMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		expected := s.config.JWT.IntrospectionKey
+		provided := ctx.Request.Header.Peek("X-API-Key")
+		if expected == "" || subtle.ConstantTimeCompare(provided, []byte(expected)) != 1 {
+			s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid API key")
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// metricsTokenMiddleware restricts access to scrapers presenting the metrics token as a bearer token,
+// which Prometheus can send where it cannot sign in for a JWT; every request is rejected when no
+// token is configured
+func (s *Server) metricsTokenMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		expected := s.config.Server.MetricsToken
+		provided, found := bytes.CutPrefix(ctx.Request.Header.Peek("Authorization"), []byte("Bearer "))
+		if expected == "" || !found || subtle.ConstantTimeCompare(provided, []byte(expected)) != 1 {
+			s.sendErrorResponse(ctx, fasthttp.StatusUnauthorized, "Invalid metrics token")
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// adminMiddleware restricts access to users with the admin role (must run after authMiddleware)
+func (s *Server) adminMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		role, _ := ctx.UserValue("user_role").(string)
+		if !models.RoleHasPermission(role, models.PermissionAdmin) {
+			s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Admin access required")
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// requireDatabaseMiddleware refuses requests that write to the database with 503 while degraded mode
+// finds it down, rather than letting them fail part way
+func (s *Server) requireDatabaseMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !s.dbHealth.Healthy() {
+			s.sendServiceError(ctx, fasthttp.StatusServiceUnavailable, "Service temporarily unavailable", database.ErrUnavailable)
+			return
+		}
 
 		next(ctx)
 	}
 }
 
+// poolRetryAfter is the Retry-After value, in seconds, sent when no database connection was available
+const poolRetryAfter = "1"
+
+// databaseDownRetryAfter is the Retry-After value, in seconds, sent in degraded mode while the
+// database is down
+const databaseDownRetryAfter = "10"
+
+// serverNotReadyRetryAfter is the Retry-After value, in seconds, sent while a server's public key is
+// still being synchronized
+const serverNotReadyRetryAfter = "5"
+
 // sendErrorResponse sends a JSON error response
 func (s *Server) sendErrorResponse(ctx *fasthttp.RequestCtx, statusCode int, message string) {
+	s.writeErrorResponse(ctx, statusCode, message, nil)
+}
+
+// sendServiceError sends a JSON error response for an internal error. The error detail is only
+// included outside production; callers are expected to log the full error themselves.
+func (s *Server) sendServiceError(ctx *fasthttp.RequestCtx, statusCode int, message string, err error) {
+	// An exhausted pool is transient; tell the client to back off rather than report a failure
+	if database.IsAcquireTimeout(err) {
+		ctx.Response.Header.Set("Retry-After", poolRetryAfter)
+		statusCode = fasthttp.StatusServiceUnavailable
+		message = "Service temporarily unavailable"
+	}
+
+	// In degraded mode the database is known to be down, which a retry after it recovers will fix
+	if errors.Is(err, database.ErrUnavailable) || (err != nil && !s.dbHealth.Healthy()) {
+		ctx.Response.Header.Set("Retry-After", databaseDownRetryAfter)
+		statusCode = fasthttp.StatusServiceUnavailable
+		message = "Service temporarily unavailable"
+	}
+
+	// A saturated WireGuard device is transient too
+	if errors.Is(err, services.ErrDeviceBusy) {
+		ctx.Response.Header.Set("Retry-After", poolRetryAfter)
+		statusCode = fasthttp.StatusServiceUnavailable
+		message = "Service temporarily unavailable"
+	}
+
+	// A server whose key is still being synchronized will be ready shortly
+	if errors.Is(err, services.ErrServerNotReady) {
+		ctx.Response.Header.Set("Retry-After", serverNotReadyRetryAfter)
+		statusCode = fasthttp.StatusServiceUnavailable
+		message = "Server not ready, retry later"
+	}
+
+	// A server provisioning at its rate limit frees up within a second or so
+	var rateLimited *services.ServerRateLimitError
+	if errors.As(err, &rateLimited) {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(rateLimited.RetryAfter.Seconds())))))
+		statusCode = fasthttp.StatusServiceUnavailable
+		message = "Server is busy, retry later"
+	}
+
+	// Provisioning too soon after the last change is the caller's to retry later, not a failure
+	var cooldown *services.CooldownError
+	if errors.As(err, &cooldown) {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(cooldown.RetryAfter.Seconds()))))
+		statusCode = fasthttp.StatusTooManyRequests
+		message = "Configuration changed too recently, retry later"
+	}
+
+	// Too many wrong passwords are let through again as the user's failed attempt limit refills
+	var passwordAttempts *services.PasswordAttemptsError
+	if errors.As(err, &passwordAttempts) {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(passwordAttempts.RetryAfter.Seconds())))))
+		statusCode = fasthttp.StatusTooManyRequests
+		message = "Too many failed password attempts, retry later"
+	}
+
+	// A server in maintenance provisions again once the window ends; pass on the operator's message
+	var maintenance *services.MaintenanceError
+	if errors.As(err, &maintenance) {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(time.Until(maintenance.Window.EndsAt).Seconds())))))
+		statusCode = fasthttp.StatusServiceUnavailable
+		message = "Server is under maintenance, retry later"
+		if maintenance.Window.Message != "" {
+			message = maintenance.Window.Message
+		}
+	}
+
+	// A disabled account stays disabled until an admin restores it
+	if errors.Is(err, services.ErrUserInactive) {
+		statusCode = fasthttp.StatusForbidden
+		message = "Account disabled"
+	}
+
+	// A revoked key has to be replaced by a fresh one; retrying will not help
+	if errors.Is(err, services.ErrKeyReused) {
+		statusCode = fasthttp.StatusConflict
+		message = "Public key was previously revoked, generate a new key pair"
+	}
+
+	// A full server stays full until keys are removed, so point the client elsewhere
+	if errors.Is(err, services.ErrAddressPoolExhausted) {
+		statusCode = fasthttp.StatusConflict
+		message = "Server has no free addresses, choose another server"
+	}
+
+	// Detail is opt-in: ENVIRONMENT defaults to development, so it must not decide on its own
+	if !s.config.Server.ErrorDetails || s.config.Server.IsProduction() {
+		err = nil
+	}
+	s.writeErrorResponse(ctx, statusCode, message, err)
+}
+
+// sendUserLookupError reports a failed user lookup: a missing user is 404 and a deactivated one 403,
+// while anything else is logged and reported as an internal error with the given message
+func (s *Server) sendUserLookupError(ctx *fasthttp.RequestCtx, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		s.sendErrorResponse(ctx, fasthttp.StatusNotFound, "User not found")
+	case errors.Is(err, services.ErrUserInactive):
+		s.sendErrorResponse(ctx, fasthttp.StatusForbidden, "Account disabled")
+	default:
+		s.logger.Error("Failed to look up user", zap.Error(err))
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, message, err)
+	}
+}
+
+// responseTimestamp formats the timestamp put on responses as configured: an RFC 3339 string by
+// default, or Unix seconds as a number
+func (s *Server) responseTimestamp(t time.Time) interface{} {
+	switch s.config.Server.TimestampFormat {
+	case config.TimestampUnix:
+		return t.Unix()
+	case config.TimestampRFC3339Nano:
+		return t.UTC().Format(time.RFC3339Nano)
+	default:
+		return t.UTC().Format(time.RFC3339)
+	}
+}
+
+// writeErrorResponse writes a JSON error body, adding the error detail when err is non-nil
+func (s *Server) writeErrorResponse(ctx *fasthttp.RequestCtx, statusCode int, message string, err error) {
 	s.setCORSHeaders(ctx)
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(statusCode)
 
 	response := map[string]interface{}{
 		"error":     true,
+		"code":      errorCodeForStatus(statusCode),
 		"message":   message,
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"timestamp": s.responseTimestamp(time.Now()),
+	}
+	if err != nil {
+		response["detail"] = err.Error()
 	}
 
-	jsonData, _ := json.Marshal(response)
+	jsonData, _ := s.marshalResponse(response)
 	ctx.SetBody(jsonData)
 }
 
@@ -118,22 +378,30 @@ func (s *Server) sendSuccessResponse(ctx *fasthttp.RequestCtx, data interface{})
 	response := map[string]interface{}{
 		"success":   true,
 		"data":      data,
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"timestamp": s.responseTimestamp(time.Now()),
 	}
 
-	jsonData, err := json.Marshal(response)
+	jsonData, err := s.marshalResponse(response)
 	if err != nil {
 		s.logger.Error("Failed to marshal response", zap.Error(err))
-		s.sendErrorResponse(ctx, fasthttp.StatusInternalServerError, "Internal server error")
+		s.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
 		return
 	}
 
 	ctx.SetBody(jsonData)
 }
 
-// parseJSONBody parses JSON request body
+// marshalResponse encodes a response body, indented when PRETTY_JSON is on and compact otherwise
+func (s *Server) marshalResponse(v interface{}) ([]byte, error) {
+	if s.config.Server.PrettyJSON {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+// parseJSONBody parses the JSON body of a POST or DELETE request
 func (s *Server) parseJSONBody(ctx *fasthttp.RequestCtx, dest interface{}) error {
-	if !ctx.IsPost() {
+	if !ctx.IsPost() && !ctx.IsDelete() {
 		return fmt.Errorf("method not allowed")
 	}
 
@@ -147,9 +415,146 @@ func (s *Server) parseJSONBody(ctx *fasthttp.RequestCtx, dest interface{}) error
 		return fmt.Errorf("request body is empty")
 	}
 
+	if err := checkJSONComplexity(body, s.config.Security.MaxJSONDepth, s.config.Security.MaxJSONTokens); err != nil {
+		return err
+	}
+
 	if err := json.Unmarshal(body, dest); err != nil {
 		return fmt.Errorf("invalid JSON: %w", err)
 	}
 
 	return nil
 }
+
+// checkJSONComplexity streams through a JSON body and rejects it once it nests deeper than
+// maxDepth or holds more than maxTokens tokens, so pathological payloads are refused before
+// being unmarshalled. A zero limit disables that check; syntax errors are left to json.Unmarshal.
+func checkJSONComplexity(body []byte, maxDepth, maxTokens int) error {
+	if maxDepth == 0 && maxTokens == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	depth, tokens := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+
+		tokens++
+		if maxTokens > 0 && tokens > maxTokens {
+			return fmt.Errorf("JSON body exceeds %d tokens", maxTokens)
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if maxDepth > 0 && depth > maxDepth {
+				return fmt.Errorf("JSON body exceeds nesting depth %d", maxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// queryBool reads a boolean query parameter such as minimal=true, returning false when it is absent
+func queryBool(ctx *fasthttp.RequestCtx, key string) (bool, error) {
+	value := ctx.QueryArgs().Peek(key)
+	if len(value) == 0 {
+		return false, nil
+	}
+
+	return strconv.ParseBool(string(value))
+}
+
+// queryInt reads an integer query parameter, returning defaultValue when it is absent
+func queryInt(ctx *fasthttp.RequestCtx, key string, defaultValue int) (int, error) {
+	value := ctx.QueryArgs().Peek(key)
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+
+	return strconv.Atoi(string(value))
+}
+
+const (
+	// defaultPageLimit is the page size used when a list request does not specify one
+	defaultPageLimit = 100
+	// maxPageLimit caps the page size a client may request
+	maxPageLimit = 1000
+)
+
+// parsePagination reads the limit and offset query parameters, applying the default page size
+// and clamping limit to maxPageLimit; non-numeric or out-of-range values are rejected
+func parsePagination(ctx *fasthttp.RequestCtx) (limit, offset int, err error) {
+	limit, err = queryInt(ctx, "limit", defaultPageLimit)
+	if err != nil || limit < 1 {
+		return 0, 0, fmt.Errorf("invalid limit")
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	offset, err = queryInt(ctx, "offset", 0)
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid offset")
+	}
+
+	return limit, offset, nil
+}
+
+// isSecureRequest reports whether the request arrived over TLS, either directly or via the TLS-terminating
+// proxy. X-Forwarded-Proto is only believed from a trusted proxy, as X-Forwarded-For is in clientIP, since
+// a client talking plain HTTP could otherwise claim HTTPS itself.
+func (s *Server) isSecureRequest(ctx *fasthttp.RequestCtx) bool {
+	if ctx.IsTLS() {
+		return true
+	}
+	remote, _ := netip.AddrFromSlice(ctx.RemoteIP())
+	return isTrustedProxy(remote.Unmap(), s.trustedProxies) && string(ctx.Request.Header.Peek("X-Forwarded-Proto")) == "https"
+}
+
+// clientIP returns the address a request originated from. X-Forwarded-For is only believed when the
+// request arrives from a trusted proxy, and is walked from the right so that a client cannot spoof
+// its address by sending the header itself: the first hop that is not a trusted proxy is the client.
+func clientIP(ctx *fasthttp.RequestCtx, trustedProxies []netip.Prefix) netip.Addr {
+	remote, _ := netip.AddrFromSlice(ctx.RemoteIP())
+	remote = remote.Unmap()
+	if !isTrustedProxy(remote, trustedProxies) {
+		return remote
+	}
+
+	hops := strings.Split(string(ctx.Request.Header.Peek("X-Forwarded-For")), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		hop = hop.Unmap()
+		if !isTrustedProxy(hop, trustedProxies) {
+			return hop
+		}
+		remote = hop
+	}
+
+	// Every hop was a proxy (or the header was unusable); the nearest valid one is the best answer
+	return remote
+}
+
+// isTrustedProxy reports whether addr belongs to one of the trusted proxy networks
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathUUID reads a UUID path parameter set by the router
+func pathUUID(ctx *fasthttp.RequestCtx, name string) (uuid.UUID, error) {
+	value, _ := ctx.UserValue(name).(string)
+	return uuid.Parse(value)
+}
@@ -0,0 +1,551 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/denzelpenzel/vpn/internal/services"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+func TestSendServiceError(t *testing.T) {
+	serviceErr := fmt.Errorf("failed to parse database config: %w", fmt.Errorf("dial tcp 10.0.0.5:5432: connection refused"))
+
+	tests := []struct {
+		name         string
+		environment  string
+		errorDetails bool
+		wantDetail   bool
+	}{
+		{name: "opted in includes detail", environment: "development", errorDetails: true, wantDetail: true},
+		{name: "development hides detail by default", environment: "development", wantDetail: false},
+		{name: "production hides detail", environment: "production", wantDetail: false},
+		{name: "production ignores opt-in", environment: "production", errorDetails: true, wantDetail: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{
+				config: &config.Config{Server: config.ServerConfig{Environment: tt.environment, ErrorDetails: tt.errorDetails}},
+				logger: zap.NewNop(),
+			}
+
+			ctx := &fasthttp.RequestCtx{}
+			server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", serviceErr)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+				t.Errorf("Expected status 500, got %d", ctx.Response.StatusCode())
+			}
+
+			var response map[string]interface{}
+			if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+
+			if response["message"] != "Internal server error" {
+				t.Errorf("Expected generic message, got %v", response["message"])
+			}
+
+			detail, hasDetail := response["detail"]
+			if hasDetail != tt.wantDetail {
+				t.Fatalf("Expected detail present = %v, got body %s", tt.wantDetail, ctx.Response.Body())
+			}
+			if tt.wantDetail && detail != serviceErr.Error() {
+				t.Errorf("Expected detail %q, got %v", serviceErr.Error(), detail)
+			}
+		})
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantLimit  int
+		wantOffset int
+		wantErr    bool
+	}{
+		{name: "defaults", query: "", wantLimit: defaultPageLimit, wantOffset: 0},
+		{name: "explicit values", query: "limit=10&offset=20", wantLimit: 10, wantOffset: 20},
+		{name: "limit clamped to max", query: "limit=5000", wantLimit: maxPageLimit, wantOffset: 0},
+		{name: "zero limit", query: "limit=0", wantErr: true},
+		{name: "negative limit", query: "limit=-5", wantErr: true},
+		{name: "negative offset", query: "offset=-1", wantErr: true},
+		{name: "non-numeric limit", query: "limit=ten", wantErr: true},
+		{name: "non-numeric offset", query: "offset=abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI("/api/admin/peers?" + tt.query)
+
+			limit, offset, err := parsePagination(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePagination() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if limit != tt.wantLimit || offset != tt.wantOffset {
+				t.Errorf("parsePagination() = (%d, %d), want (%d, %d)", limit, offset, tt.wantLimit, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestSendServiceErrorAddressPoolExhausted(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger: zap.NewNop(),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	err := fmt.Errorf("failed to allocate IP: %w", services.ErrAddressPoolExhausted)
+	server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Errorf("Expected status 409, got %d", ctx.Response.StatusCode())
+	}
+	if len(ctx.Response.Header.Peek("Retry-After")) != 0 {
+		t.Error("Expected no Retry-After for a full server")
+	}
+}
+
+func TestSendServiceErrorPoolExhausted(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger: zap.NewNop(),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	err := fmt.Errorf("failed to check email existence: %w", context.DeadlineExceeded)
+	server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Internal server error", err)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", ctx.Response.StatusCode())
+	}
+	if got := string(ctx.Response.Header.Peek("Retry-After")); got != poolRetryAfter {
+		t.Errorf("Expected Retry-After %q, got %q", poolRetryAfter, got)
+	}
+}
+
+func TestSendServiceErrorDeviceBusy(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger: zap.NewNop(),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	err := fmt.Errorf("failed to authorize user in WireGuard: %w", services.ErrDeviceBusy)
+	server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", ctx.Response.StatusCode())
+	}
+	if got := string(ctx.Response.Header.Peek("Retry-After")); got != poolRetryAfter {
+		t.Errorf("Expected Retry-After %q, got %q", poolRetryAfter, got)
+	}
+}
+
+func TestSendServiceErrorServerNotReady(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger: zap.NewNop(),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	server.sendServiceError(ctx, fasthttp.StatusServiceUnavailable, "Server not ready, retry later", services.ErrServerNotReady)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", ctx.Response.StatusCode())
+	}
+	if got := string(ctx.Response.Header.Peek("Retry-After")); got != serverNotReadyRetryAfter {
+		t.Errorf("Expected Retry-After %q, got %q", serverNotReadyRetryAfter, got)
+	}
+}
+
+func TestSendServiceErrorProvisionCooldown(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger: zap.NewNop(),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	err := &services.CooldownError{RetryAfter: 2500 * time.Millisecond}
+	server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", ctx.Response.StatusCode())
+	}
+	if got := string(ctx.Response.Header.Peek("Retry-After")); got != "3" {
+		t.Errorf("Expected Retry-After rounded up to 3, got %q", got)
+	}
+}
+
+func TestSendServiceErrorKeyReused(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger: zap.NewNop(),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", services.ErrKeyReused)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Errorf("Expected status 409, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestParseJSONBodyComplexityLimits(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Security: config.SecurityConfig{MaxJSONDepth: 32, MaxJSONTokens: 100}},
+		logger: zap.NewNop(),
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "normal payload", body: `{"public_key":"key","server_id":"id","leak_protection":{"table":"auto","route_dns":true}}`},
+		{name: "deeply nested payload", body: strings.Repeat("[", 1000) + strings.Repeat("]", 1000), wantErr: "nesting depth"},
+		{name: "too many tokens", body: `{"public_key":[` + strings.Repeat(`1,`, 200) + `1]}`, wantErr: "tokens"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBodyString(tt.body)
+
+			var dest map[string]interface{}
+			err := server.parseJSONBody(ctx, &dest)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("parseJSONBody() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseJSONBody() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Zero limits disable the check
+	server.config.Security = config.SecurityConfig{}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBodyString(strings.Repeat("[", 100) + strings.Repeat("]", 100))
+	var dest interface{}
+	if err := server.parseJSONBody(ctx, &dest); err != nil {
+		t.Errorf("Expected nesting to be allowed with limits disabled, got %v", err)
+	}
+}
+
+func TestSendUserLookupError(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantMessage string
+	}{
+		{name: "missing user", err: services.ErrUserNotFound, wantStatus: fasthttp.StatusNotFound, wantMessage: "User not found"},
+		{name: "deactivated user", err: fmt.Errorf("lookup: %w", services.ErrUserInactive), wantStatus: fasthttp.StatusForbidden, wantMessage: "Account disabled"},
+		{name: "database failure", err: fmt.Errorf("connection refused"), wantStatus: fasthttp.StatusInternalServerError, wantMessage: "Failed to configure VPN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			server.sendUserLookupError(ctx, tt.err, "Failed to configure VPN")
+
+			if ctx.Response.StatusCode() != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, ctx.Response.StatusCode())
+			}
+
+			var response map[string]interface{}
+			if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if response["message"] != tt.wantMessage {
+				t.Errorf("Expected message %q, got %v", tt.wantMessage, response["message"])
+			}
+		})
+	}
+}
+
+func TestSendServiceErrorServerRateLimited(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger: zap.NewNop(),
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	err := &services.ServerRateLimitError{RetryAfter: 200 * time.Millisecond}
+	server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", err)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", ctx.Response.StatusCode())
+	}
+	if got := string(ctx.Response.Header.Peek("Retry-After")); got != "1" {
+		t.Errorf("Expected Retry-After rounded up to 1, got %q", got)
+	}
+}
+
+func TestResponseTimestampFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		check  func(t *testing.T, timestamp interface{})
+	}{
+		{
+			format: "",
+			check: func(t *testing.T, timestamp interface{}) {
+				s, ok := timestamp.(string)
+				if !ok {
+					t.Fatalf("Expected a string timestamp, got %T", timestamp)
+				}
+				if _, err := time.Parse(time.RFC3339, s); err != nil || strings.Contains(s, ".") {
+					t.Errorf("Expected an RFC 3339 timestamp in whole seconds, got %q", s)
+				}
+			},
+		},
+		{
+			format: config.TimestampRFC3339,
+			check: func(t *testing.T, timestamp interface{}) {
+				if s, _ := timestamp.(string); s == "" || strings.Contains(s, ".") {
+					t.Errorf("Expected an RFC 3339 timestamp in whole seconds, got %v", timestamp)
+				}
+			},
+		},
+		{
+			format: config.TimestampRFC3339Nano,
+			check: func(t *testing.T, timestamp interface{}) {
+				s, _ := timestamp.(string)
+				if _, err := time.Parse(time.RFC3339Nano, s); err != nil || !strings.Contains(s, ".") {
+					t.Errorf("Expected an RFC 3339 timestamp with fractional seconds, got %v", timestamp)
+				}
+			},
+		},
+		{
+			format: config.TimestampUnix,
+			check: func(t *testing.T, timestamp interface{}) {
+				seconds, ok := timestamp.(float64)
+				if !ok {
+					t.Fatalf("Expected a numeric timestamp, got %T", timestamp)
+				}
+				if diff := time.Since(time.Unix(int64(seconds), 0)); diff < 0 || diff > time.Minute {
+					t.Errorf("Expected the current Unix time, got %v", seconds)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			server := &Server{
+				config: &config.Config{Server: config.ServerConfig{TimestampFormat: tt.format}},
+				logger: zap.NewNop(),
+			}
+
+			responders := map[string]func(ctx *fasthttp.RequestCtx){
+				"success": func(ctx *fasthttp.RequestCtx) { server.sendSuccessResponse(ctx, "ok") },
+				"error": func(ctx *fasthttp.RequestCtx) {
+					server.sendErrorResponse(ctx, fasthttp.StatusBadRequest, "bad")
+				},
+				"health": server.healthHandler,
+			}
+			for name, respond := range responders {
+				ctx := &fasthttp.RequestCtx{}
+				respond(ctx)
+
+				var response map[string]interface{}
+				if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+					t.Fatalf("%s: failed to parse response: %v", name, err)
+				}
+				t.Run(name, func(t *testing.T) { tt.check(t, response["timestamp"]) })
+			}
+		})
+	}
+}
+
+func TestChainRunsMiddlewareInOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) middleware {
+		return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+			return func(ctx *fasthttp.RequestCtx) {
+				calls = append(calls, name+" before")
+				next(ctx)
+				calls = append(calls, name+" after")
+			}
+		}
+	}
+
+	handler := chain(func(ctx *fasthttp.RequestCtx) {
+		calls = append(calls, "handler")
+	}, record("first"), record("second"), record("third"))
+	handler(&fasthttp.RequestCtx{})
+
+	want := []string{
+		"first before", "second before", "third before",
+		"handler",
+		"third after", "second after", "first after",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Expected calls %v, got %v", want, calls)
+	}
+}
+
+func TestAdminChainAuthenticatesBeforeAuthorizing(t *testing.T) {
+	server := &Server{
+		config:      &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger:      zap.NewNop(),
+		authService: services.NewAuthService("test-secret", zap.NewNop()),
+	}
+
+	called := false
+	handler := chain(func(ctx *fasthttp.RequestCtx) { called = true }, server.adminChain()...)
+
+	ctx := &fasthttp.RequestCtx{}
+	handler(ctx)
+
+	if called {
+		t.Error("Expected the handler not to run without a token")
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("Expected status 401 from the auth middleware, got %d", ctx.Response.StatusCode())
+	}
+	// The security middleware runs ahead of auth, so even rejected requests carry its headers
+	if len(ctx.Response.Header.Peek("X-Content-Type-Options")) == 0 {
+		t.Error("Expected security headers on the rejected response")
+	}
+}
+
+func TestSendServiceErrorMaintenance(t *testing.T) {
+	server := &Server{
+		config: &config.Config{Server: config.ServerConfig{Environment: "production"}},
+		logger: zap.NewNop(),
+	}
+
+	window := &models.MaintenanceWindow{
+		StartsAt: time.Now().Add(-time.Minute),
+		EndsAt:   time.Now().Add(90 * time.Second),
+		Message:  "Kernel upgrade",
+	}
+	ctx := &fasthttp.RequestCtx{}
+	server.sendServiceError(ctx, fasthttp.StatusInternalServerError, "Failed to configure VPN", &services.MaintenanceError{Window: window})
+
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", ctx.Response.StatusCode())
+	}
+	if !strings.Contains(string(ctx.Response.Body()), "Kernel upgrade") {
+		t.Errorf("Expected the window message in the response, got %s", ctx.Response.Body())
+	}
+	if retryAfter := string(ctx.Response.Header.Peek("Retry-After")); retryAfter != "90" {
+		t.Errorf("Retry-After = %q, want 90", retryAfter)
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	conf := services.RenderConfig(&models.WireGuardConfig{
+		Interface: models.WireGuardInterface{PrivateKey: services.ClientPrivateKeyPlaceholder, Address: "10.0.0.2/32", DNS: services.DefaultClientDNS},
+		Peer:      models.WireGuardPeer{PublicKey: "cHVibGlj", Endpoint: "vpn.example.com:51820", AllowedIPs: services.DefaultClientAllowedIPs},
+	})
+	configFile := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("text/plain; charset=utf-8")
+		ctx.SetBodyString(strings.Repeat(conf, 4))
+	}
+	qrImage := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("image/png")
+		ctx.SetBodyString(strings.Repeat("\x89PNG", 100))
+	}
+
+	tests := []struct {
+		name         string
+		enabled      bool
+		handler      fasthttp.RequestHandler
+		wantEncoding string
+	}{
+		{name: "config compressed", enabled: true, handler: configFile, wantEncoding: "gzip"},
+		{name: "compression disabled", enabled: false, handler: configFile},
+		{name: "PNG left alone", enabled: true, handler: qrImage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{
+				config: &config.Config{Server: config.ServerConfig{CompressConfigs: tt.enabled}},
+				logger: zap.NewNop(),
+			}
+			want := &fasthttp.RequestCtx{}
+			tt.handler(want)
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.Set("Accept-Encoding", "gzip")
+			server.compressMiddleware(tt.handler)(ctx)
+
+			encoding := string(ctx.Response.Header.ContentEncoding())
+			if encoding != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", encoding, tt.wantEncoding)
+			}
+
+			body := ctx.Response.Body()
+			if encoding == "gzip" {
+				var err error
+				if body, err = fasthttp.AppendGunzipBytes(nil, body); err != nil {
+					t.Fatalf("Failed to gunzip response: %v", err)
+				}
+			}
+			if string(body) != string(want.Response.Body()) {
+				t.Errorf("Body did not round-trip: got %q", body)
+			}
+		})
+	}
+}
+
+func TestResponsesIndentedOnlyWithPrettyJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		prettyJSON bool
+	}{
+		{name: "development indents", prettyJSON: true},
+		{name: "production is compact", prettyJSON: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{
+				config: &config.Config{Server: config.ServerConfig{PrettyJSON: tt.prettyJSON}},
+				logger: zap.NewNop(),
+			}
+
+			success := &fasthttp.RequestCtx{}
+			server.sendSuccessResponse(success, map[string]string{"status": "ok"})
+			failure := &fasthttp.RequestCtx{}
+			server.sendErrorResponse(failure, fasthttp.StatusBadRequest, "Invalid request")
+
+			for _, body := range [][]byte{success.Response.Body(), failure.Response.Body()} {
+				if !json.Valid(body) {
+					t.Fatalf("Expected valid JSON, got %s", body)
+				}
+				if indented := strings.Contains(string(body), "\n  \""); indented != tt.prettyJSON {
+					t.Errorf("Expected indented = %v, got %s", tt.prettyJSON, body)
+				}
+			}
+		})
+	}
+}
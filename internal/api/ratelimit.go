@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/denzelpenzel/vpn/internal/services"
+	"github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// Prefix lengths client addresses are masked to before they are logged
+const (
+	maskedIPv4Bits = 24
+	maskedIPv6Bits = 48
+)
+
+// denialKey identifies a rate limit denial counter
+type denialKey struct {
+	route   string
+	limiter string
+}
+
+// denialCounter counts provisioning rate limit denials by route and limiter; the zero value is ready
+// to use
+type denialCounter struct {
+	mu     sync.Mutex
+	counts map[denialKey]int64
+}
+
+// record counts one denial by limiter on route
+func (c *denialCounter) record(route, limiter string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[denialKey]int64)
+	}
+	c.counts[denialKey{route: route, limiter: limiter}]++
+}
+
+// samples returns one sample per route and limiter, sorted by route then limiter
+func (c *denialCounter) samples() []*models.MetricSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]denialKey, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].limiter < keys[j].limiter
+	})
+
+	samples := make([]*models.MetricSample, 0, len(keys))
+	for _, key := range keys {
+		samples = append(samples, &models.MetricSample{
+			Labels: map[string]string{"route": key.route, "limiter": key.limiter},
+			Value:  float64(c.counts[key]),
+		})
+	}
+	return samples
+}
+
+// rateLimitLog writes sampled rate limit decisions; the zero value logs nothing
+type rateLimitLog struct {
+	logger      *zap.Logger
+	sampleEvery uint64
+	allowed     atomic.Uint64
+	denied      atomic.Uint64
+}
+
+// sampled reports whether this decision is one of the sampled ones: the first of each outcome and
+// every sampleEvery-th after it
+func (l *rateLimitLog) sampled(allowed bool) bool {
+	seen := &l.denied
+	if allowed {
+		seen = &l.allowed
+	}
+	return (seen.Add(1)-1)%l.sampleEvery == 0
+}
+
+// SetRateLimitLogger logs one in every sampleEvery rate limit decisions of each outcome to logger at
+// debug level. The logger should be enabled for debug on its own so the rest of the API can stay quiet.
+func (s *Server) SetRateLimitLogger(logger *zap.Logger, sampleEvery int) {
+	s.rateLimitLog = &rateLimitLog{logger: logger, sampleEvery: uint64(max(sampleEvery, 1))}
+}
+
+// ObserveRateLimit records a provisioning rate limit or cooldown decision made while serving a request:
+// denials are counted by route, and decisions are logged when a rate limit logger is set. Client
+// addresses are masked.
+func (s *Server) ObserveRateLimit(ctx context.Context, decision services.RateLimitDecision) {
+	route := "unknown"
+	var client netip.Addr
+	if requestCtx, ok := ctx.(*fasthttp.RequestCtx); ok {
+		route = requestRoute(requestCtx)
+		client = clientIP(requestCtx, s.trustedProxies)
+	}
+
+	if !decision.Allowed {
+		s.rateLimitDenials.record(route, decision.Limiter)
+	}
+
+	if s.rateLimitLog == nil || !s.rateLimitLog.sampled(decision.Allowed) {
+		return
+	}
+
+	outcome := "denied"
+	if decision.Allowed {
+		outcome = "allowed"
+	}
+	s.rateLimitLog.logger.Debug("Rate limit decision",
+		zap.String("decision", outcome),
+		zap.String("limiter", decision.Limiter),
+		zap.String("key", decision.Key),
+		zap.Float64("remaining", decision.Remaining),
+		zap.Duration("retry_after", decision.RetryAfter),
+		zap.String("route", route),
+		zap.String("client", maskAddr(client)),
+	)
+}
+
+// requestRoute returns the route pattern that matched the request, so paths differing only in their
+// parameters are counted together, falling back to the raw path
+func requestRoute(ctx *fasthttp.RequestCtx) string {
+	if route, ok := ctx.UserValue(router.MatchedRoutePathParam).(string); ok && route != "" {
+		return route
+	}
+	return string(ctx.Path())
+}
+
+// maskAddr returns the network an address belongs to rather than the address itself: a /24 for IPv4
+// and a /48 for IPv6
+func maskAddr(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+
+	bits := maskedIPv6Bits
+	if addr.Is4() {
+		bits = maskedIPv4Bits
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/services"
+	"github.com/fasthttp/router"
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newRateLimitedRequest returns a request from addr that matched route
+func newRateLimitedRequest(route, addr string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue(router.MatchedRoutePathParam, route)
+	ctx.SetRemoteAddr(&net.TCPAddr{IP: net.ParseIP(addr), Port: 40000})
+	return ctx
+}
+
+func TestObserveRateLimitLogsDeniedDecision(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+	server.SetRateLimitLogger(zap.New(core), 1)
+
+	serverID := uuid.New()
+	ctx := newRateLimitedRequest("/api/client/config", "203.0.113.57")
+	server.ObserveRateLimit(ctx, services.RateLimitDecision{
+		Limiter:    services.LimiterServerProvision,
+		Key:        serverID.String(),
+		RetryAfter: 250 * time.Millisecond,
+	})
+
+	entries := logs.FilterMessage("Rate limit decision").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 decision log, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Level != zapcore.DebugLevel {
+		t.Errorf("Expected debug level, got %s", entry.Level)
+	}
+
+	fields := entry.ContextMap()
+	want := map[string]interface{}{
+		"decision": "denied",
+		"limiter":  services.LimiterServerProvision,
+		"key":      serverID.String(),
+		"route":    "/api/client/config",
+		"client":   "203.0.113.0/24",
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("Expected %s %v, got %v", name, value, fields[name])
+		}
+	}
+
+	samples := server.rateLimitDenials.samples()
+	if len(samples) != 1 || samples[0].Value != 1 || samples[0].Labels["route"] != "/api/client/config" {
+		t.Errorf("Expected one denial counted for the route, got %+v", samples)
+	}
+}
+
+func TestObserveRateLimitSamplesAndStaysQuietWhenDisabled(t *testing.T) {
+	server := &Server{config: &config.Config{}, logger: zap.NewNop()}
+	ctx := newRateLimitedRequest("/api/client/config", "2001:db8:1:2::5")
+
+	// Without a logger denials are still counted
+	server.ObserveRateLimit(ctx, services.RateLimitDecision{Limiter: services.LimiterProvisionCooldown})
+	if samples := server.rateLimitDenials.samples(); len(samples) != 1 || samples[0].Value != 1 {
+		t.Errorf("Expected the denial to be counted, got %+v", samples)
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	server.SetRateLimitLogger(zap.New(core), 3)
+	for i := 0; i < 7; i++ {
+		server.ObserveRateLimit(ctx, services.RateLimitDecision{Limiter: services.LimiterServerProvision, Allowed: true})
+	}
+
+	// The first and every third allowed decision after it
+	entries := logs.All()
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 sampled decisions, got %d", len(entries))
+	}
+	if client := entries[0].ContextMap()["client"]; client != "2001:db8:1::/48" {
+		t.Errorf("Expected the IPv6 client masked to its /48, got %v", client)
+	}
+}
+
+func TestMaskAddr(t *testing.T) {
+	tests := map[string]string{
+		"198.51.100.200":   "198.51.100.0/24",
+		"2001:db8:abcd::1": "2001:db8:abcd::/48",
+	}
+	for addr, want := range tests {
+		if got := maskAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("maskAddr(%s) = %s, want %s", addr, got, want)
+		}
+	}
+	if got := maskAddr(netip.Addr{}); got != "" {
+		t.Errorf("Expected no address to mask to nothing, got %q", got)
+	}
+}
@@ -2,11 +2,15 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
+	"net/netip"
 	"time"
 
 	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/database"
 	"github.com/denzelpenzel/vpn/internal/services"
 	"github.com/fasthttp/router"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 )
@@ -19,6 +23,18 @@ type Server struct {
 	authService      *services.AuthService
 	wireguardService *services.WireguardService
 	serverService    *services.ServerService
+	inviteService    *services.InviteService
+	auditService     *services.AuditService
+	settingsService  *services.SettingsService
+	db               *pgxpool.Pool                 // optional; only used to report pool stats
+	dbHealth         *database.Health              // optional; set in degraded mode to refuse writes while the database is down
+	geoLocator       services.GeoLocator           // optional; locates client addresses for whoami
+	clientCompat     *services.ClientCompatibility // optional; minimum client versions per platform
+	trustedProxies   []netip.Prefix
+	tlsCert          *x509.Certificate // leaf certificate when the API terminates TLS itself
+	requests         requestCounter
+	rateLimitDenials denialCounter
+	rateLimitLog     *rateLimitLog // optional; samples rate limit decisions into the debug log
 	router           *router.Router
 	server           *fasthttp.Server
 }
@@ -31,6 +47,9 @@ func NewServer(
 	authService *services.AuthService,
 	wireguardService *services.WireguardService,
 	serverService *services.ServerService,
+	inviteService *services.InviteService,
+	auditService *services.AuditService,
+	settingsService *services.SettingsService,
 ) *Server {
 	s := &Server{
 		config:           cfg,
@@ -39,30 +58,149 @@ func NewServer(
 		authService:      authService,
 		wireguardService: wireguardService,
 		serverService:    serverService,
+		inviteService:    inviteService,
+		auditService:     auditService,
+		settingsService:  settingsService,
 		router:           router.New(),
 	}
 
+	// Rate limit denials are counted by route pattern rather than by path
+	s.router.SaveMatchedRoutePath = true
+
+	// Entries were validated with the rest of the config
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			s.trustedProxies = append(s.trustedProxies, prefix.Masked())
+		}
+	}
+
 	s.setupRoutes()
 	s.setupServer()
 
 	return s
 }
 
+// SetDB sets the database pool whose usage is reported by the stats endpoint
+func (s *Server) SetDB(db *pgxpool.Pool) {
+	s.db = db
+}
+
+// SetDatabaseHealth enables degraded mode: while health finds the database down, provisioning and
+// registration are refused with 503 up front and other database failures are reported as 503
+func (s *Server) SetDatabaseHealth(health *database.Health) {
+	s.dbHealth = health
+}
+
+// SetTLSCertificate sets the certificate the API serves, whose fingerprint is published for pinning
+func (s *Server) SetTLSCertificate(cert *x509.Certificate) {
+	s.tlsCert = cert
+}
+
+// SetGeoLocator sets the locator used to report a client's coarse location
+func (s *Server) SetGeoLocator(locator services.GeoLocator) {
+	s.geoLocator = locator
+}
+
+// SetClientCompatibility sets the minimum client versions that provisioning responses are checked against
+func (s *Server) SetClientCompatibility(compat *services.ClientCompatibility) {
+	s.clientCompat = compat
+}
+
 // setupRoutes configures all API routes
 func (s *Server) setupRoutes() {
 	// Security middleware for all routes
 	s.router.GlobalOPTIONS = s.corsHandler
 
+	public, internal, authed, admin := s.publicChain(), s.internalChain(), s.authedChain(), s.adminChain()
+	// Read-only user endpoints an admin can also view through an impersonation token
+	viewable := s.viewableChain()
+	// Registration and provisioning write to the database, so degraded mode refuses them up front
+	registering := append(s.publicChain(), s.requireDatabaseMiddleware)
+	// A user whose password was reset to a temporary one can only change it
+	changingPassword := append(s.publicChain(), s.passwordChangeAuthMiddleware, s.requireDatabaseMiddleware)
+	provisioning := append(s.authedChain(), s.requireDatabaseMiddleware)
+	// Configs and peer lists grow with the number of peers, so they are worth compressing
+	provisioningCompressed := append(s.authedChain(), s.requireDatabaseMiddleware, s.compressMiddleware)
+	adminCompressed := append(s.adminChain(), s.compressMiddleware)
+
 	// Public routes (no authentication required)
-	s.router.POST("/api/users/register", s.withMiddleware(s.registerHandler))
-	s.router.POST("/api/users/login", s.withMiddleware(s.loginHandler))
+	s.router.POST("/api/users/register", chain(s.registerHandler, registering...))
+	s.router.POST("/api/users/login", chain(s.loginHandler, public...))
+	s.router.POST("/api/users/refresh", chain(s.refreshHandler, registering...))
+	s.router.POST("/api/users/accept-invite", chain(s.acceptInviteHandler, registering...))
+	s.router.GET("/api/errors", chain(s.errorCatalogHandler, public...))
+	s.router.GET("/api/client/compatibility", chain(s.compatibilityHandler, public...))
+	s.router.GET("/api/client/config/shared/{token}", chain(s.sharedConfigHandler, public...))
+
+	// Service-to-service routes (internal API key required)
+	s.router.POST("/api/auth/introspect", chain(s.introspectHandler, internal...))
 
 	// Protected routes (authentication required)
-	s.router.POST("/api/client/config", s.withMiddleware(s.authMiddleware(s.getConfigHandler)))
-	s.router.GET("/api/servers/locations", s.withMiddleware(s.authMiddleware(s.getServersHandler)))
+	s.router.GET("/api/users/me/permissions", chain(s.getPermissionsHandler, viewable...))
+	s.router.POST("/api/users/me/password", chain(s.changePasswordHandler, changingPassword...))
+	s.router.POST("/api/users/me/revoke-sessions", chain(s.revokeSessionsHandler, authed...))
+	s.router.POST("/api/users/logout", chain(s.logoutHandler, authed...))
+	s.router.POST("/api/client/config", chain(s.getConfigHandler, provisioningCompressed...))
+	s.router.DELETE("/api/client/config", chain(s.deleteConfigHandler, authed...))
+	s.router.POST("/api/client/config/regenerate", chain(s.regenerateConfigHandler, provisioningCompressed...))
+	s.router.POST("/api/client/config/sync-all", chain(s.syncAllConfigsHandler, provisioningCompressed...))
+	s.router.POST("/api/client/config/bundle", chain(s.createConfigBundleHandler, provisioningCompressed...))
+	s.router.GET("/api/client/config/file", chain(s.configFileHandler, authed...))
+	s.router.POST("/api/client/config/file", chain(s.configFileHandler, authed...))
+	s.router.POST("/api/client/config/qr", chain(s.configQRHandler, authed...))
+	s.router.GET("/api/client/bootstrap.sh", chain(s.bootstrapScriptHandler, authed...))
+	s.router.POST("/api/client/config/share", chain(s.createConfigShareHandler, provisioning...))
+	s.router.GET("/api/client/config/key-status", chain(s.keyStatusHandler, viewable...))
+	s.router.GET("/api/client/configs/history", chain(s.keyHistoryHandler, viewable...))
+	s.router.GET("/api/client/config/verify", chain(s.verifyConfigHandler, viewable...))
+	s.router.POST("/api/client/diagnostics", chain(s.diagnosticsHandler, authed...))
+	s.router.DELETE("/api/client/devices", chain(s.revokeDeviceHandler, authed...))
+	s.router.GET("/api/client/whoami", chain(s.whoamiHandler, viewable...))
+	s.router.GET("/api/client/dashboard", chain(s.dashboardHandler, viewable...))
+	s.router.GET("/api/client/usage", chain(s.getUsageHandler, viewable...))
+	s.router.GET("/api/servers/locations", chain(s.getServersHandler, viewable...))
+
+	// Admin routes (admin role required)
+	s.router.GET("/api/admin/peers", chain(s.getPeersHandler, adminCompressed...))
+	s.router.GET("/api/admin/metrics.json", chain(s.metricsJSONHandler, admin...))
+	s.router.GET("/api/admin/stats", chain(s.getStatsHandler, admin...))
+	s.router.GET("/api/admin/stats/trends", chain(s.trendsHandler, admin...))
+	s.router.POST("/api/admin/users/batch", chain(s.batchCreateUsersHandler, admin...))
+	s.router.POST("/api/admin/users/{id}/allowed-networks", chain(s.setAllowedNetworksHandler, admin...))
+	s.router.POST("/api/admin/users/{id}/reset-password", chain(s.resetPasswordHandler, admin...))
+	s.router.POST("/api/admin/users/{id}/impersonate", chain(s.impersonateHandler, admin...))
+	s.router.POST("/api/admin/users/{id}/connection-limit", chain(s.setConnectionLimitHandler, admin...))
+	s.router.POST("/api/admin/users/{id}/schedule-revoke", chain(s.scheduleRevocationHandler, admin...))
+	s.router.GET("/api/admin/users/{id}/schedule-revoke", chain(s.listScheduledRevocationsHandler, admin...))
+	s.router.DELETE("/api/admin/users/{id}/schedule-revoke/{revocation_id}", chain(s.cancelScheduledRevocationHandler, admin...))
+	s.router.POST("/api/admin/keys/cleanup", chain(s.cleanupKeysHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/reconcile", chain(s.reconcileServerHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/peers/status", chain(s.peerStatusHandler, admin...))
+	s.router.GET("/api/admin/servers/{id}/info", chain(s.serverInfoHandler, admin...))
+	s.router.GET("/api/admin/devices/{name}", chain(s.deviceInfoHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/selftest", chain(s.selfTestHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/reserve-ips", chain(s.reserveIPsHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/release-ips", chain(s.releaseIPsHandler, admin...))
+	s.router.GET("/api/admin/servers/{id}/allocations", chain(s.serverAllocationsHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/obfuscation", chain(s.setObfuscationHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/doh-template", chain(s.setDoHTemplateHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/import-key", chain(s.importServerKeyHandler, admin...))
+	s.router.POST("/api/admin/servers/{id}/maintenance", chain(s.createMaintenanceHandler, admin...))
+	s.router.GET("/api/admin/servers/{id}/maintenance", chain(s.listMaintenanceHandler, admin...))
+	s.router.DELETE("/api/admin/servers/{id}/maintenance/{window_id}", chain(s.cancelMaintenanceHandler, admin...))
+	s.router.POST("/api/admin/provision/static", chain(s.provisionStaticHandler, admin...))
+	s.router.POST("/api/admin/settings", chain(s.setSettingHandler, admin...))
+	s.router.POST("/api/admin/invites", chain(s.createInviteHandler, admin...))
+
+	// Identities clients can pin
+	s.router.GET("/api/.well-known/vpn-info", chain(s.vpnInfoHandler, public...))
 
 	// Health check endpoint
-	s.router.GET("/api/health", s.withMiddleware(s.healthHandler))
+	s.router.GET("/api/health", chain(s.healthHandler, public...))
+
+	// Prometheus scrape endpoint, authorized by the metrics token rather than a user's JWT; admins get
+	// the same metrics as JSON at /api/admin/metrics.json
+	s.router.GET("/metrics", chain(s.metricsHandler, s.scrapeChain()...))
 }
 
 // setupServer configures the FastHTTP server
@@ -87,6 +225,9 @@ func (s *Server) Start() error {
 		zap.String("address", s.config.Server.Address),
 		zap.String("environment", s.config.Server.Environment))
 
+	if s.config.Server.TLSEnabled() {
+		return s.server.ListenAndServeTLS(s.config.Server.Address, s.config.Server.TLSCertFile, s.config.Server.TLSKeyFile)
+	}
 	return s.server.ListenAndServe(s.config.Server.Address)
 }
 
@@ -96,13 +237,47 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	return s.server.ShutdownWithContext(ctx)
 }
 
-// withMiddleware wraps handlers with common middleware
-func (s *Server) withMiddleware(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
-	return s.loggingMiddleware(
-		s.securityMiddleware(
-			s.rateLimitMiddleware(handler),
-		),
-	)
+// middleware wraps a handler with behaviour that runs around it
+type middleware func(fasthttp.RequestHandler) fasthttp.RequestHandler
+
+// chain wraps handler in middlewares so they run in the order given: the first sees each request first
+func chain(handler fasthttp.RequestHandler, middlewares ...middleware) fasthttp.RequestHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// publicChain is the middleware every route runs, outermost first: requests are logged and get
+// security headers before anything else. Requests are not rate limited here; only provisioning is,
+// by the WireGuard service.
+func (s *Server) publicChain() []middleware {
+	return []middleware{s.loggingMiddleware, s.securityMiddleware}
+}
+
+// internalChain additionally requires the internal API key
+func (s *Server) internalChain() []middleware {
+	return append(s.publicChain(), s.internalAPIKeyMiddleware)
+}
+
+// authedChain additionally requires a valid token
+func (s *Server) authedChain() []middleware {
+	return append(s.publicChain(), s.authMiddleware)
+}
+
+// viewableChain is authedChain for read-only user endpoints, also accepting impersonation tokens
+func (s *Server) viewableChain() []middleware {
+	return append(s.publicChain(), s.impersonableAuthMiddleware)
+}
+
+// scrapeChain additionally requires the metrics token
+func (s *Server) scrapeChain() []middleware {
+	return append(s.publicChain(), s.metricsTokenMiddleware)
+}
+
+// adminChain additionally requires the token's user to be an admin
+func (s *Server) adminChain() []middleware {
+	return append(s.authedChain(), s.adminMiddleware)
 }
 
 // corsHandler handles CORS preflight requests
@@ -114,8 +289,8 @@ func (s *Server) corsHandler(ctx *fasthttp.RequestCtx) {
 // setCORSHeaders sets CORS headers for security
 func (s *Server) setCORSHeaders(ctx *fasthttp.RequestCtx) {
 	ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
-	ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	ctx.Response.Header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	ctx.Response.Header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Client-Platform, X-Client-Version")
 	ctx.Response.Header.Set("Access-Control-Max-Age", "86400")
 }
 
@@ -125,6 +300,16 @@ func (s *Server) healthHandler(ctx *fasthttp.RequestCtx) {
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
 
-	response := `{"status":"healthy","service":"vpn-api","timestamp":"` + time.Now().UTC().Format(time.RFC3339) + `"}`
-	ctx.SetBodyString(response)
+	// A degraded API still serves reads, so it stays in rotation
+	status := "healthy"
+	if !s.dbHealth.Healthy() {
+		status = "degraded"
+	}
+
+	response, _ := s.marshalResponse(struct {
+		Status    string      `json:"status"`
+		Service   string      `json:"service"`
+		Timestamp interface{} `json:"timestamp"`
+	}{status, "vpn-api", s.responseTimestamp(time.Now())})
+	ctx.SetBody(response)
 }
@@ -1,69 +1,690 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// minJWTSecretLength is the minimum accepted length of the JWT signing secret
+const minJWTSecretLength = 32
+
+// maxPersistentKeepalive is the largest accepted default peer keepalive
+const maxPersistentKeepalive = 120 * time.Second
+
+// minBootstrapPasswordLength matches the shortest password registration accepts
+const minBootstrapPasswordLength = 8
+
+// minIdleTimeout keeps the idle disconnect from dropping peers between the handshakes WireGuard
+// renews every two minutes while traffic flows
+const minIdleTimeout = 3 * time.Minute
+
 // Config holds all configuration for the application
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	JWT      JWTConfig
-	Security SecurityConfig
+	Server        ServerConfig
+	Database      DatabaseConfig
+	JWT           JWTConfig
+	Security      SecurityConfig
+	Workers       WorkersConfig
+	Registration  RegistrationConfig
+	WireGuard     WireGuardConfig
+	Notifications NotificationsConfig
+	DefaultServer DefaultServerConfig
+	Clients       ClientsConfig
+	Bootstrap     BootstrapConfig
 }
 
 // ServerConfig holds server configuration
 type ServerConfig struct {
-	Address     string
-	Port        int
-	Environment string
+	Address         string
+	Port            int
+	Environment     string
+	DeeplinkBaseURL string   // base of config import links handed to mobile clients
+	PublicBaseURL   string   // externally reachable base URL of the API, used to build links such as config shares
+	TrustedProxies  []string // CIDRs of proxies whose X-Forwarded-For and X-Forwarded-Proto headers are believed
+	GeoIPDatabase   string   // optional CSV geo database used to locate client addresses
+	TLSCertFile     string   // serve HTTPS directly with this certificate; empty leaves TLS to the proxy
+	TLSKeyFile      string
+	TimestampFormat string // format of the timestamp on every response: rfc3339, rfc3339nano or unix
+	CompressConfigs bool   // gzip config responses for clients accepting gzip
+	PrettyJSON      bool   // indent JSON responses
+	ErrorDetails    bool   // include internal error detail in error responses; never honoured in production
+	MetricsToken    string // bearer token Prometheus scrapers present to /metrics; empty disables the endpoint
+}
+
+// Response timestamp formats
+const (
+	TimestampRFC3339     = "rfc3339"
+	TimestampRFC3339Nano = "rfc3339nano"
+	TimestampUnix        = "unix"
+)
+
+// TLSEnabled reports whether the API terminates TLS itself
+func (c ServerConfig) TLSEnabled() bool {
+	return c.TLSCertFile != ""
+}
+
+// IsProduction reports whether the server runs in the production environment
+func (c ServerConfig) IsProduction() bool {
+	return c.Environment == "production"
+}
+
+// IsDevelopment reports whether the server runs in the development environment
+func (c ServerConfig) IsDevelopment() bool {
+	return c.Environment == "development"
 }
 
 // DatabaseConfig holds database configuration
 type DatabaseConfig struct {
-	DSN string
+	DSN            string
+	MaxConns       int32
+	AcquireTimeout time.Duration // longest a request waits for a pool connection; zero waits indefinitely
+	DegradedMode   bool          // keep serving the cached server list while health checks find the database down
+	HealthInterval time.Duration // how often the database is pinged in degraded mode
 }
 
 // JWTConfig holds JWT configuration
 type JWTConfig struct {
-	Secret string
+	Secret           string
+	IntrospectionKey string        // API key trusted callers present to the introspection endpoint; empty disables it
+	MinimalClaims    bool          // leave the email out of tokens, which then carry only the user ID and role
+	AccessTokenTTL   time.Duration // lifetime of the JWTs sent with each request
+	RefreshTokenTTL  time.Duration // lifetime of the refresh tokens that renew them
 }
 
 // SecurityConfig holds security-related configuration
 type SecurityConfig struct {
-	BCryptCost int
+	BCryptCost      int
+	Argon2Time      int      // Argon2id passes over memory
+	Argon2Memory    int      // Argon2id memory in KiB
+	DevHashCost     HashCost // cheaper hashing cost used instead of the three above when PasswordHashDev is set
+	PasswordHashDev bool     // opt in to DevHashCost; never follows from the environment alone
+	PasswordHash    string   // algorithm for new password hashes: "bcrypt" or "argon2id"
+	MaxJSONDepth    int      // deepest object/array nesting accepted in a request body; zero disables the check
+	MaxJSONTokens   int      // most JSON tokens accepted in a request body; zero disables the check
+	// StepUpOperations lists the operations that also need the caller's current password, so a stolen
+	// token alone cannot perform them
+	StepUpOperations []string
+	// PasswordMaxFailures is how many wrong passwords in a row a user gets, at sign-in and step-up
+	// together, before being limited to one attempt every PasswordFailureWindow/PasswordMaxFailures;
+	// zero disables the limit
+	PasswordMaxFailures   int
+	PasswordFailureWindow time.Duration
+}
+
+// Operations that can be listed in STEP_UP_OPERATIONS
+const (
+	StepUpRevokeSessions = "revoke_sessions"
+	StepUpRevokeDevice   = "revoke_device"
+)
+
+// HashCost is the work factor for new password hashes under each algorithm
+type HashCost struct {
+	BCryptCost   int
+	Argon2Time   int
+	Argon2Memory int // KiB
+}
+
+// Bounds on the Argon2id cost; below the memory floor Argon2id gives little over a fast hash
+const (
+	minArgon2Memory = 1024
+	maxArgon2Memory = 4 * 1024 * 1024
+)
+
+// RegistrationConfig holds user registration configuration (the zero value allows open registration)
+type RegistrationConfig struct {
+	Disabled          bool
+	RequireInvite     bool
+	PreserveEmailCase bool // store new emails as entered instead of lowercased; they are unique regardless of case
+}
+
+// WireGuardConfig holds WireGuard device management configuration
+type WireGuardConfig struct {
+	RotationGrace       time.Duration // how long a rotated-out peer stays programmed; zero removes it immediately
+	PersistentKeepalive time.Duration // keepalive for peers without a per-request override; zero disables it
+	ProvisionCooldown   time.Duration // least time between changes to one user's key on a server; zero disables it
+	MaxConcurrentOps    int           // most device configurations running at once; zero leaves it unbounded
+	ConcurrencyWait     time.Duration // how long a configuration waits for a free slot before failing with 503
+	DeviceWaitTimeout   time.Duration // how long startup waits for the device to be queryable before running without it
+	IdleTimeout         time.Duration // peers without a handshake for this long are taken off the device; zero disables it
+	ConnectionLimit     int           // most of one user's peers connected at once unless the user has their own; zero disables it
+	SoftMaxKeys         int           // active keys on a server past which new users are steered to another; zero disables it
+	ProvisionRate       int           // most provisionings per second on one server, whoever asks; zero disables it
+	ProvisionBurst      int           // provisionings a server accepts at once before ProvisionRate applies
+	RejectReusedKeys    bool          // refuse a public key the user previously had revoked on the same server
+	KeyPepper           string        // keys the stored hashes of client public keys; empty stores raw keys only
+	LogRateLimits       bool          // log provisioning rate limit decisions at debug level, whatever the log level
+	RateLimitLogSample  int           // log one in this many rate limit decisions of each outcome
+	SplitTunnelGateway  bool          // route the server's gateway address and DNS servers through split tunnels
+	EnforceNetworks     bool          // filter forwarded peer traffic to users' allowed networks with iptables
+}
+
+// DefaultServerConfig describes the server seeded into an empty servers table on startup
+type DefaultServerConfig struct {
+	Name     string
+	Location string
+	Endpoint string // public address clients connect to; empty disables seeding
+	Port     int
+}
+
+// BootstrapConfig describes the admin user created on startup when no admin exists
+type BootstrapConfig struct {
+	AdminEmail    string // empty disables seeding
+	AdminPassword string
+}
+
+// ClientsConfig holds client application compatibility configuration
+type ClientsConfig struct {
+	MinVersions []string // "platform=version" entries; clients older than their platform's entry are warned
+}
+
+// NotificationsConfig holds operator notification configuration
+type NotificationsConfig struct {
+	WebhookURL string // receives operator events such as server key changes; empty disables delivery
+}
+
+// WorkersConfig holds background worker configuration
+type WorkersConfig struct {
+	UsageInterval      time.Duration
+	PeerExpiryInterval time.Duration
+	KeySyncInterval    time.Duration
+	IdleCheckInterval  time.Duration
+	// TokenCleanupInterval is how often expired entries are purged from the revoked token denylist, and
+	// expired refresh tokens and used or expired config share links deleted
+	TokenCleanupInterval time.Duration
 }
 
 // Load loads configuration from environment variables
 func Load() (*Config, error) {
 	cfg := &Config{
 		Server: ServerConfig{
-			Address:     getEnv("SERVER_ADDRESS", "0.0.0.0:8080"),
-			Port:        getEnvAsInt("SERVER_PORT", 8080),
-			Environment: getEnv("ENVIRONMENT", "development"),
+			Address:         getEnv("SERVER_ADDRESS", "0.0.0.0:8080"),
+			Port:            getEnvAsInt("SERVER_PORT", 8080),
+			Environment:     getEnv("ENVIRONMENT", "development"),
+			DeeplinkBaseURL: getEnv("DEEPLINK_BASE_URL", "vpn://import"),
+			PublicBaseURL:   strings.TrimRight(getEnv("PUBLIC_BASE_URL", ""), "/"),
+			TrustedProxies:  getEnvAsList("TRUSTED_PROXIES"),
+			GeoIPDatabase:   getEnv("GEOIP_DATABASE_PATH", ""),
+			TLSCertFile:     getEnv("TLS_CERT_FILE", ""),
+			TLSKeyFile:      getEnv("TLS_KEY_FILE", ""),
+			TimestampFormat: getEnv("RESPONSE_TIMESTAMP_FORMAT", TimestampRFC3339),
+			CompressConfigs: getEnvAsBool("COMPRESS_CONFIGS", false),
+			PrettyJSON:      getEnvAsBool("PRETTY_JSON", false),
+			ErrorDetails:    getEnvAsBool("ERROR_DETAILS", false),
+			MetricsToken:    getEnv("METRICS_TOKEN", ""),
 		},
 		Database: DatabaseConfig{
-			DSN: os.Getenv("DATABASE_DSN"),
+			DSN:            os.Getenv("DATABASE_DSN"),
+			MaxConns:       int32(getEnvAsInt("DB_MAX_CONNS", 25)),
+			AcquireTimeout: getEnvAsDuration("DB_ACQUIRE_TIMEOUT", 2*time.Second),
+			DegradedMode:   getEnvAsBool("DB_DEGRADED_MODE", false),
+			HealthInterval: getEnvAsDuration("DB_HEALTH_CHECK_INTERVAL", 10*time.Second),
 		},
 		JWT: JWTConfig{
-			Secret: getEnv("JWT_SECRET", ""),
+			Secret:           getEnv("JWT_SECRET", ""),
+			IntrospectionKey: getEnv("INTROSPECTION_API_KEY", ""),
+			MinimalClaims:    getEnvAsBool("JWT_MINIMAL_CLAIMS", false),
+			AccessTokenTTL:   getEnvAsDuration("JWT_ACCESS_TOKEN_TTL", 15*time.Minute),
+			RefreshTokenTTL:  getEnvAsDuration("JWT_REFRESH_TOKEN_TTL", 30*24*time.Hour),
 		},
 		Security: SecurityConfig{
-			BCryptCost: getEnvAsInt("BCRYPT_COST", 12),
+			BCryptCost:            getEnvAsInt("BCRYPT_COST", 12),
+			Argon2Time:            getEnvAsInt("ARGON2_TIME", 3),
+			Argon2Memory:          getEnvAsInt("ARGON2_MEMORY_KIB", 64*1024),
+			PasswordHash:          getEnv("PASSWORD_HASH", "bcrypt"),
+			MaxJSONDepth:          getEnvAsInt("MAX_JSON_DEPTH", 32),
+			MaxJSONTokens:         getEnvAsInt("MAX_JSON_TOKENS", 10000),
+			StepUpOperations:      getEnvAsList("STEP_UP_OPERATIONS"),
+			PasswordMaxFailures:   getEnvAsInt("PASSWORD_MAX_FAILURES", 10),
+			PasswordFailureWindow: getEnvAsDuration("PASSWORD_FAILURE_WINDOW", 15*time.Minute),
+			PasswordHashDev:       getEnvAsBool("PASSWORD_HASH_DEV", false),
+			DevHashCost: HashCost{
+				BCryptCost:   getEnvAsInt("BCRYPT_COST_DEV", bcrypt.MinCost),
+				Argon2Time:   getEnvAsInt("ARGON2_TIME_DEV", 1),
+				Argon2Memory: getEnvAsInt("ARGON2_MEMORY_KIB_DEV", minArgon2Memory),
+			},
+		},
+		Workers: WorkersConfig{
+			UsageInterval:        getEnvAsDuration("USAGE_COLLECT_INTERVAL", time.Minute),
+			PeerExpiryInterval:   getEnvAsDuration("PEER_EXPIRY_INTERVAL", time.Minute),
+			KeySyncInterval:      getEnvAsDuration("KEY_SYNC_INTERVAL", 5*time.Minute),
+			IdleCheckInterval:    getEnvAsDuration("IDLE_CHECK_INTERVAL", time.Minute),
+			TokenCleanupInterval: getEnvAsDuration("TOKEN_CLEANUP_INTERVAL", time.Hour),
+		},
+		Notifications: NotificationsConfig{
+			WebhookURL: getEnv("WEBHOOK_URL", ""),
+		},
+		WireGuard: WireGuardConfig{
+			RotationGrace:       getEnvAsDuration("KEY_ROTATION_GRACE", 0),
+			PersistentKeepalive: getEnvAsDuration("PERSISTENT_KEEPALIVE", 25*time.Second),
+			ProvisionCooldown:   getEnvAsDuration("PROVISION_COOLDOWN", 0),
+			MaxConcurrentOps:    getEnvAsInt("WG_MAX_CONCURRENT_OPS", 8),
+			ConcurrencyWait:     getEnvAsDuration("WG_CONCURRENCY_WAIT", 5*time.Second),
+			DeviceWaitTimeout:   getEnvAsDuration("WG_DEVICE_WAIT_TIMEOUT", 30*time.Second),
+			IdleTimeout:         getEnvAsDuration("WG_IDLE_TIMEOUT", 0),
+			ConnectionLimit:     getEnvAsInt("WG_CONNECTION_LIMIT", 0),
+			SoftMaxKeys:         getEnvAsInt("WG_SOFT_MAX_KEYS", 0),
+			ProvisionRate:       getEnvAsInt("WG_PROVISION_RATE", 0),
+			ProvisionBurst:      getEnvAsInt("WG_PROVISION_BURST", 20),
+			RejectReusedKeys:    getEnvAsBool("WG_REJECT_REUSED_KEYS", false),
+			KeyPepper:           getEnv("WG_KEY_PEPPER", ""),
+			LogRateLimits:       getEnvAsBool("LOG_RATE_LIMIT_DECISIONS", false),
+			RateLimitLogSample:  getEnvAsInt("RATE_LIMIT_LOG_SAMPLE", 10),
+			SplitTunnelGateway:  getEnvAsBool("SPLIT_TUNNEL_INCLUDE_GATEWAY", true),
+			EnforceNetworks:     getEnvAsBool("ENFORCE_ALLOWED_NETWORKS", true),
 		},
+		DefaultServer: DefaultServerConfig{
+			Name:     getEnv("DEFAULT_SERVER_NAME", "Default Server"),
+			Location: getEnv("DEFAULT_SERVER_LOCATION", "Default Location"),
+			Endpoint: getEnv("DEFAULT_SERVER_ENDPOINT", ""),
+			Port:     getEnvAsInt("DEFAULT_SERVER_PORT", 51820),
+		},
+		Registration: RegistrationConfig{
+			Disabled:          !getEnvAsBool("REGISTRATION_ENABLED", true),
+			RequireInvite:     getEnvAsBool("REGISTRATION_REQUIRE_INVITE", false),
+			PreserveEmailCase: getEnvAsBool("PRESERVE_EMAIL_CASE", false),
+		},
+		Clients: ClientsConfig{
+			MinVersions: getEnvAsList("CLIENT_MIN_VERSIONS"),
+		},
+		Bootstrap: BootstrapConfig{
+			AdminEmail:    getEnv("BOOTSTRAP_ADMIN_EMAIL", ""),
+			AdminPassword: getEnv("BOOTSTRAP_ADMIN_PASSWORD", ""),
+		},
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
-	if cfg.Database.DSN == "" {
-		return nil, fmt.Errorf("DSN is required")
+	return cfg, nil
+}
+
+// PasswordHashCost returns the cost new passwords are hashed at: the cheap development cost when
+// PASSWORD_HASH_DEV opts in, so local runs are not slowed by production-grade hashing, and the
+// production cost otherwise. ENVIRONMENT alone never lowers it, since it defaults to development
+func (c *Config) PasswordHashCost() HashCost {
+	if c.Security.PasswordHashDev {
+		return c.Security.DevHashCost
 	}
+	return c.productionHashCost()
+}
 
-	if cfg.JWT.Secret == "" {
-		return nil, fmt.Errorf("JWT_SECRET is required")
+func (c *Config) productionHashCost() HashCost {
+	return HashCost{
+		BCryptCost:   c.Security.BCryptCost,
+		Argon2Time:   c.Security.Argon2Time,
+		Argon2Memory: c.Security.Argon2Memory,
 	}
+}
 
-	return cfg, nil
+// validateHashCost checks a hashing cost against each algorithm's limits, naming the variables with
+// the given suffix
+func validateHashCost(cost HashCost, suffix string) []error {
+	var errs []error
+
+	if cost.BCryptCost < bcrypt.MinCost || cost.BCryptCost > bcrypt.MaxCost {
+		errs = append(errs, fmt.Errorf("BCRYPT_COST%s must be between %d and %d, got %d", suffix, bcrypt.MinCost, bcrypt.MaxCost, cost.BCryptCost))
+	}
+
+	if cost.Argon2Time < 1 {
+		errs = append(errs, fmt.Errorf("ARGON2_TIME%s must be at least 1, got %d", suffix, cost.Argon2Time))
+	}
+
+	if cost.Argon2Memory < minArgon2Memory || cost.Argon2Memory > maxArgon2Memory {
+		errs = append(errs, fmt.Errorf("ARGON2_MEMORY_KIB%s must be between %d and %d, got %d", suffix, minArgon2Memory, maxArgon2Memory, cost.Argon2Memory))
+	}
+
+	return errs
+}
+
+// Validate checks the configuration and reports every problem found in a single error
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Database.DSN == "" {
+		errs = append(errs, fmt.Errorf("DATABASE_DSN is required"))
+	}
+
+	if c.Database.MaxConns <= 0 {
+		errs = append(errs, fmt.Errorf("DB_MAX_CONNS must be positive"))
+	}
+
+	if c.Database.AcquireTimeout < 0 {
+		errs = append(errs, fmt.Errorf("DB_ACQUIRE_TIMEOUT must not be negative"))
+	}
+
+	if c.JWT.Secret == "" {
+		errs = append(errs, fmt.Errorf("JWT_SECRET is required"))
+	} else if len(c.JWT.Secret) < minJWTSecretLength {
+		errs = append(errs, fmt.Errorf("JWT_SECRET must be at least %d characters", minJWTSecretLength))
+	}
+	if c.JWT.AccessTokenTTL <= 0 {
+		errs = append(errs, fmt.Errorf("JWT_ACCESS_TOKEN_TTL must be positive"))
+	}
+	if c.JWT.RefreshTokenTTL <= c.JWT.AccessTokenTTL {
+		errs = append(errs, fmt.Errorf("JWT_REFRESH_TOKEN_TTL must be longer than JWT_ACCESS_TOKEN_TTL"))
+	}
+	if c.JWT.IntrospectionKey != "" && len(c.JWT.IntrospectionKey) < minJWTSecretLength {
+		errs = append(errs, fmt.Errorf("INTROSPECTION_API_KEY must be at least %d characters", minJWTSecretLength))
+	}
+	if c.Server.MetricsToken != "" && len(c.Server.MetricsToken) < minJWTSecretLength {
+		errs = append(errs, fmt.Errorf("METRICS_TOKEN must be at least %d characters", minJWTSecretLength))
+	}
+	if c.WireGuard.KeyPepper != "" && len(c.WireGuard.KeyPepper) < minJWTSecretLength {
+		errs = append(errs, fmt.Errorf("WG_KEY_PEPPER must be at least %d characters", minJWTSecretLength))
+	}
+
+	errs = append(errs, validateHashCost(c.productionHashCost(), "")...)
+	errs = append(errs, validateHashCost(c.Security.DevHashCost, "_DEV")...)
+	if c.Security.PasswordHashDev && c.Server.IsProduction() {
+		errs = append(errs, fmt.Errorf("PASSWORD_HASH_DEV must not be set in production"))
+	}
+
+	switch c.Server.TimestampFormat {
+	case TimestampRFC3339, TimestampRFC3339Nano, TimestampUnix:
+	default:
+		errs = append(errs, fmt.Errorf("RESPONSE_TIMESTAMP_FORMAT must be %s, %s or %s, got %q",
+			TimestampRFC3339, TimestampRFC3339Nano, TimestampUnix, c.Server.TimestampFormat))
+	}
+
+	if c.Security.PasswordHash != "bcrypt" && c.Security.PasswordHash != "argon2id" {
+		errs = append(errs, fmt.Errorf("PASSWORD_HASH must be bcrypt or argon2id, got %q", c.Security.PasswordHash))
+	}
+
+	for _, operation := range c.Security.StepUpOperations {
+		if operation != StepUpRevokeSessions && operation != StepUpRevokeDevice {
+			errs = append(errs, fmt.Errorf("STEP_UP_OPERATIONS must list %s or %s, got %q",
+				StepUpRevokeSessions, StepUpRevokeDevice, operation))
+		}
+	}
+
+	if c.Security.PasswordMaxFailures < 0 {
+		errs = append(errs, fmt.Errorf("PASSWORD_MAX_FAILURES must not be negative"))
+	}
+	if c.Security.PasswordMaxFailures > 0 && c.Security.PasswordFailureWindow <= 0 {
+		errs = append(errs, fmt.Errorf("PASSWORD_FAILURE_WINDOW must be positive when PASSWORD_MAX_FAILURES is set"))
+	}
+
+	if c.Security.MaxJSONDepth < 0 {
+		errs = append(errs, fmt.Errorf("MAX_JSON_DEPTH must not be negative"))
+	}
+
+	if c.Security.MaxJSONTokens < 0 {
+		errs = append(errs, fmt.Errorf("MAX_JSON_TOKENS must not be negative"))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.Address); err != nil {
+		errs = append(errs, fmt.Errorf("SERVER_ADDRESS %q is not a valid host:port: %w", c.Server.Address, err))
+	}
+
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		errs = append(errs, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("TRUSTED_PROXIES entry %q is not a CIDR: %w", proxy, err))
+		}
+	}
+
+	if c.Database.DegradedMode && c.Database.HealthInterval <= 0 {
+		errs = append(errs, fmt.Errorf("DB_HEALTH_CHECK_INTERVAL must be positive"))
+	}
+
+	if c.Workers.UsageInterval <= 0 {
+		errs = append(errs, fmt.Errorf("USAGE_COLLECT_INTERVAL must be positive"))
+	}
+
+	if c.Workers.PeerExpiryInterval <= 0 {
+		errs = append(errs, fmt.Errorf("PEER_EXPIRY_INTERVAL must be positive"))
+	}
+
+	if c.Workers.KeySyncInterval <= 0 {
+		errs = append(errs, fmt.Errorf("KEY_SYNC_INTERVAL must be positive"))
+	}
+
+	if c.Workers.IdleCheckInterval <= 0 {
+		errs = append(errs, fmt.Errorf("IDLE_CHECK_INTERVAL must be positive"))
+	}
+
+	if c.Workers.TokenCleanupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("TOKEN_CLEANUP_INTERVAL must be positive"))
+	}
+
+	if c.Server.PublicBaseURL != "" {
+		if u, err := url.Parse(c.Server.PublicBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("PUBLIC_BASE_URL %q must be an absolute http or https URL", c.Server.PublicBaseURL))
+		}
+	}
+
+	if c.Notifications.WebhookURL != "" {
+		if u, err := url.Parse(c.Notifications.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("WEBHOOK_URL %q must be an absolute http or https URL", c.Notifications.WebhookURL))
+		}
+	}
+
+	if c.WireGuard.RotationGrace < 0 {
+		errs = append(errs, fmt.Errorf("KEY_ROTATION_GRACE must not be negative"))
+	}
+
+	if c.WireGuard.ProvisionCooldown < 0 {
+		errs = append(errs, fmt.Errorf("PROVISION_COOLDOWN must not be negative"))
+	}
+
+	if c.WireGuard.MaxConcurrentOps < 0 {
+		errs = append(errs, fmt.Errorf("WG_MAX_CONCURRENT_OPS must not be negative"))
+	}
+
+	if c.WireGuard.ConcurrencyWait < 0 {
+		errs = append(errs, fmt.Errorf("WG_CONCURRENCY_WAIT must not be negative"))
+	}
+
+	if c.WireGuard.DeviceWaitTimeout < 0 {
+		errs = append(errs, fmt.Errorf("WG_DEVICE_WAIT_TIMEOUT must not be negative"))
+	}
+
+	if c.WireGuard.ProvisionRate < 0 {
+		errs = append(errs, fmt.Errorf("WG_PROVISION_RATE must not be negative"))
+	}
+
+	if c.WireGuard.ProvisionRate > 0 && c.WireGuard.ProvisionBurst < 1 {
+		errs = append(errs, fmt.Errorf("WG_PROVISION_BURST must be at least 1"))
+	}
+
+	if c.WireGuard.LogRateLimits && c.WireGuard.RateLimitLogSample < 1 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_LOG_SAMPLE must be at least 1"))
+	}
+
+	if c.WireGuard.IdleTimeout != 0 && c.WireGuard.IdleTimeout < minIdleTimeout {
+		errs = append(errs, fmt.Errorf("WG_IDLE_TIMEOUT must be 0 or at least %s", minIdleTimeout))
+	}
+
+	if c.WireGuard.ConnectionLimit < 0 {
+		errs = append(errs, fmt.Errorf("WG_CONNECTION_LIMIT must not be negative"))
+	}
+
+	if c.WireGuard.SoftMaxKeys < 0 {
+		errs = append(errs, fmt.Errorf("WG_SOFT_MAX_KEYS must not be negative"))
+	}
+
+	if c.WireGuard.PersistentKeepalive < 0 || c.WireGuard.PersistentKeepalive > maxPersistentKeepalive {
+		errs = append(errs, fmt.Errorf("PERSISTENT_KEEPALIVE must be between 0 and %s", maxPersistentKeepalive))
+	}
+
+	for _, entry := range c.Clients.MinVersions {
+		if platform, version, ok := strings.Cut(entry, "="); !ok || strings.TrimSpace(platform) == "" || strings.TrimSpace(version) == "" {
+			errs = append(errs, fmt.Errorf("CLIENT_MIN_VERSIONS entry %q must be platform=version", entry))
+		}
+	}
+
+	if (c.Bootstrap.AdminEmail == "") != (c.Bootstrap.AdminPassword == "") {
+		errs = append(errs, fmt.Errorf("BOOTSTRAP_ADMIN_EMAIL and BOOTSTRAP_ADMIN_PASSWORD must be set together"))
+	} else if c.Bootstrap.AdminEmail != "" {
+		if !strings.Contains(c.Bootstrap.AdminEmail, "@") {
+			errs = append(errs, fmt.Errorf("BOOTSTRAP_ADMIN_EMAIL %q is not an email address", c.Bootstrap.AdminEmail))
+		}
+		if len(c.Bootstrap.AdminPassword) < minBootstrapPasswordLength {
+			errs = append(errs, fmt.Errorf("BOOTSTRAP_ADMIN_PASSWORD must be at least %d characters", minBootstrapPasswordLength))
+		}
+	}
+
+	if c.DefaultServer.Endpoint != "" && (c.DefaultServer.Port < 1 || c.DefaultServer.Port > 65535) {
+		errs = append(errs, fmt.Errorf("DEFAULT_SERVER_PORT must be between 1 and 65535, got %d", c.DefaultServer.Port))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// redactedValue replaces secrets in the effective configuration dump
+const redactedValue = "[REDACTED]"
+
+// dsnPasswordPattern matches the password of a keyword/value database DSN
+var dsnPasswordPattern = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// Redacted returns the effective configuration as a map that is safe to log: secrets are
+// replaced by a fixed marker and credentials embedded in URLs are masked
+func (c *Config) Redacted() map[string]interface{} {
+	secret := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return redactedValue
+	}
+
+	return map[string]interface{}{
+		"server": map[string]interface{}{
+			"address":           c.Server.Address,
+			"environment":       c.Server.Environment,
+			"deeplink_base_url": c.Server.DeeplinkBaseURL,
+			"public_base_url":   c.Server.PublicBaseURL,
+			"trusted_proxies":   c.Server.TrustedProxies,
+			"geoip_database":    c.Server.GeoIPDatabase,
+			"tls_cert_file":     c.Server.TLSCertFile,
+			"tls_enabled":       c.Server.TLSEnabled(),
+			"timestamp_format":  c.Server.TimestampFormat,
+			"compress_configs":  c.Server.CompressConfigs,
+			"pretty_json":       c.Server.PrettyJSON,
+			"error_details":     c.Server.ErrorDetails,
+			"metrics_token":     secret(c.Server.MetricsToken),
+		},
+		"database": map[string]interface{}{
+			"dsn":             redactDSN(c.Database.DSN),
+			"max_conns":       c.Database.MaxConns,
+			"acquire_timeout": c.Database.AcquireTimeout.String(),
+			"degraded_mode":   c.Database.DegradedMode,
+			"health_interval": c.Database.HealthInterval.String(),
+		},
+		"jwt": map[string]interface{}{
+			"secret":            secret(c.JWT.Secret),
+			"introspection_key": secret(c.JWT.IntrospectionKey),
+			"minimal_claims":    c.JWT.MinimalClaims,
+			"access_token_ttl":  c.JWT.AccessTokenTTL.String(),
+			"refresh_token_ttl": c.JWT.RefreshTokenTTL.String(),
+		},
+		"security": map[string]interface{}{
+			"bcrypt_cost":             c.Security.BCryptCost,
+			"argon2_time":             c.Security.Argon2Time,
+			"argon2_memory":           c.Security.Argon2Memory,
+			"password_hash":           c.Security.PasswordHash,
+			"max_json_depth":          c.Security.MaxJSONDepth,
+			"max_json_tokens":         c.Security.MaxJSONTokens,
+			"step_up_operations":      c.Security.StepUpOperations,
+			"password_max_failures":   c.Security.PasswordMaxFailures,
+			"password_failure_window": c.Security.PasswordFailureWindow.String(),
+			"password_hash_dev":       c.Security.PasswordHashDev,
+			"dev_hash_cost": map[string]interface{}{
+				"bcrypt_cost":   c.Security.DevHashCost.BCryptCost,
+				"argon2_time":   c.Security.DevHashCost.Argon2Time,
+				"argon2_memory": c.Security.DevHashCost.Argon2Memory,
+			},
+		},
+		"workers": map[string]interface{}{
+			"usage_interval":         c.Workers.UsageInterval.String(),
+			"peer_expiry_interval":   c.Workers.PeerExpiryInterval.String(),
+			"key_sync_interval":      c.Workers.KeySyncInterval.String(),
+			"idle_check_interval":    c.Workers.IdleCheckInterval.String(),
+			"token_cleanup_interval": c.Workers.TokenCleanupInterval.String(),
+		},
+		"registration": map[string]interface{}{
+			"enabled":        !c.Registration.Disabled,
+			"require_invite": c.Registration.RequireInvite,
+			"preserve_case":  c.Registration.PreserveEmailCase,
+		},
+		"wireguard": map[string]interface{}{
+			"rotation_grace":       c.WireGuard.RotationGrace.String(),
+			"persistent_keepalive": c.WireGuard.PersistentKeepalive.String(),
+			"provision_cooldown":   c.WireGuard.ProvisionCooldown.String(),
+			"max_concurrent_ops":   c.WireGuard.MaxConcurrentOps,
+			"concurrency_wait":     c.WireGuard.ConcurrencyWait.String(),
+			"device_wait_timeout":  c.WireGuard.DeviceWaitTimeout.String(),
+			"idle_timeout":         c.WireGuard.IdleTimeout.String(),
+			"connection_limit":     c.WireGuard.ConnectionLimit,
+			"soft_max_keys":        c.WireGuard.SoftMaxKeys,
+			"provision_rate":       c.WireGuard.ProvisionRate,
+			"provision_burst":      c.WireGuard.ProvisionBurst,
+			"reject_reused_keys":   c.WireGuard.RejectReusedKeys,
+			"key_pepper":           secret(c.WireGuard.KeyPepper),
+			"log_rate_limits":      c.WireGuard.LogRateLimits,
+			"rate_limit_sample":    c.WireGuard.RateLimitLogSample,
+			"split_tunnel_gateway": c.WireGuard.SplitTunnelGateway,
+			"enforce_networks":     c.WireGuard.EnforceNetworks,
+		},
+		"default_server": map[string]interface{}{
+			"name":     c.DefaultServer.Name,
+			"location": c.DefaultServer.Location,
+			"endpoint": c.DefaultServer.Endpoint,
+			"port":     c.DefaultServer.Port,
+		},
+		"clients": map[string]interface{}{
+			"min_versions": c.Clients.MinVersions,
+		},
+		"bootstrap": map[string]interface{}{
+			"admin_email":    c.Bootstrap.AdminEmail,
+			"admin_password": secret(c.Bootstrap.AdminPassword),
+		},
+		"notifications": map[string]interface{}{
+			"webhook_url": redactURL(c.Notifications.WebhookURL),
+		},
+	}
+}
+
+// redactDSN masks the password of a URL or keyword/value database DSN
+func redactDSN(dsn string) string {
+	if strings.Contains(dsn, "://") {
+		return redactURL(dsn)
+	}
+	return dsnPasswordPattern.ReplaceAllString(dsn, "${1}"+redactedValue)
+}
+
+// redactURL masks the password and query string of a URL, either of which may carry credentials
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedValue
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redactedValue
+	}
+
+	return u.Redacted()
 }
 
 // getEnv gets an environment variable or returns a default value
@@ -83,3 +704,34 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvAsBool gets an environment variable as boolean or returns a default value
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsList gets a comma-separated environment variable as a list, skipping empty items
+func getEnvAsList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvAsDuration gets an environment variable as duration or returns a default value
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
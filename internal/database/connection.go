@@ -24,8 +24,13 @@ func NewConnection(cfg config.DatabaseConfig, automigrate bool, logger *zap.Logg
 	}
 
 	// Security: Set connection pool limits
-	poolConfig.MaxConns = 25
-	poolConfig.MinConns = 5
+	if cfg.MaxConns > 0 {
+		poolConfig.MaxConns = cfg.MaxConns
+	}
+	poolConfig.MinConns = min(5, poolConfig.MaxConns)
+
+	// Fail fast instead of queueing indefinitely when every connection is in use
+	poolConfig.ConnConfig.Tracer = &acquireTracer{timeout: cfg.AcquireTimeout, logger: logger}
 
 	// Create connection pool with timeout context
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
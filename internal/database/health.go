@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// healthPingTimeout bounds how long a health check waits for the database to answer
+const healthPingTimeout = 5 * time.Second
+
+// ErrUnavailable is returned for work that needs the database while the health check finds it down
+var ErrUnavailable = errors.New("database unavailable")
+
+// Health tracks whether the database answered its last health check. A nil Health is always healthy,
+// for running without degraded mode.
+type Health struct {
+	down   atomic.Bool
+	logger *zap.Logger
+}
+
+// NewHealth creates a health tracker that starts out healthy
+func NewHealth(logger *zap.Logger) *Health {
+	return &Health{logger: logger}
+}
+
+// Healthy reports whether the database answered its last health check
+func (h *Health) Healthy() bool {
+	return h == nil || !h.down.Load()
+}
+
+// Check pings the database and records whether it answered, logging when that changes
+func (h *Health) Check(ctx context.Context, ping func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+
+	err := ping(ctx)
+	if wasDown := h.down.Swap(err != nil); wasDown == (err != nil) {
+		return
+	}
+	if err != nil {
+		h.logger.Error("Database unreachable, entering degraded mode", zap.Error(err))
+	} else {
+		h.logger.Info("Database reachable again, leaving degraded mode")
+	}
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// acquireTracer bounds how long a caller waits for a pool connection and records the waits.
+// pgxpool hands the context returned by TraceAcquireStart to the acquisition itself, so the
+// timeout applies to waiting for a connection only and never to the query that follows.
+type acquireTracer struct {
+	timeout time.Duration
+	logger  *zap.Logger
+
+	mu       sync.Mutex
+	timeouts int64
+	maxWait  time.Duration
+}
+
+// acquireSpan carries an acquisition's start time and timeout cancel func from start to end
+type acquireSpan struct {
+	start  time.Time
+	cancel context.CancelFunc
+}
+
+type acquireSpanKey struct{}
+
+// TraceQueryStart implements pgx.QueryTracer, which pgxpool requires of any tracer
+func (t *acquireTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+// TraceQueryEnd implements pgx.QueryTracer
+func (t *acquireTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+// TraceAcquireStart starts the acquisition timeout
+func (t *acquireTracer) TraceAcquireStart(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireStartData) context.Context {
+	span := &acquireSpan{start: time.Now()}
+	if t.timeout > 0 {
+		ctx, span.cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	return context.WithValue(ctx, acquireSpanKey{}, span)
+}
+
+// TraceAcquireEnd stops the acquisition timeout and records the wait
+func (t *acquireTracer) TraceAcquireEnd(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	span, ok := ctx.Value(acquireSpanKey{}).(*acquireSpan)
+	if !ok {
+		return
+	}
+	if span.cancel != nil {
+		span.cancel()
+	}
+	wait := time.Since(span.start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if wait > t.maxWait {
+		t.maxWait = wait
+	}
+	if errors.Is(data.Err, context.DeadlineExceeded) {
+		t.timeouts++
+		t.logger.Warn("Timed out waiting for a database connection",
+			zap.Duration("wait", wait),
+			zap.Int32("max_conns", pool.Stat().MaxConns()))
+	}
+}
+
+// PoolStats returns the pool's connection counts and acquisition waits
+func PoolStats(pool *pgxpool.Pool) models.DatabasePoolStats {
+	stat := pool.Stat()
+	stats := models.DatabasePoolStats{
+		MaxConns:          stat.MaxConns(),
+		AcquiredConns:     stat.AcquiredConns(),
+		IdleConns:         stat.IdleConns(),
+		AcquireCount:      stat.AcquireCount(),
+		EmptyAcquireCount: stat.EmptyAcquireCount(),
+	}
+	if stat.AcquireCount() > 0 {
+		stats.AvgAcquireWaitMs = stat.AcquireDuration().Milliseconds() / stat.AcquireCount()
+	}
+
+	if t, ok := pool.Config().ConnConfig.Tracer.(*acquireTracer); ok {
+		t.mu.Lock()
+		stats.AcquireTimeouts = t.timeouts
+		stats.MaxAcquireWaitMs = t.maxWait.Milliseconds()
+		t.mu.Unlock()
+	}
+
+	return stats
+}
+
+// IsAcquireTimeout reports whether err came from waiting too long for a pool connection.
+// Request handlers run without a deadline of their own, so a deadline error reaching them
+// can only come from the acquisition timeout.
+func IsAcquireTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,194 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Component is a unit of the application with optional start and stop hooks
+type Component struct {
+	Name      string
+	DependsOn []string // names of components that must start before and stop after this one
+	Start     func(ctx context.Context) error
+	Stop      func(ctx context.Context) error
+}
+
+// Registry starts components in dependency order and stops them in reverse
+type Registry struct {
+	logger     *zap.Logger
+	components map[string]Component
+	names      []string // registration order, used to keep ordering deterministic
+	started    []string
+}
+
+// NewRegistry creates an empty lifecycle registry
+func NewRegistry(logger *zap.Logger) *Registry {
+	return &Registry{
+		logger:     logger,
+		components: make(map[string]Component),
+	}
+}
+
+// Register adds a component to the registry
+func (r *Registry) Register(component Component) error {
+	if component.Name == "" {
+		return fmt.Errorf("component name is required")
+	}
+
+	if _, exists := r.components[component.Name]; exists {
+		return fmt.Errorf("component %q already registered", component.Name)
+	}
+
+	r.components[component.Name] = component
+	r.names = append(r.names, component.Name)
+	return nil
+}
+
+// Start starts all components so that every component starts after its dependencies.
+// If a component fails to start, the components already started are stopped.
+func (r *Registry) Start(ctx context.Context) error {
+	order, err := r.startOrder()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		component := r.components[name]
+		if component.Start != nil {
+			if err := component.Start(ctx); err != nil {
+				startErr := fmt.Errorf("failed to start %s: %w", name, err)
+				if stopErr := r.Stop(ctx); stopErr != nil {
+					return errors.Join(startErr, stopErr)
+				}
+				return startErr
+			}
+		}
+
+		r.started = append(r.started, name)
+		r.logger.Info("Component started", zap.String("component", name))
+	}
+
+	return nil
+}
+
+// Stop stops all started components in reverse start order, so that every component stops
+// before its dependencies. All stop hooks run even if some fail; their errors are joined.
+func (r *Registry) Stop(ctx context.Context) error {
+	var errs []error
+
+	for i := len(r.started) - 1; i >= 0; i-- {
+		name := r.started[i]
+		component := r.components[name]
+		if component.Stop != nil {
+			if err := component.Stop(ctx); err != nil {
+				r.logger.Error("Failed to stop component", zap.String("component", name), zap.Error(err))
+				errs = append(errs, fmt.Errorf("failed to stop %s: %w", name, err))
+				continue
+			}
+		}
+
+		r.logger.Info("Component stopped", zap.String("component", name))
+	}
+
+	r.started = nil
+	return errors.Join(errs...)
+}
+
+// startOrder returns component names topologically sorted by their dependencies
+func (r *Registry) startOrder() ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int, len(r.components))
+	order := make([]string, 0, len(r.components))
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle detected at component %q", name)
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, dependency := range r.components[name].DependsOn {
+			if _, ok := r.components[dependency]; !ok {
+				return fmt.Errorf("component %q depends on unknown component %q", name, dependency)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range r.names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// Worker returns a component that calls run every interval until stopped. Stop waits for an
+// in-flight run to finish or for the stop context to expire.
+func Worker(name string, interval time.Duration, run func(ctx context.Context), dependsOn ...string) Component {
+	var (
+		cancel context.CancelFunc
+		done   chan struct{}
+	)
+
+	return Component{
+		Name:      name,
+		DependsOn: dependsOn,
+		Start: func(ctx context.Context) error {
+			if interval <= 0 {
+				return fmt.Errorf("worker %s: interval must be positive", name)
+			}
+
+			var workerCtx context.Context
+			workerCtx, cancel = context.WithCancel(context.Background())
+			done = make(chan struct{})
+
+			go func() {
+				defer close(done)
+
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+
+				for {
+					select {
+					case <-workerCtx.Done():
+						return
+					case <-ticker.C:
+						run(workerCtx)
+					}
+				}
+			}()
+
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return fmt.Errorf("worker %s did not stop: %w", name, ctx.Err())
+			}
+		},
+	}
+}
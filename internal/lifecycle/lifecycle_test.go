@@ -0,0 +1,144 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// recordingComponent returns a component that appends its name to the given logs on start and stop
+func recordingComponent(name string, started, stopped *[]string, dependsOn ...string) Component {
+	return Component{
+		Name:      name,
+		DependsOn: dependsOn,
+		Start: func(ctx context.Context) error {
+			*started = append(*started, name)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			*stopped = append(*stopped, name)
+			return nil
+		},
+	}
+}
+
+func TestStopOrderRespectsDependencies(t *testing.T) {
+	var started, stopped []string
+	registry := NewRegistry(zap.NewNop())
+
+	// Register out of dependency order on purpose
+	components := []Component{
+		recordingComponent("api", &started, &stopped, "database", "wireguard"),
+		recordingComponent("worker", &started, &stopped, "database"),
+		recordingComponent("database", &started, &stopped),
+		recordingComponent("wireguard", &started, &stopped),
+	}
+	for _, component := range components {
+		if err := registry.Register(component); err != nil {
+			t.Fatalf("Register() error = %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	if err := registry.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := registry.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	wantStarted := []string{"database", "wireguard", "api", "worker"}
+	if !reflect.DeepEqual(started, wantStarted) {
+		t.Errorf("Start order = %v, want %v", started, wantStarted)
+	}
+
+	wantStopped := []string{"worker", "api", "wireguard", "database"}
+	if !reflect.DeepEqual(stopped, wantStopped) {
+		t.Errorf("Stop order = %v, want %v", stopped, wantStopped)
+	}
+}
+
+func TestStartFailureStopsStartedComponents(t *testing.T) {
+	var started, stopped []string
+	registry := NewRegistry(zap.NewNop())
+
+	registry.Register(recordingComponent("database", &started, &stopped))
+	registry.Register(Component{
+		Name:      "api",
+		DependsOn: []string{"database"},
+		Start:     func(ctx context.Context) error { return errors.New("address in use") },
+	})
+
+	if err := registry.Start(context.Background()); err == nil {
+		t.Fatal("Start() error = nil, want failure")
+	}
+
+	if !reflect.DeepEqual(stopped, []string{"database"}) {
+		t.Errorf("Expected started dependency to be stopped, got %v", stopped)
+	}
+}
+
+func TestStartRejectsInvalidDependencies(t *testing.T) {
+	var started, stopped []string
+
+	cyclic := NewRegistry(zap.NewNop())
+	cyclic.Register(recordingComponent("a", &started, &stopped, "b"))
+	cyclic.Register(recordingComponent("b", &started, &stopped, "a"))
+	if err := cyclic.Start(context.Background()); err == nil {
+		t.Error("Expected dependency cycle to be rejected")
+	}
+
+	missing := NewRegistry(zap.NewNop())
+	missing.Register(recordingComponent("api", &started, &stopped, "database"))
+	if err := missing.Start(context.Background()); err == nil {
+		t.Error("Expected unknown dependency to be rejected")
+	}
+
+	if len(started) != 0 {
+		t.Errorf("Expected nothing to start, got %v", started)
+	}
+
+	duplicate := NewRegistry(zap.NewNop())
+	duplicate.Register(Component{Name: "api"})
+	if err := duplicate.Register(Component{Name: "api"}); err == nil {
+		t.Error("Expected duplicate registration to be rejected")
+	}
+}
+
+func TestWorker(t *testing.T) {
+	runs := make(chan struct{}, 10)
+	worker := Worker("ticker", time.Millisecond, func(ctx context.Context) {
+		select {
+		case runs <- struct{}{}:
+		default:
+		}
+	})
+
+	ctx := context.Background()
+	if err := worker.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Fatal("Worker did not run")
+	}
+
+	if err := worker.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	// Drain runs that raced with Stop, then make sure no more happen
+	for len(runs) > 0 {
+		<-runs
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(runs) != 0 {
+		t.Error("Worker kept running after Stop")
+	}
+}
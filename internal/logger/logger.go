@@ -12,6 +12,35 @@ func NewLogger() (*zap.Logger, error) {
 	// Get environment
 	env := os.Getenv("ENVIRONMENT")
 
+	logger, err := newConfig(env).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("VPN Service Logger initialized - NO USER DATA WILL BE LOGGED",
+		zap.String("environment", env),
+		zap.String("policy", "no-logs-for-user-activity"))
+
+	return logger, nil
+}
+
+// NewDebugLogger creates a logger named name that writes debug entries whatever the environment's
+// level, for opt-in diagnostics that should not need debug logging enabled everywhere. Its entries
+// are not sampled; callers log sparingly.
+func NewDebugLogger(name string) (*zap.Logger, error) {
+	config := newConfig(os.Getenv("ENVIRONMENT"))
+	config.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	config.Sampling = nil
+
+	logger, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+	return logger.Named(name), nil
+}
+
+// newConfig returns the logger configuration for an environment
+func newConfig(env string) zap.Config {
 	var config zap.Config
 
 	if env == "production" {
@@ -66,14 +95,5 @@ func NewLogger() (*zap.Logger, error) {
 		}
 	}
 
-	logger, err := config.Build()
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Info("VPN Service Logger initialized - NO USER DATA WILL BE LOGGED",
-		zap.String("environment", env),
-		zap.String("policy", "no-logs-for-user-activity"))
-
-	return logger, nil
+	return config
 }
@@ -8,15 +8,90 @@ import (
 
 // Server represents a VPN server
 type Server struct {
-	ID         uuid.UUID `json:"id" db:"id"`
-	Name       string    `json:"name" db:"name"`
-	Location   string    `json:"location" db:"location"`
-	Endpoint   string    `json:"endpoint" db:"endpoint"`
-	PublicKey  string    `json:"public_key" db:"public_key"`
-	Port       int       `json:"port" db:"port"`
-	IsActive   bool      `json:"is_active" db:"is_active"`
-	CreatedAt  time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+	ID        uuid.UUID `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	Location  string    `json:"location" db:"location"`
+	Endpoint  string    `json:"endpoint" db:"endpoint"`
+	PublicKey string    `json:"public_key" db:"public_key"`
+	Port      int       `json:"port" db:"port"`
+	DNSSearch string    `json:"dns_search,omitempty" db:"dns_search"` // search domains for client configs
+	Subnet    string    `json:"subnet,omitempty" db:"subnet"`         // IPv4 client address pool
+	SubnetV6  string    `json:"subnet_v6,omitempty" db:"subnet_v6"`   // IPv6 client address pool
+	IsActive  bool      `json:"is_active" db:"is_active"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	// Endpoints are alternative addresses for clients in specific locations; Endpoint serves the rest
+	Endpoints []ServerEndpoint `json:"endpoints,omitempty"`
+	// LastSeenAt is when the server's device last answered the usage collector; nil if it never has
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty" db:"last_seen_at"`
+	// Obfuscation is the AmneziaWG profile for clients that request an obfuscated config; nil if the
+	// server only speaks standard WireGuard
+	Obfuscation *ObfuscationProfile `json:"obfuscation,omitempty" db:"obfuscation"`
+	// DoHTemplate is the DNS-over-HTTPS URL suggested to clients that ask for a DoH hint; empty if none
+	DoHTemplate string `json:"doh_template,omitempty" db:"doh_template"`
+	// Maintenance is the server's active or next maintenance window; nil if none is scheduled
+	Maintenance *MaintenanceWindow `json:"maintenance,omitempty"`
+}
+
+// MaintenanceWindow is a scheduled period during which a server provisions no new keys; existing
+// peers are not touched, but may be interrupted by the maintenance itself
+type MaintenanceWindow struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	ServerID  uuid.UUID `json:"server_id" db:"server_id"`
+	StartsAt  time.Time `json:"starts_at" db:"starts_at"`
+	EndsAt    time.Time `json:"ends_at" db:"ends_at"`
+	Message   string    `json:"message,omitempty" db:"message"` // shown to users warned about the window
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Active reports whether the window is in progress at t
+func (w *MaintenanceWindow) Active(t time.Time) bool {
+	return !t.Before(w.StartsAt) && t.Before(w.EndsAt)
+}
+
+// MaintenanceWindowRequest schedules a maintenance window on a server
+type MaintenanceWindowRequest struct {
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// ObfuscationProfile holds AmneziaWG parameters that disguise WireGuard traffic. S1, S2 and H1-H4
+// must match the server's interface; the junk packet settings only affect the client.
+type ObfuscationProfile struct {
+	Jc   int    `json:"jc"`   // junk packets sent before each handshake
+	Jmin int    `json:"jmin"` // minimum junk packet size in bytes
+	Jmax int    `json:"jmax"` // maximum junk packet size in bytes
+	S1   int    `json:"s1"`   // junk bytes prepended to handshake initiations
+	S2   int    `json:"s2"`   // junk bytes prepended to handshake responses
+	H1   uint32 `json:"h1"`   // message type replacing handshake initiation
+	H2   uint32 `json:"h2"`   // message type replacing handshake response
+	H3   uint32 `json:"h3"`   // message type replacing cookie reply
+	H4   uint32 `json:"h4"`   // message type replacing transport data
+}
+
+// ImportServerKeyRequest adopts an existing private key for a server
+type ImportServerKeyRequest struct {
+	PrivateKey string `json:"private_key"`
+}
+
+// ObfuscationRequest sets a server's obfuscation profile; a null profile removes it
+type ObfuscationRequest struct {
+	Profile *ObfuscationProfile `json:"profile"`
+}
+
+// DoHTemplateRequest sets a server's DNS-over-HTTPS template; an empty template removes it
+type DoHTemplateRequest struct {
+	Template string `json:"doh_template"`
+}
+
+// ServerEndpoint is an alternative server address handed to clients matching every selector that is
+// set. It shares the server's port and key.
+type ServerEndpoint struct {
+	Endpoint string `json:"endpoint" db:"endpoint"`
+	Country  string `json:"country,omitempty" db:"country"`
+	Region   string `json:"region,omitempty" db:"region"`
+	ASN      uint32 `json:"asn,omitempty" db:"asn"`
 }
 
 // ServerResponse represents server response for clients (without private key)
@@ -27,6 +102,14 @@ type ServerResponse struct {
 	Endpoint  string    `json:"endpoint"`
 	PublicKey string    `json:"public_key"`
 	Port      int       `json:"port"`
+	// Maintenance is the server's active or next maintenance window, for clients to warn users
+	Maintenance *MaintenanceWindow `json:"maintenance,omitempty"`
+}
+
+// ServerListOptions controls sorting and limiting of the server locations list
+type ServerListOptions struct {
+	Limit  int    // zero returns every server
+	SortBy string // "location" (default), "name" or "load"
 }
 
 // UserKey represents a user's WireGuard key pair association with a server
@@ -36,33 +119,483 @@ type UserKey struct {
 	ServerID   uuid.UUID `json:"server_id" db:"server_id"`
 	PublicKey  string    `json:"public_key" db:"public_key"`
 	AllowedIPs string    `json:"allowed_ips" db:"allowed_ips"`
-	CreatedAt  time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
-	IsActive   bool      `json:"is_active" db:"is_active"`
+	// PersistentKeepalive overrides the server default keepalive in seconds when set
+	PersistentKeepalive *int      `json:"persistent_keepalive,omitempty" db:"persistent_keepalive"`
+	CreatedAt           time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at" db:"updated_at"`
+	IsActive            bool      `json:"is_active" db:"is_active"`
+	// IdleRemovedAt is set while the key's peer is off the device for being idle; the key stays active
+	// and its next config request re-adds the peer
+	IdleRemovedAt *time.Time `json:"idle_removed_at,omitempty" db:"idle_removed_at"`
+}
+
+// PeerResponse represents a WireGuard peer as seen on the device (never includes the preshared key)
+type PeerResponse struct {
+	PublicKey           string    `json:"public_key"`
+	Endpoint            string    `json:"endpoint,omitempty"`
+	AllowedIPs          []string  `json:"allowed_ips"`
+	LastHandshake       time.Time `json:"last_handshake"`
+	ReceiveBytes        int64     `json:"receive_bytes"`
+	TransmitBytes       int64     `json:"transmit_bytes"`
+	PersistentKeepalive int       `json:"persistent_keepalive"` // seconds
+	PresharedKeySet     bool      `json:"preshared_key_set"`
+}
+
+// Pagination represents paging metadata for list responses
+type Pagination struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	Total  int `json:"total"`
+}
+
+// PeerListResponse represents a page of device peers
+type PeerListResponse struct {
+	Peers      []*PeerResponse `json:"peers"`
+	Pagination Pagination      `json:"pagination"`
+}
+
+// ProvisioningStats represents provisioning counters and latencies for a server
+type ProvisioningStats struct {
+	ServerID      uuid.UUID  `json:"server_id"`
+	Successes     int64      `json:"successes"`
+	Failures      int64      `json:"failures"`
+	AvgLatencyMs  int64      `json:"avg_latency_ms"`
+	MaxLatencyMs  int64      `json:"max_latency_ms"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+// ServerTraffic is the traffic a server has carried for all its peers since usage was first collected
+type ServerTraffic struct {
+	ServerID      uuid.UUID `json:"server_id"`
+	ReceiveBytes  int64     `json:"rx_bytes"`
+	TransmitBytes int64     `json:"tx_bytes"`
+}
+
+// MetricFamily is a named metric with its samples, as exported by both metrics endpoints
+type MetricFamily struct {
+	Name    string          `json:"name"`
+	Type    string          `json:"type"` // "counter" or "gauge"
+	Help    string          `json:"help"`
+	Samples []*MetricSample `json:"samples"`
+}
+
+// MetricSample is one labelled value of a metric family
+type MetricSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// VPNInfo lists the identities a client can pin for the control and data planes
+type VPNInfo struct {
+	TLS     *CertificateFingerprint `json:"tls,omitempty"` // only when the API terminates TLS itself
+	Servers []ServerKeyFingerprint  `json:"servers"`
+}
+
+// CertificateFingerprint identifies a TLS certificate
+type CertificateFingerprint struct {
+	SHA256     string    `json:"sha256"`      // hex SHA-256 of the DER certificate
+	SPKISHA256 string    `json:"spki_sha256"` // base64 SHA-256 of the subject public key info
+	NotAfter   time.Time `json:"not_after"`
+}
+
+// ServerKeyFingerprint identifies a server's WireGuard public key
+type ServerKeyFingerprint struct {
+	ServerID    uuid.UUID `json:"server_id"`
+	Name        string    `json:"name"`
+	PublicKey   string    `json:"public_key"`
+	Fingerprint string    `json:"fingerprint"` // hex SHA-256 of the raw key
+}
+
+// GeoLocation is a coarse location resolved from an IP address
+type GeoLocation struct {
+	Country string `json:"country"`
+	Region  string `json:"region,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"` // autonomous system announcing the address, when known
+}
+
+// ConnectionInfo reports the address a client's requests arrive from
+type ConnectionInfo struct {
+	IP       string       `json:"ip"`
+	Location *GeoLocation `json:"location,omitempty"` // only when a geo database is configured and covers the address
+}
+
+// DatabasePoolStats represents database connection pool usage and acquisition waits
+type DatabasePoolStats struct {
+	MaxConns          int32 `json:"max_conns"`
+	AcquiredConns     int32 `json:"acquired_conns"`
+	IdleConns         int32 `json:"idle_conns"`
+	AcquireCount      int64 `json:"acquire_count"`
+	EmptyAcquireCount int64 `json:"empty_acquire_count"` // acquisitions that had to wait for a connection
+	AcquireTimeouts   int64 `json:"acquire_timeouts"`
+	AvgAcquireWaitMs  int64 `json:"avg_acquire_wait_ms"`
+	MaxAcquireWaitMs  int64 `json:"max_acquire_wait_ms"`
+}
+
+// ServerUsage represents a user's data usage on a single server
+type ServerUsage struct {
+	ServerID      uuid.UUID `json:"server_id"`
+	ServerName    string    `json:"server_name"`
+	ReceiveBytes  int64     `json:"receive_bytes"`
+	TransmitBytes int64     `json:"transmit_bytes"`
+}
+
+// UsageResponse represents a user's aggregate data usage across servers
+type UsageResponse struct {
+	Servers            []*ServerUsage `json:"servers"`
+	TotalReceiveBytes  int64          `json:"total_receive_bytes"`
+	TotalTransmitBytes int64          `json:"total_transmit_bytes"`
+}
+
+// DashboardServer is one server on a user's dashboard: the key's allocation, live status and usage
+type DashboardServer struct {
+	ServerID      uuid.UUID  `json:"server_id"`
+	ServerName    string     `json:"server_name"`
+	PublicKey     string     `json:"public_key"`
+	AllowedIPs    string     `json:"allowed_ips"`
+	Connected     bool       `json:"connected"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"` // omitted before the first handshake
+	ReceiveBytes  int64      `json:"receive_bytes"`
+	TransmitBytes int64      `json:"transmit_bytes"`
+}
+
+// KeyHistoryEntry describes one addition, rotation or revocation of a user's key; the public key is masked
+type KeyHistoryEntry struct {
+	ID         uuid.UUID `json:"id"`
+	KeyID      uuid.UUID `json:"key_id"` // the user's key on the server, shared by all its events
+	ServerID   uuid.UUID `json:"server_id"`
+	ServerName string    `json:"server_name"`
+	Event      string    `json:"event"` // added, rotated or revoked
+	PublicKey  string    `json:"public_key"`
+	AllowedIPs string    `json:"allowed_ips"`
+	CreatedAt  time.Time `json:"created_at"` // when the event happened
+}
+
+// KeyCleanupRequest represents an admin request to deactivate keys unused for longer than MaxAge
+type KeyCleanupRequest struct {
+	MaxAge   string `json:"max_age"`             // Go duration, e.g. "720h"
+	ServerID string `json:"server_id,omitempty"` // limits the cleanup to one server
+}
+
+// KeyCleanupResponse reports the result of a stale key cleanup
+type KeyCleanupResponse struct {
+	Deactivated  int `json:"deactivated"`
+	PeersRemoved int `json:"peers_removed"`
+}
+
+// ReconcileResponse summarizes a full reconciliation of the device with the database
+type ReconcileResponse struct {
+	Applied int `json:"applied"` // active keys programmed, including ones already present
+	Added   int `json:"added"`   // peers that were missing from the device
+	Removed int `json:"removed"` // orphan peers pruned from the device
+}
+
+// PeerStatusRequest asks for the device status of several peers at once
+type PeerStatusRequest struct {
+	PublicKeys []string `json:"public_keys"`
+}
+
+// PeerStatus is one peer's status on the device. Error is set, and the rest left empty, when the
+// requested key is malformed.
+type PeerStatus struct {
+	PublicKey     string     `json:"public_key"`
+	Programmed    bool       `json:"programmed"` // the peer is configured on the device
+	Connected     bool       `json:"connected"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"` // omitted before the first handshake
+	Error         string     `json:"error,omitempty"`
+}
+
+// PeerStatusResponse lists peer statuses in the order they were requested
+type PeerStatusResponse struct {
+	Peers []*PeerStatus `json:"peers"`
+}
+
+// PoolUtilization describes how much of a server's client address pool is allocated
+type PoolUtilization struct {
+	Subnet      string  `json:"subnet"`
+	Size        uint64  `json:"size"` // client addresses, excluding the network, server and broadcast ones
+	Allocated   int     `json:"allocated"`
+	Utilization float64 `json:"utilization"` // Allocated as a fraction of Size
+}
+
+// IPReservationRequest asks for a block of client addresses to be reserved on a server
+type IPReservationRequest struct {
+	Count int `json:"count"`
+}
+
+// IPReservationResponse lists newly reserved addresses as host CIDRs
+type IPReservationResponse struct {
+	Addresses []string `json:"addresses"`
+}
+
+// IPReleaseRequest lists reserved addresses to free
+type IPReleaseRequest struct {
+	Addresses []string `json:"addresses"`
+}
+
+// IPReleaseResponse lists the addresses that were reserved and are now free
+type IPReleaseResponse struct {
+	Released []string `json:"released"`
+}
+
+// IPAllocation is one address held on a server, by an active key or a reservation. Keys' owners
+// are identified only by masked email and public key.
+type IPAllocation struct {
+	Address   string `json:"address"`
+	User      string `json:"user,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	Status    string `json:"status"` // active, idle_removed or reserved
+}
+
+// IPAllocationListResponse is a page of a server's allocated addresses, sorted by address
+type IPAllocationListResponse struct {
+	Allocations []*IPAllocation `json:"allocations"`
+	Pagination  Pagination      `json:"pagination"`
+}
+
+// ServerInfo gathers what an operator needs to check a server's health in one response
+type ServerInfo struct {
+	ID                   uuid.UUID        `json:"id"`
+	Name                 string           `json:"name"`
+	LastSeen             *time.Time       `json:"last_seen,omitempty"` // omitted until the device has answered
+	UpdatedAt            time.Time        `json:"updated_at"`
+	PublicKeyFingerprint string           `json:"public_key_fingerprint,omitempty"` // omitted until a valid key is synced
+	ActiveKeys           int              `json:"active_keys"`
+	Pool                 *PoolUtilization `json:"pool"`
+	// Maintenance is the server's active or next maintenance window; omitted if none is scheduled
+	Maintenance *MaintenanceWindow `json:"maintenance,omitempty"`
+}
+
+// DeviceInfo describes a WireGuard device as the kernel reports it; the private key is never included
+type DeviceInfo struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	PublicKey    string `json:"public_key"`
+	ListenPort   int    `json:"listen_port"`
+	FirewallMark int    `json:"firewall_mark"`
+	PeerCount    int    `json:"peer_count"`
+}
+
+// SelfTestRequest optionally names an upstream host:port for the self-test to probe
+type SelfTestRequest struct {
+	Probe string `json:"probe,omitempty"`
+}
+
+// SelfTestCheck is the outcome of one self-test check
+type SelfTestCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// SelfTestReport lists the self-test checks run against a server's WireGuard device
+type SelfTestReport struct {
+	ServerID uuid.UUID       `json:"server_id"`
+	Healthy  bool            `json:"healthy"` // every check passed
+	Checks   []SelfTestCheck `json:"checks"`
+}
+
+// DashboardResponse lists every server a user is provisioned on
+type DashboardResponse struct {
+	Servers            []*DashboardServer `json:"servers"`
+	Devices            int                `json:"devices"`           // active keys, connected or not
+	ConnectedDevices   int                `json:"connected_devices"` // keys with a recent handshake
+	TotalReceiveBytes  int64              `json:"total_receive_bytes"`
+	TotalTransmitBytes int64              `json:"total_transmit_bytes"`
 }
 
 // WireGuardConfig represents a complete WireGuard configuration
 type WireGuardConfig struct {
 	Interface WireGuardInterface `json:"interface"`
 	Peer      WireGuardPeer      `json:"peer"`
+	// ClientWarning tells an out-of-date or unsupported client to update; it is not part of the config
+	ClientWarning string `json:"client_warning,omitempty"`
+	// Steering names the server the config is for when it is not the one requested; it is not part
+	// of the config
+	Steering *ServerSteering `json:"steering,omitempty"`
+}
+
+// ServerSteering reports that a config was provisioned on another server because the requested one
+// had reached its soft maximum of active keys
+type ServerSteering struct {
+	RequestedServerID uuid.UUID `json:"requested_server_id"`
+	ServerID          uuid.UUID `json:"server_id"`
+	Name              string    `json:"name"`
+	Location          string    `json:"location"`
 }
 
 // WireGuardInterface represents the [Interface] section of WireGuard config
 type WireGuardInterface struct {
-	PrivateKey string `json:"private_key"`
-	Address    string `json:"address"`
-	DNS        string `json:"dns"`
+	PrivateKey string   `json:"private_key"`
+	Address    string   `json:"address"`
+	DNS        string   `json:"dns"`
+	DNSSearch  []string `json:"dns_search,omitempty"` // written after the resolvers on the DNS line
+	Table      string   `json:"table,omitempty"`
+	// Obfuscation adds AmneziaWG parameters to the section; standard WireGuard clients reject them
+	Obfuscation *ObfuscationProfile `json:"obfuscation,omitempty"`
+	// DoHTemplate is written as a "# DoH:" comment after the DNS line, which standard parsers skip
+	DoHTemplate string `json:"doh_template,omitempty"`
 }
 
 // WireGuardPeer represents the [Peer] section of WireGuard config
 type WireGuardPeer struct {
-	PublicKey  string `json:"public_key"`
-	Endpoint   string `json:"endpoint"`
-	AllowedIPs string `json:"allowed_ips"`
+	PublicKey           string `json:"public_key"`
+	Endpoint            string `json:"endpoint"`
+	AllowedIPs          string `json:"allowed_ips"`
+	PersistentKeepalive int    `json:"persistent_keepalive,omitempty"` // seconds; omitted when disabled
 }
 
 // ConfigRequest represents a client config request
 type ConfigRequest struct {
 	PublicKey string `json:"public_key" validate:"required"`
 	ServerID  string `json:"server_id" validate:"required,uuid"`
+	// PersistentKeepalive overrides the server default keepalive in seconds (0-120, 0 disables)
+	PersistentKeepalive *int `json:"persistent_keepalive,omitempty"`
+	ConfigOptionsRequest
+}
+
+// ConfigOptionsRequest holds the rendering options a request for a config of an existing or new key
+// may ask for
+type ConfigOptionsRequest struct {
+	LeakProtection *LeakProtection `json:"leak_protection,omitempty"`
+	// DNSSearch overrides the server's DNS search domains (comma-separated)
+	DNSSearch string `json:"dns_search,omitempty"`
+	// Obfuscated requests an AmneziaWG config using the server's obfuscation profile
+	Obfuscated bool `json:"obfuscated,omitempty"`
+	// DoHHint asks for the server's DNS-over-HTTPS template as a config comment, if it has one
+	DoHHint bool `json:"doh_hint,omitempty"`
+}
+
+// DeleteConfigRequest names the server whose config the user is removing, with the password for step-up
+type DeleteConfigRequest struct {
+	ServerID        string `json:"server_id"`
+	CurrentPassword string `json:"current_password"`
+}
+
+// StaticProvisionRequest represents an admin request to provision a user's key at a fixed address
+type StaticProvisionRequest struct {
+	UserID     string `json:"user_id" validate:"required,uuid"`
+	ServerID   string `json:"server_id" validate:"required,uuid"`
+	PublicKey  string `json:"public_key" validate:"required"`
+	AllowedIPs string `json:"allowed_ips" validate:"required"` // a single host address within the server subnet
+	// PersistentKeepalive overrides the server default keepalive in seconds (0-120, 0 disables)
+	PersistentKeepalive *int `json:"persistent_keepalive,omitempty"`
+}
+
+// LeakProtection holds optional DNS leak mitigation directives for a client config
+type LeakProtection struct {
+	Table    string `json:"table,omitempty"` // wg-quick Table: "auto", "off" or a routing table number
+	RouteDNS bool   `json:"route_dns"`       // route the configured DNS servers through the tunnel
+}
+
+// KeyStatusResponse reports whether a public key is active for the requesting user
+type KeyStatusResponse struct {
+	PublicKey  string     `json:"public_key"`
+	Registered bool       `json:"registered"`
+	ServerID   *uuid.UUID `json:"server_id,omitempty"`
+	// IdleRemoved reports that the key is still registered but its peer was taken off the device for
+	// being idle; requesting the config again restores it. Revoked keys are not registered.
+	IdleRemoved bool `json:"idle_removed,omitempty"`
+}
+
+// DiagnosticsRequest is what a client reports about its connection to a server. It carries nothing
+// sensitive: no keys and no addresses.
+type DiagnosticsRequest struct {
+	ServerID      string     `json:"server_id"`
+	Platform      string     `json:"platform,omitempty"`
+	ClientVersion string     `json:"client_version,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"` // as the client sees it; omitted before the first
+}
+
+// Diagnosis is the most likely problem with a client's connection and what to do about it
+type Diagnosis struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// DiagnosticsResponse is the server's diagnosis of a client's connection along with its own view of the peer
+type DiagnosticsResponse struct {
+	ServerID            uuid.UUID  `json:"server_id"`
+	Diagnosis           Diagnosis  `json:"diagnosis"`
+	PeerProgrammed      bool       `json:"peer_programmed"`
+	ServerLastHandshake *time.Time `json:"server_last_handshake,omitempty"`
+	ClientWarning       string     `json:"client_warning,omitempty"`
+}
+
+// PlatformSupport is a supported client platform and the oldest client version it accepts
+type PlatformSupport struct {
+	Platform   string `json:"platform"`
+	MinVersion string `json:"min_version"`
+}
+
+// CompatibilityResponse lists the client platforms the API supports
+type CompatibilityResponse struct {
+	Platforms []PlatformSupport `json:"platforms"`
+}
+
+// ConfigBundle carries everything a client needs to import a config in one response
+type ConfigBundle struct {
+	ServerID  uuid.UUID `json:"server_id"`
+	Config    string    `json:"config"`
+	QRCodePNG string    `json:"qr_code_png"` // base64-encoded PNG of the config
+	Deeplink  string    `json:"deeplink"`
+	ExpiresAt time.Time `json:"expires_at"` // deeplink expiry
+	// ClientWarning tells an out-of-date or unsupported client to update
+	ClientWarning string `json:"client_warning,omitempty"`
+}
+
+// ConfigShareRequest represents a request for a shareable link to a server's config
+type ConfigShareRequest struct {
+	ServerID uuid.UUID `json:"server_id"`
+}
+
+// ConfigShare is a single-use link to a user's config that can be fetched without signing in
+type ConfigShare struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url,omitempty"` // set when PUBLIC_BASE_URL is configured
+	ServerID  uuid.UUID `json:"server_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SharedConfigResponse carries the config fetched through a share link. The link never carries a
+// private key, so the config holds a placeholder for the private key of the creator's key on the
+// server; the redeeming device's own key is not provisioned and would not be accepted.
+type SharedConfigResponse struct {
+	ServerID uuid.UUID `json:"server_id"`
+	Config   string    `json:"config"`
+}
+
+// ConfigFileRequest asks for the config of the user's key on a server as a .conf file or QR code. The
+// private key is optional; without it the config holds a placeholder for the device to fill in. The
+// rendering options are those of a ConfigRequest.
+type ConfigFileRequest struct {
+	ServerID   string `json:"server_id"`
+	PrivateKey string `json:"private_key,omitempty"`
+	ConfigOptionsRequest
+}
+
+// RegenerateConfigRequest represents a request to rotate to a server-generated keypair
+type RegenerateConfigRequest struct {
+	ServerID string `json:"server_id" validate:"required,uuid"`
+}
+
+// SyncAllConfigsRequest represents a request to move every one of a user's servers to a new public key
+type SyncAllConfigsRequest struct {
+	PublicKey string `json:"public_key" validate:"required"`
+}
+
+// ServerSyncResult reports the outcome of rotating the key on one server; Config is set on success
+// and Error on failure
+type ServerSyncResult struct {
+	ServerID uuid.UUID        `json:"server_id"`
+	Success  bool             `json:"success"`
+	Config   *WireGuardConfig `json:"config,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// SyncAllConfigsResponse lists the per-server results of a sync-all request
+type SyncAllConfigsResponse struct {
+	Results       []*ServerSyncResult `json:"results"`
+	Succeeded     int                 `json:"succeeded"`
+	Failed        int                 `json:"failed"`
+	ClientWarning string              `json:"client_warning,omitempty"` // asks an out-of-date client to update
 }
@@ -6,20 +6,61 @@ import (
 	"github.com/google/uuid"
 )
 
+// User roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Permissions granted by roles
+const (
+	PermissionConfigManage = "config:manage" // provision, rotate and revoke own devices
+	PermissionServersRead  = "servers:read"
+	PermissionUsageRead    = "usage:read"
+	PermissionAdmin        = "admin" // access to /api/admin endpoints
+)
+
+// rolePermissions is the single mapping from roles to permissions; middleware checks and the
+// permissions endpoint both derive from it
+var rolePermissions = map[string][]string{
+	RoleUser:  {PermissionConfigManage, PermissionServersRead, PermissionUsageRead},
+	RoleAdmin: {PermissionConfigManage, PermissionServersRead, PermissionUsageRead, PermissionAdmin},
+}
+
+// PermissionsForRole returns the permissions granted to a role; unknown roles have none
+func PermissionsForRole(role string) []string {
+	return append([]string{}, rolePermissions[role]...)
+}
+
+// RoleHasPermission reports whether a role grants a permission
+func RoleHasPermission(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
 // User represents a user in the system
 type User struct {
-	ID           uuid.UUID `json:"id" db:"id"`
-	Email        string    `json:"email" db:"email"`
-	PasswordHash string    `json:"-" db:"password_hash"` // Never expose password hash in JSON
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
-	IsActive     bool      `json:"is_active" db:"is_active"`
+	ID                 uuid.UUID `json:"id" db:"id"`
+	Email              string    `json:"email" db:"email"`
+	DisplayName        string    `json:"display_name,omitempty" db:"display_name"`
+	PasswordHash       string    `json:"-" db:"password_hash"` // Never expose password hash in JSON
+	Role               string    `json:"role" db:"role"`
+	MustChangePassword bool      `json:"must_change_password" db:"must_change_password"` // set after an admin reset to a temporary password
+	CreatedAt          time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at" db:"updated_at"`
+	IsActive           bool      `json:"is_active" db:"is_active"`
 }
 
 // UserRegistration represents user registration request
 type UserRegistration struct {
-	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8"`
+	Email       string `json:"email" validate:"required,email"`
+	Password    string `json:"password" validate:"required,min=8"`
+	InviteCode  string `json:"invite_code,omitempty"`
+	DisplayName string `json:"display_name,omitempty"` // optional friendly name shown in place of the email
 }
 
 // UserLogin represents user login request
@@ -28,10 +69,217 @@ type UserLogin struct {
 	Password string `json:"password" validate:"required"`
 }
 
+// IntrospectionRequest asks whether a token is currently valid
+type IntrospectionRequest struct {
+	Token string `json:"token"`
+}
+
+// IntrospectionResponse describes a token in the style of RFC 7662; only Active is set for a token
+// that is invalid, expired or revoked
+type IntrospectionResponse struct {
+	Active bool       `json:"active"`
+	UserID *uuid.UUID `json:"user_id,omitempty"`
+	Email  string     `json:"email,omitempty"`
+	Exp    int64      `json:"exp,omitempty"`
+	Act    *Actor     `json:"act,omitempty"` // set for impersonation tokens
+}
+
+// Actor identifies who is acting on behalf of a token's subject, as in the RFC 8693 act claim
+type Actor struct {
+	Subject uuid.UUID `json:"sub"`
+}
+
+// ImpersonationResponse carries a token for viewing the API as another user
+type ImpersonationResponse struct {
+	Token     string    `json:"token"`
+	UserID    uuid.UUID `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 // UserResponse represents user response (without sensitive data)
 type UserResponse struct {
-	ID        uuid.UUID `json:"id"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
-	IsActive  bool      `json:"is_active"`
+	ID                 uuid.UUID `json:"id"`
+	Email              string    `json:"email"`
+	DisplayName        string    `json:"display_name,omitempty"`
+	Role               string    `json:"role"`
+	MustChangePassword bool      `json:"must_change_password"`
+	CreatedAt          time.Time `json:"created_at"`
+	IsActive           bool      `json:"is_active"`
+}
+
+// RevokeSessionsRequest asks to sign out every session; KeepCurrent issues the caller a replacement
+// token so the session making the request stays signed in
+type RevokeSessionsRequest struct {
+	KeepCurrent     bool   `json:"keep_current,omitempty"`
+	CurrentPassword string `json:"current_password,omitempty"` // required when revoking sessions needs step-up
+}
+
+// StepUpRequest carries the caller's current password for an operation that needs step-up
+// re-authentication but takes no other body
+type StepUpRequest struct {
+	CurrentPassword string `json:"current_password"`
+}
+
+// RevokeSessionsResponse reports the revocation cutoff and, when the current session was kept, its new
+// token and refresh token
+type RevokeSessionsResponse struct {
+	RevokedBefore time.Time `json:"revoked_before"`
+	Token         string    `json:"token,omitempty"`
+	*RefreshToken
+}
+
+// RefreshToken is a refresh token as issued, shown only once; the database keeps its hash
+type RefreshToken struct {
+	Token     string    `json:"refresh_token"`
+	UserID    uuid.UUID `json:"-"`
+	ExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// RefreshRequest exchanges a refresh token for a new access token
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshResponse carries a new access token, valid for ExpiresIn seconds, and the refresh token
+// replacing the one presented
+type RefreshResponse struct {
+	Token            string    `json:"token"`
+	ExpiresIn        int       `json:"expires_in"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// LogoutRequest optionally carries the session's refresh token, which is revoked along with the
+// access token so it cannot sign the session back in
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// LogoutResponse reports the revoked token's ID and when it would have expired, and whether a refresh
+// token was revoked with it
+type LogoutResponse struct {
+	TokenID             string    `json:"token_id"`
+	ExpiresAt           time.Time `json:"expires_at"`
+	RefreshTokenRevoked bool      `json:"refresh_token_revoked"`
+}
+
+// PermissionsResponse reports the caller's role and the permissions it grants
+type PermissionsResponse struct {
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// TrendBucket counts registrations and successful logins in one time bucket starting at Start
+type TrendBucket struct {
+	Start         time.Time `json:"start"`
+	Registrations int64     `json:"registrations"`
+	Logins        int64     `json:"logins"`
+}
+
+// TrendsResponse is a series of registration and login counts over [From, To)
+type TrendsResponse struct {
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Bucket string         `json:"bucket"`
+	Series []*TrendBucket `json:"series"`
+}
+
+// ConnectionLimitRequest represents an admin request to set a user's concurrent connection limit;
+// a null limit restores the server-wide one and zero allows any number
+type ConnectionLimitRequest struct {
+	MaxConcurrentConnections *int `json:"max_concurrent_connections"`
+}
+
+// AllowedNetworksRequest represents an admin request to set a user's allowed networks policy
+type AllowedNetworksRequest struct {
+	AllowedNetworks []string `json:"allowed_networks"`
+}
+
+// Invite represents an invite code for invite-only registration
+type Invite struct {
+	ID        uuid.UUID  `json:"id" db:"id"`
+	Code      string     `json:"code" db:"code"`
+	CreatedBy *uuid.UUID `json:"created_by,omitempty" db:"created_by"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	UserID    *uuid.UUID `json:"user_id,omitempty" db:"user_id"` // set for an invite to a pre-created account
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+// InviteRequest represents an admin request to create an invite
+type InviteRequest struct {
+	ExpiresInHours int `json:"expires_in_hours,omitempty"`
+}
+
+// BatchUserEntry is one account in an admin batch; the role defaults to user
+type BatchUserEntry struct {
+	Email      string `json:"email"`
+	Role       string `json:"role,omitempty"`
+	SendInvite bool   `json:"send_invite"`
+}
+
+// BatchUserRequest represents an admin request to create several accounts at once
+type BatchUserRequest struct {
+	Users []BatchUserEntry `json:"users"`
+}
+
+// BatchUserResult is the outcome for one batch entry, in request order. Error is set, and the rest
+// left empty, when the entry was not created.
+type BatchUserResult struct {
+	Email           string     `json:"email"`
+	UserID          *uuid.UUID `json:"user_id,omitempty"`
+	Role            string     `json:"role,omitempty"`
+	InviteCode      string     `json:"invite_code,omitempty"`
+	InviteExpiresAt *time.Time `json:"invite_expires_at,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// BatchUserResponse reports each batch entry and how many accounts were created
+type BatchUserResponse struct {
+	Created int                `json:"created"`
+	Results []*BatchUserResult `json:"results"`
+}
+
+// AcceptInviteRequest sets the password of a pre-created account with its invite code
+type AcceptInviteRequest struct {
+	InviteCode string `json:"invite_code"`
+	Password   string `json:"password"`
+}
+
+// SettingRequest represents an admin request to change a runtime setting
+type SettingRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ChangePasswordRequest replaces the caller's password; it is the only request a user whose password
+// was reset to a temporary one may make
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ResetPasswordRequest represents an admin password reset; an empty password generates a temporary one
+type ResetPasswordRequest struct {
+	Password string `json:"password,omitempty"`
+}
+
+// ResetPasswordResponse is returned by an admin password reset
+type ResetPasswordResponse struct {
+	UserID             uuid.UUID `json:"user_id"`
+	TemporaryPassword  string    `json:"temporary_password,omitempty"` // only set when generated, shown once
+	MustChangePassword bool      `json:"must_change_password"`
+}
+
+// ScheduledRevocation deactivates all of a user's keys and removes their peers once RevokeAt passes
+type ScheduledRevocation struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	UserID      uuid.UUID  `json:"user_id" db:"user_id"`
+	RevokeAt    time.Time  `json:"revoke_at" db:"revoke_at"`
+	ScheduledBy *uuid.UUID `json:"scheduled_by,omitempty" db:"scheduled_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// ScheduleRevocationRequest represents an admin request to revoke a user's access at a future time
+type ScheduleRevocationRequest struct {
+	RevokeAt time.Time `json:"revoke_at"`
 }
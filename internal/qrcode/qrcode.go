@@ -0,0 +1,556 @@
+// Package qrcode encodes data as QR Code symbols (ISO/IEC 18004) and renders them as PNG images.
+//
+// Only what the service needs is supported: byte mode at error correction level M, versions 1-40.
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+const (
+	minVersion = 1
+	maxVersion = 40
+
+	// quietZone is the number of light modules required around the symbol
+	quietZone = 4
+)
+
+// Error correction codewords per block and number of blocks for level M, indexed by version
+var (
+	eccCodewordsPerBlock = [maxVersion + 1]int{
+		-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+		26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	}
+	eccBlocks = [maxVersion + 1]int{
+		-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+		17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49,
+	}
+)
+
+// Code is an encoded QR Code symbol
+type Code struct {
+	Version int
+	Size    int
+
+	modules    [][]bool // true is dark, indexed [row][column]
+	isFunction [][]bool // finder, timing, alignment, format and version modules
+}
+
+// Encode encodes data in byte mode using the smallest version that fits
+func Encode(data []byte) (*Code, error) {
+	version := minVersion
+	for ; version <= maxVersion; version++ {
+		if dataBits(version, len(data)) <= numDataCodewords(version)*8 {
+			break
+		}
+	}
+	if version > maxVersion {
+		return nil, fmt.Errorf("data too long for a QR code: %d bytes", len(data))
+	}
+
+	code := newCode(version)
+	code.drawFunctionPatterns()
+	code.drawCodewords(addECCAndInterleave(version, encodeData(version, data)))
+
+	// Pick the mask with the lowest penalty; masking is an involution so each trial is undone
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		code.applyMask(mask)
+		code.drawFormatBits(mask)
+		if penalty := code.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		code.applyMask(mask)
+	}
+	code.applyMask(bestMask)
+	code.drawFormatBits(bestMask)
+
+	return code, nil
+}
+
+// Module reports whether the module at the given row and column is dark
+func (c *Code) Module(row, col int) bool {
+	return c.modules[row][col]
+}
+
+// ScaleFor returns the largest scale at which the symbol and its quiet zone fit in side pixels,
+// or 0 when they do not fit even at one pixel per module
+func (c *Code) ScaleFor(side int) int {
+	return side / c.Side(1)
+}
+
+// Side returns the side in pixels of the image PNG renders at scale, quiet zone included
+func (c *Code) Side(scale int) int {
+	return (c.Size + 2*quietZone) * scale
+}
+
+// PNG renders the symbol with a quiet zone, using scale pixels per module
+func (c *Code) PNG(scale int) ([]byte, error) {
+	if scale < 1 {
+		return nil, fmt.Errorf("invalid scale: %d", scale)
+	}
+
+	side := c.Side(scale)
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for row := 0; row < c.Size; row++ {
+		for col := 0; col < c.Size; col++ {
+			if !c.modules[row][col] {
+				continue
+			}
+			x0, y0 := (col+quietZone)*scale, (row+quietZone)*scale
+			for y := y0; y < y0+scale; y++ {
+				for x := x0; x < x0+scale; x++ {
+					img.SetColorIndex(x, y, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func newCode(version int) *Code {
+	size := version*4 + 17
+	code := &Code{
+		Version:    version,
+		Size:       size,
+		modules:    make([][]bool, size),
+		isFunction: make([][]bool, size),
+	}
+	for i := range code.modules {
+		code.modules[i] = make([]bool, size)
+		code.isFunction[i] = make([]bool, size)
+	}
+	return code
+}
+
+// dataBits returns the bit length of a byte mode segment holding n bytes
+func dataBits(version, n int) int {
+	return 4 + charCountBits(version) + n*8
+}
+
+// charCountBits returns the width of the byte mode character count indicator
+func charCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// numRawDataModules returns the number of modules available for codewords, excluding function patterns
+func numRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// numDataCodewords returns the number of data codewords a version holds at level M
+func numDataCodewords(version int) int {
+	return numRawDataModules(version)/8 - eccCodewordsPerBlock[version]*eccBlocks[version]
+}
+
+// encodeData builds the data codewords: mode, count, payload, terminator and padding
+func encodeData(version int, data []byte) []byte {
+	var bits bitBuffer
+	bits.append(0x4, 4) // byte mode
+	bits.append(len(data), charCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	capacity := numDataCodewords(version) * 8
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	return bits.bytes()
+}
+
+// addECCAndInterleave splits data into blocks, appends Reed-Solomon codewords and interleaves the result
+func addECCAndInterleave(version int, data []byte) []byte {
+	numBlocks := eccBlocks[version]
+	eccLen := eccCodewordsPerBlock[version]
+	rawCodewords := numRawDataModules(version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortDataLen := rawCodewords/numBlocks - eccLen
+
+	divisor := reedSolomonDivisor(eccLen)
+	dataBlocks := make([][]byte, numBlocks)
+	eccData := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortDataLen
+		if i >= numShortBlocks {
+			n++
+		}
+		dataBlocks[i] = data[k : k+n]
+		eccData[i] = reedSolomonRemainder(dataBlocks[i], divisor)
+		k += n
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := 0; i <= shortDataLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for _, block := range eccData {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// reedSolomonDivisor returns the generator polynomial of the given degree, highest term omitted
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// reedSolomonRemainder returns the error correction codewords for data
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func (c *Code) setFunction(row, col int, dark bool) {
+	c.modules[row][col] = dark
+	c.isFunction[row][col] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.Size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	c.drawFinderPattern(3, 3)
+	c.drawFinderPattern(3, c.Size-4)
+	c.drawFinderPattern(c.Size-4, 3)
+
+	positions := alignmentPatternPositions(c.Version)
+	last := len(positions) - 1
+	for i, row := range positions {
+		for j, col := range positions {
+			// Skip the three corners occupied by finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignmentPattern(row, col)
+		}
+	}
+
+	// Reserve the format areas now; the real bits are drawn once the mask is chosen
+	c.drawFormatBits(0)
+	c.drawVersionBits()
+}
+
+// drawFinderPattern draws a finder pattern and its separator centred on the given module
+func (c *Code) drawFinderPattern(row, col int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			r, cl := row+dy, col+dx
+			if r < 0 || r >= c.Size || cl < 0 || cl >= c.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.setFunction(r, cl, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignmentPattern(row, col int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(row+dy, col+dx, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPatternPositions returns the row/column centres of alignment patterns for a version
+func alignmentPatternPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	numAlign := version/7 + 2
+	step := 26
+	if version != 32 {
+		step = (version*4 + numAlign*2 + 1) / (numAlign*2 - 2) * 2
+	}
+
+	positions := make([]int, numAlign)
+	positions[0] = 6
+	for i, pos := numAlign-1, version*4+10; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// formatBits returns the 15-bit BCH-protected format information for level M and a mask
+func formatBits(mask int) int {
+	data := 0<<3 | mask // level M is encoded as 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) drawFormatBits(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	// First copy, around the top-left finder
+	for i := 0; i <= 5; i++ {
+		c.setFunction(i, 8, bit(i))
+	}
+	c.setFunction(7, 8, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(8, 7, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(8, 14-i, bit(i))
+	}
+
+	// Second copy, split between the top-right and bottom-left finders
+	for i := 0; i < 8; i++ {
+		c.setFunction(8, c.Size-1-i, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(c.Size-15+i, 8, bit(i))
+	}
+	c.setFunction(c.Size-8, 8, true) // dark module
+}
+
+// versionBits returns the 18-bit BCH-protected version information
+func versionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func (c *Code) drawVersionBits() {
+	if c.Version < 7 {
+		return
+	}
+
+	bits := versionBits(c.Version)
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 != 0
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(b, a, dark)
+		c.setFunction(a, b, dark)
+	}
+}
+
+// drawCodewords places codeword bits in the zigzag order, skipping function modules
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			row := vert
+			if upward {
+				row = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				col := right - j
+				if c.isFunction[row][col] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[row][col] = (codewords[i>>3]>>(7-i&7))&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask XORs the data modules with the given mask pattern
+func (c *Code) applyMask(mask int) {
+	for row := 0; row < c.Size; row++ {
+		for col := 0; col < c.Size; col++ {
+			if c.isFunction[row][col] {
+				continue
+			}
+			if maskBit(mask, row, col) {
+				c.modules[row][col] = !c.modules[row][col]
+			}
+		}
+	}
+}
+
+func maskBit(mask, row, col int) bool {
+	switch mask {
+	case 0:
+		return (row+col)%2 == 0
+	case 1:
+		return row%2 == 0
+	case 2:
+		return col%3 == 0
+	case 3:
+		return (row+col)%3 == 0
+	case 4:
+		return (row/2+col/3)%2 == 0
+	case 5:
+		return row*col%2+row*col%3 == 0
+	case 6:
+		return (row*col%2+row*col%3)%2 == 0
+	default:
+		return ((row+col)%2+row*col%3)%2 == 0
+	}
+}
+
+// penalty scores the symbol using the ISO/IEC 18004 mask evaluation rules; lower is better
+func (c *Code) penalty() int {
+	penalty := 0
+
+	line := make([]bool, c.Size)
+	for i := 0; i < c.Size; i++ {
+		penalty += linePenalty(c.modules[i])
+		for j := 0; j < c.Size; j++ {
+			line[j] = c.modules[j][i]
+		}
+		penalty += linePenalty(line)
+	}
+
+	dark := 0
+	for row := 0; row < c.Size; row++ {
+		for col := 0; col < c.Size; col++ {
+			if c.modules[row][col] {
+				dark++
+			}
+			if row+1 < c.Size && col+1 < c.Size {
+				m := c.modules[row][col]
+				if m == c.modules[row][col+1] && m == c.modules[row+1][col] && m == c.modules[row+1][col+1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	// Deviation of the dark proportion from 50%, in steps of 5%
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	penalty += max(k, 0) * 10
+
+	return penalty
+}
+
+// finderLike is the 1:1:3:1:1 dark/light pattern preceded or followed by four light modules
+var finderLike = [2][11]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// linePenalty scores runs of same-coloured modules and finder-like patterns in one row or column
+func linePenalty(line []bool) int {
+	penalty := 0
+
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			penalty += run - 2
+		}
+		run = 1
+	}
+
+	for i := 0; i+11 <= len(line); i++ {
+		for _, pattern := range finderLike {
+			match := true
+			for j, dark := range pattern {
+				if line[i+j] != dark {
+					match = false
+					break
+				}
+			}
+			if match {
+				penalty += 40
+			}
+		}
+	}
+
+	return penalty
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// bitBuffer accumulates bits most significant first
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, (value>>i)&1 != 0)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	result := make([]byte, (len(b)+7)/8)
+	for i, bit := range b {
+		if bit {
+			result[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+	return result
+}
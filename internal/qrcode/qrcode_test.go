@@ -0,0 +1,288 @@
+package qrcode
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestCodewordTables(t *testing.T) {
+	// Every version's blocks must exactly fill its raw codeword capacity
+	for version := minVersion; version <= maxVersion; version++ {
+		rawCodewords := numRawDataModules(version) / 8
+		if numDataCodewords(version) <= 0 || rawCodewords/eccBlocks[version] <= eccCodewordsPerBlock[version] {
+			t.Errorf("version %d: inconsistent block layout", version)
+		}
+	}
+
+	if got := numDataCodewords(1); got != 16 {
+		t.Errorf("version 1-M data codewords = %d, want 16", got)
+	}
+	if got := numDataCodewords(40); got != 2334 {
+		t.Errorf("version 40-M data codewords = %d, want 2334", got)
+	}
+}
+
+func TestReedSolomonRemainder(t *testing.T) {
+	// "HELLO WORLD" at 1-M from the ISO/IEC 18004 worked example
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	got := reedSolomonRemainder(data, reedSolomonDivisor(10))
+	if !bytes.Equal(got, want) {
+		t.Errorf("reedSolomonRemainder() = %v, want %v", got, want)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	if got := formatBits(0); got != 0b101010000010010 {
+		t.Errorf("formatBits(0) = %015b, want 101010000010010", got)
+	}
+	if got := formatBits(7); got != 0b100101010100000 {
+		t.Errorf("formatBits(7) = %015b, want 100101010100000", got)
+	}
+	if got := versionBits(7); got != 0b000111110010010100 {
+		t.Errorf("versionBits(7) = %018b, want 000111110010010100", got)
+	}
+}
+
+func TestAlignmentPatternPositions(t *testing.T) {
+	tests := map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		7:  {6, 22, 38},
+		32: {6, 34, 60, 86, 112, 138},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	}
+
+	for version, want := range tests {
+		got := alignmentPatternPositions(version)
+		if len(got) != len(want) {
+			t.Errorf("version %d: positions = %v, want %v", version, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("version %d: positions = %v, want %v", version, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	payloads := []string{
+		"",
+		"HELLO WORLD",
+		"[Interface]\nPrivateKey = YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY=\nAddress = 10.0.0.2/32\n" +
+			"DNS = 1.1.1.1, 8.8.8.8\n\n[Peer]\nPublicKey = YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY=\n" +
+			"Endpoint = vpn.example.com:51820\nAllowedIPs = 0.0.0.0/0, ::/0\n",
+		strings.Repeat("x", 1000),
+		strings.Repeat("\xff", 2331),
+	}
+
+	for _, payload := range payloads {
+		code, err := Encode([]byte(payload))
+		if err != nil {
+			t.Fatalf("Encode(%d bytes) error = %v", len(payload), err)
+		}
+		if code.Size != code.Version*4+17 {
+			t.Errorf("version %d: size = %d", code.Version, code.Size)
+		}
+
+		if got := decode(t, code); got != payload {
+			t.Errorf("round trip of %d bytes at version %d = %q", len(payload), code.Version, got)
+		}
+	}
+}
+
+func TestEncodeCapacity(t *testing.T) {
+	// Version 40-M holds at most 2331 bytes in byte mode
+	code, err := Encode(make([]byte, 2331))
+	if err != nil {
+		t.Fatalf("Encode(2331 bytes) error = %v", err)
+	}
+	if code.Version != 40 {
+		t.Errorf("Expected version 40, got %d", code.Version)
+	}
+
+	if _, err := Encode(make([]byte, 2332)); err == nil {
+		t.Error("Expected error for data exceeding version 40 capacity")
+	}
+}
+
+func TestPNG(t *testing.T) {
+	code, err := Encode([]byte("HELLO WORLD"))
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	data, err := code.PNG(4)
+	if err != nil {
+		t.Fatalf("PNG() error = %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("png.Decode() error = %v", err)
+	}
+
+	side := (code.Size + 2*quietZone) * 4
+	if bounds := img.Bounds(); bounds.Dx() != side || bounds.Dy() != side {
+		t.Errorf("PNG size = %v, want %dx%d", bounds, side, side)
+	}
+
+	// The top-left finder's corner is dark and the quiet zone is light
+	if r, _, _, _ := img.At(quietZone*4, quietZone*4).RGBA(); r != 0 {
+		t.Error("Expected finder corner to be dark")
+	}
+	if r, _, _, _ := img.At(0, 0).RGBA(); r == 0 {
+		t.Error("Expected quiet zone to be light")
+	}
+
+	if _, err := code.PNG(0); err == nil {
+		t.Error("Expected error for invalid scale")
+	}
+}
+
+func TestScaleFor(t *testing.T) {
+	code, err := Encode([]byte("HELLO WORLD"))
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	full := code.Size + 2*quietZone
+
+	tests := []struct {
+		side int
+		want int
+	}{
+		{side: full * 5, want: 5},
+		{side: full*5 + full - 1, want: 5},
+		{side: full, want: 1},
+		{side: full - 1, want: 0},
+		{side: 0, want: 0},
+	}
+	for _, tt := range tests {
+		if got := code.ScaleFor(tt.side); got != tt.want {
+			t.Errorf("ScaleFor(%d) = %d, want %d", tt.side, got, tt.want)
+		}
+	}
+	if got := code.Side(5); got != full*5 {
+		t.Errorf("Side(5) = %d, want %d", got, full*5)
+	}
+}
+
+// decode reads a symbol produced by Encode back into its payload, independently of the
+// encoder's internal state except for the function pattern layout
+func decode(t *testing.T, code *Code) string {
+	t.Helper()
+
+	// Read the mask from the first copy of the format information
+	var bits int
+	for i := 0; i <= 5; i++ {
+		bits |= boolBit(code.Module(i, 8)) << i
+	}
+	bits |= boolBit(code.Module(7, 8)) << 6
+	bits |= boolBit(code.Module(8, 8)) << 7
+	bits |= boolBit(code.Module(8, 7)) << 8
+	for i := 9; i < 15; i++ {
+		bits |= boolBit(code.Module(8, 14-i)) << i
+	}
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if formatBits(m) == bits {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("version %d: unrecognised format bits %015b", code.Version, bits)
+	}
+
+	// Rebuild the function pattern layout and read the codewords in zigzag order
+	layout := newCode(code.Version)
+	layout.drawFunctionPatterns()
+
+	var stream bitBuffer
+	for right := code.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < code.Size; vert++ {
+			row := vert
+			if upward {
+				row = code.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				col := right - j
+				if layout.isFunction[row][col] {
+					continue
+				}
+				stream = append(stream, code.Module(row, col) != maskBit(mask, row, col))
+			}
+		}
+	}
+	codewords := stream.bytes()[:numRawDataModules(code.Version)/8]
+
+	// De-interleave the data codewords and check each block's error correction
+	version := code.Version
+	numBlocks := eccBlocks[version]
+	eccLen := eccCodewordsPerBlock[version]
+	numShortBlocks := numBlocks - len(codewords)%numBlocks
+	shortDataLen := len(codewords)/numBlocks - eccLen
+
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= shortDataLen; i++ {
+		for b := range blocks {
+			if i < shortDataLen || b >= numShortBlocks {
+				blocks[b] = append(blocks[b], codewords[k])
+				k++
+			}
+		}
+	}
+	divisor := reedSolomonDivisor(eccLen)
+	var data []byte
+	for b, block := range blocks {
+		ecc := make([]byte, eccLen)
+		for i := range ecc {
+			ecc[i] = codewords[k+i*numBlocks+b]
+		}
+		if !bytes.Equal(ecc, reedSolomonRemainder(block, divisor)) {
+			t.Fatalf("version %d: block %d error correction mismatch", version, b)
+		}
+		data = append(data, block...)
+	}
+
+	// Parse the byte mode segment
+	var reader bitBuffer
+	for _, b := range data {
+		reader.append(int(b), 8)
+	}
+	if readBits(reader, 0, 4) != 0x4 {
+		t.Fatalf("version %d: unexpected mode", version)
+	}
+	n := readBits(reader, 4, charCountBits(version))
+	offset := 4 + charCountBits(version)
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(readBits(reader, offset+i*8, 8))
+	}
+	return string(payload)
+}
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func readBits(bits bitBuffer, offset, length int) int {
+	value := 0
+	for i := 0; i < length; i++ {
+		value = value<<1 | boolBit(bits[offset+i])
+	}
+	return value
+}
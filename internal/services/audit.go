@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Audited actions. Registrations, logins and password changes are recorded with the user as both actor and target;
+// impersonation and batch account creation with the admin as actor and the user as target.
+const (
+	AuditActionPasswordReset       = "user.password_reset"
+	AuditActionPasswordChanged     = "user.password_changed"
+	AuditActionUserCreated         = "user.created"
+	AuditActionRegistered          = "user.registered"
+	AuditActionLogin               = "user.login"
+	AuditActionImpersonationStart  = "user.impersonation_started"
+	AuditActionImpersonatedRequest = "user.impersonated_request"
+)
+
+// MaxTrendBuckets is the most buckets Trends returns in one series
+const MaxTrendBuckets = 1000
+
+// trendBuckets maps each trend granularity to its shortest span, used to bound the series length
+var trendBuckets = map[string]time.Duration{
+	"hour":  time.Hour,
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 28 * 24 * time.Hour,
+}
+
+// ValidateTrendRange rejects an unknown bucket granularity, a range that does not end after it
+// starts and one spanning more than MaxTrendBuckets buckets
+func ValidateTrendRange(from, to time.Time, bucket string) error {
+	span, ok := trendBuckets[bucket]
+	if !ok {
+		return fmt.Errorf("bucket must be one of hour, day, week or month")
+	}
+	if !to.After(from) {
+		return fmt.Errorf("to must be after from")
+	}
+	if to.Sub(from) > span*MaxTrendBuckets {
+		return fmt.Errorf("range must span at most %d buckets of a %s", MaxTrendBuckets, bucket)
+	}
+	return nil
+}
+
+// AuditService records administrative actions
+type AuditService struct {
+	db     *pgxpool.Pool
+	logger *zap.Logger
+}
+
+// NewAuditService creates a new audit service
+func NewAuditService(db *pgxpool.Pool, logger *zap.Logger) *AuditService {
+	return &AuditService{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Record stores an audit entry for an action taken by actorID on targetID; details must not
+// contain secrets
+func (s *AuditService) Record(ctx context.Context, actorID uuid.UUID, action string, targetID uuid.UUID, details map[string]interface{}) error {
+	var detailsJSON []byte
+	if details != nil {
+		var err error
+		if detailsJSON, err = json.Marshal(details); err != nil {
+			return fmt.Errorf("failed to encode audit details: %w", err)
+		}
+	}
+
+	query := `INSERT INTO audit_log (actor_id, action, target_id, details) VALUES ($1, $2, $3, $4)`
+	if _, err := s.db.Exec(ctx, query, actorID, action, targetID, detailsJSON); err != nil {
+		s.logger.Error("Failed to record audit entry", zap.Error(err), zap.String("action", action))
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+
+	s.logger.Info("Audit entry recorded",
+		zap.String("action", action),
+		zap.String("actor_id", actorID.String()),
+		zap.String("target_id", targetID.String()))
+
+	return nil
+}
+
+// Trends counts registrations and logins in [from, to), bucketed by hour, day, week or month in
+// UTC. Every bucket the range touches is returned, empty ones included, oldest first.
+func (s *AuditService) Trends(ctx context.Context, from, to time.Time, bucket string) ([]*models.TrendBucket, error) {
+	if err := ValidateTrendRange(from, to, bucket); err != nil {
+		return nil, err
+	}
+
+	// Buckets are built from UTC wall-clock times so day boundaries ignore the session time zone
+	query := `
+		SELECT b.start AT TIME ZONE 'UTC',
+			COUNT(a.id) FILTER (WHERE a.action = $4),
+			COUNT(a.id) FILTER (WHERE a.action = $5)
+		FROM generate_series(
+			date_trunc($3::text, $1::timestamptz AT TIME ZONE 'UTC'),
+			$2::timestamptz AT TIME ZONE 'UTC',
+			('1 ' || $3)::interval
+		) AS b(start)
+		LEFT JOIN audit_log a
+			ON date_trunc($3, a.created_at AT TIME ZONE 'UTC') = b.start
+			AND a.created_at >= $1 AND a.created_at < $2
+			AND a.action IN ($4, $5)
+		WHERE b.start < $2::timestamptz AT TIME ZONE 'UTC'
+		GROUP BY b.start
+		ORDER BY b.start
+	`
+	rows, err := s.db.Query(ctx, query, from, to, bucket, AuditActionRegistered, AuditActionLogin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trends: %w", err)
+	}
+	defer rows.Close()
+
+	series := []*models.TrendBucket{}
+	for rows.Next() {
+		entry := &models.TrendBucket{}
+		if err := rows.Scan(&entry.Start, &entry.Registrations, &entry.Logins); err != nil {
+			return nil, fmt.Errorf("failed to scan trend bucket: %w", err)
+		}
+		entry.Start = entry.Start.UTC()
+		series = append(series, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate trend buckets: %w", err)
+	}
+
+	return series, nil
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestValidateTrendRange(t *testing.T) {
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		to      time.Time
+		bucket  string
+		wantErr bool
+	}{
+		{name: "a month of days", to: from.AddDate(0, 1, 0), bucket: "day"},
+		{name: "a year of months", to: from.AddDate(1, 0, 0), bucket: "month"},
+		{name: "unknown bucket", to: from.AddDate(0, 1, 0), bucket: "minute", wantErr: true},
+		{name: "empty range", to: from, bucket: "day", wantErr: true},
+		{name: "reversed range", to: from.Add(-time.Hour), bucket: "hour", wantErr: true},
+		{name: "too many buckets", to: from.Add((MaxTrendBuckets + 1) * time.Hour), bucket: "hour", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTrendRange(from, tt.to, tt.bucket)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTrendRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrends(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+	service := NewAuditService(db, logger)
+	user := newTestUser(t, NewUserService(db, logger))
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM audit_log WHERE actor_id = $1`, user.ID)
+	})
+
+	// Seeded well in the past so entries recorded by other tests fall outside every range
+	day := time.Date(2001, 5, 1, 0, 0, 0, 0, time.UTC)
+	seed := []struct {
+		action string
+		at     time.Time
+	}{
+		{AuditActionRegistered, day.Add(time.Hour)},
+		{AuditActionLogin, day.Add(2 * time.Hour)},
+		{AuditActionLogin, day.Add(23 * time.Hour)},
+		{AuditActionLogin, day.Add(49 * time.Hour)},
+		{AuditActionRegistered, day.Add(50 * time.Hour)},
+		{AuditActionPasswordReset, day.Add(51 * time.Hour)},
+		{AuditActionLogin, day.Add(-time.Hour)},
+		{AuditActionLogin, day.Add(72 * time.Hour)},
+	}
+	for _, entry := range seed {
+		if _, err := db.Exec(ctx, `INSERT INTO audit_log (actor_id, action, target_id, created_at) VALUES ($1, $2, $1, $3)`,
+			user.ID, entry.action, entry.at); err != nil {
+			t.Fatalf("Failed to seed audit entry: %v", err)
+		}
+	}
+
+	series, err := service.Trends(ctx, day, day.Add(72*time.Hour), "day")
+	if err != nil {
+		t.Fatalf("Trends() error = %v", err)
+	}
+
+	want := []struct {
+		registrations, logins int64
+	}{{1, 2}, {0, 0}, {1, 1}}
+	if len(series) != len(want) {
+		t.Fatalf("Trends() returned %d buckets, want %d", len(series), len(want))
+	}
+	for i, bucket := range series {
+		if !bucket.Start.Equal(day.AddDate(0, 0, i)) {
+			t.Errorf("Bucket %d starts at %s, want %s", i, bucket.Start, day.AddDate(0, 0, i))
+		}
+		if bucket.Registrations != want[i].registrations || bucket.Logins != want[i].logins {
+			t.Errorf("Bucket %d = %d registrations and %d logins, want %d and %d",
+				i, bucket.Registrations, bucket.Logins, want[i].registrations, want[i].logins)
+		}
+	}
+
+	// A range starting mid-bucket only counts entries from its start
+	series, err = service.Trends(ctx, day.Add(12*time.Hour), day.Add(24*time.Hour), "day")
+	if err != nil {
+		t.Fatalf("Trends() error = %v", err)
+	}
+	if len(series) != 1 || !series[0].Start.Equal(day) || series[0].Registrations != 0 || series[0].Logins != 1 {
+		t.Errorf("Trends() from mid-day = %+v, want one bucket with a single login", series)
+	}
+
+	if _, err := service.Trends(ctx, day, day.Add(72*time.Hour), "fortnight"); err == nil {
+		t.Error("Trends() with an unknown bucket should fail")
+	}
+}
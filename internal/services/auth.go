@@ -1,47 +1,289 @@
 package services
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"math/big"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
+
+	"github.com/denzelpenzel/vpn/internal/database"
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// ErrInvalidToken is returned by ValidateToken for a token that must not be accepted, as opposed to
+// a failure to check it
+var ErrInvalidToken = errors.New("invalid token")
+
+// ImpersonationTokenTTL is how long an impersonation token is valid for
+const ImpersonationTokenTTL = 15 * time.Minute
+
+// defaultBCryptCost is the bcrypt cost used until SetPasswordHasher selects a configured hasher
+const defaultBCryptCost = 12
+
+// Token lifetimes used until SetTokenLifetimes sets configured ones
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
 )
 
 // AuthService handles authentication and authorization
 type AuthService struct {
 	jwtSecret []byte
 	logger    *zap.Logger
+	db        *pgxpool.Pool // optional; holds the revoked token denylist
+
+	// hasher hashes new passwords; existing hashes are verified with the algorithm they were made with
+	hasher          PasswordHasher
+	hasherAlgorithm string
+
+	// minimalClaims leaves the email out of issued tokens, which then identify the user only by ID
+	minimalClaims bool
+
+	// accessTTL is the lifetime of issued JWTs and refreshTTL that of the refresh tokens renewing them
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+
+	// health is set in degraded mode, when tokens are checked against revocations as of the last
+	// snapshot while the database is down
+	health *database.Health
+
+	// passwordFailures limits wrong passwords per user, at sign-in and step-up alike; nil disables it
+	passwordFailures *failureLimiter
+
+	// revocations is the last revocation snapshot; nil until one is taken
+	revocationsMu sync.RWMutex
+	revocations   *revocationSnapshot
+}
+
+// revocationSnapshot holds the token denylist, the session cutoffs and the users who must change their
+// password as of when it was taken
+type revocationSnapshot struct {
+	revoked    map[string]bool
+	cutoffs    map[uuid.UUID]time.Time
+	mustChange map[uuid.UUID]bool
 }
 
 // NewAuthService creates a new auth service
 func NewAuthService(jwtSecret string, logger *zap.Logger) *AuthService {
 	return &AuthService{
-		jwtSecret: []byte(jwtSecret),
-		logger:    logger,
+		jwtSecret:       []byte(jwtSecret),
+		logger:          logger,
+		hasher:          BcryptHasher{Cost: defaultBCryptCost},
+		hasherAlgorithm: PasswordHashBcrypt,
+		accessTTL:       defaultAccessTokenTTL,
+		refreshTTL:      defaultRefreshTokenTTL,
+	}
+}
+
+// SetPasswordHasher selects the algorithm new passwords are hashed with
+func (s *AuthService) SetPasswordHasher(algorithm string, hasher PasswordHasher) {
+	s.hasher = hasher
+	s.hasherAlgorithm = algorithm
+}
+
+// SetMinimalClaims sets whether issued tokens leave out the user's email, keeping it out of every
+// request and anything that logs headers. Handlers then look the email up when they need it.
+// Tokens already issued keep whatever claims they were issued with.
+func (s *AuthService) SetMinimalClaims(minimal bool) {
+	s.minimalClaims = minimal
+}
+
+// SetTokenLifetimes sets how long issued access tokens and refresh tokens are valid for. Tokens
+// already issued keep the lifetime they were issued with.
+func (s *AuthService) SetTokenLifetimes(access, refresh time.Duration) {
+	s.accessTTL = access
+	s.refreshTTL = refresh
+}
+
+// SetPasswordAttemptLimit lets a user get their password wrong maxFailures times in a row, after which
+// CheckPassword allows another attempt every window/maxFailures. Zero disables the limit.
+func (s *AuthService) SetPasswordAttemptLimit(maxFailures int, window time.Duration) {
+	if maxFailures <= 0 {
+		s.passwordFailures = nil
+		return
+	}
+	s.passwordFailures = newFailureLimiter(maxFailures, window)
+}
+
+// AccessTokenTTL returns how long issued access tokens are valid for
+func (s *AuthService) AccessTokenTTL() time.Duration {
+	return s.accessTTL
+}
+
+// SetDatabaseHealth enables degraded mode: while health finds the database down, tokens are checked
+// against the denylist and session cutoffs of the last RefreshRevocations, so signed-in users can keep
+// reading without revoked sessions coming back. Until a snapshot has been taken no token is accepted.
+func (s *AuthService) SetDatabaseHealth(health *database.Health) {
+	s.health = health
+}
+
+// RefreshRevocations snapshots the token denylist, session cutoffs and pending password changes that
+// degraded mode checks tokens against; it is called while the database is reachable
+func (s *AuthService) RefreshRevocations(ctx context.Context) error {
+	if s.db == nil {
+		return nil
+	}
+
+	rows, err := s.db.Query(ctx, `SELECT jti FROM revoked_tokens WHERE expires_at > NOW()`)
+	if err != nil {
+		return fmt.Errorf("failed to load revoked tokens: %w", err)
+	}
+	jtis, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to load revoked tokens: %w", err)
+	}
+
+	snapshot := &revocationSnapshot{
+		revoked:    make(map[string]bool, len(jtis)),
+		cutoffs:    make(map[uuid.UUID]time.Time),
+		mustChange: make(map[uuid.UUID]bool),
+	}
+	for _, jti := range jtis {
+		snapshot.revoked[jti] = true
+	}
+
+	rows, err = s.db.Query(ctx, `SELECT id, tokens_valid_after FROM users WHERE tokens_valid_after IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to load session cutoffs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID uuid.UUID
+		var cutoff time.Time
+		if err := rows.Scan(&userID, &cutoff); err != nil {
+			return fmt.Errorf("failed to scan session cutoff: %w", err)
+		}
+		snapshot.cutoffs[userID] = cutoff
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate session cutoffs: %w", err)
+	}
+
+	rows, err = s.db.Query(ctx, `SELECT id FROM users WHERE must_change_password = true`)
+	if err != nil {
+		return fmt.Errorf("failed to load password changes: %w", err)
+	}
+	userIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return fmt.Errorf("failed to load password changes: %w", err)
+	}
+	for _, userID := range userIDs {
+		snapshot.mustChange[userID] = true
+	}
+
+	s.revocationsMu.Lock()
+	s.revocations = snapshot
+	s.revocationsMu.Unlock()
+
+	return nil
+}
+
+// recordRevocation applies a revocation made by this instance to the snapshot, so it holds should the
+// database go down before the next refresh
+func (s *AuthService) recordRevocation(apply func(snapshot *revocationSnapshot)) {
+	s.revocationsMu.Lock()
+	defer s.revocationsMu.Unlock()
+
+	if s.revocations != nil {
+		apply(s.revocations)
 	}
 }
 
+// checkRevocationSnapshot checks a token against the last revocation snapshot, for while the
+// database is down. Without a snapshot the token cannot be checked and it fails with
+// database.ErrUnavailable.
+func (s *AuthService) checkRevocationSnapshot(claims *Claims) error {
+	s.revocationsMu.RLock()
+	defer s.revocationsMu.RUnlock()
+
+	if s.revocations == nil {
+		return database.ErrUnavailable
+	}
+	if s.revocations.revoked[claims.ID] {
+		return fmt.Errorf("%w: token revoked", ErrInvalidToken)
+	}
+
+	// Revoking the admin's sessions ends their impersonations too
+	subjects := []uuid.UUID{claims.UserID}
+	if claims.IsImpersonation() {
+		subjects = append(subjects, claims.Act.Subject)
+	}
+	for _, subject := range subjects {
+		cutoff, ok := s.revocations.cutoffs[subject]
+		if ok && (claims.IssuedAt == nil || claims.IssuedAt.Time.Before(cutoff)) {
+			return fmt.Errorf("%w: issued before the user's sessions were revoked", ErrInvalidToken)
+		}
+	}
+	claims.MustChangePassword = s.revocations.mustChange[claims.UserID] && !claims.IsImpersonation()
+
+	return nil
+}
+
+// SetDB sets the database holding revoked and refresh tokens; without it no token is considered
+// revoked and no refresh tokens are issued
+func (s *AuthService) SetDB(db *pgxpool.Pool) {
+	s.db = db
+}
+
 // Claims represents JWT claims
 type Claims struct {
 	UserID uuid.UUID `json:"user_id"`
-	Email  string    `json:"email"`
+	Email  string    `json:"email,omitempty"` // omitted from tokens issued with minimal claims
+	Role   string    `json:"role"`
+	// Act is the admin viewing the API as this user; only impersonation tokens carry it
+	Act *models.Actor `json:"act,omitempty"`
+	// MustChangePassword is not part of the token: ValidateToken sets it from the user record
+	MustChangePassword bool `json:"-"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken generates a JWT token for a user
-func (s *AuthService) GenerateToken(userID uuid.UUID, email string) (string, error) {
+// IsImpersonation reports whether the token was issued to an admin impersonating its user
+func (c *Claims) IsImpersonation() bool {
+	return c.Act != nil
+}
+
+// GenerateToken generates a short-lived JWT token for a user; refresh tokens renew it
+func (s *AuthService) GenerateToken(userID uuid.UUID, email, role string) (string, error) {
+	return s.generateToken(userID, email, role, time.Now())
+}
+
+// GenerateTokenAfter generates a JWT token that is accepted despite a session cutoff at the given
+// time. Token issue times are whole seconds, so a token issued in the same second as the cutoff
+// would otherwise count as issued before it.
+func (s *AuthService) GenerateTokenAfter(userID uuid.UUID, email, role string, cutoff time.Time) (string, error) {
+	issuedAt := cutoff.Truncate(time.Second)
+	if issuedAt.Before(cutoff) {
+		issuedAt = issuedAt.Add(time.Second)
+	}
+	return s.generateToken(userID, email, role, issuedAt)
+}
+
+func (s *AuthService) generateToken(userID uuid.UUID, email, role string, issuedAt time.Time) (string, error) {
+	if s.minimalClaims {
+		email = ""
+	}
+
 	claims := &Claims{
 		UserID: userID,
 		Email:  email,
+		Role:   role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // 24 hours
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.accessTTL)),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    "vpn-service",
 			Subject:   userID.String(),
+			ID:        uuid.NewString(),
 		},
 	}
 
@@ -55,15 +297,52 @@ func (s *AuthService) GenerateToken(userID uuid.UUID, email string) (string, err
 		return "", fmt.Errorf("failed to generate token: %w", err)
 	}
 
-	s.logger.Info("JWT token generated",
-		zap.String("user_id", userID.String()),
-		zap.String("email", email))
+	fields := []zap.Field{zap.String("user_id", userID.String())}
+	if email != "" {
+		fields = append(fields, zap.String("email", email))
+	}
+	s.logger.Info("JWT token generated", fields...)
 
 	return tokenString, nil
 }
 
-// ValidateToken validates a JWT token and returns claims
-func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
+// GenerateImpersonationToken issues a token for adminID to view the API as a user, valid for
+// ImpersonationTokenTTL. The act claim records the admin; the middleware only lets such tokens reach
+// read-only user endpoints, and never admin ones whatever the user's role.
+func (s *AuthService) GenerateImpersonationToken(adminID, userID uuid.UUID, role string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ImpersonationTokenTTL)
+	claims := &Claims{
+		UserID: userID,
+		Role:   role,
+		Act:    &models.Actor{Subject: adminID},
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "vpn-service",
+			Subject:   userID.String(),
+			ID:        uuid.NewString(),
+		},
+	}
+
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.jwtSecret)
+	if err != nil {
+		s.logger.Error("Failed to sign impersonation token", zap.Error(err))
+		return "", time.Time{}, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	s.logger.Info("Impersonation token generated",
+		zap.String("admin_id", adminID.String()),
+		zap.String("user_id", userID.String()))
+
+	return tokenString, expiresAt, nil
+}
+
+// ValidateToken validates a JWT token and returns claims. Tokens that are malformed, expired, revoked or
+// issued before the user revoked their sessions fail with ErrInvalidToken; any other error means the
+// token could not be checked.
+func (s *AuthService) ValidateToken(ctx context.Context, tokenString string) (*Claims, error) {
 	// Parse token
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		// Validate signing method
@@ -75,36 +354,268 @@ func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 
 	if err != nil {
 		s.logger.Warn("Invalid JWT token", zap.Error(err))
-		return nil, fmt.Errorf("invalid token: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
 	}
 
 	// Extract claims
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("%w: invalid claims", ErrInvalidToken)
+	}
+
+	if claims.IsImpersonation() {
+		// An impersonation token outliving its TTL was not issued by GenerateImpersonationToken
+		if claims.ExpiresAt == nil || claims.IssuedAt == nil || claims.ExpiresAt.Sub(claims.IssuedAt.Time) > ImpersonationTokenTTL {
+			return nil, fmt.Errorf("%w: impersonation token lifetime too long", ErrInvalidToken)
+		}
+	}
+
+	// While the database is down revocations are checked as of the last snapshot
+	if !s.health.Healthy() {
+		if err := s.checkRevocationSnapshot(claims); err != nil {
+			return nil, err
+		}
 		return claims, nil
 	}
 
-	return nil, fmt.Errorf("invalid token claims")
+	mustChange, err := s.checkSessionCutoff(ctx, claims.UserID, claims.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	// An admin impersonating the user is not the one holding the temporary password
+	claims.MustChangePassword = mustChange && !claims.IsImpersonation()
+	revoked, err := s.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("%w: token revoked", ErrInvalidToken)
+	}
+	// Revoking the admin's sessions ends their impersonations too
+	if claims.IsImpersonation() {
+		if _, err := s.checkSessionCutoff(ctx, claims.Act.Subject, claims.IssuedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	return claims, nil
+}
+
+// checkSessionCutoff rejects a token issued before the user last revoked their sessions. It also
+// reports whether the user must change their password, read from the same row.
+func (s *AuthService) checkSessionCutoff(ctx context.Context, userID uuid.UUID, issuedAt *jwt.NumericDate) (bool, error) {
+	if s.db == nil {
+		return false, nil
+	}
+
+	var cutoff *time.Time
+	var mustChange bool
+	err := s.db.QueryRow(ctx, `SELECT tokens_valid_after, must_change_password FROM users WHERE id = $1`, userID).Scan(&cutoff, &mustChange)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Whether the user still exists is for the caller to decide
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check session revocation: %w", err)
+	}
+
+	if cutoff != nil && (issuedAt == nil || issuedAt.Time.Before(*cutoff)) {
+		s.logger.Warn("Rejected token issued before sessions were revoked", zap.String("user_id", userID.String()))
+		return false, fmt.Errorf("%w: issued before the user's sessions were revoked", ErrInvalidToken)
+	}
+
+	return mustChange, nil
+}
+
+// RevokeSessions invalidates every token and refresh token issued to the user so far and returns the
+// cutoff; tokens issued from now on are unaffected. It returns ErrUserNotFound when there is no such user.
+func (s *AuthService) RevokeSessions(ctx context.Context, userID uuid.UUID) (time.Time, error) {
+	if s.db == nil {
+		return time.Time{}, fmt.Errorf("session revocation requires a database")
+	}
+
+	var cutoff time.Time
+	// Refresh tokens would otherwise keep renewing the revoked sessions
+	query := `
+		WITH revoked AS (
+			UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL
+		)
+		UPDATE users SET tokens_valid_after = NOW(), updated_at = NOW() WHERE id = $1 RETURNING tokens_valid_after
+	`
+	err := s.db.QueryRow(ctx, query, userID).Scan(&cutoff)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, ErrUserNotFound
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	s.recordRevocation(func(snapshot *revocationSnapshot) {
+		snapshot.cutoffs[userID] = cutoff
+	})
+
+	s.logger.Info("All sessions revoked", zap.String("user_id", userID.String()))
+
+	return cutoff, nil
+}
+
+// RevokeToken adds a validated token to the denylist until it expires. Tokens issued without an
+// ID cannot be revoked individually.
+func (s *AuthService) RevokeToken(ctx context.Context, claims *Claims) error {
+	if s.db == nil {
+		return fmt.Errorf("token revocation requires a database")
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return fmt.Errorf("token cannot be revoked: missing ID or expiry")
+	}
+
+	query := `
+		INSERT INTO revoked_tokens (jti, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	if _, err := s.db.Exec(ctx, query, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	s.recordRevocation(func(snapshot *revocationSnapshot) {
+		snapshot.revoked[claims.ID] = true
+	})
+
+	s.logger.Info("JWT token revoked",
+		zap.String("user_id", claims.UserID.String()),
+		zap.String("jti", claims.ID))
+
+	return nil
+}
+
+// IsTokenRevoked reports whether the token with the given ID is on the denylist
+func (s *AuthService) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	if s.db == nil || jti == "" {
+		return false, nil
+	}
+
+	var revoked bool
+	err := s.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)`, jti).Scan(&revoked)
+	if err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+
+	return revoked, nil
 }
 
-// HashPassword hashes a password using bcrypt
+// PurgeExpiredRevokedTokens deletes denylist entries for tokens that have expired anyway and returns
+// how many were removed
+func (s *AuthService) PurgeExpiredRevokedTokens(ctx context.Context) (int64, error) {
+	if s.db == nil {
+		return 0, nil
+	}
+
+	tag, err := s.db.Exec(ctx, `DELETE FROM revoked_tokens WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge revoked tokens: %w", err)
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		s.logger.Info("Purged expired revoked tokens", zap.Int64("count", n))
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// temporaryPasswordAlphabets are the character classes a generated password draws from; one of each
+// is always included so the result satisfies the password policy
+var temporaryPasswordAlphabets = []string{
+	"ABCDEFGHJKLMNPQRSTUVWXYZ",
+	"abcdefghijkmnopqrstuvwxyz",
+	"23456789",
+}
+
+// GenerateTemporaryPassword returns a random password of the given length containing upper case,
+// lower case and digit characters
+func (s *AuthService) GenerateTemporaryPassword(length int) (string, error) {
+	if length < len(temporaryPasswordAlphabets) {
+		return "", fmt.Errorf("password length too short: %d", length)
+	}
+
+	all := strings.Join(temporaryPasswordAlphabets, "")
+	password := make([]byte, length)
+	for i := range password {
+		alphabet := all
+		if i < len(temporaryPasswordAlphabets) {
+			alphabet = temporaryPasswordAlphabets[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %w", err)
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+
+	// Shuffle so the guaranteed classes are not always in the first positions
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %w", err)
+		}
+		password[i], password[j.Int64()] = password[j.Int64()], password[i]
+	}
+
+	return string(password), nil
+}
+
+// HashPassword hashes a password with the configured algorithm
 func (s *AuthService) HashPassword(password string) (string, error) {
-	// Use cost 12 for security (configurable via environment)
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
 		s.logger.Error("Failed to hash password", zap.Error(err))
 		return "", fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	return string(hash), nil
+	return hash, nil
 }
 
-// VerifyPassword verifies a password against its hash
+// VerifyPassword verifies a password against its hash, using the algorithm identified by the hash
+// prefix so hashes made before a change of algorithm keep working
 func (s *AuthService) VerifyPassword(password, hash string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	if err != nil {
+	var hasher PasswordHasher
+	switch passwordHashAlgorithm(hash) {
+	case PasswordHashArgon2id:
+		hasher = NewArgon2idHasher()
+	case PasswordHashBcrypt:
+		hasher = BcryptHasher{}
+	default:
+		s.logger.Warn("Password hash has an unknown algorithm")
+		return fmt.Errorf("invalid password")
+	}
+
+	if err := hasher.Verify(password, hash); err != nil {
 		s.logger.Warn("Password verification failed")
 		return fmt.Errorf("invalid password")
 	}
 
 	return nil
 }
+
+// CheckPassword verifies a user's password like VerifyPassword, counting a wrong one against the user's
+// failed attempt limit. A user at the limit gets a PasswordAttemptsError without the password being
+// checked, so guessing goes no faster with a stolen token than at sign-in.
+func (s *AuthService) CheckPassword(userID uuid.UUID, password, hash string) error {
+	if s.passwordFailures == nil {
+		return s.VerifyPassword(password, hash)
+	}
+
+	if retryAfter := s.passwordFailures.retryAfter(userID); retryAfter > 0 {
+		return &PasswordAttemptsError{RetryAfter: retryAfter}
+	}
+	if err := s.VerifyPassword(password, hash); err != nil {
+		s.passwordFailures.fail(userID)
+		return err
+	}
+	s.passwordFailures.reset(userID)
+
+	return nil
+}
+
+// NeedsRehash reports whether a hash was made with an algorithm other than the configured one,
+// so it should be replaced the next time the password is known
+func (s *AuthService) NeedsRehash(hash string) bool {
+	return passwordHashAlgorithm(hash) != s.hasherAlgorithm
+}
@@ -0,0 +1,293 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/denzelpenzel/vpn/internal/database"
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+func TestGenerateTemporaryPassword(t *testing.T) {
+	service := NewAuthService("test-secret", zap.NewNop())
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		password, err := service.GenerateTemporaryPassword(16)
+		if err != nil {
+			t.Fatalf("GenerateTemporaryPassword() error = %v", err)
+		}
+		if len(password) != 16 {
+			t.Errorf("Expected 16 characters, got %q", password)
+		}
+		for _, alphabet := range temporaryPasswordAlphabets {
+			if !strings.ContainsAny(password, alphabet) {
+				t.Errorf("Password %q is missing a character from %q", password, alphabet)
+			}
+		}
+		if seen[password] {
+			t.Errorf("Duplicate password %q", password)
+		}
+		seen[password] = true
+	}
+
+	if _, err := service.GenerateTemporaryPassword(2); err == nil {
+		t.Error("Expected error for a length that cannot satisfy the policy")
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, NewUserService(db, zap.NewNop()))
+
+	service := NewAuthService("test-secret", zap.NewNop())
+	service.SetDB(db)
+
+	oldToken, err := service.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if _, err := service.ValidateToken(t.Context(), oldToken); err != nil {
+		t.Fatalf("Expected token to be valid before revocation, got %v", err)
+	}
+
+	cutoff, err := service.RevokeSessions(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("RevokeSessions() error = %v", err)
+	}
+
+	if _, err := service.ValidateToken(t.Context(), oldToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected token issued before the cutoff to be rejected, got %v", err)
+	}
+
+	// A token for the session that asked to stay signed in
+	keptToken, err := service.GenerateTokenAfter(user.ID, user.Email, user.Role, cutoff)
+	if err != nil {
+		t.Fatalf("GenerateTokenAfter() error = %v", err)
+	}
+	if _, err := service.ValidateToken(t.Context(), keptToken); err != nil {
+		t.Errorf("Expected token issued at the cutoff to be accepted, got %v", err)
+	}
+
+	// A later login
+	newToken, err := service.generateToken(user.ID, user.Email, user.Role, cutoff.Add(time.Second))
+	if err != nil {
+		t.Fatalf("generateToken() error = %v", err)
+	}
+	if _, err := service.ValidateToken(t.Context(), newToken); err != nil {
+		t.Errorf("Expected token issued after the cutoff to be accepted, got %v", err)
+	}
+
+	if _, err := service.RevokeSessions(t.Context(), uuid.New()); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound for an unknown user, got %v", err)
+	}
+}
+
+func TestValidateTokenDegraded(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, NewUserService(db, zap.NewNop()))
+
+	service := NewAuthService("test-secret", zap.NewNop())
+	service.SetDB(db)
+	health := database.NewHealth(zap.NewNop())
+	service.SetDatabaseHealth(health)
+
+	loggedOut, err := service.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	claims, err := service.ValidateToken(t.Context(), loggedOut)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM revoked_tokens WHERE jti = $1`, claims.ID)
+	})
+	if err := service.RevokeToken(t.Context(), claims); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+	active, err := service.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	health.Check(t.Context(), func(context.Context) error { return errors.New("connection refused") })
+
+	// Nothing is known about revocations yet, so no token can be accepted
+	if _, err := service.ValidateToken(t.Context(), active); !errors.Is(err, database.ErrUnavailable) {
+		t.Errorf("ValidateToken() without a snapshot error = %v, want database.ErrUnavailable", err)
+	}
+
+	health.Check(t.Context(), func(context.Context) error { return nil })
+	if err := service.RefreshRevocations(t.Context()); err != nil {
+		t.Fatalf("RefreshRevocations() error = %v", err)
+	}
+	health.Check(t.Context(), func(context.Context) error { return errors.New("connection refused") })
+
+	if _, err := service.ValidateToken(t.Context(), loggedOut); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a logged-out token to stay rejected while degraded, got %v", err)
+	}
+	if _, err := service.ValidateToken(t.Context(), active); err != nil {
+		t.Errorf("Expected an unrevoked token to be accepted while degraded, got %v", err)
+	}
+
+	// A revocation made after the snapshot still holds should the database go down
+	health.Check(t.Context(), func(context.Context) error { return nil })
+	if _, err := service.RevokeSessions(t.Context(), user.ID); err != nil {
+		t.Fatalf("RevokeSessions() error = %v", err)
+	}
+	health.Check(t.Context(), func(context.Context) error { return errors.New("connection refused") })
+	if _, err := service.ValidateToken(t.Context(), active); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a token issued before revoke-sessions to be rejected while degraded, got %v", err)
+	}
+}
+
+func TestPurgeExpiredRevokedTokens(t *testing.T) {
+	db := newTestDB(t)
+
+	service := NewAuthService("test-secret", zap.NewNop())
+	service.SetDB(db)
+
+	expired, live := uuid.NewString(), uuid.NewString()
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM revoked_tokens WHERE jti = ANY($1)`, []string{expired, live})
+	})
+	for jti, expiresAt := range map[string]time.Time{expired: time.Now().Add(-time.Minute), live: time.Now().Add(time.Hour)} {
+		claims := &Claims{RegisteredClaims: jwt.RegisteredClaims{ID: jti, ExpiresAt: jwt.NewNumericDate(expiresAt)}}
+		if err := service.RevokeToken(t.Context(), claims); err != nil {
+			t.Fatalf("RevokeToken() error = %v", err)
+		}
+	}
+
+	if _, err := service.PurgeExpiredRevokedTokens(t.Context()); err != nil {
+		t.Fatalf("PurgeExpiredRevokedTokens() error = %v", err)
+	}
+
+	if revoked, err := service.IsTokenRevoked(t.Context(), expired); err != nil || revoked {
+		t.Errorf("Expected the expired entry to be purged, got revoked=%v err=%v", revoked, err)
+	}
+	if revoked, err := service.IsTokenRevoked(t.Context(), live); err != nil || !revoked {
+		t.Errorf("Expected the unexpired entry to remain, got revoked=%v err=%v", revoked, err)
+	}
+}
+
+func TestGenerateTokenAfterRoundsUp(t *testing.T) {
+	service := NewAuthService("test-secret", zap.NewNop())
+	cutoff := time.Date(2026, 1, 2, 3, 4, 5, 600_000_000, time.UTC)
+
+	token, err := service.GenerateTokenAfter(uuid.New(), "user@example.com", "user", cutoff)
+	if err != nil {
+		t.Fatalf("GenerateTokenAfter() error = %v", err)
+	}
+	claims, err := service.ValidateToken(t.Context(), token)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	if want := cutoff.Truncate(time.Second).Add(time.Second); !claims.IssuedAt.Time.Equal(want) {
+		t.Errorf("Expected issued at %s, got %s", want, claims.IssuedAt.Time)
+	}
+}
+
+// tokenPayload decodes the claims of a signed token without verifying it
+func tokenPayload(t *testing.T, token string) map[string]interface{} {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Malformed token %q", token)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("Failed to decode token payload: %v", err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		t.Fatalf("Failed to parse token payload: %v", err)
+	}
+	return payload
+}
+
+func TestGenerateTokenMinimalClaims(t *testing.T) {
+	service := NewAuthService("test-secret", zap.NewNop())
+	userID := uuid.New()
+
+	for _, minimal := range []bool{false, true} {
+		service.SetMinimalClaims(minimal)
+
+		token, err := service.GenerateToken(userID, "claims@example.com", "user")
+		if err != nil {
+			t.Fatalf("GenerateToken() error = %v", err)
+		}
+		if _, ok := tokenPayload(t, token)["email"]; ok == minimal {
+			t.Errorf("Minimal claims %v: email in token = %v", minimal, ok)
+		}
+
+		claims, err := service.ValidateToken(t.Context(), token)
+		if err != nil {
+			t.Fatalf("ValidateToken() error = %v", err)
+		}
+		wantEmail := "claims@example.com"
+		if minimal {
+			wantEmail = ""
+		}
+		if claims.UserID != userID || claims.Role != "user" || claims.Email != wantEmail {
+			t.Errorf("Minimal claims %v: got %+v", minimal, claims)
+		}
+	}
+}
+
+func TestGenerateImpersonationToken(t *testing.T) {
+	service := NewAuthService("test-secret", zap.NewNop())
+	adminID, userID := uuid.New(), uuid.New()
+
+	token, expiresAt, err := service.GenerateImpersonationToken(adminID, userID, "user")
+	if err != nil {
+		t.Fatalf("GenerateImpersonationToken() error = %v", err)
+	}
+	if lifetime := time.Until(expiresAt); lifetime > ImpersonationTokenTTL {
+		t.Errorf("Impersonation token lifetime = %s, want at most %s", lifetime, ImpersonationTokenTTL)
+	}
+
+	claims, err := service.ValidateToken(t.Context(), token)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	if !claims.IsImpersonation() || claims.Act.Subject != adminID || claims.UserID != userID {
+		t.Errorf("ValidateToken() = %+v, want user %s acted on by %s", claims, userID, adminID)
+	}
+
+	regular, err := service.GenerateToken(userID, "", "user")
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if _, ok := tokenPayload(t, regular)["act"]; ok {
+		t.Error("A regular token must not carry an act claim")
+	}
+
+	// A correctly signed token with an act claim and a regular lifetime is not one this service issues
+	forged := &Claims{
+		UserID: userID,
+		Role:   "user",
+		Act:    &models.Actor{Subject: adminID},
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, forged).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	if _, err := service.ValidateToken(t.Context(), signed); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ValidateToken() of a long-lived impersonation token error = %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// bootstrapScript generates a keypair with wg, provisions the public key against the API and writes the
+// returned config with the local private key filled in. The token is read from VPN_TOKEN at run time
+// and only ever handed to curl on stdin, so it appears neither in the script nor in the process list.
+const bootstrapScript = `#!/bin/sh
+# VPN bootstrap: generates a WireGuard keypair on this machine, registers its public key and writes the
+# config. The private key never leaves this machine.
+#
+# Usage: VPN_TOKEN=<access token> sh bootstrap.sh
+set -eu
+
+API_URL={{API_URL}}
+SERVER_ID={{SERVER_ID}}
+CONFIG_PATH="${VPN_CONFIG_PATH:-./vpn.conf}"
+
+if [ -z "${VPN_TOKEN:-}" ]; then
+	echo "Set VPN_TOKEN to your access token" >&2
+	exit 1
+fi
+for cmd in wg curl jq; do
+	if ! command -v "$cmd" >/dev/null 2>&1; then
+		echo "$cmd is required" >&2
+		exit 1
+	fi
+done
+
+umask 077
+private_key=$(wg genkey)
+public_key=$(printf '%s\n' "$private_key" | wg pubkey)
+
+body=$(jq -cn --arg key "$public_key" --arg server "$SERVER_ID" '{public_key: $key, server_id: $server}')
+response=$(printf 'Authorization: Bearer %s\n' "$VPN_TOKEN" |
+	curl -sS -X POST "$API_URL/api/client/config" -H @- -H 'Content-Type: application/json' --data "$body")
+
+if ! printf '%s' "$response" | jq -e '.success == true' >/dev/null 2>&1; then
+	message=$(printf '%s' "$response" | jq -r '.message // empty' 2>/dev/null || true)
+	echo "Provisioning failed: ${message:-unexpected response}" >&2
+	exit 1
+fi
+
+printf '%s' "$response" | VPN_PRIVATE_KEY="$private_key" jq -r '.data |
+	"[Interface]\n" +
+	"PrivateKey = \(env.VPN_PRIVATE_KEY)\n" +
+	"Address = \(.interface.address)\n" +
+	"DNS = \(([.interface.dns] + (.interface.dns_search // [])) | join(", "))\n" +
+	(if .interface.table then "Table = \(.interface.table)\n" else "" end) +
+	"\n[Peer]\n" +
+	"PublicKey = \(.peer.public_key)\n" +
+	"Endpoint = \(.peer.endpoint)\n" +
+	"AllowedIPs = \(.peer.allowed_ips)\n" +
+	(if .peer.persistent_keepalive then "PersistentKeepalive = \(.peer.persistent_keepalive)\n" else "" end)' >"$CONFIG_PATH"
+
+echo "Wrote $CONFIG_PATH"
+`
+
+// RenderBootstrapScript returns a shell script that provisions a locally generated key on the server
+// through the API at apiURL. Every templated value is shell-quoted; no key material is embedded.
+func RenderBootstrapScript(apiURL string, serverID uuid.UUID) string {
+	return strings.NewReplacer(
+		"{{API_URL}}", shellQuote(strings.TrimRight(apiURL, "/")),
+		"{{SERVER_ID}}", shellQuote(serverID.String()),
+	).Replace(bootstrapScript)
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
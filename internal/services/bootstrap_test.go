@@ -0,0 +1,42 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRenderBootstrapScript(t *testing.T) {
+	serverID := uuid.New()
+	script := RenderBootstrapScript("https://vpn.example.com/", serverID)
+
+	for _, want := range []string{
+		"API_URL='https://vpn.example.com'\n",
+		"SERVER_ID='" + serverID.String() + "'\n",
+		"private_key=$(wg genkey)",
+		`"$API_URL/api/client/config"`,
+		`"${VPN_TOKEN:-}"`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected script to contain %q", want)
+		}
+	}
+
+	// The private key is generated by the script; the server puts no key material in it
+	if strings.Contains(script, ClientPrivateKeyPlaceholder) {
+		t.Error("Expected no private key placeholder in the script")
+	}
+	if strings.Contains(script, "{{") {
+		t.Error("Expected every template placeholder to be filled in")
+	}
+}
+
+func TestRenderBootstrapScriptQuotesValues(t *testing.T) {
+	script := RenderBootstrapScript("https://evil.example.com'; rm -rf / #", uuid.New())
+
+	want := `API_URL='https://evil.example.com'\''; rm -rf / #'` + "\n"
+	if !strings.Contains(script, want) {
+		t.Errorf("Expected the API URL to be quoted as a single word, got script:\n%s", script)
+	}
+}
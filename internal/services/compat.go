@@ -0,0 +1,144 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// ClientCompatibility holds the minimum client version accepted on each supported platform
+type ClientCompatibility struct {
+	minVersions map[string]string // platform -> minimum version, platforms lower-cased
+}
+
+// NewClientCompatibility builds the compatibility table from "platform=version" entries
+func NewClientCompatibility(entries []string) (*ClientCompatibility, error) {
+	compat := &ClientCompatibility{minVersions: make(map[string]string, len(entries))}
+	for _, entry := range entries {
+		platform, version, ok := strings.Cut(entry, "=")
+		platform = strings.ToLower(strings.TrimSpace(platform))
+		version = strings.TrimSpace(version)
+		if !ok || platform == "" {
+			return nil, fmt.Errorf("client version entry %q must be platform=version", entry)
+		}
+		if _, err := parseVersion(version); err != nil {
+			return nil, fmt.Errorf("client version entry %q: %w", entry, err)
+		}
+		if _, exists := compat.minVersions[platform]; exists {
+			return nil, fmt.Errorf("client platform %q listed more than once", platform)
+		}
+		compat.minVersions[platform] = version
+	}
+
+	return compat, nil
+}
+
+// Platforms lists the supported platforms and their minimum versions, sorted by platform
+func (c *ClientCompatibility) Platforms() []models.PlatformSupport {
+	platforms := make([]models.PlatformSupport, 0, len(c.minVersions))
+	for platform, version := range c.minVersions {
+		platforms = append(platforms, models.PlatformSupport{Platform: platform, MinVersion: version})
+	}
+	sort.Slice(platforms, func(i, j int) bool {
+		return platforms[i].Platform < platforms[j].Platform
+	})
+	return platforms
+}
+
+// CheckClient returns a warning for a client that should update: one on an unsupported platform or
+// older than its platform's minimum version. A client that does not identify itself, or a table with
+// no platforms, gets no warning.
+func (c *ClientCompatibility) CheckClient(platform, version string) string {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	if platform == "" || len(c.minVersions) == 0 {
+		return ""
+	}
+
+	minVersion, ok := c.minVersions[platform]
+	if !ok {
+		return fmt.Sprintf("Platform %q is not supported", platform)
+	}
+
+	cmp, err := CompareVersions(version, minVersion)
+	if err != nil {
+		return fmt.Sprintf("Client version %q is not recognized; version %s or later is required", version, minVersion)
+	}
+	if cmp < 0 {
+		return fmt.Sprintf("Client version %s is out of date; update to %s or later", version, minVersion)
+	}
+
+	return ""
+}
+
+// version is a parsed dotted version; a pre-release sorts before the release it precedes
+type version struct {
+	parts      []int
+	prerelease string
+}
+
+// parseVersion parses versions like "1.4", "v2.0.1" and "1.5.0-beta.2"
+func parseVersion(s string) (version, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	core, prerelease, _ := strings.Cut(s, "-")
+	if core == "" {
+		return version{}, fmt.Errorf("invalid version %q", s)
+	}
+
+	var v version
+	for _, field := range strings.Split(core, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return version{}, fmt.Errorf("invalid version %q", s)
+		}
+		v.parts = append(v.parts, n)
+	}
+	v.prerelease = prerelease
+
+	return v, nil
+}
+
+// CompareVersions compares two dotted versions, returning -1, 0 or 1 as a is older than, equal to or
+// newer than b. Missing components count as zero, so "1.4" equals "1.4.0"; pre-releases are ordered
+// lexically and before their release.
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < max(len(va.parts), len(vb.parts)); i++ {
+		var pa, pb int
+		if i < len(va.parts) {
+			pa = va.parts[i]
+		}
+		if i < len(vb.parts) {
+			pb = vb.parts[i]
+		}
+		if pa != pb {
+			if pa < pb {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	switch {
+	case va.prerelease == vb.prerelease:
+		return 0, nil
+	case va.prerelease == "":
+		return 1, nil
+	case vb.prerelease == "":
+		return -1, nil
+	case va.prerelease < vb.prerelease:
+		return -1, nil
+	default:
+		return 1, nil
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "1.4.0", b: "1.4.0", want: 0},
+		{a: "1.4", b: "1.4.0", want: 0},
+		{a: "v1.4.1", b: "1.4.0", want: 1},
+		{a: "1.10.0", b: "1.9.9", want: 1},
+		{a: "0.9", b: "1.0", want: -1},
+		{a: "1.5.0-beta", b: "1.5.0", want: -1},
+		{a: "1.5.0-beta.2", b: "1.5.0-beta.1", want: 1},
+		{a: "1.5.0", b: "1.5.0-rc.1", want: 1},
+	}
+
+	for _, tt := range tests {
+		got, err := CompareVersions(tt.a, tt.b)
+		if err != nil {
+			t.Fatalf("CompareVersions(%q, %q) error = %v", tt.a, tt.b, err)
+		}
+		if got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "1.x", "1..2", "-beta"} {
+		if _, err := CompareVersions(invalid, "1.0"); err == nil {
+			t.Errorf("Expected error for version %q", invalid)
+		}
+	}
+}
+
+func TestNewClientCompatibilityRejectsInvalidEntries(t *testing.T) {
+	for _, entries := range [][]string{
+		{"ios"},
+		{"=1.0.0"},
+		{"ios=latest"},
+		{"ios=1.0.0", "iOS=1.1.0"},
+	} {
+		if _, err := NewClientCompatibility(entries); err == nil {
+			t.Errorf("Expected error for %v", entries)
+		}
+	}
+}
+
+func TestCheckClient(t *testing.T) {
+	compat, err := NewClientCompatibility([]string{"ios=1.4.0", "android=2.0"})
+	if err != nil {
+		t.Fatalf("NewClientCompatibility() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		platform    string
+		version     string
+		wantWarning string
+	}{
+		{name: "up to date", platform: "ios", version: "1.4.2"},
+		{name: "exactly the minimum", platform: "Android", version: "2.0.0"},
+		{name: "out of date", platform: "ios", version: "1.3.9", wantWarning: "out of date"},
+		{name: "unrecognized version", platform: "android", version: "nightly", wantWarning: "not recognized"},
+		{name: "unknown platform", platform: "symbian", version: "1.0", wantWarning: "not supported"},
+		{name: "client does not identify itself"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warning := compat.CheckClient(tt.platform, tt.version)
+			if tt.wantWarning == "" {
+				if warning != "" {
+					t.Errorf("Expected no warning, got %q", warning)
+				}
+				return
+			}
+			if !strings.Contains(warning, tt.wantWarning) {
+				t.Errorf("Expected warning containing %q, got %q", tt.wantWarning, warning)
+			}
+		})
+	}
+
+	platforms := compat.Platforms()
+	if len(platforms) != 2 || platforms[0].Platform != "android" || platforms[1].MinVersion != "1.4.0" {
+		t.Errorf("Expected platforms sorted by name, got %+v", platforms)
+	}
+}
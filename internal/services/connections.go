@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// userConnection is one of a user's peers that has handshaked recently
+type userConnection struct {
+	keyID     uuid.UUID
+	serverID  uuid.UUID
+	publicKey string
+	handshake time.Time
+}
+
+// excessConnections returns the connections over limit, keeping the ones with the most recent
+// handshakes. A limit of zero or less allows any number.
+func excessConnections(connections []userConnection, limit int) []userConnection {
+	if limit <= 0 || len(connections) <= limit {
+		return nil
+	}
+
+	sorted := append([]userConnection(nil), connections...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].handshake.Equal(sorted[j].handshake) {
+			return sorted[i].handshake.After(sorted[j].handshake)
+		}
+		// Ties go to the same key on every server so they agree on which peer to drop
+		return sorted[i].keyID.String() < sorted[j].keyID.String()
+	})
+	return sorted[limit:]
+}
+
+// SetConnectionLimit sets how many of a user's peers may be connected at once, across servers, for
+// users without their own limit; zero leaves them unlimited
+func (s *WireguardService) SetConnectionLimit(limit int) {
+	s.connectionLimit = limit
+}
+
+// EnforceConnectionLimits takes this server's peers off the device for users with more peers
+// connected than their limit allows and returns how many were removed. A peer counts as connected
+// with a handshake within ConnectedHandshakeWindow; peers on other servers are judged by the
+// handshake their usage collector last recorded. The peers with the oldest handshakes over the limit
+// are removed, each server dropping only its own. Like an idle disconnect the keys stay active, so
+// the device can reconnect with its next config request.
+func (s *WireguardService) EnforceConnectionLimits(ctx context.Context, serverID uuid.UUID) (int, error) {
+	devicePeers, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	handshakes := make(map[string]time.Time)
+	var connected []string
+	for _, peer := range devicePeers {
+		if IsConnected(peer, now) {
+			handshakes[peer.PublicKey.String()] = peer.LastHandshakeTime
+			connected = append(connected, peer.PublicKey.String())
+		}
+	}
+	if len(connected) == 0 {
+		return 0, nil
+	}
+
+	// Only users connected here are checked; a NULL user limit falls back to the server-wide one
+	query := `
+		SELECT k.id, k.user_id, k.server_id, k.public_key, k.last_used_at,
+			COALESCE(u.max_concurrent_connections, $3)
+		FROM user_keys k
+		JOIN users u ON u.id = k.user_id
+		WHERE k.is_active = true AND k.idle_removed_at IS NULL
+			AND k.user_id IN (
+				SELECT user_id FROM user_keys
+				WHERE server_id = $1 AND public_key = ANY($2) AND is_active = true
+			)
+	`
+	rows, err := s.db.Query(ctx, query, serverID, connected, s.connectionLimit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query connected users' keys: %w", err)
+	}
+
+	connections := make(map[uuid.UUID][]userConnection)
+	limits := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var (
+			conn     userConnection
+			userID   uuid.UUID
+			lastUsed *time.Time
+			limit    int
+		)
+		if err := rows.Scan(&conn.keyID, &userID, &conn.serverID, &conn.publicKey, &lastUsed, &limit); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan connected user's key: %w", err)
+		}
+		limits[userID] = limit
+
+		// The device knows best for its own peers, which the usage collector may not have seen yet
+		if handshake, ok := handshakes[conn.publicKey]; ok {
+			conn.handshake = handshake
+		} else if conn.serverID != serverID && lastUsed != nil && now.Sub(*lastUsed) < ConnectedHandshakeWindow {
+			conn.handshake = *lastUsed
+		} else {
+			continue
+		}
+		connections[userID] = append(connections[userID], conn)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate connected users' keys: %w", err)
+	}
+
+	var excessIDs []uuid.UUID
+	for userID, userConnections := range connections {
+		for _, conn := range excessConnections(userConnections, limits[userID]) {
+			if conn.serverID == serverID {
+				excessIDs = append(excessIDs, conn.keyID)
+			}
+		}
+	}
+	if len(excessIDs) == 0 {
+		return 0, nil
+	}
+
+	markQuery := `
+		UPDATE user_keys SET idle_removed_at = NOW()
+		WHERE id = ANY($1) AND is_active = true AND idle_removed_at IS NULL
+		RETURNING public_key
+	`
+	markRows, err := s.db.Query(ctx, markQuery, excessIDs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark keys over the connection limit: %w", err)
+	}
+	defer markRows.Close()
+
+	var peers []wgtypes.PeerConfig
+	for markRows.Next() {
+		var publicKey string
+		if err := markRows.Scan(&publicKey); err != nil {
+			return 0, fmt.Errorf("failed to scan key over the connection limit: %w", err)
+		}
+		key, err := wgtypes.ParseKey(publicKey)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+	}
+
+	if err := markRows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate keys over the connection limit: %w", err)
+	}
+
+	if len(peers) == 0 {
+		return 0, nil
+	}
+
+	removed, failures, err := s.configurePeers(ctx, peers)
+	for _, failure := range failures {
+		s.logger.Warn("Failed to remove peer over the connection limit",
+			zap.String("public_key", MaskPublicKey(failure.publicKey.String())),
+			zap.Error(failure.err))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to configure WireGuard device: %w", err)
+	}
+
+	s.logger.Info("Disconnected WireGuard peers over the connection limit",
+		zap.String("server_id", serverID.String()),
+		zap.Int("removed_count", removed))
+
+	return removed, nil
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestExcessConnections(t *testing.T) {
+	now := time.Now()
+	newest := userConnection{keyID: uuid.New(), handshake: now}
+	middle := userConnection{keyID: uuid.New(), handshake: now.Add(-time.Minute)}
+	oldest := userConnection{keyID: uuid.New(), handshake: now.Add(-2 * time.Minute)}
+	connections := []userConnection{middle, oldest, newest}
+
+	if excess := excessConnections(connections, 2); len(excess) != 1 || excess[0].keyID != oldest.keyID {
+		t.Errorf("excessConnections() limit 2 = %+v, want only the oldest", excess)
+	}
+	if excess := excessConnections(connections, 1); len(excess) != 2 || excess[0].keyID != middle.keyID || excess[1].keyID != oldest.keyID {
+		t.Errorf("excessConnections() limit 1 = %+v, want all but the newest", excess)
+	}
+	if excess := excessConnections(connections, 3); excess != nil {
+		t.Errorf("excessConnections() at the limit = %+v, want none", excess)
+	}
+	if excess := excessConnections(connections, 0); excess != nil {
+		t.Errorf("excessConnections() without a limit = %+v, want none", excess)
+	}
+	if connections[0].keyID != middle.keyID {
+		t.Error("excessConnections() reordered its input")
+	}
+}
+
+func TestEnforceConnectionLimits(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+	userService := NewUserService(db, logger)
+	servers := []uuid.UUID{
+		newTestServer(t, db, "limit-a", "test"),
+		newTestServer(t, db, "limit-b", "test"),
+		newTestServer(t, db, "limit-c", "test"),
+	}
+
+	client := &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}}
+	service := NewWireguardServiceWithClient(logger, client)
+	service.SetDB(db)
+	service.SetConnectionLimit(2)
+
+	// connect provisions the user on every server, the peer on the first handshaking most recently
+	connect := func(userID uuid.UUID) []string {
+		t.Helper()
+		keys := make([]string, len(servers))
+		for i, serverID := range servers {
+			keys[i] = newTestPeers(t, 1)[0].PublicKey.String()
+			if _, err := service.AddUserKey(ctx, userID, serverID, keys[i]); err != nil {
+				t.Fatalf("AddUserKey() error = %v", err)
+			}
+		}
+
+		client.mu.Lock()
+		for i, peer := range client.device.Peers {
+			for j, publicKey := range keys {
+				if peer.PublicKey.String() == publicKey {
+					client.device.Peers[i].LastHandshakeTime = time.Now().Add(-time.Duration(j*30) * time.Second)
+				}
+			}
+		}
+		client.mu.Unlock()
+		return keys
+	}
+
+	limited := newTestUser(t, userService)
+	limitedKeys := connect(limited.ID)
+	unlimited := newTestUser(t, userService)
+	unlimitedKeys := connect(unlimited.ID)
+	anyNumber := 0
+	if err := userService.SetUserConnectionLimit(ctx, unlimited.ID, &anyNumber); err != nil {
+		t.Fatalf("SetUserConnectionLimit() error = %v", err)
+	}
+
+	// Servers holding connections within the limit leave them alone
+	for _, serverID := range servers[:2] {
+		removed, err := service.EnforceConnectionLimits(ctx, serverID)
+		if err != nil {
+			t.Fatalf("EnforceConnectionLimits() error = %v", err)
+		}
+		if removed != 0 {
+			t.Errorf("EnforceConnectionLimits() on a server within the limit removed %d peers", removed)
+		}
+	}
+
+	removed, err := service.EnforceConnectionLimits(ctx, servers[2])
+	if err != nil {
+		t.Fatalf("EnforceConnectionLimits() error = %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("EnforceConnectionLimits() removed %d peers, want 1", removed)
+	}
+	if client.hasPeer(limitedKeys[2]) {
+		t.Error("The peer with the oldest handshake should be removed from the device")
+	}
+	for _, publicKey := range []string{limitedKeys[0], limitedKeys[1], unlimitedKeys[2]} {
+		if !client.hasPeer(publicKey) {
+			t.Errorf("Peer %s should stay on the device", MaskPublicKey(publicKey))
+		}
+	}
+
+	var active bool
+	var idleRemovedAt *time.Time
+	if err := db.QueryRow(ctx, `SELECT is_active, idle_removed_at FROM user_keys WHERE public_key = $1`, limitedKeys[2]).Scan(&active, &idleRemovedAt); err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	if !active || idleRemovedAt == nil {
+		t.Error("A key over the connection limit should stay active and be marked for restoring")
+	}
+
+	// A per-user limit tightens the server-wide one
+	one := 1
+	if err := userService.SetUserConnectionLimit(ctx, limited.ID, &one); err != nil {
+		t.Fatalf("SetUserConnectionLimit() error = %v", err)
+	}
+	if removed, err := service.EnforceConnectionLimits(ctx, servers[1]); err != nil || removed != 1 {
+		t.Errorf("EnforceConnectionLimits() with a per-user limit removed %d peers (err %v), want 1", removed, err)
+	}
+	if client.hasPeer(limitedKeys[1]) || !client.hasPeer(limitedKeys[0]) {
+		t.Error("Only the most recently handshaked peer should stay connected")
+	}
+
+	if err := userService.SetUserConnectionLimit(ctx, uuid.New(), nil); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("SetUserConnectionLimit() for an unknown user error = %v, want ErrUserNotFound", err)
+	}
+}
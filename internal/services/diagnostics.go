@@ -0,0 +1,74 @@
+package services
+
+import (
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Diagnosis codes reported to clients, from the most to the least fundamental problem
+const (
+	DiagnosisNoKey          = "no_key"
+	DiagnosisIdleRemoved    = "idle_removed"
+	DiagnosisPeerMissing    = "peer_missing"
+	DiagnosisNoHandshake    = "no_handshake"
+	DiagnosisHandshakeStale = "handshake_stale"
+	DiagnosisOtherServer    = "other_server"
+	DiagnosisOtherDevice    = "other_device"
+	DiagnosisHealthy        = "healthy"
+)
+
+// Diagnose correlates what a client reports with the server's view of its key and peer: userKey is
+// the user's active key on the server (nil when there is none), peer is that key's peer on the device
+// (nil when it is not programmed) and clientHandshake is the last handshake the client saw, if any.
+// Only the first problem found is reported, since fixing it usually changes the rest.
+func Diagnose(userKey *models.UserKey, peer *wgtypes.Peer, clientHandshake *time.Time, now time.Time) models.Diagnosis {
+	switch {
+	case userKey == nil:
+		return models.Diagnosis{
+			Code:    DiagnosisNoKey,
+			Message: "No active configuration for this server; request a config to provision one",
+		}
+	case userKey.IdleRemovedAt != nil:
+		return models.Diagnosis{
+			Code:    DiagnosisIdleRemoved,
+			Message: "Peer was disconnected for inactivity; request the config again to restore it",
+		}
+	case peer == nil:
+		return models.Diagnosis{
+			Code:    DiagnosisPeerMissing,
+			Message: "Peer not programmed on the server; try re-provisioning",
+		}
+	}
+
+	clientConnected := clientHandshake != nil && now.Sub(*clientHandshake) < ConnectedHandshakeWindow
+	serverConnected := IsConnected(*peer, now)
+
+	switch {
+	case clientConnected && !serverConnected:
+		// The client has a live tunnel, just not with this key on this server
+		return models.Diagnosis{
+			Code:    DiagnosisOtherServer,
+			Message: "Client reports a recent handshake this server has not seen; check the config points at this server",
+		}
+	case peer.LastHandshakeTime.IsZero():
+		return models.Diagnosis{
+			Code:    DiagnosisNoHandshake,
+			Message: "Server has never seen a handshake from this key; check the endpoint is reachable and the config is current",
+		}
+	case !serverConnected:
+		return models.Diagnosis{
+			Code:    DiagnosisHandshakeStale,
+			Message: "Handshake stale; check persistent keepalive and NAT",
+		}
+	case clientHandshake != nil && !clientConnected:
+		// The server keeps hearing from this key, but not from this client
+		return models.Diagnosis{
+			Code:    DiagnosisOtherDevice,
+			Message: "Server sees recent handshakes from this key that the client has not; the config may be in use on another device",
+		}
+	}
+
+	return models.Diagnosis{Code: DiagnosisHealthy, Message: "Connection looks healthy"}
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDiagnose(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-30 * time.Second)
+	stale := now.Add(-10 * time.Minute)
+	idleAt := now.Add(-time.Hour)
+
+	key := &models.UserKey{IsActive: true}
+	peerAt := func(handshake time.Time) *wgtypes.Peer {
+		return &wgtypes.Peer{LastHandshakeTime: handshake}
+	}
+
+	tests := []struct {
+		name            string
+		userKey         *models.UserKey
+		peer            *wgtypes.Peer
+		clientHandshake *time.Time
+		want            string
+	}{
+		{name: "no key", want: DiagnosisNoKey},
+		{name: "idle removed", userKey: &models.UserKey{IsActive: true, IdleRemovedAt: &idleAt}, want: DiagnosisIdleRemoved},
+		{name: "peer missing", userKey: key, want: DiagnosisPeerMissing},
+		{name: "peer missing despite client handshake", userKey: key, clientHandshake: &recent, want: DiagnosisPeerMissing},
+		{name: "never handshaked", userKey: key, peer: peerAt(time.Time{}), want: DiagnosisNoHandshake},
+		{name: "stale handshake", userKey: key, peer: peerAt(stale), want: DiagnosisHandshakeStale},
+		{name: "stale handshake seen by both", userKey: key, peer: peerAt(stale), clientHandshake: &stale, want: DiagnosisHandshakeStale},
+		{name: "client connected elsewhere", userKey: key, peer: peerAt(stale), clientHandshake: &recent, want: DiagnosisOtherServer},
+		{name: "key used by another device", userKey: key, peer: peerAt(recent), clientHandshake: &stale, want: DiagnosisOtherDevice},
+		{name: "healthy", userKey: key, peer: peerAt(recent), clientHandshake: &recent, want: DiagnosisHealthy},
+		{name: "healthy without client report", userKey: key, peer: peerAt(recent), want: DiagnosisHealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Diagnose(tt.userKey, tt.peer, tt.clientHandshake, now)
+			if got.Code != tt.want {
+				t.Errorf("Diagnose() = %q (%s), want %q", got.Code, got.Message, tt.want)
+			}
+			if got.Message == "" {
+				t.Error("Expected a message with the diagnosis")
+			}
+		})
+	}
+}
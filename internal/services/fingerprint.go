@@ -0,0 +1,36 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// CertificateFingerprint returns the SHA-256 fingerprints of a certificate and of its public key
+// (SPKI), the two forms clients commonly pin
+func CertificateFingerprint(cert *x509.Certificate) *models.CertificateFingerprint {
+	certSum := sha256.Sum256(cert.Raw)
+	spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return &models.CertificateFingerprint{
+		SHA256:     hex.EncodeToString(certSum[:]),
+		SPKISHA256: base64.StdEncoding.EncodeToString(spkiSum[:]),
+		NotAfter:   cert.NotAfter.UTC(),
+	}
+}
+
+// KeyFingerprint returns the hex SHA-256 of a base64 WireGuard public key's raw bytes
+func KeyFingerprint(publicKey string) (string, error) {
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %w", err)
+	}
+
+	sum := sha256.Sum256(key[:])
+	return hex.EncodeToString(sum[:]), nil
+}
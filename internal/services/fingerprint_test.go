@@ -0,0 +1,113 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestCertificateFingerprint(t *testing.T) {
+	certPEM, keyPEM := newTestCertificate(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	// Load the certificate the way the server does
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() error = %v", err)
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+
+	fingerprint := CertificateFingerprint(leaf)
+
+	// Equivalent to `openssl x509 -noout -fingerprint -sha256` on the configured file
+	block, _ := pem.Decode(certPEM)
+	want := sha256.Sum256(block.Bytes)
+	if fingerprint.SHA256 != hex.EncodeToString(want[:]) {
+		t.Errorf("SHA256 = %s, want %x", fingerprint.SHA256, want)
+	}
+
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	if fingerprint.SPKISHA256 != base64.StdEncoding.EncodeToString(spki[:]) {
+		t.Errorf("SPKISHA256 = %s, want %s", fingerprint.SPKISHA256, base64.StdEncoding.EncodeToString(spki[:]))
+	}
+	if !fingerprint.NotAfter.Equal(leaf.NotAfter) {
+		t.Errorf("NotAfter = %v, want %v", fingerprint.NotAfter, leaf.NotAfter)
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKey() error = %v", err)
+	}
+	publicKey := privateKey.PublicKey()
+
+	got, err := KeyFingerprint(publicKey.String())
+	if err != nil {
+		t.Fatalf("KeyFingerprint() error = %v", err)
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(publicKey.String())
+	want := sha256.Sum256(raw)
+	if got != hex.EncodeToString(want[:]) {
+		t.Errorf("KeyFingerprint() = %s, want %x", got, want)
+	}
+
+	if _, err := KeyFingerprint("not-a-key"); err == nil {
+		t.Error("Expected error for invalid key")
+	}
+}
+
+// newTestCertificate returns a PEM-encoded self-signed certificate and its private key
+func newTestCertificate(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vpn.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{"vpn.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// PeerFirewall filters the traffic the server forwards from peers. WireGuard only accepts packets from
+// a peer whose source is one of its device-side AllowedIPs, the peer's tunnel address, so rules keyed
+// on that address hold a client to its allowed networks whatever routes it configures itself.
+type PeerFirewall interface {
+	// SetPeerPolicy limits the traffic forwarded from a tunnel address to networks; no networks lifts
+	// the limit
+	SetPeerPolicy(address string, networks []string) error
+}
+
+// policyChain is the chain traffic forwarded from the WireGuard interface is sent through
+const policyChain = "VPN-POLICY"
+
+// commandRunner runs a command with stdin as its input
+type commandRunner func(stdin, name string, args ...string) error
+
+// IPTablesFirewall is a PeerFirewall backed by iptables and ip6tables. Each restricted address gets a
+// chain of its own that returns for its allowed networks and drops everything else.
+type IPTablesFirewall struct {
+	iface  string
+	logger *zap.Logger
+	run    commandRunner
+
+	mu sync.Mutex
+	// ipv6 is whether ip6tables could be set up; IPv6 addresses cannot be restricted without it
+	ipv6 bool
+	// restricted holds the addresses whose chain the policy chain jumps to
+	restricted map[string]bool
+}
+
+// NewIPTablesFirewall sets up the policy chain for traffic forwarded from iface. A chain left by a
+// previous run is emptied, so policies must be applied again, as peer reconciliation does.
+func NewIPTablesFirewall(iface string, logger *zap.Logger) (*IPTablesFirewall, error) {
+	return newIPTablesFirewall(iface, logger, runCommand)
+}
+
+func newIPTablesFirewall(iface string, logger *zap.Logger, run commandRunner) (*IPTablesFirewall, error) {
+	f := &IPTablesFirewall{
+		iface:      iface,
+		logger:     logger,
+		run:        run,
+		restricted: make(map[string]bool),
+	}
+
+	if err := f.setup("iptables"); err != nil {
+		return nil, err
+	}
+	if err := f.setup("ip6tables"); err != nil {
+		logger.Warn("IPv6 peer policies are unavailable", zap.Error(err))
+	} else {
+		f.ipv6 = true
+	}
+
+	return f, nil
+}
+
+// setup creates or empties the policy chain and sends the interface's forwarded traffic through it
+func (f *IPTablesFirewall) setup(binary string) error {
+	// With --noflush, restore creates a declared chain or flushes the existing one, leaving the rest alone
+	if err := f.run(fmt.Sprintf("*filter\n:%s - [0:0]\nCOMMIT\n", policyChain), binary+"-restore", "--noflush"); err != nil {
+		return fmt.Errorf("failed to create %s chain: %w", policyChain, err)
+	}
+
+	jump := []string{"FORWARD", "-i", f.iface, "-j", policyChain}
+	if f.run("", binary, append([]string{"-C"}, jump...)...) == nil {
+		return nil
+	}
+	if err := f.run("", binary, append([]string{"-I"}, jump...)...); err != nil {
+		return fmt.Errorf("failed to hook %s chain: %w", policyChain, err)
+	}
+	return nil
+}
+
+// SetPeerPolicy implements PeerFirewall. A peer's chain is replaced in one restore, so its traffic is
+// never let through unfiltered while the policy changes.
+func (f *IPTablesFirewall) SetPeerPolicy(address string, networks []string) error {
+	prefix, err := netip.ParsePrefix(address)
+	if err != nil {
+		return fmt.Errorf("invalid peer address %q: %w", address, err)
+	}
+	prefix = prefix.Masked()
+	source := prefix.String()
+
+	binary := "iptables"
+	if prefix.Addr().Is6() {
+		binary = "ip6tables"
+	}
+	sum := sha256.Sum256([]byte(source))
+	chain := "VPN-P-" + hex.EncodeToString(sum[:8])
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(networks) == 0 {
+		if !f.restricted[source] {
+			return nil
+		}
+		// The emptied chain is left behind for the address's next policy
+		if err := f.run("", binary, "-D", policyChain, "-s", source, "-j", chain); err != nil {
+			return fmt.Errorf("failed to lift policy for %s: %w", source, err)
+		}
+		delete(f.restricted, source)
+		return nil
+	}
+
+	if prefix.Addr().Is6() && !f.ipv6 {
+		return fmt.Errorf("cannot restrict %s: ip6tables is unavailable", source)
+	}
+
+	var rules strings.Builder
+	fmt.Fprintf(&rules, "*filter\n:%s - [0:0]\n", chain)
+	for _, network := range networks {
+		allowed, err := netip.ParsePrefix(network)
+		if err != nil {
+			return fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		// Networks of the other address family are left to that family's address
+		if allowed.Addr().Is6() != prefix.Addr().Is6() {
+			continue
+		}
+		fmt.Fprintf(&rules, "-A %s -d %s -j RETURN\n", chain, allowed.Masked())
+	}
+	fmt.Fprintf(&rules, "-A %s -j DROP\nCOMMIT\n", chain)
+
+	if err := f.run(rules.String(), binary+"-restore", "--noflush"); err != nil {
+		return fmt.Errorf("failed to set policy for %s: %w", source, err)
+	}
+
+	if !f.restricted[source] {
+		if err := f.run("", binary, "-A", policyChain, "-s", source, "-j", chain); err != nil {
+			return fmt.Errorf("failed to set policy for %s: %w", source, err)
+		}
+		f.restricted[source] = true
+	}
+
+	return nil
+}
+
+// runCommand runs a command, returning its output with the error when it fails
+func runCommand(stdin, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
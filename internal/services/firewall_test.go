@@ -0,0 +1,133 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// recordedCommand is a command run through a recording commandRunner
+type recordedCommand struct {
+	stdin string
+	line  string
+}
+
+// commandRecorder records commands, failing those whose line starts with a prefix in fail
+type commandRecorder struct {
+	commands []recordedCommand
+	fail     []string
+}
+
+func (r *commandRecorder) run(stdin, name string, args ...string) error {
+	line := strings.Join(append([]string{name}, args...), " ")
+	r.commands = append(r.commands, recordedCommand{stdin: stdin, line: line})
+	for _, prefix := range r.fail {
+		if strings.HasPrefix(line, prefix) {
+			return errors.New("command failed")
+		}
+	}
+	return nil
+}
+
+func (r *commandRecorder) lines() []string {
+	lines := make([]string, 0, len(r.commands))
+	for _, command := range r.commands {
+		lines = append(lines, command.line)
+	}
+	return lines
+}
+
+func TestIPTablesFirewallSetup(t *testing.T) {
+	recorder := &commandRecorder{fail: []string{"iptables -C", "ip6tables -C"}}
+	if _, err := newIPTablesFirewall("wg0", zap.NewNop(), recorder.run); err != nil {
+		t.Fatalf("newIPTablesFirewall() error = %v", err)
+	}
+
+	want := []string{
+		"iptables-restore --noflush",
+		"iptables -C FORWARD -i wg0 -j VPN-POLICY",
+		"iptables -I FORWARD -i wg0 -j VPN-POLICY",
+		"ip6tables-restore --noflush",
+		"ip6tables -C FORWARD -i wg0 -j VPN-POLICY",
+		"ip6tables -I FORWARD -i wg0 -j VPN-POLICY",
+	}
+	if got := recorder.lines(); !slices.Equal(got, want) {
+		t.Errorf("Expected commands %q, got %q", want, got)
+	}
+	if stdin := recorder.commands[0].stdin; !strings.Contains(stdin, ":VPN-POLICY - [0:0]") {
+		t.Errorf("Expected the policy chain to be declared, got %q", stdin)
+	}
+
+	// An existing hook is not added twice
+	recorder = &commandRecorder{}
+	if _, err := newIPTablesFirewall("wg0", zap.NewNop(), recorder.run); err != nil {
+		t.Fatalf("newIPTablesFirewall() error = %v", err)
+	}
+	if slices.Contains(recorder.lines(), "iptables -I FORWARD -i wg0 -j VPN-POLICY") {
+		t.Error("Expected an existing hook to be kept")
+	}
+
+	// IPv4 is required
+	recorder = &commandRecorder{fail: []string{"iptables-restore"}}
+	if _, err := newIPTablesFirewall("wg0", zap.NewNop(), recorder.run); err == nil {
+		t.Error("Expected setup to fail without iptables")
+	}
+}
+
+func TestIPTablesFirewallSetPeerPolicy(t *testing.T) {
+	recorder := &commandRecorder{}
+	firewall, err := newIPTablesFirewall("wg0", zap.NewNop(), recorder.run)
+	if err != nil {
+		t.Fatalf("newIPTablesFirewall() error = %v", err)
+	}
+
+	recorder.commands = nil
+	networks := []string{"10.20.0.0/16", "1.1.1.1/32", "2606:4700:4700::1111/128"}
+	if err := firewall.SetPeerPolicy("10.0.0.2/32", networks); err != nil {
+		t.Fatalf("SetPeerPolicy() error = %v", err)
+	}
+	if len(recorder.commands) != 2 {
+		t.Fatalf("Expected a restore and a jump, got %q", recorder.lines())
+	}
+	rules := recorder.commands[0].stdin
+	for _, rule := range []string{"-d 10.20.0.0/16 -j RETURN", "-d 1.1.1.1/32 -j RETURN", "-j DROP\nCOMMIT"} {
+		if !strings.Contains(rules, rule) {
+			t.Errorf("Expected rules to contain %q, got %q", rule, rules)
+		}
+	}
+	if strings.Contains(rules, "2606:4700") {
+		t.Errorf("Expected IPv6 networks left out of an IPv4 chain, got %q", rules)
+	}
+	chain := strings.Fields(recorder.commands[1].line)[6]
+	if want := "iptables -A VPN-POLICY -s 10.0.0.2/32 -j " + chain; recorder.commands[1].line != want || !strings.HasPrefix(chain, "VPN-P-") {
+		t.Errorf("Expected jump %q, got %q", want, recorder.commands[1].line)
+	}
+
+	// A changed policy replaces the chain's rules without adding another jump
+	recorder.commands = nil
+	if err := firewall.SetPeerPolicy("10.0.0.2/32", []string{"10.30.0.0/16"}); err != nil {
+		t.Fatalf("SetPeerPolicy() error = %v", err)
+	}
+	if got := recorder.lines(); !slices.Equal(got, []string{"iptables-restore --noflush"}) {
+		t.Errorf("Expected only a restore, got %q", got)
+	}
+
+	// Lifting the policy unhooks the chain; an unrestricted address needs nothing
+	recorder.commands = nil
+	if err := firewall.SetPeerPolicy("10.0.0.2/32", nil); err != nil {
+		t.Fatalf("SetPeerPolicy() error = %v", err)
+	}
+	if err := firewall.SetPeerPolicy("10.0.0.3/32", nil); err != nil {
+		t.Fatalf("SetPeerPolicy() error = %v", err)
+	}
+	if got := recorder.lines(); !slices.Equal(got, []string{"iptables -D VPN-POLICY -s 10.0.0.2/32 -j " + chain}) {
+		t.Errorf("Expected the jump deleted, got %q", got)
+	}
+
+	if err := firewall.SetPeerPolicy("not-an-address", networks); err == nil {
+		t.Error("Expected an invalid address to be rejected")
+	}
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// ErrLocationUnknown is returned by a GeoLocator when an address is not covered by its database
+var ErrLocationUnknown = errors.New("location unknown")
+
+// GeoLocator resolves an IP address to a coarse location
+type GeoLocator interface {
+	Locate(addr netip.Addr) (*models.GeoLocation, error)
+}
+
+// geoRange is one network of a CSV geo database, stored as an inclusive address range
+type geoRange struct {
+	first, last netip.Addr
+	location    models.GeoLocation
+}
+
+// CSVGeoLocator is a GeoLocator backed by a CSV file of "network,country[,region[,asn]]" rows,
+// where network is a CIDR and asn is a number with or without an "AS" prefix. Networks must not overlap.
+type CSVGeoLocator struct {
+	ranges []geoRange // sorted by first address
+}
+
+// NewCSVGeoLocator loads a CSV geo database from a file
+func NewCSVGeoLocator(path string) (*CSVGeoLocator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open geo database: %w", err)
+	}
+	defer f.Close()
+
+	return ParseCSVGeoDatabase(f)
+}
+
+// ParseCSVGeoDatabase reads a CSV geo database; blank lines and lines starting with # are ignored
+func ParseCSVGeoDatabase(r io.Reader) (*CSVGeoLocator, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	locator := &CSVGeoLocator{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read geo database: %w", err)
+		}
+		if len(record) < 2 {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("geo database line %d: expected network and country", line)
+		}
+
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("geo database line %d: %w", line, err)
+		}
+		prefix = prefix.Masked()
+
+		entry := geoRange{
+			first:    prefix.Addr(),
+			last:     lastAddr(prefix),
+			location: models.GeoLocation{Country: strings.TrimSpace(record[1])},
+		}
+		if len(record) > 2 {
+			entry.location.Region = strings.TrimSpace(record[2])
+		}
+		if len(record) > 3 {
+			if entry.location.ASN, err = parseASN(record[3]); err != nil {
+				line, _ := reader.FieldPos(3)
+				return nil, fmt.Errorf("geo database line %d: %w", line, err)
+			}
+		}
+		locator.ranges = append(locator.ranges, entry)
+	}
+
+	sort.Slice(locator.ranges, func(i, j int) bool {
+		return locator.ranges[i].first.Less(locator.ranges[j].first)
+	})
+
+	return locator, nil
+}
+
+// Locate returns the location of the network containing addr
+func (l *CSVGeoLocator) Locate(addr netip.Addr) (*models.GeoLocation, error) {
+	addr = addr.Unmap()
+
+	// Find the last range starting at or before addr
+	i := sort.Search(len(l.ranges), func(i int) bool {
+		return addr.Less(l.ranges[i].first)
+	}) - 1
+	if i < 0 {
+		return nil, ErrLocationUnknown
+	}
+
+	entry := l.ranges[i]
+	if addr.BitLen() != entry.first.BitLen() || entry.last.Less(addr) {
+		return nil, ErrLocationUnknown
+	}
+
+	location := entry.location
+	return &location, nil
+}
+
+// parseASN parses an autonomous system number such as "64500" or "AS64500"; blank is zero
+func parseASN(value string) (uint32, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if len(value) > 2 && strings.EqualFold(value[:2], "AS") {
+		value = value[2:]
+	}
+	asn, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ASN %q", value)
+	}
+	return uint32(asn), nil
+}
+
+// lastAddr returns the last address of a masked prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestCSVGeoLocator(t *testing.T) {
+	database := `# network,country,region,asn
+203.0.113.0/24,NL,North Holland,AS64500
+198.51.100.0/25,DE
+2001:db8::/32,US,California,64501
+`
+	locator, err := ParseCSVGeoDatabase(strings.NewReader(database))
+	if err != nil {
+		t.Fatalf("ParseCSVGeoDatabase() error = %v", err)
+	}
+
+	tests := []struct {
+		addr        string
+		wantCountry string
+		wantRegion  string
+		wantASN     uint32
+	}{
+		{addr: "203.0.113.0", wantCountry: "NL", wantRegion: "North Holland", wantASN: 64500},
+		{addr: "203.0.113.255", wantCountry: "NL", wantRegion: "North Holland", wantASN: 64500},
+		{addr: "::ffff:203.0.113.7", wantCountry: "NL", wantRegion: "North Holland", wantASN: 64500},
+		{addr: "198.51.100.127", wantCountry: "DE"},
+		{addr: "198.51.100.128"},
+		{addr: "192.0.2.1"},
+		{addr: "2001:db8:ffff::1", wantCountry: "US", wantRegion: "California", wantASN: 64501},
+		{addr: "2001:db9::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			location, err := locator.Locate(netip.MustParseAddr(tt.addr))
+			if tt.wantCountry == "" {
+				if !errors.Is(err, ErrLocationUnknown) {
+					t.Errorf("Locate() error = %v, want ErrLocationUnknown", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Locate() error = %v", err)
+			}
+			if location.Country != tt.wantCountry || location.Region != tt.wantRegion || location.ASN != tt.wantASN {
+				t.Errorf("Locate() = %+v, want %s/%s/AS%d", location, tt.wantCountry, tt.wantRegion, tt.wantASN)
+			}
+		})
+	}
+}
+
+func TestParseCSVGeoDatabaseRejectsInvalidRows(t *testing.T) {
+	for _, database := range []string{"203.0.113.0/24\n", "not-a-network,NL\n", "203.0.113.0/24,NL,,ASX\n"} {
+		if _, err := ParseCSVGeoDatabase(strings.NewReader(database)); err == nil {
+			t.Errorf("Expected error for %q", database)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidInvite is returned when an invite code is unknown, already used, or expired
+var ErrInvalidInvite = errors.New("invalid invite code")
+
+// InviteService handles invite codes for invite-only registration
+type InviteService struct {
+	db     *pgxpool.Pool
+	logger *zap.Logger
+}
+
+// NewInviteService creates a new invite service
+func NewInviteService(db *pgxpool.Pool, logger *zap.Logger) *InviteService {
+	return &InviteService{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// CreateInvite creates a single-use invite code; a zero ttl creates a code that never expires
+func (s *InviteService) CreateInvite(ctx context.Context, createdBy uuid.UUID, ttl time.Duration) (*models.Invite, error) {
+	code, err := generateInviteCode()
+	if err != nil {
+		return nil, err
+	}
+
+	var expiresAt *time.Time
+	if ttl > 0 {
+		expiry := time.Now().Add(ttl).UTC()
+		expiresAt = &expiry
+	}
+
+	invite := &models.Invite{}
+	query := `
+		INSERT INTO invites (code, created_by, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id, code, created_by, expires_at, created_at
+	`
+
+	err = s.db.QueryRow(ctx, query, code, createdBy, expiresAt).Scan(
+		&invite.ID,
+		&invite.Code,
+		&invite.CreatedBy,
+		&invite.ExpiresAt,
+		&invite.CreatedAt,
+	)
+
+	if err != nil {
+		s.logger.Error("Failed to create invite", zap.Error(err))
+		return nil, fmt.Errorf("failed to create invite: %w", err)
+	}
+
+	s.logger.Info("Invite created",
+		zap.String("invite_id", invite.ID.String()),
+		zap.String("created_by", createdBy.String()))
+
+	return invite, nil
+}
+
+// generateInviteCode returns a random hex invite code
+func generateInviteCode() (string, error) {
+	var code [16]byte
+	if _, err := rand.Read(code[:]); err != nil {
+		return "", fmt.Errorf("failed to generate invite code: %w", err)
+	}
+	return hex.EncodeToString(code[:]), nil
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// SetKeyPepper makes the service store a keyed hash of each client public key and match keys by it.
+// A key's raw value is kept only while its peer is active, since the device must be programmed with
+// it; deactivated keys are left with just the hash. Changing the pepper makes existing hashes
+// unmatchable, and an empty pepper stores and matches raw keys.
+func (s *WireguardService) SetKeyPepper(pepper []byte) {
+	if len(pepper) == 0 {
+		s.keyPepper = nil
+		return
+	}
+	s.keyPepper = pepper
+}
+
+// hashPublicKey returns the hex HMAC-SHA256 of a public key under the pepper
+func hashPublicKey(pepper []byte, publicKey string) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(publicKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keyHash returns the hash to store alongside a public key, or nil when keys are not hashed
+func (s *WireguardService) keyHash(publicKey string) *string {
+	if s.keyPepper == nil {
+		return nil
+	}
+	hash := hashPublicKey(s.keyPepper, publicKey)
+	return &hash
+}
+
+// keyLookup returns the value matched against COALESCE(public_key_hash, public_key) to find a
+// stored key: its hash when keys are hashed, otherwise the key itself
+func (s *WireguardService) keyLookup(publicKey string) string {
+	if s.keyPepper == nil {
+		return publicKey
+	}
+	return hashPublicKey(s.keyPepper, publicKey)
+}
+
+// HashStoredKeys brings stored key hashes in line with the current pepper and returns how many keys
+// were changed. With a pepper, every key whose raw value is still stored is hashed under it, including
+// keys hashed under an earlier pepper, and the raw values of deactivated keys are dropped; revoked
+// keys recorded unhashed are hashed too. Without a pepper the hashes of keys with a raw value are
+// cleared, so lookups by the raw key find them again. Keys left with only a hash under another pepper
+// cannot be recovered and no longer match. It is safe to repeat.
+func (s *WireguardService) HashStoredKeys(ctx context.Context) (int, error) {
+	if s.keyPepper == nil {
+		result, err := s.db.Exec(ctx, `UPDATE user_keys SET public_key_hash = NULL WHERE public_key_hash IS NOT NULL AND public_key IS NOT NULL`)
+		if err != nil {
+			return 0, fmt.Errorf("failed to clear key hashes: %w", err)
+		}
+		cleared := int(result.RowsAffected())
+		if cleared > 0 {
+			s.logger.Info("Cleared stored public key hashes", zap.Int("cleared_count", cleared))
+		}
+		return cleared, nil
+	}
+
+	rows, err := s.db.Query(ctx, `SELECT id, public_key, COALESCE(public_key_hash, '') FROM user_keys WHERE public_key IS NOT NULL`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query stored keys: %w", err)
+	}
+
+	var ids []uuid.UUID
+	var keys, hashes []string
+	for rows.Next() {
+		var id uuid.UUID
+		var publicKey, storedHash string
+		if err := rows.Scan(&id, &publicKey, &storedHash); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan stored key: %w", err)
+		}
+		hash := hashPublicKey(s.keyPepper, publicKey)
+		if hash == storedHash {
+			continue
+		}
+		ids = append(ids, id)
+		keys = append(keys, publicKey)
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate stored keys: %w", err)
+	}
+
+	hashed := 0
+	if len(ids) > 0 {
+		// A key rotated since the query keeps its new, already hashed value
+		query := `
+			UPDATE user_keys k
+			SET public_key_hash = h.hash,
+				public_key = CASE WHEN k.is_active THEN k.public_key END
+			FROM unnest($1::uuid[], $2::text[], $3::text[]) AS h(id, public_key, hash)
+			WHERE k.id = h.id AND k.public_key = h.public_key
+		`
+		result, err := s.db.Exec(ctx, query, ids, keys, hashes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to store key hashes: %w", err)
+		}
+		hashed = int(result.RowsAffected())
+		s.logger.Info("Hashed stored public keys", zap.Int("hashed_count", hashed))
+	}
+
+	if err := s.hashRevokedKeys(ctx); err != nil {
+		return hashed, err
+	}
+
+	return hashed, nil
+}
+
+// hashRevokedKeys replaces the raw keys recorded in revoked_keys before hashing was enabled with
+// their hashes. Raw keys are told apart by length: base64 WireGuard keys are 44 characters and the
+// hex hashes 64.
+func (s *WireguardService) hashRevokedKeys(ctx context.Context) error {
+	rows, err := s.db.Query(ctx, `SELECT DISTINCT key_lookup FROM revoked_keys WHERE length(key_lookup) <> 64`)
+	if err != nil {
+		return fmt.Errorf("failed to query unhashed revoked keys: %w", err)
+	}
+
+	var keys, hashes []string
+	for rows.Next() {
+		var publicKey string
+		if err := rows.Scan(&publicKey); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan unhashed revoked key: %w", err)
+		}
+		keys = append(keys, publicKey)
+		hashes = append(hashes, hashPublicKey(s.keyPepper, publicKey))
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate unhashed revoked keys: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	query := `
+		WITH raw AS (
+			DELETE FROM revoked_keys r
+			USING unnest($1::text[], $2::text[]) AS h(public_key, hash)
+			WHERE r.key_lookup = h.public_key
+			RETURNING r.user_id, r.server_id, h.hash, r.revoked_at
+		)
+		INSERT INTO revoked_keys (user_id, server_id, key_lookup, revoked_at)
+		SELECT user_id, server_id, hash, revoked_at FROM raw
+		ON CONFLICT (user_id, server_id, key_lookup) DO NOTHING
+	`
+	if _, err := s.db.Exec(ctx, query, keys, hashes); err != nil {
+		return fmt.Errorf("failed to store revoked key hashes: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestKeyLookup(t *testing.T) {
+	service := NewWireguardServiceWithClient(zap.NewNop(), &fakeWGClient{})
+	publicKey := newTestPeers(t, 1)[0].PublicKey.String()
+
+	if got := service.keyLookup(publicKey); got != publicKey {
+		t.Errorf("keyLookup() without a pepper = %q, want the raw key", got)
+	}
+	if service.keyHash(publicKey) != nil {
+		t.Error("keyHash() without a pepper should be nil")
+	}
+
+	service.SetKeyPepper([]byte("first-pepper"))
+	first := service.keyLookup(publicKey)
+	if first == publicKey || len(first) != 64 {
+		t.Errorf("keyLookup() with a pepper = %q, want a hex HMAC", first)
+	}
+	if hash := service.keyHash(publicKey); hash == nil || *hash != first {
+		t.Errorf("keyHash() = %v, want %q", hash, first)
+	}
+
+	service.SetKeyPepper([]byte("second-pepper"))
+	if service.keyLookup(publicKey) == first {
+		t.Error("keyLookup() should depend on the pepper")
+	}
+}
+
+func TestHashedKeyLookups(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+	user := newTestUser(t, NewUserService(db, logger))
+
+	client := &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}}
+	service := NewWireguardServiceWithClient(logger, client)
+	service.SetDB(db)
+	service.SetKeyPepper([]byte("a-key-pepper-long-enough-for-testing"))
+	service.SetRejectReusedKeys(true)
+
+	publicKey := newTestPeers(t, 1)[0].PublicKey.String()
+	if _, err := service.AddUserKey(ctx, user.ID, defaultServerID, publicKey); err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+
+	// The raw key still finds the stored key through its hash
+	userKey, err := service.GetUserKeyByPublicKey(ctx, user.ID, publicKey)
+	if err != nil {
+		t.Fatalf("GetUserKeyByPublicKey() error = %v", err)
+	}
+	var hash *string
+	if err := db.QueryRow(ctx, `SELECT public_key_hash FROM user_keys WHERE id = $1`, userKey.ID).Scan(&hash); err != nil {
+		t.Fatalf("Failed to read key hash: %v", err)
+	}
+	if hash == nil || *hash != service.keyLookup(publicKey) {
+		t.Errorf("public_key_hash = %v, want the key's HMAC", hash)
+	}
+
+	if err := service.RevokeUserKeyByPublicKey(ctx, user.ID, publicKey); err != nil {
+		t.Fatalf("RevokeUserKeyByPublicKey() error = %v", err)
+	}
+	if client.hasPeer(publicKey) {
+		t.Error("Revoked key should be removed from the device")
+	}
+
+	// Only the hash of a deactivated key is kept, and it still recognizes the key
+	var storedKey *string
+	if err := db.QueryRow(ctx, `SELECT public_key FROM user_keys WHERE id = $1`, userKey.ID).Scan(&storedKey); err != nil {
+		t.Fatalf("Failed to read stored key: %v", err)
+	}
+	if storedKey != nil {
+		t.Errorf("Deactivated key kept its raw public key %q", *storedKey)
+	}
+	if _, err := service.AddUserKey(ctx, user.ID, defaultServerID, publicKey); !errors.Is(err, ErrKeyReused) {
+		t.Errorf("AddUserKey() with the revoked key error = %v, want ErrKeyReused", err)
+	}
+
+	history, err := service.ListUserKeyHistory(ctx, user.ID, nil)
+	if err != nil {
+		t.Fatalf("ListUserKeyHistory() error = %v", err)
+	}
+	if len(history) != 2 || history[0].Event != "revoked" || history[0].PublicKey != MaskPublicKey(publicKey) {
+		t.Errorf("ListUserKeyHistory() = %+v, want the addition and the revocation with the masked key", history)
+	}
+}
+
+func TestHashStoredKeys(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+	userService := NewUserService(db, logger)
+	active, revoked := newTestUser(t, userService), newTestUser(t, userService)
+
+	client := &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}}
+	service := NewWireguardServiceWithClient(logger, client)
+	service.SetDB(db)
+
+	peers := newTestPeers(t, 2)
+	activeKey, revokedKey := peers[0].PublicKey.String(), peers[1].PublicKey.String()
+	if _, err := service.AddUserKey(ctx, active.ID, defaultServerID, activeKey); err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+	if _, err := service.AddUserKey(ctx, revoked.ID, defaultServerID, revokedKey); err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+	if err := service.RemoveUserKey(ctx, revoked.ID, defaultServerID); err != nil {
+		t.Fatalf("RemoveUserKey() error = %v", err)
+	}
+
+	// Keys stored before hashing was enabled are only found once hashed
+	service.SetKeyPepper([]byte("a-key-pepper-long-enough-for-testing"))
+	if _, err := service.GetUserKeyByPublicKey(ctx, active.ID, activeKey); !errors.Is(err, ErrUserKeyNotFound) {
+		t.Fatalf("GetUserKeyByPublicKey() before hashing error = %v, want ErrUserKeyNotFound", err)
+	}
+
+	if _, err := service.HashStoredKeys(ctx); err != nil {
+		t.Fatalf("HashStoredKeys() error = %v", err)
+	}
+	if _, err := service.GetUserKeyByPublicKey(ctx, active.ID, activeKey); err != nil {
+		t.Errorf("GetUserKeyByPublicKey() after hashing error = %v", err)
+	}
+
+	var storedKey *string
+	query := `SELECT public_key FROM user_keys WHERE user_id = $1 AND server_id = $2`
+	if err := db.QueryRow(ctx, query, revoked.ID, defaultServerID).Scan(&storedKey); err != nil {
+		t.Fatalf("Failed to read stored key: %v", err)
+	}
+	if storedKey != nil {
+		t.Errorf("Deactivated key kept its raw public key %q after hashing", *storedKey)
+	}
+
+	hashed, err := service.HashStoredKeys(ctx)
+	if err != nil {
+		t.Fatalf("HashStoredKeys() repeated error = %v", err)
+	}
+	if hashed != 0 {
+		t.Errorf("HashStoredKeys() repeated hashed %d keys, want 0", hashed)
+	}
+
+	// The revoked key, recorded before hashing, is recognized by its hash
+	service.SetRejectReusedKeys(true)
+	if _, err := service.AddUserKey(ctx, revoked.ID, defaultServerID, revokedKey); !errors.Is(err, ErrKeyReused) {
+		t.Errorf("AddUserKey() with the revoked key after hashing error = %v, want ErrKeyReused", err)
+	}
+
+	// A new pepper re-hashes the active key so it is still found
+	service.SetKeyPepper([]byte("another-key-pepper-long-enough-for-testing"))
+	if hashed, err := service.HashStoredKeys(ctx); err != nil || hashed == 0 {
+		t.Fatalf("HashStoredKeys() under a new pepper = %d, %v, want the active key re-hashed", hashed, err)
+	}
+	if _, err := service.GetUserKeyByPublicKey(ctx, active.ID, activeKey); err != nil {
+		t.Errorf("GetUserKeyByPublicKey() after re-hashing error = %v", err)
+	}
+
+	// Removing the pepper clears the hash so the raw key is found again
+	service.SetKeyPepper(nil)
+	if cleared, err := service.HashStoredKeys(ctx); err != nil || cleared == 0 {
+		t.Fatalf("HashStoredKeys() without a pepper = %d, %v, want the active key's hash cleared", cleared, err)
+	}
+	if _, err := service.GetUserKeyByPublicKey(ctx, active.ID, activeKey); err != nil {
+		t.Errorf("GetUserKeyByPublicKey() after clearing hashes error = %v", err)
+	}
+	var hash *string
+	hashQuery := `SELECT public_key, public_key_hash FROM user_keys WHERE user_id = $1 AND server_id = $2`
+	if err := db.QueryRow(ctx, hashQuery, active.ID, defaultServerID).Scan(&storedKey, &hash); err != nil {
+		t.Fatalf("Failed to read stored key: %v", err)
+	}
+	if storedKey == nil || *storedKey != activeKey || hash != nil {
+		t.Errorf("Expected the active key stored raw without a hash, got key %v hash %v", storedKey, hash)
+	}
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// MaxMaintenanceMessage is the longest message a maintenance window may carry
+const MaxMaintenanceMessage = 500
+
+var (
+	// ErrServerMaintenance is returned when provisioning on a server during its maintenance window
+	ErrServerMaintenance = errors.New("server under maintenance")
+
+	// ErrMaintenanceWindowNotFound is returned when cancelling a window the server does not have
+	ErrMaintenanceWindowNotFound = errors.New("maintenance window not found")
+)
+
+// MaintenanceError is returned while a server is in a maintenance window
+type MaintenanceError struct {
+	Window *models.MaintenanceWindow
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("%s until %s", ErrServerMaintenance, e.Window.EndsAt.UTC().Format(time.RFC3339))
+}
+
+// Is makes a MaintenanceError match ErrServerMaintenance
+func (e *MaintenanceError) Is(target error) bool {
+	return target == ErrServerMaintenance
+}
+
+// ValidateMaintenanceWindow rejects a window that ends before it starts, has already ended or whose
+// message is too long
+func ValidateMaintenanceWindow(req *models.MaintenanceWindowRequest, now time.Time) error {
+	if req.StartsAt.IsZero() || req.EndsAt.IsZero() {
+		return fmt.Errorf("starts_at and ends_at are required")
+	}
+	if !req.EndsAt.After(req.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	if !req.EndsAt.After(now) {
+		return fmt.Errorf("ends_at must be in the future")
+	}
+	if len(req.Message) > MaxMaintenanceMessage {
+		return fmt.Errorf("message must be at most %d characters", MaxMaintenanceMessage)
+	}
+	return nil
+}
+
+// CreateMaintenanceWindow schedules a maintenance window on a server. It returns ErrServerNotFound
+// for an unknown server.
+func (s *ServerService) CreateMaintenanceWindow(ctx context.Context, serverID uuid.UUID, req *models.MaintenanceWindowRequest) (*models.MaintenanceWindow, error) {
+	if err := ValidateMaintenanceWindow(req, time.Now()); err != nil {
+		return nil, err
+	}
+
+	window := &models.MaintenanceWindow{}
+	query := `
+		INSERT INTO maintenance_windows (server_id, starts_at, ends_at, message)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, server_id, starts_at, ends_at, message, created_at
+	`
+	err := s.db.QueryRow(ctx, query, serverID, req.StartsAt, req.EndsAt, req.Message).Scan(
+		&window.ID,
+		&window.ServerID,
+		&window.StartsAt,
+		&window.EndsAt,
+		&window.Message,
+		&window.CreatedAt,
+	)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, ErrServerNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create maintenance window: %w", err)
+	}
+
+	s.invalidateServers()
+
+	s.logger.Info("Maintenance window scheduled",
+		zap.String("server_id", serverID.String()),
+		zap.String("window_id", window.ID.String()),
+		zap.Time("starts_at", window.StartsAt),
+		zap.Time("ends_at", window.EndsAt))
+
+	return window, nil
+}
+
+// ListMaintenanceWindows returns a server's active and upcoming maintenance windows, soonest first
+func (s *ServerService) ListMaintenanceWindows(ctx context.Context, serverID uuid.UUID) ([]*models.MaintenanceWindow, error) {
+	query := `
+		SELECT id, server_id, starts_at, ends_at, message, created_at
+		FROM maintenance_windows
+		WHERE server_id = $1 AND ends_at > NOW()
+		ORDER BY starts_at, ends_at
+	`
+	rows, err := s.db.Query(ctx, query, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query maintenance windows: %w", err)
+	}
+	defer rows.Close()
+
+	windows := []*models.MaintenanceWindow{}
+	for rows.Next() {
+		window := &models.MaintenanceWindow{}
+		if err := rows.Scan(
+			&window.ID,
+			&window.ServerID,
+			&window.StartsAt,
+			&window.EndsAt,
+			&window.Message,
+			&window.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan maintenance window: %w", err)
+		}
+		windows = append(windows, window)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate maintenance windows: %w", err)
+	}
+
+	return windows, nil
+}
+
+// CancelMaintenanceWindow removes one of a server's maintenance windows, ending it early if it is
+// in progress. It returns ErrMaintenanceWindowNotFound when the server has no such window.
+func (s *ServerService) CancelMaintenanceWindow(ctx context.Context, serverID, windowID uuid.UUID) error {
+	result, err := s.db.Exec(ctx, `DELETE FROM maintenance_windows WHERE id = $1 AND server_id = $2`, windowID, serverID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel maintenance window: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrMaintenanceWindowNotFound
+	}
+
+	s.invalidateServers()
+
+	s.logger.Info("Maintenance window cancelled",
+		zap.String("server_id", serverID.String()),
+		zap.String("window_id", windowID.String()))
+
+	return nil
+}
+
+// nextMaintenance returns the server's active or next maintenance window, or nil if none is scheduled
+func (s *ServerService) nextMaintenance(ctx context.Context, serverID uuid.UUID) (*models.MaintenanceWindow, error) {
+	window := &models.MaintenanceWindow{}
+	query := `
+		SELECT id, server_id, starts_at, ends_at, message, created_at
+		FROM maintenance_windows
+		WHERE server_id = $1 AND ends_at > NOW()
+		ORDER BY starts_at, ends_at
+		LIMIT 1
+	`
+	err := s.db.QueryRow(ctx, query, serverID).Scan(
+		&window.ID,
+		&window.ServerID,
+		&window.StartsAt,
+		&window.EndsAt,
+		&window.Message,
+		&window.CreatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load maintenance window: %w", err)
+	}
+	return window, nil
+}
+
+// checkMaintenance fails with a MaintenanceError while the server is in a maintenance window
+func (s *WireguardService) checkMaintenance(ctx context.Context, serverID uuid.UUID) error {
+	window := &models.MaintenanceWindow{}
+	query := `
+		SELECT id, server_id, starts_at, ends_at, message, created_at
+		FROM maintenance_windows
+		WHERE server_id = $1 AND starts_at <= NOW() AND ends_at > NOW()
+		ORDER BY ends_at DESC
+		LIMIT 1
+	`
+	err := s.db.QueryRow(ctx, query, serverID).Scan(
+		&window.ID,
+		&window.ServerID,
+		&window.StartsAt,
+		&window.EndsAt,
+		&window.Message,
+		&window.CreatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check maintenance windows: %w", err)
+	}
+	return &MaintenanceError{Window: window}
+}
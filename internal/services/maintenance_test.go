@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+func TestValidateMaintenanceWindow(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		req     models.MaintenanceWindowRequest
+		wantErr bool
+	}{
+		{name: "upcoming", req: models.MaintenanceWindowRequest{StartsAt: now.Add(time.Hour), EndsAt: now.Add(2 * time.Hour)}},
+		{name: "in progress", req: models.MaintenanceWindowRequest{StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}},
+		{name: "missing times", req: models.MaintenanceWindowRequest{EndsAt: now.Add(time.Hour)}, wantErr: true},
+		{name: "ends before start", req: models.MaintenanceWindowRequest{StartsAt: now.Add(2 * time.Hour), EndsAt: now.Add(time.Hour)}, wantErr: true},
+		{name: "already ended", req: models.MaintenanceWindowRequest{StartsAt: now.Add(-2 * time.Hour), EndsAt: now.Add(-time.Hour)}, wantErr: true},
+		{
+			name:    "message too long",
+			req:     models.MaintenanceWindowRequest{StartsAt: now, EndsAt: now.Add(time.Hour), Message: strings.Repeat("a", MaxMaintenanceMessage+1)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMaintenanceWindow(&tt.req, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateMaintenanceWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowBlocksProvisioning(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+	userService := NewUserService(db, logger)
+	serverService := NewServerService(db, logger)
+	serverID := newTestServer(t, db, "maintenance", "test")
+
+	service := NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	service.SetDB(db)
+
+	// An upcoming window does not block provisioning yet
+	_, err := serverService.CreateMaintenanceWindow(ctx, serverID, &models.MaintenanceWindowRequest{
+		StartsAt: time.Now().Add(time.Hour),
+		EndsAt:   time.Now().Add(2 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+	peers := newTestPeers(t, 2)
+	if _, err := service.AddUserKey(ctx, newTestUser(t, userService).ID, serverID, peers[0].PublicKey.String()); err != nil {
+		t.Fatalf("AddUserKey() before the window error = %v", err)
+	}
+
+	active, err := serverService.CreateMaintenanceWindow(ctx, serverID, &models.MaintenanceWindowRequest{
+		StartsAt: time.Now().Add(-time.Minute),
+		EndsAt:   time.Now().Add(time.Hour),
+		Message:  "Kernel upgrade",
+	})
+	if err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+
+	user := newTestUser(t, userService)
+	_, err = service.AddUserKey(ctx, user.ID, serverID, peers[1].PublicKey.String())
+	var maintenance *MaintenanceError
+	if !errors.As(err, &maintenance) {
+		t.Fatalf("AddUserKey() during the window error = %v, want MaintenanceError", err)
+	}
+	if !errors.Is(err, ErrServerMaintenance) || maintenance.Window.Message != "Kernel upgrade" {
+		t.Errorf("MaintenanceError window = %+v, want the active window", maintenance.Window)
+	}
+
+	// Other servers are unaffected, and cancelling the window lifts the block
+	if _, err := service.AddUserKey(ctx, user.ID, defaultServerID, peers[1].PublicKey.String()); err != nil {
+		t.Errorf("AddUserKey() on another server error = %v", err)
+	}
+	if err := serverService.CancelMaintenanceWindow(ctx, serverID, active.ID); err != nil {
+		t.Fatalf("CancelMaintenanceWindow() error = %v", err)
+	}
+	if err := serverService.CancelMaintenanceWindow(ctx, serverID, active.ID); !errors.Is(err, ErrMaintenanceWindowNotFound) {
+		t.Errorf("CancelMaintenanceWindow() repeated error = %v, want ErrMaintenanceWindowNotFound", err)
+	}
+	if _, err := service.AddUserKey(ctx, user.ID, serverID, newTestPeers(t, 1)[0].PublicKey.String()); err != nil {
+		t.Errorf("AddUserKey() after cancelling error = %v", err)
+	}
+}
+
+func TestMaintenanceWindowInServerResponses(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewServerService(db, zap.NewNop())
+	serverID := newTestServer(t, db, "maintenance-listing", "test")
+
+	if _, err := service.CreateMaintenanceWindow(ctx, uuid.New(), &models.MaintenanceWindowRequest{
+		StartsAt: time.Now(),
+		EndsAt:   time.Now().Add(time.Hour),
+	}); !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("CreateMaintenanceWindow() for an unknown server error = %v, want ErrServerNotFound", err)
+	}
+
+	// Warm the cache so the new window has to invalidate it
+	if _, err := service.GetActiveServers(ctx, models.ServerListOptions{}); err != nil {
+		t.Fatalf("GetActiveServers() error = %v", err)
+	}
+
+	later, err := service.CreateMaintenanceWindow(ctx, serverID, &models.MaintenanceWindowRequest{
+		StartsAt: time.Now().Add(3 * time.Hour),
+		EndsAt:   time.Now().Add(4 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+	next, err := service.CreateMaintenanceWindow(ctx, serverID, &models.MaintenanceWindowRequest{
+		StartsAt: time.Now().Add(time.Hour),
+		EndsAt:   time.Now().Add(2 * time.Hour),
+		Message:  "Network maintenance",
+	})
+	if err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+
+	servers, err := service.GetActiveServers(ctx, models.ServerListOptions{})
+	if err != nil {
+		t.Fatalf("GetActiveServers() error = %v", err)
+	}
+	var listed *models.ServerResponse
+	for _, server := range servers {
+		if server.ID == serverID {
+			listed = server
+		}
+	}
+	if listed == nil || listed.Maintenance == nil || listed.Maintenance.ID != next.ID {
+		t.Fatalf("Listed server = %+v, want the next window %s", listed, next.ID)
+	}
+	if listed.Maintenance.Message != "Network maintenance" {
+		t.Errorf("Listed window message = %q", listed.Maintenance.Message)
+	}
+
+	server, err := service.GetServerByID(ctx, serverID)
+	if err != nil {
+		t.Fatalf("GetServerByID() error = %v", err)
+	}
+	if server.Maintenance == nil || server.Maintenance.ID != next.ID {
+		t.Errorf("Server maintenance = %+v, want the next window %s", server.Maintenance, next.ID)
+	}
+
+	windows, err := service.ListMaintenanceWindows(ctx, serverID)
+	if err != nil {
+		t.Fatalf("ListMaintenanceWindows() error = %v", err)
+	}
+	if len(windows) != 2 || windows[0].ID != next.ID || windows[1].ID != later.ID {
+		t.Errorf("ListMaintenanceWindows() = %+v, want the next then the later window", windows)
+	}
+}
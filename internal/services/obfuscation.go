@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// AmneziaWG parameter limits. Junk packets and padded handshakes must still fit a 1280 byte minimum
+// IPv6 MTU; 148 and 92 bytes are the sizes of the initiation and response messages.
+const (
+	MaxObfuscationJunkCount    = 128
+	MaxObfuscationJunkSize     = 1280
+	MaxObfuscationInitJunk     = MaxObfuscationJunkSize - 148
+	MaxObfuscationResponseJunk = MaxObfuscationJunkSize - 92
+)
+
+// ValidateObfuscationProfile rejects AmneziaWG parameters the client or server would refuse or that
+// would make obfuscated packets indistinguishable from each other
+func ValidateObfuscationProfile(p *models.ObfuscationProfile) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.Jc < 1 || p.Jc > MaxObfuscationJunkCount {
+		return fmt.Errorf("jc must be between 1 and %d", MaxObfuscationJunkCount)
+	}
+	if p.Jmin < 0 || p.Jmax > MaxObfuscationJunkSize || p.Jmin >= p.Jmax {
+		return fmt.Errorf("jmin and jmax must satisfy 0 <= jmin < jmax <= %d", MaxObfuscationJunkSize)
+	}
+	if p.S1 < 0 || p.S1 > MaxObfuscationInitJunk {
+		return fmt.Errorf("s1 must be between 0 and %d", MaxObfuscationInitJunk)
+	}
+	if p.S2 < 0 || p.S2 > MaxObfuscationResponseJunk {
+		return fmt.Errorf("s2 must be between 0 and %d", MaxObfuscationResponseJunk)
+	}
+	// Equal padded sizes would let the response be mistaken for an initiation
+	if p.S1+148 == p.S2+92 {
+		return fmt.Errorf("s2 must not equal s1 + 56")
+	}
+
+	headers := []uint32{p.H1, p.H2, p.H3, p.H4}
+	for i, h := range headers {
+		// 1-4 are the standard WireGuard message types the headers are meant to hide
+		if h <= 4 {
+			return fmt.Errorf("h%d must be greater than 4", i+1)
+		}
+		for j := range i {
+			if headers[j] == h {
+				return fmt.Errorf("h%d and h%d must differ", j+1, i+1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetObfuscationProfile stores the AmneziaWG profile handed to clients of a server that request an
+// obfuscated config, or removes it when profile is nil. It returns ErrServerNotFound for an unknown
+// or inactive server.
+func (s *ServerService) SetObfuscationProfile(ctx context.Context, serverID uuid.UUID, profile *models.ObfuscationProfile) error {
+	if err := ValidateObfuscationProfile(profile); err != nil {
+		return err
+	}
+
+	var profileJSON []byte
+	if profile != nil {
+		var err error
+		if profileJSON, err = json.Marshal(profile); err != nil {
+			return fmt.Errorf("failed to encode obfuscation profile: %w", err)
+		}
+	}
+
+	query := `UPDATE servers SET obfuscation = $2, updated_at = NOW() WHERE id = $1 AND is_active = true`
+	result, err := s.db.Exec(ctx, query, serverID, profileJSON)
+	if err != nil {
+		return fmt.Errorf("failed to store obfuscation profile: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrServerNotFound
+	}
+
+	s.logger.Info("Server obfuscation profile updated",
+		zap.String("server_id", serverID.String()),
+		zap.Bool("enabled", profile != nil))
+
+	return nil
+}
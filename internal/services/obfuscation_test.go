@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+func testObfuscationProfile() *models.ObfuscationProfile {
+	return &models.ObfuscationProfile{
+		Jc: 4, Jmin: 40, Jmax: 70, S1: 15, S2: 42,
+		H1: 1106457265, H2: 249455488, H3: 1209847463, H4: 1646644382,
+	}
+}
+
+func TestValidateObfuscationProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(p *models.ObfuscationProfile)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(p *models.ObfuscationProfile) {}},
+		{name: "no junk packets", modify: func(p *models.ObfuscationProfile) { p.Jc = 0 }, wantErr: true},
+		{name: "too many junk packets", modify: func(p *models.ObfuscationProfile) { p.Jc = 129 }, wantErr: true},
+		{name: "jmin not below jmax", modify: func(p *models.ObfuscationProfile) { p.Jmin = 70 }, wantErr: true},
+		{name: "jmax too large", modify: func(p *models.ObfuscationProfile) { p.Jmax = 1281 }, wantErr: true},
+		{name: "s1 too large", modify: func(p *models.ObfuscationProfile) { p.S1 = MaxObfuscationInitJunk + 1 }, wantErr: true},
+		{name: "s2 too large", modify: func(p *models.ObfuscationProfile) { p.S2 = MaxObfuscationResponseJunk + 1 }, wantErr: true},
+		{name: "s2 equals s1 plus 56", modify: func(p *models.ObfuscationProfile) { p.S2 = p.S1 + 56 }, wantErr: true},
+		{name: "standard header", modify: func(p *models.ObfuscationProfile) { p.H3 = 3 }, wantErr: true},
+		{name: "duplicate headers", modify: func(p *models.ObfuscationProfile) { p.H4 = p.H1 }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := testObfuscationProfile()
+			tt.modify(profile)
+			err := ValidateObfuscationProfile(profile)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateObfuscationProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := ValidateObfuscationProfile(nil); err != nil {
+		t.Errorf("ValidateObfuscationProfile(nil) error = %v, want nil", err)
+	}
+}
+
+func TestSetObfuscationProfile(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewServerService(db, zap.NewNop())
+	serverID := newTestServer(t, db, "obfuscated", "test")
+
+	profile := testObfuscationProfile()
+	if err := service.SetObfuscationProfile(ctx, serverID, profile); err != nil {
+		t.Fatalf("SetObfuscationProfile() error = %v", err)
+	}
+	server, err := service.GetServerByID(ctx, serverID)
+	if err != nil {
+		t.Fatalf("GetServerByID() error = %v", err)
+	}
+	if server.Obfuscation == nil || *server.Obfuscation != *profile {
+		t.Errorf("Obfuscation = %+v, want %+v", server.Obfuscation, profile)
+	}
+
+	if err := service.SetObfuscationProfile(ctx, serverID, nil); err != nil {
+		t.Fatalf("SetObfuscationProfile(nil) error = %v", err)
+	}
+	if server, err = service.GetServerByID(ctx, serverID); err != nil {
+		t.Fatalf("GetServerByID() error = %v", err)
+	}
+	if server.Obfuscation != nil {
+		t.Errorf("Obfuscation = %+v after removal, want nil", server.Obfuscation)
+	}
+
+	invalid := testObfuscationProfile()
+	invalid.Jc = 0
+	if err := service.SetObfuscationProfile(ctx, serverID, invalid); err == nil {
+		t.Error("SetObfuscationProfile() accepted an invalid profile")
+	}
+
+	if err := service.SetObfuscationProfile(ctx, uuid.New(), profile); !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("SetObfuscationProfile() error = %v for an unknown server, want ErrServerNotFound", err)
+	}
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms selectable with PASSWORD_HASH
+const (
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+// ErrPasswordMismatch is returned by a PasswordHasher when a password does not match a hash
+var ErrPasswordMismatch = errors.New("password does not match")
+
+// PasswordHasher hashes passwords and verifies them against hashes it produced
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, hash string) error
+}
+
+// PasswordHashCost is the work factor for new password hashes; zero Argon2id fields keep the defaults
+type PasswordHashCost struct {
+	BCryptCost   int
+	Argon2Time   uint32
+	Argon2Memory uint32 // KiB
+}
+
+// NewPasswordHasher returns the hasher for an algorithm name, hashing at the given cost
+func NewPasswordHasher(algorithm string, cost PasswordHashCost) (PasswordHasher, error) {
+	switch algorithm {
+	case PasswordHashBcrypt:
+		return BcryptHasher{Cost: cost.BCryptCost}, nil
+	case PasswordHashArgon2id:
+		hasher := NewArgon2idHasher()
+		if cost.Argon2Time > 0 {
+			hasher.Time = cost.Argon2Time
+		}
+		if cost.Argon2Memory > 0 {
+			hasher.Memory = cost.Argon2Memory
+		}
+		return hasher, nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", algorithm)
+	}
+}
+
+// passwordHashAlgorithm identifies the algorithm of a stored hash from its prefix
+func passwordHashAlgorithm(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return PasswordHashArgon2id
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return PasswordHashBcrypt
+	default:
+		return ""
+	}
+}
+
+// BcryptHasher hashes passwords with bcrypt, which only uses the first 72 bytes of a password
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash hashes a password with bcrypt
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify checks a password against a bcrypt hash
+func (h BcryptHasher) Verify(password, hash string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// Argon2idHasher hashes passwords with Argon2id and encodes them in the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash), so each hash carries its own parameters
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen int
+}
+
+// NewArgon2idHasher returns an Argon2id hasher with the RFC 9106 second recommended parameters
+func NewArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+// Hash hashes a password with Argon2id under a random salt
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks a password against an Argon2id hash using the parameters stored in the hash
+func (h Argon2idHasher) Verify(password, hash string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return fmt.Errorf("unsupported argon2id version")
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return fmt.Errorf("invalid argon2id key: %w", err)
+	}
+
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fastArgon2idHasher keeps Argon2id tests quick while exercising the same encoding
+var fastArgon2idHasher = Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		PasswordHashBcrypt:   BcryptHasher{Cost: bcrypt.MinCost},
+		PasswordHashArgon2id: fastArgon2idHasher,
+	}
+
+	for algorithm, hasher := range hashers {
+		t.Run(algorithm, func(t *testing.T) {
+			hash, err := hasher.Hash("SecurePass123")
+			if err != nil {
+				t.Fatalf("Hash() error = %v", err)
+			}
+			if got := passwordHashAlgorithm(hash); got != algorithm {
+				t.Errorf("passwordHashAlgorithm() = %q, want %q", got, algorithm)
+			}
+
+			if err := hasher.Verify("SecurePass123", hash); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+			if err := hasher.Verify("WrongPass123", hash); !errors.Is(err, ErrPasswordMismatch) {
+				t.Errorf("Verify() error = %v, want ErrPasswordMismatch", err)
+			}
+		})
+	}
+}
+
+func TestArgon2idHashEncodesParameters(t *testing.T) {
+	hash, err := fastArgon2idHasher.Hash("SecurePass123")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Unexpected hash encoding %q", hash)
+	}
+
+	// Verification reads the parameters from the hash, not from the verifying hasher
+	if err := NewArgon2idHasher().Verify("SecurePass123", hash); err != nil {
+		t.Errorf("Verify() with different parameters error = %v", err)
+	}
+
+	if err := fastArgon2idHasher.Verify("SecurePass123", "$argon2id$v=19$garbage"); err == nil {
+		t.Error("Expected malformed hash to be rejected")
+	}
+}
+
+func TestVerifyPasswordAcrossAlgorithms(t *testing.T) {
+	service := NewAuthService("test-secret", zap.NewNop())
+
+	bcryptHash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("SecurePass123")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	argon2idHash, err := fastArgon2idHasher.Hash("SecurePass123")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+
+	// Switching the configured algorithm must not lock out users with existing hashes
+	for _, algorithm := range []string{PasswordHashBcrypt, PasswordHashArgon2id} {
+		hasher, err := NewPasswordHasher(algorithm, PasswordHashCost{BCryptCost: bcrypt.MinCost})
+		if err != nil {
+			t.Fatalf("NewPasswordHasher() error = %v", err)
+		}
+		service.SetPasswordHasher(algorithm, hasher)
+
+		for _, hash := range []string{bcryptHash, argon2idHash} {
+			if err := service.VerifyPassword("SecurePass123", hash); err != nil {
+				t.Errorf("[%s] VerifyPassword(%s) error = %v", algorithm, passwordHashAlgorithm(hash), err)
+			}
+			if err := service.VerifyPassword("WrongPass123", hash); err == nil {
+				t.Errorf("[%s] Expected wrong password to be rejected for %s", algorithm, passwordHashAlgorithm(hash))
+			}
+
+			wantRehash := passwordHashAlgorithm(hash) != algorithm
+			if got := service.NeedsRehash(hash); got != wantRehash {
+				t.Errorf("[%s] NeedsRehash(%s) = %v, want %v", algorithm, passwordHashAlgorithm(hash), got, wantRehash)
+			}
+		}
+	}
+
+	if err := service.VerifyPassword("SecurePass123", "plaintext"); err == nil {
+		t.Error("Expected hash of unknown algorithm to be rejected")
+	}
+	if _, err := NewPasswordHasher("md5", PasswordHashCost{BCryptCost: bcrypt.MinCost}); err == nil {
+		t.Error("Expected unknown algorithm to be rejected")
+	}
+}
+
+func TestNewPasswordHasherAppliesCost(t *testing.T) {
+	hasher, err := NewPasswordHasher(PasswordHashArgon2id, PasswordHashCost{Argon2Time: 1, Argon2Memory: 1024})
+	if err != nil {
+		t.Fatalf("NewPasswordHasher() error = %v", err)
+	}
+	hash, err := hasher.Hash("SecurePass123")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	if !strings.Contains(hash, "$m=1024,t=1,") {
+		t.Errorf("Expected the configured Argon2id cost in the hash, got %q", hash)
+	}
+
+	hasher, err = NewPasswordHasher(PasswordHashBcrypt, PasswordHashCost{BCryptCost: bcrypt.MinCost + 1})
+	if err != nil {
+		t.Fatalf("NewPasswordHasher() error = %v", err)
+	}
+	hash, err = hasher.Hash("SecurePass123")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost != bcrypt.MinCost+1 {
+		t.Errorf("Expected bcrypt cost %d, got %d (%v)", bcrypt.MinCost+1, cost, err)
+	}
+}
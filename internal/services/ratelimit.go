@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrServerRateLimited is matched by a ServerRateLimitError
+var ErrServerRateLimited = errors.New("server provisioning rate exceeded")
+
+// ServerRateLimitError is returned when a server has provisioned as many peers as its rate limit
+// allows for now, however many clients are asking
+type ServerRateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ServerRateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrServerRateLimited, e.RetryAfter.Round(time.Millisecond))
+}
+
+// Is makes a ServerRateLimitError match ErrServerRateLimited
+func (e *ServerRateLimitError) Is(target error) bool {
+	return target == ErrServerRateLimited
+}
+
+// ErrTooManyPasswordAttempts is matched by a PasswordAttemptsError
+var ErrTooManyPasswordAttempts = errors.New("too many failed password attempts")
+
+// PasswordAttemptsError is returned when a user has got their password wrong as many times as the
+// failed attempt limit allows for now; the password itself is not checked
+type PasswordAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *PasswordAttemptsError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyPasswordAttempts, e.RetryAfter.Round(time.Second))
+}
+
+// Is makes a PasswordAttemptsError match ErrTooManyPasswordAttempts
+func (e *PasswordAttemptsError) Is(target error) bool {
+	return target == ErrTooManyPasswordAttempts
+}
+
+// Limiters reported in a RateLimitDecision
+const (
+	LimiterServerProvision   = "server_provision"
+	LimiterProvisionCooldown = "provision_cooldown"
+)
+
+// RateLimitDecision describes one check against a rate limit
+type RateLimitDecision struct {
+	Limiter    string
+	Key        string // what the limit applies to: a server ID, or a user and server ID pair
+	Allowed    bool
+	Remaining  float64       // tokens left in the server's bucket; always zero for the cooldown
+	RetryAfter time.Duration // zero when allowed
+}
+
+// RateLimitObserver is told about every rate-limit decision, with the context of the request that was
+// checked. It runs on the request path and must not block.
+type RateLimitObserver func(ctx context.Context, decision RateLimitDecision)
+
+// provisionLimiter is a token bucket per server: each provisioning takes a token, and tokens refill at
+// rate per second up to burst
+type provisionLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[uuid.UUID]*tokenBucket
+}
+
+// tokenBucket is one server's bucket as of its last update
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newProvisionLimiter(rate, burst int) *provisionLimiter {
+	return &provisionLimiter{
+		rate:    float64(rate),
+		burst:   float64(max(burst, 1)),
+		now:     time.Now,
+		buckets: make(map[uuid.UUID]*tokenBucket),
+	}
+}
+
+// take consumes a token for the server, returning zero on success or how long until one is available,
+// along with the tokens left
+func (l *provisionLimiter) take(serverID uuid.UUID) (time.Duration, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[serverID]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[serverID] = bucket
+	}
+	bucket.refill(now, l.rate, l.burst)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, bucket.tokens
+	}
+
+	return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second)), bucket.tokens
+}
+
+// refill adds the tokens earned since the bucket's last update at rate per second, up to burst
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(burst, b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+}
+
+// failureLimiter is a token bucket per user that only failures draw from: a user may keep trying while
+// their bucket has a token, and is refused once failures have emptied it until it refills
+type failureLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[uuid.UUID]*tokenBucket
+}
+
+// newFailureLimiter allows maxFailures failures at once, refilling all of them over window
+func newFailureLimiter(maxFailures int, window time.Duration) *failureLimiter {
+	return &failureLimiter{
+		rate:    float64(maxFailures) / window.Seconds(),
+		burst:   float64(maxFailures),
+		now:     time.Now,
+		buckets: make(map[uuid.UUID]*tokenBucket),
+	}
+}
+
+// retryAfter returns how long until the user may try again, zero when they may now
+func (l *failureLimiter) retryAfter(userID uuid.UUID) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[userID]
+	if !ok {
+		return 0
+	}
+	bucket.refill(l.now(), l.rate, l.burst)
+
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// fail takes a token for a failure by the user. Buckets are only made for users that exist, so
+// there are never more of them than users.
+func (l *failureLimiter) fail(userID uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[userID]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[userID] = bucket
+	}
+	bucket.refill(now, l.rate, l.burst)
+	bucket.tokens = max(0, bucket.tokens-1)
+}
+
+// reset forgets the user's failures after they got it right
+func (l *failureLimiter) reset(userID uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.buckets, userID)
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProvisionLimiterIsPerServer(t *testing.T) {
+	now := time.Now()
+	limiter := newProvisionLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	busy, idle := uuid.New(), uuid.New()
+	for i := 0; i < 3; i++ {
+		wait, remaining := limiter.take(busy)
+		if wait != 0 {
+			t.Fatalf("take %d within burst: expected no wait, got %s", i+1, wait)
+		}
+		if want := float64(2 - i); remaining != want {
+			t.Errorf("take %d within burst: expected %v tokens left, got %v", i+1, want, remaining)
+		}
+	}
+
+	wait, _ := limiter.take(busy)
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected a wait of 500ms once the burst is spent, got %s", wait)
+	}
+	if wait, _ := limiter.take(idle); wait != 0 {
+		t.Errorf("Expected another server to stay available, got wait %s", wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if wait, _ := limiter.take(busy); wait != 0 {
+		t.Errorf("Expected a token after refilling, got wait %s", wait)
+	}
+	if wait, _ := limiter.take(busy); wait == 0 {
+		t.Error("Expected the refilled token to be spent")
+	}
+}
+
+func TestCheckPasswordLimitsFailures(t *testing.T) {
+	authService := NewAuthService("test-secret", zap.NewNop())
+	authService.SetPasswordHasher(PasswordHashBcrypt, BcryptHasher{Cost: bcrypt.MinCost})
+	hash, err := authService.HashPassword("correct horse battery")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	now := time.Now()
+	authService.SetPasswordAttemptLimit(2, time.Minute)
+	authService.passwordFailures.now = func() time.Time { return now }
+
+	userID, other := uuid.New(), uuid.New()
+	if err := authService.CheckPassword(userID, "correct horse battery", hash); err != nil {
+		t.Fatalf("CheckPassword() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := authService.CheckPassword(userID, "wrong", hash); err == nil || errors.Is(err, ErrTooManyPasswordAttempts) {
+			t.Fatalf("wrong password %d: expected it to be checked and refused, got %v", i+1, err)
+		}
+	}
+
+	var attemptsErr *PasswordAttemptsError
+	err = authService.CheckPassword(userID, "correct horse battery", hash)
+	if !errors.As(err, &attemptsErr) || attemptsErr.RetryAfter != 30*time.Second {
+		t.Fatalf("Expected a 30s PasswordAttemptsError at the limit, got %v", err)
+	}
+	if err := authService.CheckPassword(other, "correct horse battery", hash); err != nil {
+		t.Errorf("Expected another user to be unaffected, got %v", err)
+	}
+
+	// A refilled attempt that succeeds clears the failures
+	now = now.Add(30 * time.Second)
+	if err := authService.CheckPassword(userID, "correct horse battery", hash); err != nil {
+		t.Fatalf("Expected an attempt after refilling, got %v", err)
+	}
+	if err := authService.CheckPassword(userID, "wrong", hash); errors.Is(err, ErrTooManyPasswordAttempts) {
+		t.Error("Expected the failures to be forgotten after the right password")
+	}
+}
+
+func TestAddUserKeyServerRateLimited(t *testing.T) {
+	db := newTestDB(t)
+	service := NewWireguardServiceWithClient(zap.NewNop(), &fakeWGClient{})
+	service.SetDB(db)
+	service.SetServerProvisionRate(1, 2)
+
+	busy, idle := newTestServer(t, db, "rate-busy", "test"), uuid.New()
+	for i := 0; i < 2; i++ {
+		if err := service.checkServerProvisionRate(context.Background(), busy); err != nil {
+			t.Fatalf("provisioning %d within burst: %v", i+1, err)
+		}
+	}
+
+	_, err := service.AddUserKey(context.Background(), uuid.New(), busy, "key")
+	if !errors.Is(err, ErrServerRateLimited) {
+		t.Fatalf("Expected ErrServerRateLimited, got %v", err)
+	}
+	var rateLimited *ServerRateLimitError
+	if !errors.As(err, &rateLimited) || rateLimited.RetryAfter <= 0 {
+		t.Errorf("Expected a ServerRateLimitError with a positive RetryAfter, got %v", err)
+	}
+
+	if err := service.checkServerProvisionRate(context.Background(), idle); err != nil {
+		t.Errorf("Expected another server to stay available, got %v", err)
+	}
+}
+
+func TestMaintenanceDoesNotSpendProvisionRate(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewWireguardServiceWithClient(zap.NewNop(), &fakeWGClient{})
+	service.SetDB(db)
+	service.SetServerProvisionRate(1, 1)
+
+	serverID := newTestServer(t, db, "rate-maintained", "test")
+	if _, err := db.Exec(ctx, `INSERT INTO maintenance_windows (server_id, starts_at, ends_at) VALUES ($1, NOW() - INTERVAL '1 minute', NOW() + INTERVAL '1 hour')`, serverID); err != nil {
+		t.Fatalf("Failed to schedule maintenance: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := service.AddUserKey(ctx, uuid.New(), serverID, "key"); !errors.Is(err, ErrServerMaintenance) {
+			t.Fatalf("AddUserKey() %d in maintenance error = %v, want ErrServerMaintenance", i+1, err)
+		}
+	}
+	if err := service.checkServerProvisionRate(ctx, serverID); err != nil {
+		t.Errorf("Expected requests refused for maintenance to leave the burst untouched, got %v", err)
+	}
+}
+
+func TestServerProvisionRateDisabled(t *testing.T) {
+	service := NewWireguardServiceWithClient(zap.NewNop(), &fakeWGClient{})
+	service.SetServerProvisionRate(0, 1)
+
+	serverID := uuid.New()
+	for i := 0; i < 100; i++ {
+		if err := service.checkServerProvisionRate(context.Background(), serverID); err != nil {
+			t.Fatalf("Expected no limit, got %v", err)
+		}
+	}
+}
+
+func TestServerProvisionRateReportsDecisions(t *testing.T) {
+	service := NewWireguardServiceWithClient(zap.NewNop(), &fakeWGClient{})
+	service.SetServerProvisionRate(1, 1)
+
+	var decisions []RateLimitDecision
+	service.SetRateLimitObserver(func(ctx context.Context, decision RateLimitDecision) {
+		decisions = append(decisions, decision)
+	})
+
+	serverID := uuid.New()
+	service.checkServerProvisionRate(context.Background(), serverID)
+	service.checkServerProvisionRate(context.Background(), serverID)
+
+	if len(decisions) != 2 {
+		t.Fatalf("Expected 2 decisions, got %d", len(decisions))
+	}
+	if d := decisions[0]; !d.Allowed || d.Limiter != LimiterServerProvision || d.Key != serverID.String() || d.RetryAfter != 0 {
+		t.Errorf("Unexpected first decision: %+v", d)
+	}
+	if d := decisions[1]; d.Allowed || d.RetryAfter <= 0 {
+		t.Errorf("Expected the second decision to be denied with a retry, got %+v", d)
+	}
+}
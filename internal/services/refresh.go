@@ -0,0 +1,186 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// ErrRefreshTokenReused is returned when a refresh token that was already rotated is presented again.
+// Only a copy of the token can be replayed, so every token of its family is revoked.
+var ErrRefreshTokenReused = fmt.Errorf("%w: refresh token reused", ErrInvalidToken)
+
+// RefreshTokensEnabled reports whether refresh tokens can be issued, which needs the database
+func (s *AuthService) RefreshTokensEnabled() bool {
+	return s.db != nil
+}
+
+// IssueRefreshToken starts a new refresh token family for a user, as at login. The token is
+// returned only here; the database keeps its hash.
+func (s *AuthService) IssueRefreshToken(ctx context.Context, userID uuid.UUID) (*models.RefreshToken, error) {
+	if s.db == nil {
+		return nil, fmt.Errorf("refresh tokens require a database")
+	}
+
+	token, err := generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := &models.RefreshToken{Token: token, UserID: userID}
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+		RETURNING expires_at
+	`
+	if err := s.db.QueryRow(ctx, query, userID, uuid.New(), hashRefreshToken(token), s.refreshTTL.Seconds()).Scan(&refresh.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("failed to issue refresh token: %w", err)
+	}
+
+	return refresh, nil
+}
+
+// RotateRefreshToken consumes a refresh token and returns its replacement in the same family, for
+// the same user. Unknown, expired and revoked tokens fail with ErrInvalidToken; a token that was
+// already rotated fails with ErrRefreshTokenReused after its whole family is revoked.
+func (s *AuthService) RotateRefreshToken(ctx context.Context, token string) (*models.RefreshToken, error) {
+	if s.db == nil {
+		return nil, fmt.Errorf("refresh tokens require a database")
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the token so concurrent rotations of it are told apart from a replay
+	var (
+		id, userID, familyID uuid.UUID
+		expiresAt            time.Time
+		usedAt, revokedAt    *time.Time
+	)
+	query := `
+		SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE
+	`
+	err = tx.QueryRow(ctx, query, hashRefreshToken(token)).Scan(&id, &userID, &familyID, &expiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: unknown refresh token", ErrInvalidToken)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up refresh token: %w", err)
+	}
+
+	switch {
+	case revokedAt != nil:
+		return nil, fmt.Errorf("%w: refresh token revoked", ErrInvalidToken)
+	case usedAt != nil:
+		if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, familyID); err != nil {
+			return nil, fmt.Errorf("failed to revoke refresh token family: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("failed to revoke refresh token family: %w", err)
+		}
+		s.logger.Warn("Refresh token reused, revoked its family",
+			zap.String("user_id", userID.String()),
+			zap.String("family_id", familyID.String()))
+		return nil, ErrRefreshTokenReused
+	case !time.Now().Before(expiresAt):
+		return nil, fmt.Errorf("%w: refresh token expired", ErrInvalidToken)
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`, id); err != nil {
+		return nil, fmt.Errorf("failed to consume refresh token: %w", err)
+	}
+
+	next, err := generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	refresh := &models.RefreshToken{Token: next, UserID: userID}
+	insertQuery := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+		RETURNING expires_at
+	`
+	if err := tx.QueryRow(ctx, insertQuery, userID, familyID, hashRefreshToken(next), s.refreshTTL.Seconds()).Scan(&refresh.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("failed to issue refresh token: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit refresh token rotation: %w", err)
+	}
+
+	return refresh, nil
+}
+
+// RevokeRefreshToken revokes a user's refresh token together with every token rotated from the same
+// sign-in, as at logout. A token that is unknown or belongs to another user fails with ErrInvalidToken.
+func (s *AuthService) RevokeRefreshToken(ctx context.Context, userID uuid.UUID, token string) error {
+	if s.db == nil {
+		return fmt.Errorf("refresh tokens require a database")
+	}
+
+	query := `
+		UPDATE refresh_tokens SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1 AND user_id = $2)
+	`
+	tag, err := s.db.Exec(ctx, query, hashRefreshToken(token), userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: unknown refresh token", ErrInvalidToken)
+	}
+
+	s.logger.Info("Refresh token family revoked", zap.String("user_id", userID.String()))
+
+	return nil
+}
+
+// PurgeExpiredRefreshTokens deletes refresh tokens that have expired and returns how many were removed.
+// A replay of a purged token is then reported as unknown rather than reused, which still rejects it.
+func (s *AuthService) PurgeExpiredRefreshTokens(ctx context.Context) (int64, error) {
+	if s.db == nil {
+		return 0, nil
+	}
+
+	tag, err := s.db.Exec(ctx, `DELETE FROM refresh_tokens WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge refresh tokens: %w", err)
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		s.logger.Info("Purged expired refresh tokens", zap.Int64("count", n))
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// generateRefreshToken returns a random URL-safe refresh token
+func generateRefreshToken() (string, error) {
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw[:]), nil
+}
+
+// hashRefreshToken returns the hex SHA-256 of a refresh token, which is what is stored
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, NewUserService(db, zap.NewNop()))
+
+	service := NewAuthService("test-secret", zap.NewNop())
+	service.SetDB(db)
+
+	issued, err := service.IssueRefreshToken(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("IssueRefreshToken() error = %v", err)
+	}
+
+	rotated, err := service.RotateRefreshToken(t.Context(), issued.Token)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken() error = %v", err)
+	}
+	if rotated.UserID != user.ID {
+		t.Errorf("Expected the rotated token to belong to %s, got %s", user.ID, rotated.UserID)
+	}
+	if rotated.Token == issued.Token {
+		t.Error("Expected a new token on rotation")
+	}
+
+	// Replaying the rotated token revokes the family, including the token that replaced it
+	if _, err := service.RotateRefreshToken(t.Context(), issued.Token); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("Expected ErrRefreshTokenReused on replay, got %v", err)
+	}
+	if _, err := service.RotateRefreshToken(t.Context(), rotated.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected the replacement to be revoked with its family, got %v", err)
+	}
+
+	// A family started by another login is unaffected
+	other, err := service.IssueRefreshToken(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("IssueRefreshToken() error = %v", err)
+	}
+	if _, err := service.RotateRefreshToken(t.Context(), other.Token); err != nil {
+		t.Errorf("Expected another family's token to rotate, got %v", err)
+	}
+
+	if _, err := service.RotateRefreshToken(t.Context(), "not-a-refresh-token"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for an unknown token, got %v", err)
+	}
+}
+
+func TestRevokeRefreshToken(t *testing.T) {
+	db := newTestDB(t)
+	userService := NewUserService(db, zap.NewNop())
+	user, other := newTestUser(t, userService), newTestUser(t, userService)
+
+	service := NewAuthService("test-secret", zap.NewNop())
+	service.SetDB(db)
+
+	issued, err := service.IssueRefreshToken(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("IssueRefreshToken() error = %v", err)
+	}
+	rotated, err := service.RotateRefreshToken(t.Context(), issued.Token)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken() error = %v", err)
+	}
+	otherLogin, err := service.IssueRefreshToken(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("IssueRefreshToken() error = %v", err)
+	}
+
+	if err := service.RevokeRefreshToken(t.Context(), other.ID, rotated.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken revoking another user's token, got %v", err)
+	}
+	if err := service.RevokeRefreshToken(t.Context(), user.ID, "not-a-refresh-token"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for an unknown token, got %v", err)
+	}
+
+	// Revoking the first token of the family also revokes the one rotated from it
+	if err := service.RevokeRefreshToken(t.Context(), user.ID, issued.Token); err != nil {
+		t.Fatalf("RevokeRefreshToken() error = %v", err)
+	}
+	if _, err := service.RotateRefreshToken(t.Context(), rotated.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected the family to be revoked, got %v", err)
+	}
+	if _, err := service.RotateRefreshToken(t.Context(), otherLogin.Token); err != nil {
+		t.Errorf("Expected another login's token to rotate, got %v", err)
+	}
+}
+
+func TestRevokeSessionsRevokesRefreshTokens(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, NewUserService(db, zap.NewNop()))
+
+	service := NewAuthService("test-secret", zap.NewNop())
+	service.SetDB(db)
+
+	issued, err := service.IssueRefreshToken(t.Context(), user.ID)
+	if err != nil {
+		t.Fatalf("IssueRefreshToken() error = %v", err)
+	}
+
+	if _, err := service.RevokeSessions(t.Context(), user.ID); err != nil {
+		t.Fatalf("RevokeSessions() error = %v", err)
+	}
+
+	if _, err := service.RotateRefreshToken(t.Context(), issued.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a refresh token issued before revocation to be rejected, got %v", err)
+	}
+}
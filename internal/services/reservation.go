@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// MaxIPReservation is the most addresses ReserveIPs reserves in one call
+const MaxIPReservation = 256
+
+// Statuses of a server address in ListAllocations
+const (
+	AllocationStatusActive      = "active"
+	AllocationStatusIdleRemoved = "idle_removed"
+	AllocationStatusReserved    = "reserved"
+)
+
+var (
+	// ErrAddressPoolExhausted is returned when a server's subnet has too few free addresses for a new
+	// key or a reservation
+	ErrAddressPoolExhausted = errors.New("address pool exhausted")
+
+	// ErrInvalidAddress is returned when an address to release is not a single host address
+	ErrInvalidAddress = errors.New("invalid address")
+)
+
+// ReserveIPs holds count free addresses in the server's client subnet for peers provisioned outside
+// the API, returning them as host CIDRs. Reserved addresses are never allocated to keys. Either all
+// count addresses are reserved or, with ErrAddressPoolExhausted, none are.
+func (s *WireguardService) ReserveIPs(ctx context.Context, serverID uuid.UUID, count int) ([]string, error) {
+	if count < 1 || count > MaxIPReservation {
+		return nil, fmt.Errorf("reservation size must be between 1 and %d", MaxIPReservation)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockServerAddresses(ctx, tx, serverID); err != nil {
+		return nil, err
+	}
+
+	network, err := s.serverSubnet(ctx, tx, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	taken, err := s.allocatedIPs(ctx, tx, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like allocateUserIP, skip the server's own address at offset 1
+	addresses := make([]string, 0, count)
+	for offset := 2; len(addresses) < count; offset++ {
+		ip, err := hostAddress(network, offset)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %d of %d addresses free in %s", ErrAddressPoolExhausted, len(addresses), count, network)
+		}
+		if address := hostCIDR(ip); !taken[address] {
+			addresses = append(addresses, address)
+		}
+	}
+
+	query := `INSERT INTO ip_reservations (server_id, address) SELECT $1, unnest($2::text[])`
+	if _, err := tx.Exec(ctx, query, serverID, addresses); err != nil {
+		// A unique violation means another reservation took one of the addresses first
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, fmt.Errorf("%w: concurrent reservation, retry", ErrConflict)
+		}
+		return nil, fmt.Errorf("failed to reserve addresses: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to reserve addresses: %w", err)
+	}
+
+	return addresses, nil
+}
+
+// ReleaseIPs frees reserved addresses on a server, returning those that were reserved. Addresses may
+// be given with or without a host prefix length; ones that are not reserved are ignored.
+func (s *WireguardService) ReleaseIPs(ctx context.Context, serverID uuid.UUID, addresses []string) ([]string, error) {
+	normalized := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			parsed, ipNet, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q is not an address", ErrInvalidAddress, address)
+			}
+			if ones, bits := ipNet.Mask.Size(); ones != bits {
+				return nil, fmt.Errorf("%w: %q is not a single host", ErrInvalidAddress, address)
+			}
+			ip = parsed
+		}
+		normalized = append(normalized, hostCIDR(ip))
+	}
+
+	query := `DELETE FROM ip_reservations WHERE server_id = $1 AND address = ANY($2) RETURNING address`
+	rows, err := s.db.Query(ctx, query, serverID, normalized)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release addresses: %w", err)
+	}
+
+	released := []string{}
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan released address: %w", err)
+		}
+		released = append(released, address)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to release addresses: %w", err)
+	}
+
+	return released, nil
+}
+
+// allocationsQuery expands the addresses held on server $1 by active keys and reservations into one
+// row each; dual-stack keys hold one address per family, listed separately
+const allocationsQuery = `
+	WITH allocations AS (
+		SELECT btrim(entry) AS address, u.email, COALESCE(uk.public_key, '') AS public_key,
+			uk.idle_removed_at IS NOT NULL AS idle_removed
+		FROM user_keys uk
+		JOIN users u ON u.id = uk.user_id
+		CROSS JOIN LATERAL unnest(string_to_array(uk.allowed_ips, ',')) AS entry
+		WHERE uk.server_id = $1 AND uk.is_active = true
+		UNION ALL
+		SELECT address, '', '', false FROM ip_reservations WHERE server_id = $1
+	)
+`
+
+// ListAllocations returns a page of the addresses held on a server by active keys or reservations,
+// sorted by address, along with the total. Owners are identified only by masked email and key, so
+// the listing can be used to debug the address pool without disclosing who holds which address.
+func (s *WireguardService) ListAllocations(ctx context.Context, serverID uuid.UUID, limit, offset int) ([]*models.IPAllocation, int, error) {
+	var total int
+	if err := s.db.QueryRow(ctx, allocationsQuery+`SELECT COUNT(*) FROM allocations`, serverID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count allocations: %w", err)
+	}
+
+	// inet orders numerically with IPv4 before IPv6
+	query := allocationsQuery + `
+		SELECT address, email, public_key, idle_removed
+		FROM allocations
+		ORDER BY address::inet, address
+		LIMIT $2 OFFSET $3
+	`
+	rows, err := s.db.Query(ctx, query, serverID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list allocations: %w", err)
+	}
+	defer rows.Close()
+
+	allocations := []*models.IPAllocation{}
+	for rows.Next() {
+		var address, email, publicKey string
+		var idleRemoved bool
+		if err := rows.Scan(&address, &email, &publicKey, &idleRemoved); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan allocation: %w", err)
+		}
+
+		allocation := &models.IPAllocation{Address: address, Status: AllocationStatusReserved}
+		if email != "" {
+			allocation.Status = AllocationStatusActive
+			if idleRemoved {
+				allocation.Status = AllocationStatusIdleRemoved
+			}
+			allocation.User = MaskEmail(email)
+			allocation.PublicKey = MaskPublicKey(publicKey)
+		}
+		allocations = append(allocations, allocation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to list allocations: %w", err)
+	}
+
+	return allocations, total, nil
+}
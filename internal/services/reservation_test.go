@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestReserveIPs(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+
+	// A /29 leaves .2 through .6 for clients
+	serverID := newTestServer(t, db, "Reservations", "Reservations Location")
+	if _, err := db.Exec(ctx, `UPDATE servers SET subnet = '10.77.0.0/29' WHERE id = $1`, serverID); err != nil {
+		t.Fatalf("Failed to set subnet: %v", err)
+	}
+
+	service := NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	service.SetDB(db)
+
+	reserved, err := service.ReserveIPs(ctx, serverID, 3)
+	if err != nil {
+		t.Fatalf("ReserveIPs() error = %v", err)
+	}
+	if want := []string{"10.77.0.2/32", "10.77.0.3/32", "10.77.0.4/32"}; !slices.Equal(reserved, want) {
+		t.Errorf("Expected %v reserved, got %v", want, reserved)
+	}
+
+	// Neither auto-allocation nor a static address may take a reserved one
+	user := newTestUser(t, NewUserService(db, logger))
+	peers := newTestPeers(t, 2)
+	if _, err := service.AddUserKeyWithStaticIP(ctx, user.ID, serverID, peers[0].PublicKey.String(), "10.77.0.3", nil); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddUserKeyWithStaticIP() on a reserved address error = %v, want ErrConflict", err)
+	}
+	key, err := service.AddUserKey(ctx, user.ID, serverID, peers[1].PublicKey.String())
+	if err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+	if key.AllowedIPs != "10.77.0.5/32" {
+		t.Errorf("Expected the first unreserved address, got %s", key.AllowedIPs)
+	}
+
+	// Only .6 is left, so a reservation of two fails without reserving anything
+	if _, err := service.ReserveIPs(ctx, serverID, 2); !errors.Is(err, ErrAddressPoolExhausted) {
+		t.Fatalf("ReserveIPs() beyond the pool error = %v, want ErrAddressPoolExhausted", err)
+	}
+	if last, err := service.ReserveIPs(ctx, serverID, 1); err != nil || !slices.Equal(last, []string{"10.77.0.6/32"}) {
+		t.Fatalf("ReserveIPs() of the last address = %v, %v", last, err)
+	}
+
+	// Released addresses can be reserved again; unreserved ones are ignored
+	released, err := service.ReleaseIPs(ctx, serverID, []string{"10.77.0.3", "10.77.0.4/32", "10.77.0.5"})
+	if err != nil {
+		t.Fatalf("ReleaseIPs() error = %v", err)
+	}
+	slices.Sort(released)
+	if want := []string{"10.77.0.3/32", "10.77.0.4/32"}; !slices.Equal(released, want) {
+		t.Errorf("Expected %v released, got %v", want, released)
+	}
+	if again, err := service.ReserveIPs(ctx, serverID, 2); err != nil || !slices.Equal(again, []string{"10.77.0.3/32", "10.77.0.4/32"}) {
+		t.Errorf("ReserveIPs() after release = %v, %v", again, err)
+	}
+
+	if _, err := service.ReleaseIPs(ctx, serverID, []string{"10.77.0.0/29"}); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("ReleaseIPs() of a network error = %v, want ErrInvalidAddress", err)
+	}
+}
+
+func TestListAllocations(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+
+	serverID := newTestServer(t, db, "Allocations", "Allocations Location")
+	if _, err := db.Exec(ctx, `UPDATE servers SET subnet = '10.78.0.0/28' WHERE id = $1`, serverID); err != nil {
+		t.Fatalf("Failed to set subnet: %v", err)
+	}
+
+	service := NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	service.SetDB(db)
+
+	// Allocate out of address order: .10 before .4, then a reservation of .2
+	userService := NewUserService(db, logger)
+	first, second := newTestUser(t, userService), newTestUser(t, userService)
+	peers := newTestPeers(t, 2)
+	if _, err := service.AddUserKeyWithStaticIP(ctx, first.ID, serverID, peers[0].PublicKey.String(), "10.78.0.10", nil); err != nil {
+		t.Fatalf("AddUserKeyWithStaticIP() error = %v", err)
+	}
+	idleKey, err := service.AddUserKeyWithStaticIP(ctx, second.ID, serverID, peers[1].PublicKey.String(), "10.78.0.4", nil)
+	if err != nil {
+		t.Fatalf("AddUserKeyWithStaticIP() error = %v", err)
+	}
+	if _, err := db.Exec(ctx, `UPDATE user_keys SET idle_removed_at = NOW() WHERE id = $1`, idleKey.ID); err != nil {
+		t.Fatalf("Failed to mark key idle: %v", err)
+	}
+	if _, err := service.ReserveIPs(ctx, serverID, 1); err != nil {
+		t.Fatalf("ReserveIPs() error = %v", err)
+	}
+
+	allocations, total, err := service.ListAllocations(ctx, serverID, 10, 0)
+	if err != nil {
+		t.Fatalf("ListAllocations() error = %v", err)
+	}
+	if total != 3 || len(allocations) != 3 {
+		t.Fatalf("Expected 3 allocations, got %d of %d", len(allocations), total)
+	}
+
+	want := []models.IPAllocation{
+		{Address: "10.78.0.2/32", Status: AllocationStatusReserved},
+		{Address: "10.78.0.4/32", User: MaskEmail(second.Email), PublicKey: MaskPublicKey(peers[1].PublicKey.String()), Status: AllocationStatusIdleRemoved},
+		{Address: "10.78.0.10/32", User: MaskEmail(first.Email), PublicKey: MaskPublicKey(peers[0].PublicKey.String()), Status: AllocationStatusActive},
+	}
+	for i, allocation := range allocations {
+		if *allocation != want[i] {
+			t.Errorf("Allocation %d = %+v, want %+v", i, *allocation, want[i])
+		}
+		if allocation.User != "" && allocation.User != "t***@example.com" {
+			t.Errorf("Allocation %d does not mask its owner: %q", i, allocation.User)
+		}
+	}
+
+	page, total, err := service.ListAllocations(ctx, serverID, 1, 2)
+	if err != nil || total != 3 || len(page) != 1 || page[0].Address != "10.78.0.10/32" {
+		t.Errorf("ListAllocations() last page = %v, %d, %v", page, total, err)
+	}
+}
+
+func TestReserveIPsRejectsInvalidCount(t *testing.T) {
+	service := NewWireguardServiceWithClient(zap.NewNop(), &fakeWGClient{})
+	for _, count := range []int{0, MaxIPReservation + 1} {
+		if _, err := service.ReserveIPs(context.Background(), defaultServerID, count); err == nil {
+			t.Errorf("Expected an error reserving %d addresses", count)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// ErrScheduledRevocationNotFound is returned when cancelling a revocation the user does not have pending
+var ErrScheduledRevocationNotFound = errors.New("scheduled revocation not found")
+
+// ValidateRevocationTime rejects a revocation time that is missing or not in the future
+func ValidateRevocationTime(revokeAt, now time.Time) error {
+	if revokeAt.IsZero() {
+		return fmt.Errorf("revoke_at is required")
+	}
+	if !revokeAt.After(now) {
+		return fmt.Errorf("revoke_at must be in the future")
+	}
+	return nil
+}
+
+// ScheduleRevocation records that a user's access is to be revoked at revokeAt, which
+// ExecuteScheduledRevocations carries out once it passes. scheduledBy is the admin asking for it. It
+// returns ErrUserNotFound for an unknown user.
+func (s *WireguardService) ScheduleRevocation(ctx context.Context, userID uuid.UUID, revokeAt time.Time, scheduledBy uuid.UUID) (*models.ScheduledRevocation, error) {
+	if err := ValidateRevocationTime(revokeAt, time.Now()); err != nil {
+		return nil, err
+	}
+
+	revocation := &models.ScheduledRevocation{}
+	query := `
+		INSERT INTO scheduled_revocations (user_id, revoke_at, scheduled_by)
+		VALUES ($1, $2, $3)
+		RETURNING id, user_id, revoke_at, scheduled_by, created_at
+	`
+	err := s.db.QueryRow(ctx, query, userID, revokeAt, scheduledBy).Scan(
+		&revocation.ID,
+		&revocation.UserID,
+		&revocation.RevokeAt,
+		&revocation.ScheduledBy,
+		&revocation.CreatedAt,
+	)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" && pgErr.ConstraintName == "scheduled_revocations_user_id_fkey" {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to schedule revocation: %w", err)
+	}
+
+	s.logger.Info("Key revocation scheduled",
+		zap.String("user_id", userID.String()),
+		zap.String("revocation_id", revocation.ID.String()),
+		zap.Time("revoke_at", revocation.RevokeAt))
+
+	return revocation, nil
+}
+
+// ListScheduledRevocations returns a user's pending revocations, soonest first
+func (s *WireguardService) ListScheduledRevocations(ctx context.Context, userID uuid.UUID) ([]*models.ScheduledRevocation, error) {
+	query := `
+		SELECT id, user_id, revoke_at, scheduled_by, created_at
+		FROM scheduled_revocations
+		WHERE user_id = $1 AND executed_at IS NULL
+		ORDER BY revoke_at, created_at
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scheduled revocations: %w", err)
+	}
+	defer rows.Close()
+
+	revocations := []*models.ScheduledRevocation{}
+	for rows.Next() {
+		revocation := &models.ScheduledRevocation{}
+		if err := rows.Scan(
+			&revocation.ID,
+			&revocation.UserID,
+			&revocation.RevokeAt,
+			&revocation.ScheduledBy,
+			&revocation.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan scheduled revocation: %w", err)
+		}
+		revocations = append(revocations, revocation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate scheduled revocations: %w", err)
+	}
+
+	return revocations, nil
+}
+
+// CancelScheduledRevocation removes one of a user's pending revocations. It returns
+// ErrScheduledRevocationNotFound when the user has no such revocation or it has already run.
+func (s *WireguardService) CancelScheduledRevocation(ctx context.Context, userID, revocationID uuid.UUID) error {
+	query := `DELETE FROM scheduled_revocations WHERE id = $1 AND user_id = $2 AND executed_at IS NULL`
+	result, err := s.db.Exec(ctx, query, revocationID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel scheduled revocation: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrScheduledRevocationNotFound
+	}
+
+	s.logger.Info("Scheduled key revocation cancelled",
+		zap.String("user_id", userID.String()),
+		zap.String("revocation_id", revocationID.String()))
+
+	return nil
+}
+
+// ExecuteScheduledRevocations carries out every pending revocation whose time has passed and returns
+// how many keys were deactivated. Each user is disabled, so no new key can be added and no new session
+// started, their sessions and refresh tokens are revoked and their keys deactivated, all in one
+// transaction with marking the revocations executed; their peers are then removed from the device,
+// where a failure is logged and left for reconciliation to prune.
+func (s *WireguardService) ExecuteScheduledRevocations(ctx context.Context) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// The stored key is cleared when a hash stands in for it, so capture it before deactivating
+	query := `
+		WITH due AS (
+			UPDATE scheduled_revocations SET executed_at = NOW()
+			WHERE executed_at IS NULL AND revoke_at <= NOW()
+			RETURNING user_id
+		), disabled AS (
+			UPDATE users SET is_active = false, tokens_valid_after = NOW(), updated_at = NOW()
+			WHERE id IN (SELECT user_id FROM due)
+		), refresh AS (
+			UPDATE refresh_tokens SET revoked_at = NOW()
+			WHERE user_id IN (SELECT user_id FROM due) AND revoked_at IS NULL
+		), revoked AS (
+			SELECT id, public_key FROM user_keys
+			WHERE is_active = true AND user_id IN (SELECT user_id FROM due)
+			FOR UPDATE
+		), deactivated AS (
+			UPDATE user_keys k SET is_active = false, updated_at = NOW(),
+				public_key = CASE WHEN k.public_key_hash IS NULL THEN k.public_key END
+			FROM revoked
+			WHERE k.id = revoked.id
+			RETURNING k.id, k.user_id, k.server_id, k.allowed_ips, COALESCE(k.public_key_hash, k.public_key) AS key_lookup, revoked.public_key
+		), recorded AS (
+			INSERT INTO revoked_keys (user_id, server_id, key_lookup)
+			SELECT user_id, server_id, key_lookup FROM deactivated WHERE key_lookup IS NOT NULL
+			ON CONFLICT (user_id, server_id, key_lookup) DO UPDATE SET revoked_at = NOW()
+		), history AS (
+			INSERT INTO user_key_events (user_key_id, user_id, server_id, event, public_key_prefix, allowed_ips)
+			SELECT id, user_id, server_id, 'revoked', COALESCE(LEFT(public_key, 8), ''), allowed_ips FROM deactivated
+		)
+		SELECT public_key FROM deactivated
+	`
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute scheduled revocations: %w", err)
+	}
+
+	var publicKeys []string
+	for rows.Next() {
+		var publicKey *string
+		if err := rows.Scan(&publicKey); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan revoked key: %w", err)
+		}
+		if publicKey != nil {
+			publicKeys = append(publicKeys, *publicKey)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate revoked keys: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, publicKey := range publicKeys {
+		if err := s.removeUserFromWireGuard(ctx, publicKey); err != nil {
+			s.logger.Error("Failed to remove revoked peer from WireGuard engine", zap.Error(err))
+		}
+	}
+
+	if len(publicKeys) > 0 {
+		s.logger.Info("Executed scheduled key revocations", zap.Int("revoked_keys", len(publicKeys)))
+	}
+
+	return len(publicKeys), nil
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/denzelpenzel/vpn/internal/lifecycle"
+)
+
+func TestValidateRevocationTime(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		revokeAt time.Time
+		wantErr  bool
+	}{
+		{name: "future", revokeAt: now.Add(time.Hour)},
+		{name: "missing", wantErr: true},
+		{name: "now", revokeAt: now, wantErr: true},
+		{name: "past", revokeAt: now.Add(-time.Hour), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateRevocationTime(tt.revokeAt, now); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRevocationTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecuteScheduledRevocations(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+	userService := NewUserService(db, logger)
+
+	serverID := newTestServer(t, db, "Revocation", "Revocation Location")
+	if _, err := db.Exec(ctx, `UPDATE servers SET subnet = '10.86.0.0/28' WHERE id = $1`, serverID); err != nil {
+		t.Fatalf("Failed to set subnet: %v", err)
+	}
+
+	client := &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}}
+	service := NewWireguardServiceWithClient(logger, client)
+	service.SetDB(db)
+
+	admin := newTestUser(t, userService)
+	due, cancelled, future := newTestUser(t, userService), newTestUser(t, userService), newTestUser(t, userService)
+	peers := newTestPeers(t, 3)
+	for i, user := range []uuid.UUID{due.ID, cancelled.ID, future.ID} {
+		if _, err := service.AddUserKey(ctx, user, serverID, peers[i].PublicKey.String()); err != nil {
+			t.Fatalf("AddUserKey() error = %v", err)
+		}
+	}
+
+	dueRevocation, err := service.ScheduleRevocation(ctx, due.ID, time.Now().Add(time.Hour), admin.ID)
+	if err != nil {
+		t.Fatalf("ScheduleRevocation() error = %v", err)
+	}
+	cancelledRevocation, err := service.ScheduleRevocation(ctx, cancelled.ID, time.Now().Add(time.Hour), admin.ID)
+	if err != nil {
+		t.Fatalf("ScheduleRevocation() error = %v", err)
+	}
+	if _, err := service.ScheduleRevocation(ctx, future.ID, time.Now().Add(time.Hour), admin.ID); err != nil {
+		t.Fatalf("ScheduleRevocation() error = %v", err)
+	}
+
+	authService := NewAuthService("test-secret", logger)
+	authService.SetDB(db)
+	refresh, err := authService.IssueRefreshToken(ctx, due.ID)
+	if err != nil {
+		t.Fatalf("IssueRefreshToken() error = %v", err)
+	}
+
+	// Move two of them into the past, as if their time had come, and cancel one of those
+	if _, err := db.Exec(ctx, `UPDATE scheduled_revocations SET revoke_at = NOW() - INTERVAL '1 minute' WHERE id = ANY($1)`,
+		[]uuid.UUID{dueRevocation.ID, cancelledRevocation.ID}); err != nil {
+		t.Fatalf("Failed to backdate revocations: %v", err)
+	}
+	if err := service.CancelScheduledRevocation(ctx, cancelled.ID, cancelledRevocation.ID); err != nil {
+		t.Fatalf("CancelScheduledRevocation() error = %v", err)
+	}
+
+	// The worker's next tick carries out the due revocation
+	ticks := make(chan int, 1)
+	worker := lifecycle.Worker("scheduled-revocation", 10*time.Millisecond, func(ctx context.Context) {
+		revoked, err := service.ExecuteScheduledRevocations(ctx)
+		if err != nil {
+			t.Errorf("ExecuteScheduledRevocations() error = %v", err)
+		}
+		select {
+		case ticks <- revoked:
+		default:
+		}
+	})
+	if err := worker.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	select {
+	case revoked := <-ticks:
+		if revoked != 1 {
+			t.Errorf("Expected 1 key revoked, got %d", revoked)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Worker did not run")
+	}
+	if err := worker.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	if _, err := service.GetUserKey(ctx, due.ID, serverID); !errors.Is(err, ErrUserKeyNotFound) {
+		t.Errorf("Expected the due user's key to be deactivated, got %v", err)
+	}
+	if _, err := service.GetPeer(peers[0].PublicKey.String()); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("Expected the due user's peer to be removed, got %v", err)
+	}
+
+	// The due user is locked out too: disabled, signed out everywhere and unable to add a new key
+	if _, err := userService.GetUserByID(ctx, due.ID); !errors.Is(err, ErrUserInactive) {
+		t.Errorf("Expected the due user to be disabled, got %v", err)
+	}
+	var cutoff *time.Time
+	if err := db.QueryRow(ctx, `SELECT tokens_valid_after FROM users WHERE id = $1`, due.ID).Scan(&cutoff); err != nil {
+		t.Fatalf("Failed to read session cutoff: %v", err)
+	}
+	if cutoff == nil {
+		t.Error("Expected the due user's sessions to be revoked")
+	}
+	if _, err := authService.RotateRefreshToken(ctx, refresh.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected the due user's refresh token to be revoked, got %v", err)
+	}
+	if _, err := service.AddUserKey(ctx, due.ID, serverID, newTestPeers(t, 1)[0].PublicKey.String()); !errors.Is(err, ErrUserInactive) {
+		t.Errorf("Expected ErrUserInactive adding a key for the revoked user, got %v", err)
+	}
+
+	for i, user := range []uuid.UUID{cancelled.ID, future.ID} {
+		if _, err := service.GetUserKey(ctx, user, serverID); err != nil {
+			t.Errorf("Expected user %d's key to stay active, got %v", i, err)
+		}
+		if _, err := service.GetPeer(peers[i+1].PublicKey.String()); err != nil {
+			t.Errorf("Expected user %d's peer to stay on the device, got %v", i, err)
+		}
+	}
+
+	// An executed revocation is no longer pending and does not run again
+	pending, err := service.ListScheduledRevocations(ctx, due.ID)
+	if err != nil {
+		t.Fatalf("ListScheduledRevocations() error = %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending revocations after execution, got %d", len(pending))
+	}
+	if err := service.CancelScheduledRevocation(ctx, due.ID, dueRevocation.ID); !errors.Is(err, ErrScheduledRevocationNotFound) {
+		t.Errorf("Expected ErrScheduledRevocationNotFound for an executed revocation, got %v", err)
+	}
+	if revoked, err := service.ExecuteScheduledRevocations(ctx); err != nil || revoked != 0 {
+		t.Errorf("Expected nothing left to revoke, got %d, %v", revoked, err)
+	}
+
+	pending, err = service.ListScheduledRevocations(ctx, future.ID)
+	if err != nil {
+		t.Fatalf("ListScheduledRevocations() error = %v", err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("Expected the future revocation to stay pending, got %d", len(pending))
+	}
+}
+
+func TestScheduleRevocationUnknownUser(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+
+	service := NewWireguardServiceWithClient(logger, &fakeWGClient{})
+	service.SetDB(db)
+	admin := newTestUser(t, NewUserService(db, logger))
+
+	if _, err := service.ScheduleRevocation(ctx, uuid.New(), time.Now().Add(time.Hour), admin.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// selfTestProbeTimeout bounds how long the self-test probe waits for the upstream to answer
+const selfTestProbeTimeout = 5 * time.Second
+
+// Self-test check names
+const (
+	SelfTestDevice     = "device"
+	SelfTestListenPort = "listen_port"
+	SelfTestPublicKey  = "public_key"
+	SelfTestProbe      = "probe"
+)
+
+// probeDialer opens the connection a self-test probe is sent over
+type probeDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+// SelfTest checks that the WireGuard device is up with the server's listen port and public key and,
+// when probe is a host:port, that the upstream accepts a TCP connection from the tunnel's address,
+// the path client traffic takes out through NAT. Every check is run and reported; the report is
+// healthy only when all of them pass. Only the server the device carries can be tested; any other
+// fails with ErrServerNotFound rather than being judged against this host's device.
+func (s *WireguardService) SelfTest(ctx context.Context, server *models.Server, probe string) (*models.SelfTestReport, error) {
+	if err := s.checkLocalServer(server.ID); err != nil {
+		return nil, err
+	}
+
+	report := &models.SelfTestReport{ServerID: server.ID, Checks: []models.SelfTestCheck{}}
+	check := func(name string, err error, passed string) {
+		result := models.SelfTestCheck{Name: name, Passed: err == nil, Detail: passed}
+		if err != nil {
+			result.Detail = err.Error()
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	if s.wgClient == nil {
+		check(SelfTestDevice, fmt.Errorf("WireGuard client not available"), "")
+	} else if device, err := s.wgClient.Device(s.deviceName); err != nil {
+		check(SelfTestDevice, fmt.Errorf("device %s unavailable: %w", s.deviceName, err), "")
+	} else {
+		check(SelfTestDevice, nil, fmt.Sprintf("device %s is up with %d peers", device.Name, len(device.Peers)))
+
+		if device.ListenPort != server.Port {
+			check(SelfTestListenPort, fmt.Errorf("device listens on %d, server is configured for %d", device.ListenPort, server.Port), "")
+		} else {
+			check(SelfTestListenPort, nil, fmt.Sprintf("device listens on %d", device.ListenPort))
+		}
+
+		deviceKey := device.PublicKey.String()
+		if deviceKey != server.PublicKey {
+			check(SelfTestPublicKey, fmt.Errorf("device key %s does not match the stored key %s",
+				MaskPublicKey(deviceKey), MaskPublicKey(server.PublicKey)), "")
+		} else {
+			check(SelfTestPublicKey, nil, fmt.Sprintf("device key %s matches the stored key", MaskPublicKey(deviceKey)))
+		}
+	}
+
+	if probe != "" {
+		check(SelfTestProbe, s.sendProbe(ctx, probe), fmt.Sprintf("%s reachable", probe))
+	}
+
+	report.Healthy = true
+	for _, result := range report.Checks {
+		report.Healthy = report.Healthy && result.Passed
+	}
+
+	s.logger.Info("WireGuard self-test completed",
+		zap.String("server_id", server.ID.String()),
+		zap.Bool("healthy", report.Healthy))
+
+	return report, nil
+}
+
+// sendProbe opens a TCP connection to address from the device's tunnel address and closes it
+func (s *WireguardService) sendProbe(ctx context.Context, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestProbeTimeout)
+	defer cancel()
+
+	dial := s.probeDial
+	if dial == nil {
+		local, err := interfaceAddr(s.deviceName)
+		if err != nil {
+			return err
+		}
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: local}}
+		dial = dialer.DialContext
+	}
+
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("probe to %s failed: %w", address, err)
+	}
+	return conn.Close()
+}
+
+// interfaceAddr returns the first IPv4 address of a network interface, falling back to its first
+// address of any family
+func interfaceAddr(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s unavailable: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read addresses of %s: %w", name, err)
+	}
+
+	var first net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+	if first == nil {
+		return nil, fmt.Errorf("interface %s has no address", name)
+	}
+	return first, nil
+}
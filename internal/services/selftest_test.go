@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// selfTest runs SelfTest, failing the test on an error
+func selfTest(t *testing.T, service *WireguardService, server *models.Server, probe string) *models.SelfTestReport {
+	t.Helper()
+
+	report, err := service.SelfTest(context.Background(), server, probe)
+	if err != nil {
+		t.Fatalf("SelfTest() error = %v", err)
+	}
+	return report
+}
+
+// selfTestChecks indexes a report's checks by name
+func selfTestChecks(report *models.SelfTestReport) map[string]models.SelfTestCheck {
+	checks := make(map[string]models.SelfTestCheck, len(report.Checks))
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+	}
+	return checks
+}
+
+func TestSelfTest(t *testing.T) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKey() error = %v", err)
+	}
+	client := &fakeWGClient{device: &wgtypes.Device{
+		Name:       "wg0",
+		PublicKey:  privateKey.PublicKey(),
+		ListenPort: 51820,
+		Peers:      newTestPeers(t, 2),
+	}}
+	service := NewWireguardServiceWithClient(zap.NewNop(), client)
+	server := &models.Server{ID: uuid.New(), PublicKey: privateKey.PublicKey().String(), Port: 51820}
+	service.SetLocalServerID(server.ID)
+
+	var probed string
+	service.probeDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		probed = address
+		local, remote := net.Pipe()
+		remote.Close()
+		return local, nil
+	}
+
+	report := selfTest(t, service, server, "upstream.example:443")
+	if !report.Healthy || report.ServerID != server.ID {
+		t.Errorf("SelfTest() = %+v, want a healthy report", report)
+	}
+	checks := selfTestChecks(report)
+	for _, name := range []string{SelfTestDevice, SelfTestListenPort, SelfTestPublicKey, SelfTestProbe} {
+		if check, ok := checks[name]; !ok || !check.Passed {
+			t.Errorf("Check %s = %+v, want passed", name, check)
+		}
+	}
+	if probed != "upstream.example:443" {
+		t.Errorf("Probe sent to %q", probed)
+	}
+
+	// Without a probe address no probe is sent
+	if _, ok := selfTestChecks(selfTest(t, service, server, ""))[SelfTestProbe]; ok {
+		t.Error("SelfTest() without a probe should not report a probe check")
+	}
+
+	// Another server is not judged against this host's device
+	remote := &models.Server{ID: uuid.New(), PublicKey: server.PublicKey, Port: server.Port}
+	if _, err := service.SelfTest(context.Background(), remote, ""); !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("SelfTest() of a remote server error = %v, want ErrServerNotFound", err)
+	}
+}
+
+func TestSelfTestKeyMismatch(t *testing.T) {
+	deviceKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKey() error = %v", err)
+	}
+	client := &fakeWGClient{device: &wgtypes.Device{Name: "wg0", PublicKey: deviceKey.PublicKey(), ListenPort: 51820}}
+	service := NewWireguardServiceWithClient(zap.NewNop(), client)
+	service.probeDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	server := &models.Server{ID: uuid.New(), PublicKey: newTestPeers(t, 1)[0].PublicKey.String(), Port: 51821}
+	service.SetLocalServerID(server.ID)
+
+	report := selfTest(t, service, server, "upstream.example:443")
+	if report.Healthy {
+		t.Error("SelfTest() with a mismatched key should not be healthy")
+	}
+	checks := selfTestChecks(report)
+	if !checks[SelfTestDevice].Passed {
+		t.Errorf("Device check = %+v, want passed", checks[SelfTestDevice])
+	}
+	for _, name := range []string{SelfTestPublicKey, SelfTestListenPort, SelfTestProbe} {
+		if check := checks[name]; check.Passed || check.Detail == "" {
+			t.Errorf("Check %s = %+v, want failed with a detail", name, check)
+		}
+	}
+
+	// A missing device fails the device check without the checks that need it
+	client.device = nil
+	checks = selfTestChecks(selfTest(t, service, server, ""))
+	if check, ok := checks[SelfTestDevice]; !ok || check.Passed {
+		t.Errorf("Device check without a device = %+v, want failed", check)
+	}
+	if _, ok := checks[SelfTestPublicKey]; ok {
+		t.Error("Key check should be skipped without a device")
+	}
+}
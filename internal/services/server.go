@@ -2,12 +2,18 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/denzelpenzel/vpn/internal/database"
 	"github.com/denzelpenzel/vpn/internal/models"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
@@ -16,6 +22,15 @@ import (
 type ServerService struct {
 	db     *pgxpool.Pool
 	logger *zap.Logger
+
+	mu             sync.RWMutex
+	servers        []*models.ServerResponse // cached active servers, nil until first load
+	serversExpires time.Time                // when a cached maintenance window ends; zero if none does
+
+	defaultServer *DefaultServer // seeded into an empty servers table; nil disables seeding
+
+	// health is set in degraded mode, when the cached server list is served while the database is down
+	health *database.Health
 }
 
 // NewServerService creates a new server service
@@ -26,25 +41,170 @@ func NewServerService(db *pgxpool.Pool, logger *zap.Logger) *ServerService {
 	}
 }
 
-// GetActiveServers retrieves all active VPN servers
-func (s *ServerService) GetActiveServers(ctx context.Context) ([]*models.ServerResponse, error) {
+// SetDatabaseHealth enables degraded mode: while health finds the database down, GetActiveServers
+// serves the cached list however old it is rather than failing
+func (s *ServerService) SetDatabaseHealth(health *database.Health) {
+	s.health = health
+}
+
+// Sort modes accepted by GetActiveServers
+const (
+	ServerSortLocation = "location"
+	ServerSortName     = "name"
+	ServerSortLoad     = "load" // fewest active keys first
+)
+
+// serverSortOrders maps each sort mode to its ORDER BY clause
+var serverSortOrders = map[string]string{
+	ServerSortLocation: "s.location, s.name",
+	ServerSortName:     "s.name, s.location",
+	ServerSortLoad:     "COALESCE(k.active_keys, 0), s.location, s.name",
+}
+
+// ValidateServerListOptions checks the sort mode and limit of a server list request
+func ValidateServerListOptions(opts models.ServerListOptions) error {
+	if opts.SortBy != "" {
+		if _, ok := serverSortOrders[opts.SortBy]; !ok {
+			return fmt.Errorf("invalid sort mode %q: must be one of load, location, name", opts.SortBy)
+		}
+	}
+
+	if opts.Limit < 0 {
+		return fmt.Errorf("invalid limit: %d", opts.Limit)
+	}
+
+	return nil
+}
+
+// GetActiveServers retrieves active VPN servers. With no options it returns every server sorted by
+// location and name from the in-memory cache; otherwise the sort and limit are applied in the database.
+func (s *ServerService) GetActiveServers(ctx context.Context, opts models.ServerListOptions) ([]*models.ServerResponse, error) {
+	if opts != (models.ServerListOptions{}) {
+		if err := ValidateServerListOptions(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if !s.health.Healthy() {
+		return s.cachedServers(opts)
+	}
+
+	if opts != (models.ServerListOptions{}) {
+		return s.loadActiveServers(ctx, opts)
+	}
+
+	s.mu.RLock()
+	servers, expires := s.servers, s.serversExpires
+	s.mu.RUnlock()
+
+	// An ended maintenance window must not keep warning clients
+	if servers != nil && (expires.IsZero() || time.Now().Before(expires)) {
+		return servers, nil
+	}
+
+	return s.ReloadServers(ctx)
+}
+
+// cachedServers serves GetActiveServers while the database is down: the cached list, stale or not,
+// cut to opts.Limit. Sorting by load needs the database, so every sort mode gets the cached location
+// order. It fails with database.ErrUnavailable when nothing is cached.
+func (s *ServerService) cachedServers(opts models.ServerListOptions) ([]*models.ServerResponse, error) {
+	s.mu.RLock()
+	servers := s.servers
+	s.mu.RUnlock()
+
+	if servers == nil {
+		return nil, database.ErrUnavailable
+	}
+	if opts.Limit > 0 && opts.Limit < len(servers) {
+		servers = servers[:opts.Limit]
+	}
+	return servers, nil
+}
+
+// ReloadServers re-reads active servers from the database and replaces the cached list
+func (s *ServerService) ReloadServers(ctx context.Context) ([]*models.ServerResponse, error) {
+	servers, err := s.loadActiveServers(ctx, models.ServerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var expires time.Time
+	for _, server := range servers {
+		if m := server.Maintenance; m != nil && (expires.IsZero() || m.EndsAt.Before(expires)) {
+			expires = m.EndsAt
+		}
+	}
+
+	s.mu.Lock()
+	s.servers = servers
+	s.serversExpires = expires
+	s.mu.Unlock()
+
+	return servers, nil
+}
+
+// invalidateServers drops the cached server list so the next read goes to the database
+func (s *ServerService) invalidateServers() {
+	s.mu.Lock()
+	s.servers = nil
+	s.mu.Unlock()
+}
+
+// loadActiveServers queries active VPN servers from the database, sorted by location and name unless
+// opts says otherwise
+func (s *ServerService) loadActiveServers(ctx context.Context, opts models.ServerListOptions) ([]*models.ServerResponse, error) {
+	sortBy := opts.SortBy
+	if sortBy == "" {
+		sortBy = ServerSortLocation
+	}
+
 	query := `
-		SELECT id, name, location, endpoint, public_key, port
-		FROM servers
-		WHERE is_active = true
-		ORDER BY location, name
+		SELECT s.id, s.name, s.location, s.endpoint, s.public_key, s.port,
+			m.id, m.starts_at, m.ends_at, m.message, m.created_at
+		FROM servers s
 	`
+	if sortBy == ServerSortLoad {
+		query += `
+		LEFT JOIN (
+			SELECT server_id, COUNT(*) AS active_keys
+			FROM user_keys
+			WHERE is_active = true
+			GROUP BY server_id
+		) k ON k.server_id = s.id
+		`
+	}
+	query += `
+		LEFT JOIN LATERAL (
+			SELECT id, starts_at, ends_at, message, created_at
+			FROM maintenance_windows
+			WHERE server_id = s.id AND ends_at > NOW()
+			ORDER BY starts_at, ends_at
+			LIMIT 1
+		) m ON true
+		WHERE s.is_active = true
+		ORDER BY ` + serverSortOrders[sortBy]
 
-	rows, err := s.db.Query(ctx, query)
+	var args []interface{}
+	if opts.Limit > 0 {
+		query += ` LIMIT $1`
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := s.db.Query(ctx, query, args...)
 	if err != nil {
 		s.logger.Error("Failed to query servers", zap.Error(err))
 		return nil, fmt.Errorf("failed to get servers: %w", err)
 	}
 	defer rows.Close()
 
-	var servers []*models.ServerResponse
+	servers := []*models.ServerResponse{}
 	for rows.Next() {
 		server := &models.ServerResponse{}
+		// The server's active or next maintenance window, all NULL when it has none
+		var windowID *uuid.UUID
+		var startsAt, endsAt, createdAt *time.Time
+		var message *string
 		err := rows.Scan(
 			&server.ID,
 			&server.Name,
@@ -52,11 +212,26 @@ func (s *ServerService) GetActiveServers(ctx context.Context) ([]*models.ServerR
 			&server.Endpoint,
 			&server.PublicKey,
 			&server.Port,
+			&windowID,
+			&startsAt,
+			&endsAt,
+			&message,
+			&createdAt,
 		)
 		if err != nil {
 			s.logger.Error("Failed to scan server row", zap.Error(err))
 			continue
 		}
+		if windowID != nil {
+			server.Maintenance = &models.MaintenanceWindow{
+				ID:        *windowID,
+				ServerID:  server.ID,
+				StartsAt:  *startsAt,
+				EndsAt:    *endsAt,
+				Message:   *message,
+				CreatedAt: *createdAt,
+			}
+		}
 		servers = append(servers, server)
 	}
 
@@ -73,7 +248,9 @@ func (s *ServerService) GetActiveServers(ctx context.Context) ([]*models.ServerR
 func (s *ServerService) GetServerByID(ctx context.Context, serverID uuid.UUID) (*models.Server, error) {
 	server := &models.Server{}
 	query := `
-		SELECT id, name, location, endpoint, public_key, port, is_active, created_at, updated_at
+		SELECT id, name, location, endpoint, COALESCE(public_key, ''), port, COALESCE(dns_search, ''),
+			COALESCE(subnet, ''), COALESCE(subnet_v6, ''), is_active, created_at, updated_at, last_seen_at,
+			obfuscation, COALESCE(doh_template, '')
 		FROM servers
 		WHERE id = $1 AND is_active = true
 	`
@@ -85,9 +262,15 @@ func (s *ServerService) GetServerByID(ctx context.Context, serverID uuid.UUID) (
 		&server.Endpoint,
 		&server.PublicKey,
 		&server.Port,
+		&server.DNSSearch,
+		&server.Subnet,
+		&server.SubnetV6,
 		&server.IsActive,
 		&server.CreatedAt,
 		&server.UpdatedAt,
+		&server.LastSeenAt,
+		&server.Obfuscation,
+		&server.DoHTemplate,
 	)
 
 	if err != nil {
@@ -95,25 +278,275 @@ func (s *ServerService) GetServerByID(ctx context.Context, serverID uuid.UUID) (
 		return nil, fmt.Errorf("server not found")
 	}
 
+	if server.Endpoints, err = s.getServerEndpoints(ctx, serverID); err != nil {
+		return nil, err
+	}
+	if server.Maintenance, err = s.nextMaintenance(ctx, serverID); err != nil {
+		return nil, err
+	}
+
 	return server, nil
 }
 
-// CreateServer creates a new VPN server (admin function)
-func (s *ServerService) CreateServer(ctx context.Context, name, location, endpoint, publicKey string, port int) (*models.Server, error) {
+// getServerEndpoints lists a server's alternative endpoints in the order they were added
+func (s *ServerService) getServerEndpoints(ctx context.Context, serverID uuid.UUID) ([]models.ServerEndpoint, error) {
+	query := `
+		SELECT endpoint, COALESCE(country, ''), COALESCE(region, ''), COALESCE(asn, 0)
+		FROM server_endpoints
+		WHERE server_id = $1
+		ORDER BY created_at, id
+	`
+
+	rows, err := s.db.Query(ctx, query, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query server endpoints: %w", err)
+	}
+	defer rows.Close()
+
+	var endpoints []models.ServerEndpoint
+	for rows.Next() {
+		var endpoint models.ServerEndpoint
+		var asn int64
+		if err := rows.Scan(&endpoint.Endpoint, &endpoint.Country, &endpoint.Region, &asn); err != nil {
+			return nil, fmt.Errorf("failed to scan server endpoint: %w", err)
+		}
+		endpoint.ASN = uint32(asn)
+		endpoints = append(endpoints, endpoint)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate server endpoints: %w", err)
+	}
+
+	return endpoints, nil
+}
+
+// ErrServerNotReady is returned for a server whose public key has not been synchronized yet; a
+// config for it could not connect
+var ErrServerNotReady = errors.New("server public key not synchronized yet")
+
+// CheckServerReady fails with ErrServerNotReady when configs cannot be generated for a server yet
+func CheckServerReady(server *models.Server) error {
+	if strings.TrimSpace(server.PublicKey) == "" {
+		return ErrServerNotReady
+	}
+	return nil
+}
+
+// SetDoHTemplate stores the DNS-over-HTTPS URL suggested to clients of a server that ask for a DoH
+// hint, or removes it when template is empty. It returns ErrServerNotFound for an unknown or inactive
+// server.
+func (s *ServerService) SetDoHTemplate(ctx context.Context, serverID uuid.UUID, template string) error {
+	var value *string
+	if template != "" {
+		if err := ValidateDoHTemplate(template); err != nil {
+			return err
+		}
+		value = &template
+	}
+
+	query := `UPDATE servers SET doh_template = $2, updated_at = NOW() WHERE id = $1 AND is_active = true`
+	result, err := s.db.Exec(ctx, query, serverID, value)
+	if err != nil {
+		return fmt.Errorf("failed to store DoH template: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrServerNotFound
+	}
+
+	s.logger.Info("Server DoH template updated",
+		zap.String("server_id", serverID.String()),
+		zap.Bool("enabled", value != nil))
+
+	return nil
+}
+
+// ErrNoAlternativeServer is returned by RecommendServer when no other server has room
+var ErrNoAlternativeServer = errors.New("no alternative server available")
+
+// GetServerLoad returns how many active keys each server has, the load measure servers are sorted by.
+// Servers without any are left out.
+func (s *ServerService) GetServerLoad(ctx context.Context) (map[uuid.UUID]int, error) {
+	query := `
+		SELECT server_id, COUNT(*)
+		FROM user_keys
+		WHERE is_active = true
+		GROUP BY server_id
+	`
+
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server load: %w", err)
+	}
+	defer rows.Close()
+
+	load := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var serverID uuid.UUID
+		var activeKeys int
+		if err := rows.Scan(&serverID, &activeKeys); err != nil {
+			return nil, fmt.Errorf("failed to scan server load: %w", err)
+		}
+		load[serverID] = activeKeys
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate server load: %w", err)
+	}
+
+	return load, nil
+}
+
+// RecommendServer picks the server to provision a user on instead of exclude from servers, which are
+// listed least loaded first as GetActiveServers sorts them by load. A server where the user already
+// holds an active key is preferred, since provisioning there replaces that key rather than adding to
+// the load; otherwise it is the least loaded server with fewer than maxKeys active keys by load, any
+// when maxKeys is not positive. Servers whose key is not synchronized or in maintenance are skipped.
+// It fails with ErrNoAlternativeServer when there is none.
+func RecommendServer(servers []*models.ServerResponse, load map[uuid.UUID]int, held map[uuid.UUID]bool, exclude uuid.UUID, maxKeys int) (uuid.UUID, error) {
+	now := time.Now()
+	recommended := uuid.Nil
+	for _, server := range servers {
+		if server.ID == exclude || strings.TrimSpace(server.PublicKey) == "" {
+			continue
+		}
+		if m := server.Maintenance; m != nil && !m.StartsAt.After(now) && m.EndsAt.After(now) {
+			continue
+		}
+
+		if held[server.ID] {
+			return server.ID, nil
+		}
+		if recommended == uuid.Nil && (maxKeys <= 0 || load[server.ID] < maxKeys) {
+			recommended = server.ID
+		}
+	}
+
+	if recommended == uuid.Nil {
+		return uuid.Nil, ErrNoAlternativeServer
+	}
+	return recommended, nil
+}
+
+// ErrSubnetOverlap is returned when a new server's client subnet overlaps another server's
+var ErrSubnetOverlap = errors.New("subnet overlaps another server")
+
+// ValidateServerSubnet checks a client subnet for a server: an IPv4 network address leaving room for
+// the server's own address and at least one client
+func ValidateServerSubnet(subnet string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid subnet %q: %w", subnet, err)
+	}
+	if !prefix.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("subnet %s is not IPv4", subnet)
+	}
+	if prefix.Masked() != prefix {
+		return netip.Prefix{}, fmt.Errorf("subnet %s is not a network address, use %s", subnet, prefix.Masked())
+	}
+	if prefix.Bits() > 30 {
+		return netip.Prefix{}, fmt.Errorf("subnet %s is too small, use /30 or larger", subnet)
+	}
+	return prefix, nil
+}
+
+// ValidateServerSubnetV6 checks an IPv6 client subnet for a dual-stack or IPv6-only server, such as
+// a ULA /64
+func ValidateServerSubnetV6(subnet string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IPv6 subnet %q: %w", subnet, err)
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("subnet %s is not IPv6", subnet)
+	}
+	if prefix.Masked() != prefix {
+		return netip.Prefix{}, fmt.Errorf("subnet %s is not a network address, use %s", subnet, prefix.Masked())
+	}
+	if prefix.Bits() > 126 {
+		return netip.Prefix{}, fmt.Errorf("subnet %s is too small, use /126 or larger", subnet)
+	}
+	return prefix, nil
+}
+
+// CreateServer creates a new VPN server (admin function) allocating client addresses from subnet,
+// which may be larger than a /24. A non-empty subnetV6 makes the server dual-stack, giving each
+// client an IPv6 address as well; it must hold at least as many addresses as subnet. It fails with
+// ErrSubnetOverlap when another server's subnet overlaps either, so servers never hand out the
+// same address.
+func (s *ServerService) CreateServer(ctx context.Context, name, location, endpoint, publicKey, subnet, subnetV6 string, port int) (*models.Server, error) {
+	prefix, err := ValidateServerSubnet(subnet)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := []netip.Prefix{prefix}
+	if subnetV6 != "" {
+		prefixV6, err := ValidateServerSubnetV6(subnetV6)
+		if err != nil {
+			return nil, err
+		}
+		// Each client's IPv6 address sits at the same host offset as its IPv4 one
+		if 128-prefixV6.Bits() < 32-prefix.Bits() {
+			return nil, fmt.Errorf("IPv6 subnet %s is smaller than IPv4 subnet %s", prefixV6, prefix)
+		}
+		prefixes = append(prefixes, prefixV6)
+		subnetV6 = prefixV6.String()
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Keep a concurrent creation from claiming an overlapping subnet between the check and the insert
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('servers.subnet'))`); err != nil {
+		return nil, fmt.Errorf("failed to lock server subnets: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, `SELECT name, COALESCE(subnet, ''), COALESCE(subnet_v6, '') FROM servers`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server subnets: %w", err)
+	}
+	for rows.Next() {
+		var otherName, otherSubnet, otherSubnetV6 string
+		if err := rows.Scan(&otherName, &otherSubnet, &otherSubnetV6); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to load server subnets: %w", err)
+		}
+		for _, existing := range []string{otherSubnet, otherSubnetV6} {
+			other, err := netip.ParsePrefix(existing)
+			if err != nil {
+				continue
+			}
+			for _, p := range prefixes {
+				if other.Overlaps(p) {
+					rows.Close()
+					return nil, fmt.Errorf("%w: %s overlaps %s of server %q", ErrSubnetOverlap, p, other, otherName)
+				}
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load server subnets: %w", err)
+	}
+
 	server := &models.Server{}
 	query := `
-		INSERT INTO servers (name, location, endpoint, public_key, port)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, name, location, endpoint, public_key, port, is_active, created_at, updated_at
+		INSERT INTO servers (name, location, endpoint, public_key, port, subnet, subnet_v6)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		RETURNING id, name, location, endpoint, public_key, port, subnet, COALESCE(subnet_v6, ''), is_active, created_at, updated_at
 	`
 
-	err := s.db.QueryRow(ctx, query, name, location, endpoint, publicKey, port).Scan(
+	err = tx.QueryRow(ctx, query, name, location, endpoint, publicKey, port, prefix.String(), subnetV6).Scan(
 		&server.ID,
 		&server.Name,
 		&server.Location,
 		&server.Endpoint,
 		&server.PublicKey,
 		&server.Port,
+		&server.Subnet,
+		&server.SubnetV6,
 		&server.IsActive,
 		&server.CreatedAt,
 		&server.UpdatedAt,
@@ -123,42 +556,133 @@ func (s *ServerService) CreateServer(ctx context.Context, name, location, endpoi
 		s.logger.Error("Failed to create server", zap.Error(err))
 		return nil, fmt.Errorf("failed to create server: %w", err)
 	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.invalidateServers()
 
 	s.logger.Info("Server created successfully",
 		zap.String("server_id", server.ID.String()),
 		zap.String("name", name),
-		zap.String("location", location))
+		zap.String("location", location),
+		zap.String("subnet", server.Subnet),
+		zap.String("subnet_v6", server.SubnetV6))
 
 	return server, nil
 }
 
-// InitializeDefaultServers creates default servers if none exist
-// SyncServerPublicKey reads the server's public key from a file and updates the database.
-func (s *ServerService) SyncServerPublicKey(ctx context.Context, keyFilePath string, serverID uuid.UUID) error {
+// DefaultServer describes the server seeded into an empty servers table
+type DefaultServer struct {
+	ID       uuid.UUID
+	Name     string
+	Location string
+	Endpoint string
+	Port     int
+}
+
+// SetDefaultServer sets the server InitializeDefaultServers seeds
+func (s *ServerService) SetDefaultServer(server DefaultServer) {
+	s.defaultServer = &server
+}
+
+// InitializeDefaultServers creates the default server if no servers exist, so a fresh deployment
+// can sync its key and provision clients without manual setup. It reports whether the server was
+// created; it does nothing when servers exist or no default server is set, and is safe to repeat.
+func (s *ServerService) InitializeDefaultServers(ctx context.Context) (bool, error) {
+	if s.defaultServer == nil {
+		return false, nil
+	}
+
+	query := `
+		INSERT INTO servers (id, name, location, endpoint, port)
+		SELECT $1, $2, $3, $4, $5
+		WHERE NOT EXISTS (SELECT 1 FROM servers)
+		ON CONFLICT (id) DO NOTHING
+	`
+	d := s.defaultServer
+	result, err := s.db.Exec(ctx, query, d.ID, d.Name, d.Location, d.Endpoint, d.Port)
+	if err != nil {
+		return false, fmt.Errorf("failed to seed default server: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	s.invalidateServers()
+
+	s.logger.Info("Seeded default server",
+		zap.String("server_id", d.ID.String()),
+		zap.String("name", d.Name),
+		zap.String("endpoint", d.Endpoint))
+
+	return true, nil
+}
+
+// ErrKeyFileNotReady is returned by SyncServerPublicKey when the public key file is missing or empty;
+// callers should treat it as retryable since the WireGuard container writes the file on its own schedule
+var ErrKeyFileNotReady = errors.New("public key file not ready")
+
+// SyncServerPublicKey reads the server's public key from a file and updates the database. It reports
+// whether a previously stored key was replaced, in which case configs issued with the old key no longer
+// work. It returns an error wrapping ErrKeyFileNotReady when the file cannot be used yet; any other
+// error comes from the context or the database.
+func (s *ServerService) SyncServerPublicKey(ctx context.Context, keyFilePath string, serverID uuid.UUID) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
 	keyBytes, err := os.ReadFile(keyFilePath)
 	if err != nil {
 		s.logger.Warn("Could not read public key file", zap.String("path", keyFilePath), zap.Error(err))
-		return fmt.Errorf("could not read public key file: %w", err)
+		return false, fmt.Errorf("%w: %w", ErrKeyFileNotReady, err)
 	}
 	publicKey := strings.TrimSpace(string(keyBytes))
 
 	if publicKey == "" {
 		s.logger.Warn("Public key file is empty", zap.String("path", keyFilePath))
-		return fmt.Errorf("public key file is empty")
+		return false, fmt.Errorf("%w: file is empty", ErrKeyFileNotReady)
+	}
+
+	// The read may have taken a while on a slow volume; don't start the update for a cancelled caller
+	if err := ctx.Err(); err != nil {
+		return false, err
 	}
 
-	query := `UPDATE servers SET public_key = $1, updated_at = NOW() WHERE id = $2 AND (public_key IS NULL OR public_key != $1)`
-	result, err := s.db.Exec(ctx, query, publicKey, serverID)
+	query := `
+		WITH previous AS (
+			SELECT public_key FROM servers WHERE id = $2 FOR UPDATE
+		)
+		UPDATE servers SET public_key = $1, updated_at = NOW()
+		FROM previous
+		WHERE servers.id = $2 AND servers.public_key IS DISTINCT FROM $1
+		RETURNING previous.public_key
+	`
+	var previousKey *string
+	err = s.db.QueryRow(ctx, query, publicKey, serverID).Scan(&previousKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		s.logger.Debug("Server public key is already up-to-date in the database", zap.String("server_id", serverID.String()))
+		return false, nil
+	}
 	if err != nil {
 		s.logger.Error("Failed to update server public key in database", zap.Error(err))
-		return fmt.Errorf("failed to update server public key: %w", err)
+		return false, fmt.Errorf("failed to update server public key: %w", err)
 	}
 
-	if result.RowsAffected() > 0 {
+	if previousKey == nil {
 		s.logger.Info("Successfully synchronized server public key with database", zap.String("server_id", serverID.String()))
-	} else {
-		s.logger.Info("Server public key is already up-to-date in the database", zap.String("server_id", serverID.String()))
+		return false, nil
 	}
 
-	return nil
+	s.logger.Warn("Server public key changed; existing client configs must be re-provisioned",
+		zap.String("server_id", serverID.String()),
+		zap.String("previous_key", *previousKey),
+		zap.String("public_key", publicKey))
+
+	// Configs are generated from the cache, so it must not keep serving the old key
+	if _, err := s.ReloadServers(ctx); err != nil {
+		s.logger.Error("Failed to reload servers after public key change", zap.Error(err))
+	}
+
+	return true, nil
 }
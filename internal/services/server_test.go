@@ -0,0 +1,660 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/database"
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// containsServer reports whether a server list includes the given ID
+func containsServer(servers []*models.ServerResponse, serverID uuid.UUID) bool {
+	for _, server := range servers {
+		if server.ID == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReloadServers(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewServerService(db, zap.NewNop())
+
+	// Prime the cache
+	if _, err := service.GetActiveServers(ctx, models.ServerListOptions{}); err != nil {
+		t.Fatalf("GetActiveServers() error = %v", err)
+	}
+
+	// Insert a server behind the service's back
+	serverID := uuid.New()
+	_, err := db.Exec(ctx, `INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, 'Reload Test', 'Test', '192.0.2.1', 'test-key', 51820)`, serverID)
+	if err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	servers, err := service.GetActiveServers(ctx, models.ServerListOptions{})
+	if err != nil {
+		t.Fatalf("GetActiveServers() error = %v", err)
+	}
+	if containsServer(servers, serverID) {
+		t.Fatal("Expected cached list to not include server inserted after load")
+	}
+
+	if _, err := service.ReloadServers(ctx); err != nil {
+		t.Fatalf("ReloadServers() error = %v", err)
+	}
+
+	servers, err = service.GetActiveServers(ctx, models.ServerListOptions{})
+	if err != nil {
+		t.Fatalf("GetActiveServers() error = %v", err)
+	}
+	if !containsServer(servers, serverID) {
+		t.Error("Expected reloaded list to include newly inserted server")
+	}
+}
+
+// newTestServer inserts an active server and removes it when the test ends
+func newTestServer(t *testing.T, db *pgxpool.Pool, name, location string) uuid.UUID {
+	t.Helper()
+
+	serverID := uuid.New()
+	_, err := db.Exec(context.Background(),
+		`INSERT INTO servers (id, name, location, endpoint, public_key, port) VALUES ($1, $2, $3, '192.0.2.1', 'test-key', 51820)`,
+		serverID, name, location)
+	if err != nil {
+		t.Fatalf("Failed to insert server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, serverID)
+	})
+
+	return serverID
+}
+
+// serverOrder returns the positions of the given servers within a list, in list order
+func serverOrder(servers []*models.ServerResponse, ids ...uuid.UUID) []uuid.UUID {
+	wanted := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var order []uuid.UUID
+	for _, server := range servers {
+		if wanted[server.ID] {
+			order = append(order, server.ID)
+		}
+	}
+	return order
+}
+
+func TestValidateServerSubnet(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		wantErr bool
+	}{
+		{subnet: "10.0.0.0/24"},
+		{subnet: "10.8.0.0/22"},
+		{subnet: "10.9.0.0/30"},
+		{subnet: "10.9.0.0/31", wantErr: true},
+		{subnet: "10.8.1.0/22", wantErr: true},
+		{subnet: "fd00::/64", wantErr: true},
+		{subnet: "10.0.0.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if _, err := ValidateServerSubnet(tt.subnet); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateServerSubnet(%q) error = %v, wantErr %v", tt.subnet, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateServerSubnetV6(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		wantErr bool
+	}{
+		{subnet: "fd00::/64"},
+		{subnet: "fd00:1::/120"},
+		{subnet: "fd00::1/64", wantErr: true},
+		{subnet: "fd00::/127", wantErr: true},
+		{subnet: "10.0.0.0/24", wantErr: true},
+		{subnet: "::ffff:10.0.0.0/120", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if _, err := ValidateServerSubnetV6(tt.subnet); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateServerSubnetV6(%q) error = %v, wantErr %v", tt.subnet, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCreateServerSubnet(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewServerService(db, zap.NewNop())
+
+	server, err := service.CreateServer(ctx, "Wide", "Wide Location", "192.0.2.10", "test-key", "10.84.0.0/22", "", 51820)
+	if err != nil {
+		t.Fatalf("CreateServer() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, server.ID)
+	})
+	if server.Subnet != "10.84.0.0/22" {
+		t.Errorf("Expected subnet 10.84.0.0/22, got %q", server.Subnet)
+	}
+
+	stored, err := service.GetServerByID(ctx, server.ID)
+	if err != nil {
+		t.Fatalf("GetServerByID() error = %v", err)
+	}
+	if stored.Subnet != "10.84.0.0/22" {
+		t.Errorf("Expected stored subnet 10.84.0.0/22, got %q", stored.Subnet)
+	}
+
+	_, err = service.CreateServer(ctx, "Overlap", "Overlap Location", "192.0.2.11", "test-key", "10.84.2.0/24", "", 51820)
+	if !errors.Is(err, ErrSubnetOverlap) {
+		t.Errorf("Expected ErrSubnetOverlap, got %v", err)
+	}
+
+	dual, err := service.CreateServer(ctx, "Dual", "Dual Location", "192.0.2.12", "test-key", "10.84.4.0/24", "fd00:84::/64", 51820)
+	if err != nil {
+		t.Fatalf("CreateServer() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM servers WHERE id = $1`, dual.ID)
+	})
+	if dual.SubnetV6 != "fd00:84::/64" {
+		t.Errorf("Expected IPv6 subnet fd00:84::/64, got %q", dual.SubnetV6)
+	}
+
+	_, err = service.CreateServer(ctx, "Overlap V6", "Overlap Location", "192.0.2.13", "test-key", "10.84.5.0/24", "fd00:84::/96", 51820)
+	if !errors.Is(err, ErrSubnetOverlap) {
+		t.Errorf("Expected ErrSubnetOverlap for the IPv6 subnet, got %v", err)
+	}
+	_, err = service.CreateServer(ctx, "Narrow V6", "Narrow Location", "192.0.2.14", "test-key", "10.84.6.0/24", "fd00:86::/124", 51820)
+	if err == nil {
+		t.Error("Expected an IPv6 subnet smaller than the IPv4 one to be rejected")
+	}
+}
+
+func TestValidateServerListOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    models.ServerListOptions
+		wantErr bool
+	}{
+		{name: "defaults", opts: models.ServerListOptions{}},
+		{name: "load", opts: models.ServerListOptions{SortBy: ServerSortLoad, Limit: 5}},
+		{name: "location", opts: models.ServerListOptions{SortBy: ServerSortLocation}},
+		{name: "name", opts: models.ServerListOptions{SortBy: ServerSortName}},
+		{name: "unknown sort", opts: models.ServerListOptions{SortBy: "endpoint"}, wantErr: true},
+		{name: "negative limit", opts: models.ServerListOptions{Limit: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateServerListOptions(tt.opts); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateServerListOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetActiveServersOptions(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewServerService(db, zap.NewNop())
+	userService := NewUserService(db, zap.NewNop())
+
+	// Names and locations sort in opposite orders; load is a third order
+	prefix := uuid.New().String()[:8]
+	alpha := newTestServer(t, db, prefix+"-a", prefix+"-3")
+	bravo := newTestServer(t, db, prefix+"-b", prefix+"-1")
+	charlie := newTestServer(t, db, prefix+"-c", prefix+"-2")
+
+	for serverID, keys := range map[uuid.UUID]int{alpha: 1, bravo: 2} {
+		for i := 0; i < keys; i++ {
+			user := newTestUser(t, userService)
+			_, err := db.Exec(ctx, `INSERT INTO user_keys (user_id, server_id, public_key, allowed_ips) VALUES ($1, $2, $3, $4)`,
+				user.ID, serverID, uuid.New().String(), fmt.Sprintf("10.0.0.%d/32", i+2))
+			if err != nil {
+				t.Fatalf("Failed to insert user key: %v", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts models.ServerListOptions
+		want []uuid.UUID
+	}{
+		{name: "default", opts: models.ServerListOptions{}, want: []uuid.UUID{bravo, charlie, alpha}},
+		{name: "by location", opts: models.ServerListOptions{SortBy: ServerSortLocation}, want: []uuid.UUID{bravo, charlie, alpha}},
+		{name: "by name", opts: models.ServerListOptions{SortBy: ServerSortName}, want: []uuid.UUID{alpha, bravo, charlie}},
+		{name: "by load", opts: models.ServerListOptions{SortBy: ServerSortLoad}, want: []uuid.UUID{charlie, alpha, bravo}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers, err := service.GetActiveServers(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("GetActiveServers() error = %v", err)
+			}
+
+			got := serverOrder(servers, alpha, bravo, charlie)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected all test servers, got %v", got)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("Order = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+
+	servers, err := service.GetActiveServers(ctx, models.ServerListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("GetActiveServers() error = %v", err)
+	}
+	if len(servers) != 2 {
+		t.Errorf("Expected 2 servers with limit, got %d", len(servers))
+	}
+}
+
+func TestSyncServerPublicKeyFileNotReady(t *testing.T) {
+	service := NewServerService(nil, zap.NewNop())
+	dir := t.TempDir()
+
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing"), emptyFile} {
+		_, err := service.SyncServerPublicKey(context.Background(), path, defaultServerID)
+		if !errors.Is(err, ErrKeyFileNotReady) {
+			t.Errorf("SyncServerPublicKey(%s) error = %v, want ErrKeyFileNotReady", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestSyncServerPublicKeyDatabaseError(t *testing.T) {
+	// Nothing listens on port 1, so the update fails without needing a database
+	db, err := pgxpool.New(context.Background(), "postgres://vpn@127.0.0.1:1/vpn?connect_timeout=1")
+	if err != nil {
+		t.Fatalf("pgxpool.New() error = %v", err)
+	}
+	defer db.Close()
+
+	service := NewServerService(db, zap.NewNop())
+	keyFile := filepath.Join(t.TempDir(), "publickey")
+	if err := os.WriteFile(keyFile, []byte("YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY=\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	_, err = service.SyncServerPublicKey(context.Background(), keyFile, defaultServerID)
+	if err == nil {
+		t.Fatal("Expected database error")
+	}
+	if errors.Is(err, ErrKeyFileNotReady) {
+		t.Errorf("Database error must not be reported as retryable: %v", err)
+	}
+
+	// A cancelled context stops before touching the database
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := service.SyncServerPublicKey(ctx, keyFile, defaultServerID); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSyncServerPublicKeyDetectsChange(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewServerService(db, zap.NewNop())
+	serverID := newTestServer(t, db, "Key Sync", "Key Sync Location")
+
+	keyFile := filepath.Join(t.TempDir(), "publickey")
+	writeKey := func(key string) {
+		if err := os.WriteFile(keyFile, []byte(key+"\n"), 0o600); err != nil {
+			t.Fatalf("Failed to write key file: %v", err)
+		}
+	}
+	storedKey := func() string {
+		var key string
+		if err := db.QueryRow(ctx, `SELECT public_key FROM servers WHERE id = $1`, serverID).Scan(&key); err != nil {
+			t.Fatalf("Failed to read server key: %v", err)
+		}
+		return key
+	}
+
+	// The container regenerated its key, so the next tick replaces the stored one
+	const newKey = "YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY="
+	writeKey(newKey)
+	changed, err := service.SyncServerPublicKey(ctx, keyFile, serverID)
+	if err != nil {
+		t.Fatalf("SyncServerPublicKey() error = %v", err)
+	}
+	if !changed {
+		t.Error("Expected key change to be reported")
+	}
+	if got := storedKey(); got != newKey {
+		t.Errorf("Expected stored key %q, got %q", newKey, got)
+	}
+
+	// The cache must serve the new key too
+	servers, err := service.GetActiveServers(ctx, models.ServerListOptions{})
+	if err != nil {
+		t.Fatalf("GetActiveServers() error = %v", err)
+	}
+	for _, server := range servers {
+		if server.ID == serverID && server.PublicKey != newKey {
+			t.Errorf("Expected cached key %q, got %q", newKey, server.PublicKey)
+		}
+	}
+
+	// An unchanged file is not a change
+	changed, err = service.SyncServerPublicKey(ctx, keyFile, serverID)
+	if err != nil {
+		t.Fatalf("SyncServerPublicKey() error = %v", err)
+	}
+	if changed {
+		t.Error("Expected unchanged key not to be reported as a change")
+	}
+}
+
+// newIsolatedTestDB migrates a fresh schema and connects to it, so a test can empty tables without
+// touching data other tests rely on. The schema is dropped when the test ends.
+func newIsolatedTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	db := newTestDB(t)
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := db.Exec(context.Background(), "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+	})
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	searchPath := fmt.Sprintf("search_path=%s,public", schema)
+	switch {
+	case !strings.Contains(dsn, "://"):
+		dsn += " " + searchPath
+	case strings.Contains(dsn, "?"):
+		dsn += "&" + searchPath
+	default:
+		dsn += "?" + searchPath
+	}
+
+	isolated, err := database.NewConnection(config.DatabaseConfig{DSN: dsn}, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to connect to isolated schema: %v", err)
+	}
+	t.Cleanup(isolated.Close)
+
+	return isolated
+}
+
+func TestCheckServerReady(t *testing.T) {
+	if err := CheckServerReady(&models.Server{PublicKey: "   "}); !errors.Is(err, ErrServerNotReady) {
+		t.Errorf("Expected ErrServerNotReady for a blank key, got %v", err)
+	}
+	if err := CheckServerReady(&models.Server{PublicKey: "YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY="}); err != nil {
+		t.Errorf("Expected a server with a key to be ready, got %v", err)
+	}
+}
+
+func TestInitializeDefaultServersSeedsOnce(t *testing.T) {
+	db := newIsolatedTestDB(t)
+	ctx := context.Background()
+
+	if _, err := db.Exec(ctx, `DELETE FROM servers`); err != nil {
+		t.Fatalf("Failed to empty servers: %v", err)
+	}
+
+	service := NewServerService(db, zap.NewNop())
+	defaultServer := DefaultServer{
+		ID:       uuid.New(),
+		Name:     "Seeded",
+		Location: "Seed Location",
+		Endpoint: "192.0.2.10",
+		Port:     51821,
+	}
+	service.SetDefaultServer(defaultServer)
+
+	created, err := service.InitializeDefaultServers(ctx)
+	if err != nil {
+		t.Fatalf("InitializeDefaultServers() error = %v", err)
+	}
+	if !created {
+		t.Error("Expected first call to seed the default server")
+	}
+
+	created, err = service.InitializeDefaultServers(ctx)
+	if err != nil {
+		t.Fatalf("InitializeDefaultServers() second call error = %v", err)
+	}
+	if created {
+		t.Error("Expected second call to be a no-op")
+	}
+
+	// The seeded row has no public key until it is synced, so read it directly
+	var (
+		endpoint string
+		port     int
+		count    int
+	)
+	err = db.QueryRow(ctx, `SELECT endpoint, port FROM servers WHERE id = $1`, defaultServer.ID).Scan(&endpoint, &port)
+	if err != nil {
+		t.Fatalf("Failed to read seeded server: %v", err)
+	}
+	if endpoint != defaultServer.Endpoint || port != defaultServer.Port {
+		t.Errorf("Seeded server endpoint = %s:%d, want %s:%d", endpoint, port, defaultServer.Endpoint, defaultServer.Port)
+	}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM servers`).Scan(&count); err != nil {
+		t.Fatalf("Failed to count servers: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected exactly one server after seeding twice, got %d", count)
+	}
+}
+
+func TestInitializeDefaultServersNoopWhenServersExist(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	newTestServer(t, db, "Existing", "Existing Location")
+
+	service := NewServerService(db, zap.NewNop())
+	defaultServerID := uuid.New()
+	service.SetDefaultServer(DefaultServer{
+		ID:       defaultServerID,
+		Name:     "Seeded",
+		Location: "Seed Location",
+		Endpoint: "192.0.2.10",
+		Port:     51820,
+	})
+
+	created, err := service.InitializeDefaultServers(ctx)
+	if err != nil {
+		t.Fatalf("InitializeDefaultServers() error = %v", err)
+	}
+	if created {
+		t.Error("Expected no seeding when servers exist")
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM servers WHERE id = $1`, defaultServerID).Scan(&count); err != nil {
+		t.Fatalf("Failed to count servers: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected default server to not be inserted, found %d rows", count)
+	}
+}
+
+func TestInitializeDefaultServersWithoutDefault(t *testing.T) {
+	// No default server configured means no database access at all
+	service := NewServerService(nil, zap.NewNop())
+
+	created, err := service.InitializeDefaultServers(context.Background())
+	if err != nil || created {
+		t.Errorf("InitializeDefaultServers() = %v, %v; want false, nil", created, err)
+	}
+}
+
+func TestGetServerLoad(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+	serverService := NewServerService(db, logger)
+	wireguardService := NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	wireguardService.SetDB(db)
+
+	busy := newTestServer(t, db, "load-busy", "test")
+	idle := newTestServer(t, db, "load-idle", "test")
+
+	userService := NewUserService(db, logger)
+	for _, peer := range newTestPeers(t, 2) {
+		user := newTestUser(t, userService)
+		if _, err := wireguardService.AddUserKey(ctx, user.ID, busy, peer.PublicKey.String()); err != nil {
+			t.Fatalf("AddUserKey() error = %v", err)
+		}
+	}
+
+	load, err := serverService.GetServerLoad(ctx)
+	if err != nil {
+		t.Fatalf("GetServerLoad() error = %v", err)
+	}
+	if load[busy] != 2 {
+		t.Errorf("GetServerLoad() busy server = %d, want 2", load[busy])
+	}
+	if _, ok := load[idle]; ok {
+		t.Errorf("GetServerLoad() listed a server without keys: %d", load[idle])
+	}
+}
+
+func TestRecommendServer(t *testing.T) {
+	now := time.Now()
+	server := func(publicKey string) *models.ServerResponse {
+		return &models.ServerResponse{ID: uuid.New(), PublicKey: publicKey}
+	}
+	full, maintained, unsynced, empty, held := server("key"), server("key"), server(""), server("key"), server("key")
+	maintained.Maintenance = &models.MaintenanceWindow{StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Hour)}
+
+	// Least loaded first, as GetActiveServers sorts them
+	servers := []*models.ServerResponse{maintained, unsynced, empty, full, held}
+	load := map[uuid.UUID]int{full.ID: 1, held.ID: 3}
+
+	recommended, err := RecommendServer(servers, load, nil, full.ID, 1)
+	if err != nil || recommended != empty.ID {
+		t.Errorf("RecommendServer() = %s, %v; want the least loaded ready server %s", recommended, err, empty.ID)
+	}
+
+	// A server the user is already on wins, whatever its load
+	recommended, err = RecommendServer(servers, load, map[uuid.UUID]bool{held.ID: true}, full.ID, 1)
+	if err != nil || recommended != held.ID {
+		t.Errorf("RecommendServer() = %s, %v; want the server holding the user's key %s", recommended, err, held.ID)
+	}
+
+	// The held server is still skipped when it cannot serve
+	held.PublicKey = ""
+	recommended, err = RecommendServer(servers, load, map[uuid.UUID]bool{held.ID: true}, full.ID, 1)
+	if err != nil || recommended != empty.ID {
+		t.Errorf("RecommendServer() = %s, %v; want %s with the held server unsynced", recommended, err, empty.ID)
+	}
+
+	if _, err := RecommendServer(servers, load, nil, empty.ID, 1); !errors.Is(err, ErrNoAlternativeServer) {
+		t.Errorf("RecommendServer() excluding the only server with room error = %v, want ErrNoAlternativeServer", err)
+	}
+}
+
+func TestSetDoHTemplate(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewServerService(db, zap.NewNop())
+	serverID := newTestServer(t, db, "doh", "test")
+
+	template := "https://dns.example.com/dns-query"
+	if err := service.SetDoHTemplate(ctx, serverID, template); err != nil {
+		t.Fatalf("SetDoHTemplate() error = %v", err)
+	}
+	server, err := service.GetServerByID(ctx, serverID)
+	if err != nil {
+		t.Fatalf("GetServerByID() error = %v", err)
+	}
+	if server.DoHTemplate != template {
+		t.Errorf("DoHTemplate = %q, want %q", server.DoHTemplate, template)
+	}
+
+	if err := service.SetDoHTemplate(ctx, serverID, "http://dns.example.com/dns-query"); err == nil {
+		t.Error("SetDoHTemplate() accepted a plain http template")
+	}
+
+	if err := service.SetDoHTemplate(ctx, serverID, ""); err != nil {
+		t.Fatalf("SetDoHTemplate(\"\") error = %v", err)
+	}
+	if server, err = service.GetServerByID(ctx, serverID); err != nil {
+		t.Fatalf("GetServerByID() error = %v", err)
+	}
+	if server.DoHTemplate != "" {
+		t.Errorf("DoHTemplate = %q after removal, want none", server.DoHTemplate)
+	}
+
+	if err := service.SetDoHTemplate(ctx, uuid.New(), template); !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("SetDoHTemplate() error = %v for an unknown server, want ErrServerNotFound", err)
+	}
+}
+
+func TestGetActiveServersDegraded(t *testing.T) {
+	service := NewServerService(nil, zap.NewNop())
+	health := database.NewHealth(zap.NewNop())
+	service.SetDatabaseHealth(health)
+	health.Check(context.Background(), func(context.Context) error { return errors.New("connection refused") })
+
+	if _, err := service.GetActiveServers(context.Background(), models.ServerListOptions{}); !errors.Is(err, database.ErrUnavailable) {
+		t.Errorf("GetActiveServers() with nothing cached error = %v, want database.ErrUnavailable", err)
+	}
+
+	cached := []*models.ServerResponse{{ID: uuid.New(), Name: "a"}, {ID: uuid.New(), Name: "b"}}
+	service.servers = cached
+	service.serversExpires = time.Now().Add(-time.Hour)
+
+	// With no database every request is served from the cache, expired or not
+	servers, err := service.GetActiveServers(context.Background(), models.ServerListOptions{})
+	if err != nil || len(servers) != 2 {
+		t.Fatalf("GetActiveServers() = %d servers (err %v), want the 2 cached", len(servers), err)
+	}
+	servers, err = service.GetActiveServers(context.Background(), models.ServerListOptions{Limit: 1, SortBy: ServerSortLoad})
+	if err != nil || len(servers) != 1 || servers[0].ID != cached[0].ID {
+		t.Errorf("GetActiveServers() with options = %+v (err %v), want the first cached server", servers, err)
+	}
+	if _, err := service.GetActiveServers(context.Background(), models.ServerListOptions{SortBy: "bogus"}); err == nil || errors.Is(err, database.ErrUnavailable) {
+		t.Errorf("GetActiveServers() with an invalid sort error = %v, want a validation error", err)
+	}
+
+	health.Check(context.Background(), func(context.Context) error { return nil })
+	if !health.Healthy() {
+		t.Error("A successful ping should leave degraded mode")
+	}
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/denzelpenzel/vpn/internal/config"
+	"github.com/denzelpenzel/vpn/internal/database"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeWGClient is an in-memory WGClient that applies configurations to a single device
+type fakeWGClient struct {
+	mu           sync.Mutex
+	device       *wgtypes.Device
+	configureErr error // returned by ConfigureDevice when set
+	closeCount   int
+}
+
+func (f *fakeWGClient) Device(name string) (*wgtypes.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.device == nil {
+		return nil, fmt.Errorf("device %q not found", name)
+	}
+
+	device := *f.device
+	device.Peers = append([]wgtypes.Peer(nil), f.device.Peers...)
+	return &device, nil
+}
+
+func (f *fakeWGClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.device == nil {
+		return fmt.Errorf("device %q not found", name)
+	}
+
+	if f.configureErr != nil {
+		return f.configureErr
+	}
+
+	if cfg.ListenPort != nil {
+		f.device.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		f.device.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.PrivateKey != nil {
+		f.device.PrivateKey = *cfg.PrivateKey
+		f.device.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+
+	if cfg.ReplacePeers {
+		f.device.Peers = nil
+	}
+
+	for _, peerConfig := range cfg.Peers {
+		index := -1
+		for i, peer := range f.device.Peers {
+			if peer.PublicKey == peerConfig.PublicKey {
+				index = i
+				break
+			}
+		}
+
+		if peerConfig.Remove {
+			if index >= 0 {
+				f.device.Peers = append(f.device.Peers[:index], f.device.Peers[index+1:]...)
+			}
+			continue
+		}
+
+		peer := wgtypes.Peer{PublicKey: peerConfig.PublicKey, AllowedIPs: peerConfig.AllowedIPs}
+		if peerConfig.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *peerConfig.PersistentKeepaliveInterval
+		}
+
+		if index >= 0 {
+			f.device.Peers[index] = peer
+		} else {
+			f.device.Peers = append(f.device.Peers, peer)
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeWGClient) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closeCount++
+	return nil
+}
+
+// hasPeer reports whether the fake device has a peer with the given public key
+func (f *fakeWGClient) hasPeer(publicKey string) bool {
+	_, ok := f.peer(publicKey)
+	return ok
+}
+
+// peer returns the fake device's peer with the given public key
+func (f *fakeWGClient) peer(publicKey string) (wgtypes.Peer, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, peer := range f.device.Peers {
+		if peer.PublicKey.String() == publicKey {
+			return peer, true
+		}
+	}
+	return wgtypes.Peer{}, false
+}
+
+// newTestDB connects to the database in TEST_DATABASE_DSN, skipping the test when it is not set
+func newTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	db, err := database.NewConnection(config.DatabaseConfig{DSN: dsn}, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	return db
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Runtime settings; each falls back to its configured value until an admin sets it
+const (
+	SettingRegistrationEnabled       = "registration.enabled"
+	SettingRegistrationRequireInvite = "registration.require_invite"
+)
+
+// SettingKind is the type of value a setting holds
+type SettingKind string
+
+// Setting kinds
+const (
+	SettingKindBool   SettingKind = "bool"
+	SettingKindString SettingKind = "string"
+	SettingKindInt    SettingKind = "int"
+)
+
+// knownSettings lists the settings admins may change and the kind of value each holds
+var knownSettings = map[string]SettingKind{
+	SettingRegistrationEnabled:       SettingKindBool,
+	SettingRegistrationRequireInvite: SettingKindBool,
+}
+
+// ErrUnknownSetting is returned when setting a key that is not a known setting
+var ErrUnknownSetting = errors.New("unknown setting")
+
+// settingsCacheTTL bounds how long a replica serves a value another replica may have changed
+const settingsCacheTTL = 10 * time.Second
+
+// settingsCacheEntry is a cached setting value; found is false when the setting is unset
+type settingsCacheEntry struct {
+	value   string
+	found   bool
+	expires time.Time
+}
+
+// SettingsService stores runtime-mutable settings in the database. Reads are cached briefly; a
+// write invalidates the local cache immediately and other replicas within settingsCacheTTL.
+type SettingsService struct {
+	db     *pgxpool.Pool
+	logger *zap.Logger
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]settingsCacheEntry
+}
+
+// NewSettingsService creates a new settings service
+func NewSettingsService(db *pgxpool.Pool, logger *zap.Logger) *SettingsService {
+	return &SettingsService{
+		db:     db,
+		logger: logger,
+		ttl:    settingsCacheTTL,
+		cache:  make(map[string]settingsCacheEntry),
+	}
+}
+
+// SettingKindOf returns the kind of a known setting
+func SettingKindOf(key string) (SettingKind, bool) {
+	kind, ok := knownSettings[key]
+	return kind, ok
+}
+
+// ParseSettingValue checks that a raw value is valid for a known setting and returns its canonical form
+func ParseSettingValue(key, value string) (string, error) {
+	kind, ok := knownSettings[key]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownSetting, key)
+	}
+
+	switch kind {
+	case SettingKindBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("setting %s requires a boolean value", key)
+		}
+		return strconv.FormatBool(b), nil
+	case SettingKindInt:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("setting %s requires an integer value", key)
+		}
+		return strconv.Itoa(i), nil
+	default:
+		return value, nil
+	}
+}
+
+// get returns a setting's raw value, reporting whether it is set
+func (s *SettingsService) get(ctx context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, entry.found, nil
+	}
+
+	var value string
+	found := true
+	err := s.db.QueryRow(ctx, `SELECT value FROM settings WHERE key = $1`, key).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		found = false
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to get setting %s: %w", key, err)
+	}
+
+	s.mu.Lock()
+	s.cache[key] = settingsCacheEntry{value: value, found: found, expires: time.Now().Add(s.ttl)}
+	s.mu.Unlock()
+
+	return value, found, nil
+}
+
+// set stores a setting's raw value and drops it from the cache
+func (s *SettingsService) set(ctx context.Context, key, value string) error {
+	query := `
+		INSERT INTO settings (key, value, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = NOW()
+	`
+	if _, err := s.db.Exec(ctx, query, key, value); err != nil {
+		return fmt.Errorf("failed to set setting %s: %w", key, err)
+	}
+
+	s.mu.Lock()
+	delete(s.cache, key)
+	s.mu.Unlock()
+
+	s.logger.Info("Setting updated", zap.String("key", key))
+	return nil
+}
+
+// Set stores a known setting after checking the value against its kind
+func (s *SettingsService) Set(ctx context.Context, key, value string) error {
+	value, err := ParseSettingValue(key, value)
+	if err != nil {
+		return err
+	}
+	return s.set(ctx, key, value)
+}
+
+// GetString returns a string setting, or def when it is unset
+func (s *SettingsService) GetString(ctx context.Context, key, def string) (string, error) {
+	value, found, err := s.get(ctx, key)
+	if err != nil || !found {
+		return def, err
+	}
+	return value, nil
+}
+
+// SetString stores a string setting
+func (s *SettingsService) SetString(ctx context.Context, key, value string) error {
+	return s.set(ctx, key, value)
+}
+
+// GetBool returns a boolean setting, or def when it is unset or not a boolean
+func (s *SettingsService) GetBool(ctx context.Context, key string, def bool) (bool, error) {
+	value, found, err := s.get(ctx, key)
+	if err != nil || !found {
+		return def, err
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def, fmt.Errorf("setting %s is not a boolean: %w", key, err)
+	}
+	return b, nil
+}
+
+// SetBool stores a boolean setting
+func (s *SettingsService) SetBool(ctx context.Context, key string, value bool) error {
+	return s.set(ctx, key, strconv.FormatBool(value))
+}
+
+// GetInt returns an integer setting, or def when it is unset or not an integer
+func (s *SettingsService) GetInt(ctx context.Context, key string, def int) (int, error) {
+	value, found, err := s.get(ctx, key)
+	if err != nil || !found {
+		return def, err
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return def, fmt.Errorf("setting %s is not an integer: %w", key, err)
+	}
+	return i, nil
+}
+
+// SetInt stores an integer setting
+func (s *SettingsService) SetInt(ctx context.Context, key string, value int) error {
+	return s.set(ctx, key, strconv.Itoa(value))
+}
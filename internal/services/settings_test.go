@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseSettingValue(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{key: SettingRegistrationEnabled, value: "false", want: "false"},
+		{key: SettingRegistrationEnabled, value: "1", want: "true"},
+		{key: SettingRegistrationRequireInvite, value: "yes", wantErr: true},
+		{key: "unknown.setting", value: "true", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSettingValue(tt.key, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSettingValue(%s, %s) error = %v, wantErr %v", tt.key, tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSettingValue(%s, %s) = %q, want %q", tt.key, tt.value, got, tt.want)
+		}
+	}
+
+	if _, err := ParseSettingValue("unknown.setting", ""); !errors.Is(err, ErrUnknownSetting) {
+		t.Errorf("Expected ErrUnknownSetting, got %v", err)
+	}
+}
+
+func TestSettingsRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewSettingsService(db, zap.NewNop())
+
+	const prefix = "test.settings."
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM settings WHERE key LIKE $1`, prefix+"%")
+	})
+
+	// Unset settings return the default
+	if got, err := service.GetBool(ctx, prefix+"bool", true); err != nil || !got {
+		t.Errorf("GetBool() = %v, %v, want default true", got, err)
+	}
+
+	if err := service.SetBool(ctx, prefix+"bool", false); err != nil {
+		t.Fatalf("SetBool() error = %v", err)
+	}
+	if got, err := service.GetBool(ctx, prefix+"bool", true); err != nil || got {
+		t.Errorf("GetBool() = %v, %v, want false", got, err)
+	}
+
+	if err := service.SetInt(ctx, prefix+"int", 42); err != nil {
+		t.Fatalf("SetInt() error = %v", err)
+	}
+	if got, err := service.GetInt(ctx, prefix+"int", 0); err != nil || got != 42 {
+		t.Errorf("GetInt() = %v, %v, want 42", got, err)
+	}
+
+	if err := service.SetString(ctx, prefix+"string", "eu-west"); err != nil {
+		t.Fatalf("SetString() error = %v", err)
+	}
+	if got, err := service.GetString(ctx, prefix+"string", ""); err != nil || got != "eu-west" {
+		t.Errorf("GetString() = %v, %v, want eu-west", got, err)
+	}
+
+	// A value of the wrong type falls back to the default with an error
+	if got, err := service.GetInt(ctx, prefix+"string", 7); err == nil || got != 7 {
+		t.Errorf("GetInt() on a string = %v, %v, want default with error", got, err)
+	}
+}
+
+func TestSettingsCacheInvalidation(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	const key = "test.settings.cache"
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM settings WHERE key = $1`, key)
+	})
+
+	service := NewSettingsService(db, zap.NewNop())
+	replica := NewSettingsService(db, zap.NewNop())
+	replica.ttl = 50 * time.Millisecond
+
+	if err := service.SetString(ctx, key, "one"); err != nil {
+		t.Fatalf("SetString() error = %v", err)
+	}
+	if got, _ := service.GetString(ctx, key, ""); got != "one" {
+		t.Fatalf("GetString() = %q, want one", got)
+	}
+	if got, _ := replica.GetString(ctx, key, ""); got != "one" {
+		t.Fatalf("replica GetString() = %q, want one", got)
+	}
+
+	// A write through the service is visible to it immediately
+	if err := service.SetString(ctx, key, "two"); err != nil {
+		t.Fatalf("SetString() error = %v", err)
+	}
+	if got, _ := service.GetString(ctx, key, ""); got != "two" {
+		t.Errorf("GetString() after write = %q, want two", got)
+	}
+
+	// Another replica serves its cached value until the entry expires
+	if got, _ := replica.GetString(ctx, key, ""); got != "one" {
+		t.Errorf("replica GetString() before expiry = %q, want cached one", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got, _ := replica.GetString(ctx, key, ""); got != "two" {
+		t.Errorf("replica GetString() after expiry = %q, want two", got)
+	}
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+)
+
+// ConfigShareTTL is how long a shareable config link can be redeemed for
+const ConfigShareTTL = 10 * time.Minute
+
+// ErrInvalidConfigShare is returned when a config share token is unknown, already used, or expired
+var ErrInvalidConfigShare = errors.New("invalid config share link")
+
+// CreateConfigShare creates a single-use link to the user's config for a server, redeemable for
+// ConfigShareTTL. The token is returned only here; the database keeps its hash, bound to the user and
+// server it was created for. The user must already have an active key on the server.
+func (s *WireguardService) CreateConfigShare(ctx context.Context, userID, serverID uuid.UUID) (*models.ConfigShare, error) {
+	if _, err := s.GetUserKey(ctx, userID, serverID); err != nil {
+		return nil, err
+	}
+
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate share token: %w", err)
+	}
+	token := hex.EncodeToString(raw[:])
+
+	share := &models.ConfigShare{Token: token, ServerID: serverID}
+	query := `
+		INSERT INTO config_shares (token_hash, user_id, server_id, expires_at)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+		RETURNING expires_at
+	`
+	if err := s.db.QueryRow(ctx, query, hashShareToken(token), userID, serverID, ConfigShareTTL.Seconds()).Scan(&share.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("failed to create config share: %w", err)
+	}
+
+	s.logger.Info("Config share link created",
+		zap.String("user_id", userID.String()),
+		zap.String("server_id", serverID.String()))
+
+	return share, nil
+}
+
+// RedeemConfigShare consumes a share token and returns the key of the user and server it was created
+// for. A token can be redeemed once, before it expires; ErrInvalidConfigShare is returned otherwise,
+// and ErrUserKeyNotFound when the key was revoked since the link was created.
+func (s *WireguardService) RedeemConfigShare(ctx context.Context, token string) (*models.UserKey, error) {
+	var userID, serverID uuid.UUID
+	query := `
+		UPDATE config_shares SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, server_id
+	`
+	err := s.db.QueryRow(ctx, query, hashShareToken(token)).Scan(&userID, &serverID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidConfigShare
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem config share: %w", err)
+	}
+
+	s.logger.Info("Config share link redeemed",
+		zap.String("user_id", userID.String()),
+		zap.String("server_id", serverID.String()))
+
+	return s.GetUserKey(ctx, userID, serverID)
+}
+
+// PurgeConfigShares deletes share links that have been used or have expired, which can never be
+// redeemed again, and returns how many were deleted
+func (s *WireguardService) PurgeConfigShares(ctx context.Context) (int64, error) {
+	tag, err := s.db.Exec(ctx, `DELETE FROM config_shares WHERE used_at IS NOT NULL OR expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge config shares: %w", err)
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		s.logger.Info("Purged used and expired config shares", zap.Int64("count", n))
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// hashShareToken returns the hex SHA-256 of a share token, which is what is stored
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestConfigShare(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	logger := zap.NewNop()
+	userService := NewUserService(db, logger)
+	service := NewWireguardServiceWithClient(logger, &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}})
+	service.SetDB(db)
+
+	owner := newTestUser(t, userService)
+	ownerKey, err := service.AddUserKey(ctx, owner.ID, defaultServerID, newTestPeers(t, 1)[0].PublicKey.String())
+	if err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+	other := newTestUser(t, userService)
+	otherKey, err := service.AddUserKey(ctx, other.ID, defaultServerID, newTestPeers(t, 1)[0].PublicKey.String())
+	if err != nil {
+		t.Fatalf("AddUserKey() error = %v", err)
+	}
+
+	t.Run("single use", func(t *testing.T) {
+		share, err := service.CreateConfigShare(ctx, owner.ID, defaultServerID)
+		if err != nil {
+			t.Fatalf("CreateConfigShare() error = %v", err)
+		}
+
+		userKey, err := service.RedeemConfigShare(ctx, share.Token)
+		if err != nil {
+			t.Fatalf("RedeemConfigShare() error = %v", err)
+		}
+		if userKey.ID != ownerKey.ID {
+			t.Errorf("RedeemConfigShare() returned key %s, want the owner's %s", userKey.ID, ownerKey.ID)
+		}
+
+		if _, err := service.RedeemConfigShare(ctx, share.Token); !errors.Is(err, ErrInvalidConfigShare) {
+			t.Errorf("Second RedeemConfigShare() error = %v, want ErrInvalidConfigShare", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		share, err := service.CreateConfigShare(ctx, owner.ID, defaultServerID)
+		if err != nil {
+			t.Fatalf("CreateConfigShare() error = %v", err)
+		}
+		if _, err := db.Exec(ctx, `UPDATE config_shares SET expires_at = NOW() - INTERVAL '1 second' WHERE token_hash = $1`, hashShareToken(share.Token)); err != nil {
+			t.Fatalf("Failed to expire share: %v", err)
+		}
+
+		if _, err := service.RedeemConfigShare(ctx, share.Token); !errors.Is(err, ErrInvalidConfigShare) {
+			t.Errorf("RedeemConfigShare() of an expired link error = %v, want ErrInvalidConfigShare", err)
+		}
+	})
+
+	t.Run("bound to its creator", func(t *testing.T) {
+		share, err := service.CreateConfigShare(ctx, other.ID, defaultServerID)
+		if err != nil {
+			t.Fatalf("CreateConfigShare() error = %v", err)
+		}
+
+		userKey, err := service.RedeemConfigShare(ctx, share.Token)
+		if err != nil {
+			t.Fatalf("RedeemConfigShare() error = %v", err)
+		}
+		if userKey.ID != otherKey.ID || userKey.UserID == owner.ID {
+			t.Errorf("RedeemConfigShare() returned key %s, want only the creator's %s", userKey.ID, otherKey.ID)
+		}
+
+		var stored int
+		if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM config_shares WHERE token_hash = $1`, share.Token).Scan(&stored); err != nil {
+			t.Fatalf("Failed to count shares: %v", err)
+		}
+		if stored != 0 {
+			t.Error("The share token should not be stored in plain text")
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		if _, err := service.RedeemConfigShare(ctx, "unknown"); !errors.Is(err, ErrInvalidConfigShare) {
+			t.Errorf("RedeemConfigShare() of an unknown token error = %v, want ErrInvalidConfigShare", err)
+		}
+	})
+
+	t.Run("purged once used or expired", func(t *testing.T) {
+		used, err := service.CreateConfigShare(ctx, owner.ID, defaultServerID)
+		if err != nil {
+			t.Fatalf("CreateConfigShare() error = %v", err)
+		}
+		if _, err := service.RedeemConfigShare(ctx, used.Token); err != nil {
+			t.Fatalf("RedeemConfigShare() error = %v", err)
+		}
+		expired, err := service.CreateConfigShare(ctx, owner.ID, defaultServerID)
+		if err != nil {
+			t.Fatalf("CreateConfigShare() error = %v", err)
+		}
+		if _, err := db.Exec(ctx, `UPDATE config_shares SET expires_at = NOW() - INTERVAL '1 second' WHERE token_hash = $1`, hashShareToken(expired.Token)); err != nil {
+			t.Fatalf("Failed to expire share: %v", err)
+		}
+		pending, err := service.CreateConfigShare(ctx, owner.ID, defaultServerID)
+		if err != nil {
+			t.Fatalf("CreateConfigShare() error = %v", err)
+		}
+
+		if _, err := service.PurgeConfigShares(ctx); err != nil {
+			t.Fatalf("PurgeConfigShares() error = %v", err)
+		}
+		tests := []struct {
+			name  string
+			token string
+			want  int
+		}{
+			{name: "used", token: used.Token, want: 0},
+			{name: "expired", token: expired.Token, want: 0},
+			{name: "pending", token: pending.Token, want: 1},
+		}
+		for _, tt := range tests {
+			var stored int
+			if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM config_shares WHERE token_hash = $1`, hashShareToken(tt.token)).Scan(&stored); err != nil {
+				t.Fatalf("Failed to count shares: %v", err)
+			}
+			if stored != tt.want {
+				t.Errorf("Expected %d %s share left after purging, got %d", tt.want, tt.name, stored)
+			}
+		}
+	})
+
+	t.Run("requires a key", func(t *testing.T) {
+		withoutKey := newTestUser(t, userService)
+		if _, err := service.CreateConfigShare(ctx, withoutKey.ID, defaultServerID); !errors.Is(err, ErrUserKeyNotFound) {
+			t.Errorf("CreateConfigShare() without a key error = %v, want ErrUserKeyNotFound", err)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/google/uuid"
+)
+
+// ProvisioningStats keeps in-memory provisioning counters and latencies per server
+type ProvisioningStats struct {
+	mu      sync.Mutex
+	servers map[uuid.UUID]*serverProvisioningStats
+}
+
+// serverProvisioningStats holds the running totals for a single server
+type serverProvisioningStats struct {
+	successes     int64
+	failures      int64
+	totalDuration time.Duration
+	maxDuration   time.Duration
+	lastFailureAt time.Time
+}
+
+// NewProvisioningStats creates an empty provisioning stats recorder
+func NewProvisioningStats() *ProvisioningStats {
+	return &ProvisioningStats{
+		servers: make(map[uuid.UUID]*serverProvisioningStats),
+	}
+}
+
+// Record records the outcome and duration of a provisioning attempt against a server
+func (p *ProvisioningStats) Record(serverID uuid.UUID, duration time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats, ok := p.servers[serverID]
+	if !ok {
+		stats = &serverProvisioningStats{}
+		p.servers[serverID] = stats
+	}
+
+	if err != nil {
+		stats.failures++
+		stats.lastFailureAt = time.Now().UTC()
+	} else {
+		stats.successes++
+	}
+
+	stats.totalDuration += duration
+	if duration > stats.maxDuration {
+		stats.maxDuration = duration
+	}
+}
+
+// Snapshot returns the current stats for every server, sorted by server ID
+func (p *ProvisioningStats) Snapshot() []*models.ProvisioningStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	snapshot := make([]*models.ProvisioningStats, 0, len(p.servers))
+	for serverID, stats := range p.servers {
+		entry := &models.ProvisioningStats{
+			ServerID:     serverID,
+			Successes:    stats.successes,
+			Failures:     stats.failures,
+			MaxLatencyMs: stats.maxDuration.Milliseconds(),
+		}
+
+		if attempts := stats.successes + stats.failures; attempts > 0 {
+			entry.AvgLatencyMs = stats.totalDuration.Milliseconds() / attempts
+		}
+
+		if !stats.lastFailureAt.IsZero() {
+			lastFailureAt := stats.lastFailureAt
+			entry.LastFailureAt = &lastFailureAt
+		}
+
+		snapshot = append(snapshot, entry)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].ServerID.String() < snapshot[j].ServerID.String()
+	})
+
+	return snapshot
+}
+
+// TrafficTotals keeps the latest persisted traffic totals per server for export as metrics. Only
+// servers are tracked, never users or keys, so the totals cannot be tied to anyone's activity.
+type TrafficTotals struct {
+	mu      sync.Mutex
+	servers map[uuid.UUID]models.ServerTraffic
+}
+
+// NewTrafficTotals creates an empty traffic totals recorder
+func NewTrafficTotals() *TrafficTotals {
+	return &TrafficTotals{
+		servers: make(map[uuid.UUID]models.ServerTraffic),
+	}
+}
+
+// Set records a server's totals. They come from the database, so they only grow across restarts.
+func (t *TrafficTotals) Set(serverID uuid.UUID, rxBytes, txBytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.servers[serverID] = models.ServerTraffic{ServerID: serverID, ReceiveBytes: rxBytes, TransmitBytes: txBytes}
+}
+
+// Snapshot returns the totals of every server, sorted by server ID
+func (t *TrafficTotals) Snapshot() []*models.ServerTraffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make([]*models.ServerTraffic, 0, len(t.servers))
+	for _, traffic := range t.servers {
+		entry := traffic
+		snapshot = append(snapshot, &entry)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].ServerID.String() < snapshot[j].ServerID.String()
+	})
+
+	return snapshot
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestProvisioningStatsRecord(t *testing.T) {
+	stats := NewProvisioningStats()
+	serverA, serverB := uuid.New(), uuid.New()
+
+	stats.Record(serverA, 10*time.Millisecond, nil)
+	stats.Record(serverA, 30*time.Millisecond, nil)
+	stats.Record(serverA, 50*time.Millisecond, errors.New("device busy"))
+	stats.Record(serverB, 5*time.Millisecond, nil)
+
+	snapshot := stats.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("Expected stats for 2 servers, got %d", len(snapshot))
+	}
+
+	for _, entry := range snapshot {
+		switch entry.ServerID {
+		case serverA:
+			if entry.Successes != 2 || entry.Failures != 1 {
+				t.Errorf("Expected 2 successes and 1 failure, got %d/%d", entry.Successes, entry.Failures)
+			}
+			if entry.AvgLatencyMs != 30 || entry.MaxLatencyMs != 50 {
+				t.Errorf("Expected avg 30ms and max 50ms, got %d/%d", entry.AvgLatencyMs, entry.MaxLatencyMs)
+			}
+			if entry.LastFailureAt == nil {
+				t.Error("Expected last failure time to be set")
+			}
+		case serverB:
+			if entry.Successes != 1 || entry.Failures != 0 || entry.LastFailureAt != nil {
+				t.Errorf("Unexpected stats for server B: %+v", entry)
+			}
+		}
+	}
+}
+
+func TestTrafficTotals(t *testing.T) {
+	traffic := NewTrafficTotals()
+	serverA, serverB := uuid.New(), uuid.New()
+
+	traffic.Set(serverA, 100, 200)
+	traffic.Set(serverB, 1, 2)
+	traffic.Set(serverA, 150, 260)
+
+	snapshot := traffic.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("Expected totals for 2 servers, got %d", len(snapshot))
+	}
+	for _, entry := range snapshot {
+		switch entry.ServerID {
+		case serverA:
+			if entry.ReceiveBytes != 150 || entry.TransmitBytes != 260 {
+				t.Errorf("Expected the latest totals 150/260, got %d/%d", entry.ReceiveBytes, entry.TransmitBytes)
+			}
+		case serverB:
+			if entry.ReceiveBytes != 1 || entry.TransmitBytes != 2 {
+				t.Errorf("Unexpected totals for server B: %+v", entry)
+			}
+		}
+	}
+}
+
+func TestAddUserKeyRecordsFailure(t *testing.T) {
+	db := newTestDB(t)
+	logger := zap.NewNop()
+	user := newTestUser(t, NewUserService(db, logger))
+
+	client := &fakeWGClient{device: &wgtypes.Device{Name: "wg0"}, configureErr: errors.New("netlink: device busy")}
+	service := NewWireguardServiceWithClient(logger, client)
+	service.SetDB(db)
+
+	peer := newTestPeers(t, 1)[0]
+	if _, err := service.AddUserKey(context.Background(), user.ID, defaultServerID, peer.PublicKey.String()); err == nil {
+		t.Fatal("Expected AddUserKey to fail when the device rejects the peer")
+	}
+
+	snapshot := service.ProvisioningStats()
+	if len(snapshot) != 1 || snapshot[0].ServerID != defaultServerID {
+		t.Fatalf("Expected stats for the provisioned server, got %+v", snapshot)
+	}
+	if snapshot[0].Failures != 1 || snapshot[0].Successes != 0 {
+		t.Errorf("Expected 1 failure and 0 successes, got %d/%d", snapshot[0].Failures, snapshot[0].Successes)
+	}
+}
@@ -2,18 +2,61 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/denzelpenzel/vpn/internal/models"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
 
+// ErrUserNotFound is returned when a user does not exist
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserInactive is returned when a user exists but has been deactivated
+var ErrUserInactive = errors.New("user account is disabled")
+
+// ErrEmailTaken is returned when creating a user whose email is registered already, in any case
+var ErrEmailTaken = errors.New("email already registered")
+
+// MaxBatchUsers is the most accounts an admin can create in one batch
+const MaxBatchUsers = 100
+
+// BatchInviteTTL is how long invites for batch-created accounts stay valid
+const BatchInviteTTL = 7 * 24 * time.Hour
+
+// emailCacheTTL bounds how stale an email served by GetUserEmail may be
+const emailCacheTTL = 5 * time.Minute
+
+// maxCachedEmails bounds the email cache; it is emptied rather than grown past this
+const maxCachedEmails = 10000
+
+// cachedEmail is a user's email as last read by GetUserEmail
+type cachedEmail struct {
+	email   string
+	expires time.Time
+}
+
 // UserService handles user-related operations
 type UserService struct {
 	db     *pgxpool.Pool
 	logger *zap.Logger
+
+	// emails caches lookups for tokens issued without the email claim
+	emailsMu sync.Mutex
+	emails   map[uuid.UUID]cachedEmail
+
+	// preserveEmailCase stores new emails as entered instead of lowercased
+	preserveEmailCase bool
 }
 
 // NewUserService creates a new user service
@@ -24,25 +67,64 @@ func NewUserService(db *pgxpool.Pool, logger *zap.Logger) *UserService {
 	}
 }
 
+// SetPreserveEmailCase sets whether new accounts keep their email as entered rather than lowercased.
+// Emails are unique and looked up regardless of case either way.
+func (s *UserService) SetPreserveEmailCase(preserve bool) {
+	s.preserveEmailCase = preserve
+}
+
+// normalizeEmail returns the form a new account's email is stored in
+func (s *UserService) normalizeEmail(email string) string {
+	if s.preserveEmailCase {
+		return email
+	}
+	return strings.ToLower(email)
+}
+
+// MaskEmail hides all but the first character of an email's local part, keeping the domain, so an
+// owner can be recognized by an admin without the address being disclosed
+func MaskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return strings.Repeat("*", utf8.RuneCountInString(email))
+	}
+	first, _ := utf8.DecodeRuneInString(local)
+	return string(first) + "***@" + domain
+}
+
 // CreateUser creates a new user
 func (s *UserService) CreateUser(ctx context.Context, email, passwordHash string) (*models.User, error) {
+	return s.CreateUserWithDisplayName(ctx, email, passwordHash, "")
+}
+
+// CreateUserWithDisplayName creates a new user with a display name, which is expected to have been
+// normalized with NormalizeDisplayName; an empty name leaves it unset
+func (s *UserService) CreateUserWithDisplayName(ctx context.Context, email, passwordHash, displayName string) (*models.User, error) {
+	email = s.normalizeEmail(email)
 	user := &models.User{}
 
 	query := `
-		INSERT INTO users (email, password_hash)
-		VALUES ($1, $2)
-		RETURNING id, email, password_hash, created_at, updated_at, is_active
+		INSERT INTO users (email, password_hash, display_name)
+		VALUES ($1, $2, NULLIF($3, ''))
+		RETURNING id, email, COALESCE(display_name, ''), password_hash, role, must_change_password, created_at, updated_at, is_active
 	`
 
-	err := s.db.QueryRow(ctx, query, email, passwordHash).Scan(
+	err := s.db.QueryRow(ctx, query, email, passwordHash, displayName).Scan(
 		&user.ID,
 		&user.Email,
+		&user.DisplayName,
 		&user.PasswordHash,
+		&user.Role,
+		&user.MustChangePassword,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.IsActive,
 	)
 
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, ErrEmailTaken
+	}
 	if err != nil {
 		s.logger.Error("Failed to create user", zap.Error(err), zap.String("email", email))
 		return nil, fmt.Errorf("failed to create user: %w", err)
@@ -55,20 +137,261 @@ func (s *UserService) CreateUser(ctx context.Context, email, passwordHash string
 	return user, nil
 }
 
-// GetUserByEmail retrieves a user by email
+// EnsureBootstrapAdmin creates an admin with the given email and password hash when no admin exists,
+// so a fresh deployment can reach the admin routes. The admin must change the password at first login.
+// It reports whether the admin was created and does nothing when any admin exists, so it is safe to
+// repeat. An existing account with the email is never promoted; that is reported as an error.
+func (s *UserService) EnsureBootstrapAdmin(ctx context.Context, email, passwordHash string) (bool, error) {
+	email = s.normalizeEmail(email)
+	query := `
+		INSERT INTO users (email, password_hash, role, must_change_password)
+		SELECT $1, $2, $3, true
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE role = $3)
+		ON CONFLICT ((LOWER(email))) DO NOTHING
+		RETURNING id
+	`
+
+	var userID uuid.UUID
+	err := s.db.QueryRow(ctx, query, email, passwordHash, models.RoleAdmin).Scan(&userID)
+	if err == nil {
+		s.logger.Warn("Created bootstrap admin; change its password and remove the bootstrap credentials from the configuration",
+			zap.String("user_id", userID.String()),
+			zap.String("email", email))
+		return true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, fmt.Errorf("failed to create bootstrap admin: %w", err)
+	}
+
+	// Nothing was inserted: either an admin exists or the email belongs to a regular account
+	var adminExists bool
+	if err := s.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)`, models.RoleAdmin).Scan(&adminExists); err != nil {
+		return false, fmt.Errorf("failed to check for admins: %w", err)
+	}
+	if !adminExists {
+		return false, fmt.Errorf("bootstrap admin email %s is already registered to a non-admin account", email)
+	}
+
+	return false, nil
+}
+
+// CreateUserWithInvite creates a new user with an optional display name, consuming the given invite
+// code in the same transaction
+func (s *UserService) CreateUserWithInvite(ctx context.Context, email, passwordHash, displayName, inviteCode string) (*models.User, error) {
+	email = s.normalizeEmail(email)
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Claim the invite first so concurrent registrations cannot share a code
+	var inviteID uuid.UUID
+	claimQuery := `
+		UPDATE invites SET used_at = NOW()
+		WHERE code = $1 AND user_id IS NULL AND used_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING id
+	`
+	if err := tx.QueryRow(ctx, claimQuery, inviteCode).Scan(&inviteID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInvalidInvite
+		}
+		return nil, fmt.Errorf("failed to claim invite: %w", err)
+	}
+
+	user := &models.User{}
+	query := `
+		INSERT INTO users (email, password_hash, display_name)
+		VALUES ($1, $2, NULLIF($3, ''))
+		RETURNING id, email, COALESCE(display_name, ''), password_hash, role, must_change_password, created_at, updated_at, is_active
+	`
+
+	err = tx.QueryRow(ctx, query, email, passwordHash, displayName).Scan(
+		&user.ID,
+		&user.Email,
+		&user.DisplayName,
+		&user.PasswordHash,
+		&user.Role,
+		&user.MustChangePassword,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.IsActive,
+	)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, ErrEmailTaken
+	}
+	if err != nil {
+		s.logger.Error("Failed to create user", zap.Error(err), zap.String("email", email))
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE invites SET used_by = $1 WHERE id = $2`, user.ID, inviteID); err != nil {
+		return nil, fmt.Errorf("failed to record invite use: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit registration: %w", err)
+	}
+
+	s.logger.Info("User created with invite",
+		zap.String("user_id", user.ID.String()),
+		zap.String("invite_id", inviteID.String()))
+
+	return user, nil
+}
+
+// CreatePendingUser creates an account with the given role and no password, so it cannot sign in
+// until its invite is accepted. With sendInvite an invite for the account is created in the same
+// transaction and returned, expiring after inviteTTL; otherwise the returned invite is nil and an
+// admin password reset activates the account.
+func (s *UserService) CreatePendingUser(ctx context.Context, email, role string, createdBy uuid.UUID, sendInvite bool, inviteTTL time.Duration) (*models.User, *models.Invite, error) {
+	email = s.normalizeEmail(email)
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	user := &models.User{}
+	query := `
+		INSERT INTO users (email, password_hash, role)
+		VALUES ($1, '', $2)
+		RETURNING id, email, COALESCE(display_name, ''), password_hash, role, must_change_password, created_at, updated_at, is_active
+	`
+
+	err = tx.QueryRow(ctx, query, email, role).Scan(
+		&user.ID,
+		&user.Email,
+		&user.DisplayName,
+		&user.PasswordHash,
+		&user.Role,
+		&user.MustChangePassword,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.IsActive,
+	)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, nil, ErrEmailTaken
+	}
+	if err != nil {
+		s.logger.Error("Failed to create user", zap.Error(err), zap.String("email", email))
+		return nil, nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	var invite *models.Invite
+	if sendInvite {
+		code, err := generateInviteCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		expiresAt := time.Now().Add(inviteTTL).UTC()
+
+		invite = &models.Invite{}
+		inviteQuery := `
+			INSERT INTO invites (code, created_by, expires_at, user_id)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, code, created_by, expires_at, user_id, created_at
+		`
+		err = tx.QueryRow(ctx, inviteQuery, code, createdBy, expiresAt, user.ID).Scan(
+			&invite.ID,
+			&invite.Code,
+			&invite.CreatedBy,
+			&invite.ExpiresAt,
+			&invite.UserID,
+			&invite.CreatedAt,
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create invite: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit user creation: %w", err)
+	}
+
+	s.logger.Info("Pending user created",
+		zap.String("user_id", user.ID.String()),
+		zap.String("created_by", createdBy.String()),
+		zap.Bool("invited", sendInvite))
+
+	return user, invite, nil
+}
+
+// AcceptInvite sets the password of the account an invite was created for, consuming the invite.
+// It returns ErrInvalidInvite when the code is unknown, used, expired, a registration invite, or
+// for an account that has since been deactivated.
+func (s *UserService) AcceptInvite(ctx context.Context, inviteCode, passwordHash string) (*models.User, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID uuid.UUID
+	claimQuery := `
+		UPDATE invites SET used_at = NOW(), used_by = user_id
+		WHERE code = $1 AND user_id IS NOT NULL AND used_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING user_id
+	`
+	if err := tx.QueryRow(ctx, claimQuery, inviteCode).Scan(&userID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInvalidInvite
+		}
+		return nil, fmt.Errorf("failed to claim invite: %w", err)
+	}
+
+	user := &models.User{}
+	query := `
+		UPDATE users SET password_hash = $1, updated_at = NOW()
+		WHERE id = $2 AND is_active = true
+		RETURNING id, email, COALESCE(display_name, ''), password_hash, role, must_change_password, created_at, updated_at, is_active
+	`
+	err = tx.QueryRow(ctx, query, passwordHash, userID).Scan(
+		&user.ID,
+		&user.Email,
+		&user.DisplayName,
+		&user.PasswordHash,
+		&user.Role,
+		&user.MustChangePassword,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.IsActive,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidInvite
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to set password: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit invite acceptance: %w", err)
+	}
+
+	s.logger.Info("Invite accepted", zap.String("user_id", user.ID.String()))
+
+	return user, nil
+}
+
+// GetUserByEmail retrieves an active user by email, whatever its case
 func (s *UserService) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	user := &models.User{}
 
 	query := `
-		SELECT id, email, password_hash, created_at, updated_at, is_active
+		SELECT id, email, COALESCE(display_name, ''), password_hash, role, must_change_password, created_at, updated_at, is_active
 		FROM users
-		WHERE email = $1 AND is_active = true
+		WHERE LOWER(email) = LOWER($1) AND is_active = true
 	`
 
 	err := s.db.QueryRow(ctx, query, email).Scan(
 		&user.ID,
 		&user.Email,
+		&user.DisplayName,
 		&user.PasswordHash,
+		&user.Role,
+		&user.MustChangePassword,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.IsActive,
@@ -82,38 +405,93 @@ func (s *UserService) GetUserByEmail(ctx context.Context, email string) (*models
 	return user, nil
 }
 
-// GetUserByID retrieves a user by ID
+// GetUserByID retrieves an active user by ID. It returns ErrUserNotFound when there is no such user
+// and ErrUserInactive when the user has been deactivated.
 func (s *UserService) GetUserByID(ctx context.Context, userID uuid.UUID) (*models.User, error) {
+	user, err := s.GetUserByIDIncludingInactive(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		s.logger.Warn("User is deactivated", zap.String("user_id", userID.String()))
+		return nil, ErrUserInactive
+	}
+
+	return user, nil
+}
+
+// GetUserByIDIncludingInactive retrieves a user by ID whether or not it is active. It returns
+// ErrUserNotFound when there is no such user.
+func (s *UserService) GetUserByIDIncludingInactive(ctx context.Context, userID uuid.UUID) (*models.User, error) {
 	user := &models.User{}
 
 	query := `
-		SELECT id, email, password_hash, created_at, updated_at, is_active
+		SELECT id, email, COALESCE(display_name, ''), password_hash, role, must_change_password, created_at, updated_at, is_active
 		FROM users
-		WHERE id = $1 AND is_active = true
+		WHERE id = $1
 	`
 
 	err := s.db.QueryRow(ctx, query, userID).Scan(
 		&user.ID,
 		&user.Email,
+		&user.DisplayName,
 		&user.PasswordHash,
+		&user.Role,
+		&user.MustChangePassword,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.IsActive,
 	)
 
-	if err != nil {
+	if errors.Is(err, pgx.ErrNoRows) {
 		s.logger.Warn("User not found", zap.String("user_id", userID.String()))
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		s.logger.Error("Failed to get user", zap.Error(err))
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
 	return user, nil
 }
 
-// EmailExists checks if an email already exists
+// GetUserEmail returns a user's email, for handlers serving tokens that carry only the user ID.
+// Lookups are cached for emailCacheTTL. It returns ErrUserNotFound when there is no such user.
+func (s *UserService) GetUserEmail(ctx context.Context, userID uuid.UUID) (string, error) {
+	now := time.Now()
+
+	s.emailsMu.Lock()
+	cached, ok := s.emails[userID]
+	s.emailsMu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.email, nil
+	}
+
+	var email string
+	err := s.db.QueryRow(ctx, `SELECT email FROM users WHERE id = $1`, userID).Scan(&email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		s.logger.Error("Failed to get user email", zap.Error(err))
+		return "", fmt.Errorf("failed to get user email: %w", err)
+	}
+
+	s.emailsMu.Lock()
+	if s.emails == nil || len(s.emails) >= maxCachedEmails {
+		s.emails = make(map[uuid.UUID]cachedEmail)
+	}
+	s.emails[userID] = cachedEmail{email: email, expires: now.Add(emailCacheTTL)}
+	s.emailsMu.Unlock()
+
+	return email, nil
+}
+
+// EmailExists checks if an email already exists, whatever its case
 func (s *UserService) EmailExists(ctx context.Context, email string) (bool, error) {
 	var exists bool
 
-	query := `SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)`
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1))`
 
 	err := s.db.QueryRow(ctx, query, email).Scan(&exists)
 	if err != nil {
@@ -124,12 +502,211 @@ func (s *UserService) EmailExists(ctx context.Context, email string) (bool, erro
 	return exists, nil
 }
 
+// CountUsers returns the number of registered users
+func (s *UserService) CountUsers(ctx context.Context) (int64, error) {
+	var count int64
+	if err := s.db.QueryRow(ctx, `SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	return count, nil
+}
+
+// AdminResetPassword replaces a user's password hash; mustChange flags the new password as temporary
+func (s *UserService) AdminResetPassword(ctx context.Context, userID uuid.UUID, passwordHash string, mustChange bool) error {
+	query := `UPDATE users SET password_hash = $1, must_change_password = $2, updated_at = NOW() WHERE id = $3`
+
+	result, err := s.db.Exec(ctx, query, passwordHash, mustChange, userID)
+	if err != nil {
+		s.logger.Error("Failed to reset password", zap.Error(err))
+		return fmt.Errorf("failed to reset password: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	s.logger.Info("User password reset by admin",
+		zap.String("user_id", userID.String()),
+		zap.Bool("must_change_password", mustChange))
+
+	return nil
+}
+
+// UpdatePasswordHash replaces a user's password hash without changing the password, such as when
+// rehashing it with a newly configured algorithm
+func (s *UserService) UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2`
+
+	result, err := s.db.Exec(ctx, query, passwordHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// ChangePassword replaces a password the user has chosen themselves, clearing any must-change flag
+// left by an admin reset
+func (s *UserService) ChangePassword(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1, must_change_password = false, updated_at = NOW() WHERE id = $2`
+
+	result, err := s.db.Exec(ctx, query, passwordHash, userID)
+	if err != nil {
+		s.logger.Error("Failed to change password", zap.Error(err))
+		return fmt.Errorf("failed to change password: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	s.logger.Info("User changed password", zap.String("user_id", userID.String()))
+
+	return nil
+}
+
+// GetAllowedNetworks retrieves the admin-set allowed networks policy for a user (nil means full tunnel).
+// It returns ErrUserNotFound or ErrUserInactive when the user cannot be provisioned.
+func (s *UserService) GetAllowedNetworks(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	var (
+		networks []string
+		isActive bool
+	)
+
+	query := `SELECT allowed_networks, is_active FROM users WHERE id = $1`
+
+	err := s.db.QueryRow(ctx, query, userID).Scan(&networks, &isActive)
+	if errors.Is(err, pgx.ErrNoRows) {
+		s.logger.Warn("User not found", zap.String("user_id", userID.String()))
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		s.logger.Error("Failed to get allowed networks", zap.Error(err))
+		return nil, fmt.Errorf("failed to get allowed networks: %w", err)
+	}
+	if !isActive {
+		s.logger.Warn("User is deactivated", zap.String("user_id", userID.String()))
+		return nil, ErrUserInactive
+	}
+
+	return networks, nil
+}
+
+// SetAllowedNetworks sets the allowed networks policy for a user; an empty list restores full tunnel.
+// It shapes the routes in the user's generated configs; WireguardService.ApplyNetworkPolicy enforces
+// it on the user's peers. It returns ErrUserNotFound for an unknown user.
+func (s *UserService) SetAllowedNetworks(ctx context.Context, userID uuid.UUID, networks []string) ([]string, error) {
+	normalized, err := NormalizeNetworks(networks)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE users SET allowed_networks = $1, updated_at = NOW() WHERE id = $2`
+
+	result, err := s.db.Exec(ctx, query, normalized, userID)
+	if err != nil {
+		s.logger.Error("Failed to update allowed networks", zap.Error(err))
+		return nil, fmt.Errorf("failed to update allowed networks: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	s.logger.Info("User allowed networks updated",
+		zap.String("user_id", userID.String()),
+		zap.Int("network_count", len(normalized)))
+
+	return normalized, nil
+}
+
+// SetUserConnectionLimit sets how many of a user's peers may be connected at once, overriding the
+// server-wide limit; nil restores the server-wide limit and zero allows any number. It returns
+// ErrUserNotFound for an unknown user.
+func (s *UserService) SetUserConnectionLimit(ctx context.Context, userID uuid.UUID, limit *int) error {
+	if limit != nil && *limit < 0 {
+		return fmt.Errorf("max_concurrent_connections must not be negative")
+	}
+
+	query := `UPDATE users SET max_concurrent_connections = $1, updated_at = NOW() WHERE id = $2`
+
+	result, err := s.db.Exec(ctx, query, limit, userID)
+	if err != nil {
+		s.logger.Error("Failed to update connection limit", zap.Error(err))
+		return fmt.Errorf("failed to update connection limit: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	s.logger.Info("User connection limit updated",
+		zap.String("user_id", userID.String()),
+		zap.Bool("overridden", limit != nil))
+
+	return nil
+}
+
+// NormalizeNetworks validates a list of CIDRs and returns them in canonical form (nil for an empty list)
+func NormalizeNetworks(networks []string) ([]string, error) {
+	if len(networks) == 0 {
+		return nil, nil
+	}
+
+	normalized := make([]string, 0, len(networks))
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(network))
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		normalized = append(normalized, ipNet.String())
+	}
+
+	return normalized, nil
+}
+
+// maxDisplayNameLength is the longest display name accepted, in characters
+const maxDisplayNameLength = 64
+
+// NormalizeDisplayName trims a display name and collapses runs of whitespace to single spaces. Names
+// are limited to letters, numbers, spaces and . ' - _ so they are safe to show anywhere; an empty
+// name is allowed and means none.
+func NormalizeDisplayName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("display name must be valid UTF-8")
+	}
+
+	name = strings.Join(strings.Fields(name), " ")
+	if utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return "", fmt.Errorf("display name must be at most %d characters", maxDisplayNameLength)
+	}
+
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r), unicode.IsMark(r), unicode.IsDigit(r):
+		case r == ' ', r == '.', r == '\'', r == '-', r == '_':
+		default:
+			return "", fmt.Errorf("display name may only contain letters, numbers, spaces and . ' - _")
+		}
+	}
+
+	return name, nil
+}
+
 // ToUserResponse converts User to UserResponse (removes sensitive data)
 func (s *UserService) ToUserResponse(user *models.User) *models.UserResponse {
 	return &models.UserResponse{
-		ID:        user.ID,
-		Email:     user.Email,
-		CreatedAt: user.CreatedAt,
-		IsActive:  user.IsActive,
+		ID:                 user.ID,
+		Email:              user.Email,
+		DisplayName:        user.DisplayName,
+		Role:               user.Role,
+		MustChangePassword: user.MustChangePassword,
+		CreatedAt:          user.CreatedAt,
+		IsActive:           user.IsActive,
 	}
 }
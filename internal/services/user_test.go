@@ -0,0 +1,395 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// newTestUser creates a user with a unique email, removed when the test finishes
+func newTestUser(t *testing.T, service *UserService) *models.User {
+	t.Helper()
+
+	user, err := service.CreateUser(context.Background(), fmt.Sprintf("test-%s@example.com", uuid.New()), "$2a$12$test")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	t.Cleanup(func() {
+		service.db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	return user
+}
+
+func TestMaskEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"alice@example.com", "a***@example.com"},
+		{"a@example.com", "a***@example.com"},
+		{"éva@example.com", "é***@example.com"},
+		{"@example.com", "************"},
+		{"invalid", "*******"},
+	}
+
+	for _, tt := range tests {
+		if got := MaskEmail(tt.email); got != tt.want {
+			t.Errorf("MaskEmail(%q) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks []string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "empty policy",
+			networks: nil,
+			want:     nil,
+		},
+		{
+			name:     "canonicalizes host bits",
+			networks: []string{"10.10.1.5/16", " 192.168.0.0/24"},
+			want:     []string{"10.10.0.0/16", "192.168.0.0/24"},
+		},
+		{
+			name:     "IPv6 network",
+			networks: []string{"fd00:1::/64"},
+			want:     []string{"fd00:1::/64"},
+		},
+		{
+			name:     "invalid CIDR",
+			networks: []string{"10.0.0.0/16", "not-a-network"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeNetworks(tt.networks)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeNetworks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NormalizeNetworks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeDisplayName(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", in: "", want: ""},
+		{name: "collapses whitespace", in: "  Ada \t Lovelace  ", want: "Ada Lovelace"},
+		{name: "accented and punctuated", in: "Zoë O'Brien-Smith Jr.", want: "Zoë O'Brien-Smith Jr."},
+		{name: "non-Latin script", in: "山田 太郎", want: "山田 太郎"},
+		{name: "exactly the limit", in: strings.Repeat("a", maxDisplayNameLength), want: strings.Repeat("a", maxDisplayNameLength)},
+		{name: "too long", in: strings.Repeat("é", maxDisplayNameLength+1), wantErr: true},
+		{name: "markup", in: "<b>Ada</b>", wantErr: true},
+		{name: "control character", in: "Ada\x00Lovelace", wantErr: true},
+		{name: "bidi override", in: "Ada\u202eLovelace", wantErr: true},
+		{name: "invalid UTF-8", in: "Ada\xffLovelace", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeDisplayName(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeDisplayName(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeDisplayName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAllowedIPs(t *testing.T) {
+	if got := ClientAllowedIPs(nil); got != DefaultClientAllowedIPs {
+		t.Errorf("ClientAllowedIPs(nil) = %q, want full tunnel", got)
+	}
+
+	if got := ClientAllowedIPs([]string{"10.10.0.0/16", "192.168.0.0/24"}); got != "10.10.0.0/16, 192.168.0.0/24" {
+		t.Errorf("ClientAllowedIPs() = %q, want only policy networks", got)
+	}
+}
+
+func TestAllowedNetworksPolicy(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewUserService(db, zap.NewNop())
+	user := newTestUser(t, service)
+
+	networks, err := service.GetAllowedNetworks(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetAllowedNetworks() error = %v", err)
+	}
+	if networks != nil {
+		t.Errorf("Expected no policy for new user, got %v", networks)
+	}
+
+	if _, err := service.SetAllowedNetworks(ctx, user.ID, []string{"10.10.1.0/16"}); err != nil {
+		t.Fatalf("SetAllowedNetworks() error = %v", err)
+	}
+
+	networks, err = service.GetAllowedNetworks(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetAllowedNetworks() error = %v", err)
+	}
+	if got := ClientAllowedIPs(networks); got != "10.10.0.0/16" {
+		t.Errorf("Expected config restricted to policy, got %q", got)
+	}
+
+	if _, err := service.SetAllowedNetworks(ctx, user.ID, []string{"bogus"}); err == nil {
+		t.Error("Expected invalid network to be rejected")
+	}
+
+	if _, err := service.SetAllowedNetworks(ctx, uuid.New(), nil); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("SetAllowedNetworks() error = %v for an unknown user, want ErrUserNotFound", err)
+	}
+}
+
+func TestAdminResetPassword(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewUserService(db, zap.NewNop())
+	user := newTestUser(t, service)
+
+	if err := service.AdminResetPassword(ctx, user.ID, "$2a$12$reset", true); err != nil {
+		t.Fatalf("AdminResetPassword() error = %v", err)
+	}
+
+	updated, err := service.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+	if updated.PasswordHash != "$2a$12$reset" || !updated.MustChangePassword {
+		t.Errorf("Expected reset hash and must-change flag, got %q %v", updated.PasswordHash, updated.MustChangePassword)
+	}
+
+	if err := service.AdminResetPassword(ctx, uuid.New(), "$2a$12$reset", false); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound for unknown user, got %v", err)
+	}
+}
+
+func TestGetUserByIDDistinguishesInactive(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewUserService(db, zap.NewNop())
+
+	user := newTestUser(t, service)
+	if _, err := service.GetUserByID(ctx, user.ID); err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+
+	if _, err := db.Exec(ctx, `UPDATE users SET is_active = false WHERE id = $1`, user.ID); err != nil {
+		t.Fatalf("Failed to deactivate user: %v", err)
+	}
+
+	if _, err := service.GetUserByID(ctx, user.ID); !errors.Is(err, ErrUserInactive) {
+		t.Errorf("GetUserByID() error = %v, want ErrUserInactive", err)
+	}
+	if _, err := service.GetAllowedNetworks(ctx, user.ID); !errors.Is(err, ErrUserInactive) {
+		t.Errorf("GetAllowedNetworks() error = %v, want ErrUserInactive", err)
+	}
+
+	inactive, err := service.GetUserByIDIncludingInactive(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByIDIncludingInactive() error = %v", err)
+	}
+	if inactive.ID != user.ID || inactive.IsActive {
+		t.Errorf("Expected the deactivated user, got %+v", inactive)
+	}
+
+	// A user that never existed is not found, not disabled
+	missing := uuid.New()
+	if _, err := service.GetUserByID(ctx, missing); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUserByID() error = %v, want ErrUserNotFound", err)
+	}
+	if _, err := service.GetUserByIDIncludingInactive(ctx, missing); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUserByIDIncludingInactive() error = %v, want ErrUserNotFound", err)
+	}
+	if _, err := service.GetAllowedNetworks(ctx, missing); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetAllowedNetworks() error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestEnsureBootstrapAdminCreatesOnce(t *testing.T) {
+	db := newIsolatedTestDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `DELETE FROM users`); err != nil {
+		t.Fatalf("Failed to empty users: %v", err)
+	}
+	service := NewUserService(db, zap.NewNop())
+
+	created, err := service.EnsureBootstrapAdmin(ctx, "admin@example.com", "$2a$12$bootstrap")
+	if err != nil {
+		t.Fatalf("EnsureBootstrapAdmin() error = %v", err)
+	}
+	if !created {
+		t.Fatal("Expected the admin to be created on an empty database")
+	}
+
+	admin, err := service.GetUserByEmail(ctx, "admin@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail() error = %v", err)
+	}
+	if admin.Role != models.RoleAdmin || !admin.MustChangePassword || admin.PasswordHash != "$2a$12$bootstrap" {
+		t.Errorf("Expected an admin with the hashed password who must change it, got %+v", admin)
+	}
+
+	// Restarting with the same or different credentials leaves the existing admin alone
+	for _, email := range []string{"admin@example.com", "other-admin@example.com"} {
+		created, err := service.EnsureBootstrapAdmin(ctx, email, "$2a$12$other")
+		if err != nil || created {
+			t.Errorf("%s: expected a no-op once an admin exists, got created=%v err=%v", email, created, err)
+		}
+	}
+	if count, err := service.CountUsers(ctx); err != nil || count != 1 {
+		t.Errorf("Expected exactly one user, got %d (err %v)", count, err)
+	}
+}
+
+func TestEnsureBootstrapAdminSkipsWhenAdminExists(t *testing.T) {
+	db := newIsolatedTestDB(t)
+	ctx := context.Background()
+	service := NewUserService(db, zap.NewNop())
+
+	existing := newTestUser(t, service)
+	if _, err := db.Exec(ctx, `UPDATE users SET role = $2 WHERE id = $1`, existing.ID, models.RoleAdmin); err != nil {
+		t.Fatalf("Failed to promote user: %v", err)
+	}
+
+	created, err := service.EnsureBootstrapAdmin(ctx, "bootstrap@example.com", "$2a$12$bootstrap")
+	if err != nil || created {
+		t.Fatalf("Expected a no-op when an admin exists, got created=%v err=%v", created, err)
+	}
+	if _, err := service.GetUserByEmail(ctx, "bootstrap@example.com"); err == nil {
+		t.Error("Expected no bootstrap admin to be created")
+	}
+}
+
+func TestEnsureBootstrapAdminDoesNotPromoteExistingAccount(t *testing.T) {
+	db := newIsolatedTestDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `DELETE FROM users`); err != nil {
+		t.Fatalf("Failed to empty users: %v", err)
+	}
+	service := NewUserService(db, zap.NewNop())
+
+	existing := newTestUser(t, service)
+	if _, err := service.EnsureBootstrapAdmin(ctx, existing.Email, "$2a$12$bootstrap"); err == nil {
+		t.Error("Expected an error when the bootstrap email belongs to a regular account")
+	}
+
+	user, err := service.GetUserByID(ctx, existing.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+	if user.Role != models.RoleUser || user.PasswordHash != existing.PasswordHash {
+		t.Errorf("Expected the existing account to be left unchanged, got %+v", user)
+	}
+}
+
+func TestGetUserEmail(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewUserService(db, zap.NewNop())
+	user := newTestUser(t, service)
+
+	email, err := service.GetUserEmail(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserEmail() error = %v", err)
+	}
+	if email != user.Email {
+		t.Errorf("GetUserEmail() = %q, want %q", email, user.Email)
+	}
+
+	// Later lookups are served from the cache
+	if _, err := db.Exec(ctx, `UPDATE users SET email = $2 WHERE id = $1`, user.ID, "changed-"+user.Email); err != nil {
+		t.Fatalf("Failed to change email: %v", err)
+	}
+	if email, err := service.GetUserEmail(ctx, user.ID); err != nil || email != user.Email {
+		t.Errorf("GetUserEmail() = %q, %v; want the cached %q", email, err, user.Email)
+	}
+
+	if _, err := service.GetUserEmail(ctx, uuid.New()); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUserEmail() for an unknown user error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	service := NewUserService(nil, zap.NewNop())
+	if got := service.normalizeEmail("Mixed.Case@Example.COM"); got != "mixed.case@example.com" {
+		t.Errorf("normalizeEmail() = %q, want it lowercased", got)
+	}
+
+	service.SetPreserveEmailCase(true)
+	if got := service.normalizeEmail("Mixed.Case@Example.COM"); got != "Mixed.Case@Example.COM" {
+		t.Errorf("normalizeEmail() preserving case = %q, want it unchanged", got)
+	}
+}
+
+func TestEmailsAreCaseInsensitive(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	service := NewUserService(db, zap.NewNop())
+
+	email := fmt.Sprintf("Case-%s@Example.com", uuid.New())
+	user, err := service.CreateUser(ctx, email, "$2a$12$test")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	if user.Email != strings.ToLower(email) {
+		t.Errorf("Stored email = %q, want it lowercased", user.Email)
+	}
+
+	upper := strings.ToUpper(email)
+	if exists, err := service.EmailExists(ctx, upper); err != nil || !exists {
+		t.Errorf("EmailExists(%q) = %v, %v; want true", upper, exists, err)
+	}
+	if found, err := service.GetUserByEmail(ctx, upper); err != nil || found.ID != user.ID {
+		t.Errorf("GetUserByEmail(%q) = %+v, %v; want the user", upper, found, err)
+	}
+
+	// The same address in another case is a duplicate, even when stored as entered
+	service.SetPreserveEmailCase(true)
+	if _, err := service.CreateUser(ctx, upper, "$2a$12$test"); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("CreateUser() with a differently-cased duplicate error = %v, want ErrEmailTaken", err)
+	}
+
+	preserved := fmt.Sprintf("Preserved-%s@Example.com", uuid.New())
+	other, err := service.CreateUser(ctx, preserved, "$2a$12$test")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, other.ID)
+	})
+	if other.Email != preserved {
+		t.Errorf("Stored email = %q, want the original casing %q", other.Email, preserved)
+	}
+	if found, err := service.GetUserByEmail(ctx, strings.ToLower(preserved)); err != nil || found.ID != other.ID {
+		t.Errorf("GetUserByEmail() in lowercase = %+v, %v; want the user", found, err)
+	}
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Events delivered to the operator webhook
+const (
+	EventServerKeyChanged = "server.key_changed"
+)
+
+// webhookTimeout bounds a single webhook delivery
+const webhookTimeout = 10 * time.Second
+
+// WebhookNotifier posts operator events to a configured URL
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+	logger *zap.Logger
+}
+
+// NewWebhookNotifier creates a new webhook notifier; an empty URL disables delivery
+func NewWebhookNotifier(url string, logger *zap.Logger) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+	}
+}
+
+// Notify posts an event as {"event", "data", "timestamp"} JSON. It does nothing when no URL is configured.
+func (n *WebhookNotifier) Notify(ctx context.Context, event string, data interface{}) error {
+	if n.url == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"event":     event,
+		"data":      data,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to deliver webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	n.logger.Info("Webhook delivered", zap.String("event", event))
+	return nil
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestWebhookNotifierNotify(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Invalid webhook body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(server.URL, zap.NewNop())
+	if err := notifier.Notify(context.Background(), EventServerKeyChanged, map[string]string{"server_id": "abc"}); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	if received["event"] != EventServerKeyChanged {
+		t.Errorf("Expected event %q, got %v", EventServerKeyChanged, received["event"])
+	}
+	if data, _ := received["data"].(map[string]interface{}); data["server_id"] != "abc" {
+		t.Errorf("Expected event data to be delivered, got %v", received["data"])
+	}
+}
+
+func TestWebhookNotifierErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	if err := NewWebhookNotifier(server.URL, zap.NewNop()).Notify(context.Background(), EventServerKeyChanged, nil); err == nil {
+		t.Error("Expected error for non-2xx response")
+	}
+
+	// Without a URL, delivery is disabled
+	if err := NewWebhookNotifier("", zap.NewNop()).Notify(context.Background(), EventServerKeyChanged, nil); err != nil {
+		t.Errorf("Expected disabled notifier to succeed, got %v", err)
+	}
+}
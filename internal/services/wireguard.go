@@ -4,26 +4,243 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/denzelpenzel/vpn/internal/models"
+	"github.com/denzelpenzel/vpn/internal/qrcode"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/sync/semaphore"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+const (
+	// DefaultClientAllowedIPs routes all client traffic through the tunnel
+	DefaultClientAllowedIPs = "0.0.0.0/0, ::/0"
+
+	// DefaultClientAllowedIPsV6 routes all client traffic through the tunnel on an IPv6-only server
+	DefaultClientAllowedIPsV6 = "::/0"
+
+	// DefaultClientDNS is the resolver list written to client configs
+	DefaultClientDNS = "1.1.1.1, 8.8.8.8"
+
+	// DefaultClientDNSV6 is the resolver list written to client configs on an IPv6-only server
+	DefaultClientDNSV6 = "2606:4700:4700::1111, 2001:4860:4860::8888"
+
+	// ClientPrivateKeyPlaceholder marks where the client must insert its own private key
+	ClientPrivateKeyPlaceholder = "[CLIENT_PRIVATE_KEY]"
+
+	// DefaultConfigQRSize is the side, in pixels, of config QR codes when the client asks for none
+	DefaultConfigQRSize = 512
+
+	// MaxConfigQRSize is the largest config QR code side, in pixels, a client may ask for
+	MaxConfigQRSize = 2048
+
+	// DefaultPersistentKeepalive is the keepalive used for keys without an override
+	DefaultPersistentKeepalive = 25 * time.Second
+
+	// MaxPersistentKeepalive is the largest keepalive, in seconds, a client may request
+	MaxPersistentKeepalive = 120
+
+	// ConnectedHandshakeWindow is how recent a peer's last handshake must be for it to count as
+	// connected; WireGuard re-handshakes every two minutes while traffic flows
+	ConnectedHandshakeWindow = 3 * time.Minute
+
+	// MaxPeerStatusKeys is the most public keys PeerStatuses accepts in one call
+	MaxPeerStatusKeys = 500
+
+	// peerCacheTTL bounds how stale the device peer list served by CachedPeers may be
+	peerCacheTTL = 5 * time.Second
+)
+
+var (
+	// ErrPeerNotFound is returned when a public key is not programmed on the WireGuard device
+	ErrPeerNotFound = errors.New("peer not found on WireGuard device")
+
+	// ErrUserKeyNotFound is returned when a user has no active key on a server
+	ErrUserKeyNotFound = errors.New("user key not found")
+
+	// ErrConflict is returned when a requested address is already allocated to another key
+	ErrConflict = errors.New("address already allocated")
+
+	// ErrProvisioningCooldown is matched by a CooldownError
+	ErrProvisioningCooldown = errors.New("provisioning cooldown in effect")
+
+	// ErrInvalidStaticIP is returned when a requested static address is malformed or outside the server subnet
+	ErrInvalidStaticIP = errors.New("invalid static IP")
+
+	// ErrDeviceBusy is returned when a device configuration cannot start within the concurrency wait
+	ErrDeviceBusy = errors.New("WireGuard device busy")
+
+	// ErrServerNotFound is returned when reconciling a server that does not exist
+	ErrServerNotFound = errors.New("server not found")
+
+	// ErrReconcileInProgress is returned when a full reconciliation is already running on the device
+	ErrReconcileInProgress = errors.New("reconciliation already in progress")
+
+	// ErrDeviceNotReady is matched by a DeviceNotReadyError
+	ErrDeviceNotReady = errors.New("WireGuard device not ready")
+
+	// ErrKeyReused is returned when a user submits a public key they previously had revoked on the server
+	ErrKeyReused = errors.New("public key was previously revoked")
+
+	// ErrUnknownDevice is returned for an interface that is not the WireGuard device this service manages
+	ErrUnknownDevice = errors.New("unknown WireGuard device")
+
+	// ErrServerKeyMismatch is returned when an imported private key does not derive the server's public key
+	ErrServerKeyMismatch = errors.New("private key does not match the server's public key")
+
+	// ErrConfigQRTooSmall is returned when a config QR code cannot fit in the size asked for
+	ErrConfigQRTooSmall = errors.New("QR code size too small for the config")
+)
+
+// devicePollInterval is how often WaitForDevice queries a device that is not ready yet
+const devicePollInterval = 500 * time.Millisecond
+
+// DeviceNotReadyError is returned when the WireGuard device could not be queried within the wait
+type DeviceNotReadyError struct {
+	Waited time.Duration
+	Err    error // the last failure querying the device
+}
+
+func (e *DeviceNotReadyError) Error() string {
+	return fmt.Sprintf("%s after %s: %v", ErrDeviceNotReady, e.Waited.Round(time.Millisecond), e.Err)
+}
+
+func (e *DeviceNotReadyError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a DeviceNotReadyError match ErrDeviceNotReady
+func (e *DeviceNotReadyError) Is(target error) bool {
+	return target == ErrDeviceNotReady
+}
+
+// CooldownError is returned when a user changes their key on a server again before the provisioning
+// cooldown has elapsed
+type CooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrProvisioningCooldown, e.RetryAfter.Round(time.Second))
+}
+
+// Is makes a CooldownError match ErrProvisioningCooldown
+func (e *CooldownError) Is(target error) bool {
+	return target == ErrProvisioningCooldown
+}
+
+// ConfigOptions controls how a client configuration is generated
+type ConfigOptions struct {
+	PrivateKey      string                     // client private key; the placeholder is used when empty
+	AllowedNetworks []string                   // allowed networks policy; full tunnel when empty
+	LeakProtection  *models.LeakProtection     // optional DNS leak protection directives
+	DNSSearch       string                     // search domains overriding the server's; the server's apply when empty
+	ClientAddr      netip.Addr                 // requesting client's address, used to pick the server endpoint
+	Obfuscation     *models.ObfuscationProfile // AmneziaWG parameters; standard WireGuard when nil
+	DoHHint         bool                       // add the server's DNS-over-HTTPS template as a comment
+}
+
+// WGClient is the subset of the wgctrl client used to manage the WireGuard device
+type WGClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
 // WireguardService handles WireGuard-related operations
 type WireguardService struct {
 	db         *pgxpool.Pool
 	logger     *zap.Logger
-	wgClient   *wgctrl.Client
+	wgClient   WGClient
 	deviceName string // WireGuard interface name (e.g., "wg0")
+	closeOnce  sync.Once
+	stats      *ProvisioningStats
+	traffic    *TrafficTotals
+
+	// rotationGrace is how long a rotated-out peer stays programmed; zero removes it immediately
+	rotationGrace time.Duration
+
+	// splitTunnelGateway adds the server's gateway address and the DNS servers to split-tunnel configs
+	splitTunnelGateway bool
+
+	// firewall enforces users' allowed networks on the traffic their peers send; nil leaves the
+	// policies to the routes in generated configs
+	firewall PeerFirewall
+
+	// keepalive applies to keys without their own persistent_keepalive override
+	keepalive time.Duration
+
+	// provisionCooldown is the least time between changes to one user's key on a server; zero disables it
+	provisionCooldown time.Duration
+
+	// rejectReusedKeys refuses keys the user previously had revoked on the same server
+	rejectReusedKeys bool
+
+	// keyPepper keys the public key hashes stored for lookups; nil stores and matches raw keys
+	keyPepper []byte
+
+	// provisionLimit bounds how fast each server provisions peers; nil leaves it unbounded
+	provisionLimit *provisionLimiter
+
+	// rateLimitObserver is told about provisioning rate limit and cooldown decisions; nil disables it
+	rateLimitObserver RateLimitObserver
+
+	// geoLocator locates clients to pick the nearest server endpoint; nil always uses the primary one
+	geoLocator GeoLocator
+
+	// idleTimeout is how long a peer may go without a handshake before it is taken off the device; zero disables it
+	idleTimeout time.Duration
+
+	// connectionLimit is how many of a user's peers may be connected at once when the user has no
+	// limit of their own; zero leaves them unlimited
+	connectionLimit int
+
+	// deviceSlots bounds concurrent device configuration; nil leaves it unbounded
+	deviceSlots *semaphore.Weighted
+	// deviceWait is how long a configuration waits for a slot before failing with ErrDeviceBusy
+	deviceWait time.Duration
+
+	// reconcileMu keeps reconciliations of the device from overlapping
+	reconcileMu sync.Mutex
+
+	// localServerID is the server row backed by the device; operations that act on the whole device
+	// refuse every other server
+	localServerID uuid.UUID
+
+	// peerCache holds the last device peer list read by CachedPeers
+	peerCacheMu      sync.Mutex
+	peerCache        []wgtypes.Peer
+	peerCacheExpires time.Time
+
+	// devicePoll is how often WaitForDevice retries the device
+	devicePoll time.Duration
+
+	// probeDial opens self-test probes; nil dials from the device's tunnel address
+	probeDial probeDialer
+
+	// serverKeyFile is where an imported server private key is persisted so the device comes back
+	// up with it; empty only applies it to the running device
+	serverKeyFile string
 }
 
 // NewWireguardService creates a new WireGuard service
@@ -34,11 +251,77 @@ func NewWireguardService(logger *zap.Logger) (*WireguardService, error) {
 		return nil, err
 	}
 
+	return NewWireguardServiceWithClient(logger, wgClient), nil
+}
+
+// NewWireguardServiceWithClient creates a new WireGuard service using the given client
+func NewWireguardServiceWithClient(logger *zap.Logger, wgClient WGClient) *WireguardService {
 	return &WireguardService{
 		logger:     logger,
 		wgClient:   wgClient,
 		deviceName: "wg0", // Default WireGuard interface name
-	}, nil
+		stats:      NewProvisioningStats(),
+		traffic:    NewTrafficTotals(),
+		keepalive:  DefaultPersistentKeepalive,
+		devicePoll: devicePollInterval,
+
+		splitTunnelGateway: true,
+	}
+}
+
+// WaitForDevice polls until the WireGuard device can be queried, for hosts where the interface
+// comes up after the API starts. It gives up with a DeviceNotReadyError once timeout has elapsed,
+// leaving the caller to decide whether to start without the device; a zero timeout checks once.
+func (s *WireguardService) WaitForDevice(ctx context.Context, timeout time.Duration) error {
+	if s.wgClient == nil {
+		return &DeviceNotReadyError{Err: fmt.Errorf("WireGuard client not available")}
+	}
+
+	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(s.devicePoll)
+	defer ticker.Stop()
+
+	for attempt := 1; ; attempt++ {
+		_, err := s.wgClient.Device(s.deviceName)
+		if err == nil {
+			if attempt > 1 {
+				s.logger.Info("WireGuard device ready",
+					zap.String("device", s.deviceName),
+					zap.Duration("waited", time.Since(start)))
+			}
+			return nil
+		}
+		if timeout <= 0 {
+			return &DeviceNotReadyError{Err: err}
+		}
+
+		s.logger.Debug("WireGuard device not ready, retrying",
+			zap.String("device", s.deviceName),
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return &DeviceNotReadyError{Waited: time.Since(start), Err: err}
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close releases the underlying WireGuard client; it is safe to call more than once
+func (s *WireguardService) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.wgClient == nil {
+			return
+		}
+		err = s.wgClient.Close()
+	})
+	return err
 }
 
 // SetDB sets the database connection (called after initialization)
@@ -46,6 +329,231 @@ func (s *WireguardService) SetDB(db *pgxpool.Pool) {
 	s.db = db
 }
 
+// SetPersistentKeepalive sets the keepalive used for keys that do not override it; zero disables it
+func (s *WireguardService) SetPersistentKeepalive(keepalive time.Duration) {
+	s.keepalive = keepalive
+}
+
+// keepaliveFor returns the effective keepalive for a key's optional override in seconds
+func (s *WireguardService) keepaliveFor(override *int) time.Duration {
+	if override != nil {
+		return time.Duration(*override) * time.Second
+	}
+	return s.keepalive
+}
+
+// ValidatePersistentKeepalive checks a client-requested keepalive override in seconds
+func ValidatePersistentKeepalive(keepalive *int) error {
+	if keepalive != nil && (*keepalive < 0 || *keepalive > MaxPersistentKeepalive) {
+		return fmt.Errorf("persistent keepalive must be between 0 and %d seconds", MaxPersistentKeepalive)
+	}
+	return nil
+}
+
+// SetProvisionCooldown sets the least time between changes to one user's key on a server
+func (s *WireguardService) SetProvisionCooldown(cooldown time.Duration) {
+	s.provisionCooldown = cooldown
+}
+
+// checkProvisionCooldown fails with a CooldownError when the user's key on a server was provisioned,
+// rotated or removed less than the cooldown ago. Requesting the already-active key again is not a
+// change and is always allowed.
+func (s *WireguardService) checkProvisionCooldown(ctx context.Context, userID, serverID uuid.UUID, publicKey string) error {
+	if s.provisionCooldown <= 0 {
+		return nil
+	}
+
+	var remaining float64
+	var unchanged bool
+	query := `
+		SELECT EXTRACT(EPOCH FROM (updated_at + make_interval(secs => $3) - NOW()))::float8,
+			is_active AND COALESCE(public_key_hash, public_key) = $4
+		FROM user_keys
+		WHERE user_id = $1 AND server_id = $2
+	`
+	err := s.db.QueryRow(ctx, query, userID, serverID, s.provisionCooldown.Seconds(), s.keyLookup(publicKey)).Scan(&remaining, &unchanged)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check provisioning cooldown: %w", err)
+	}
+
+	decision := RateLimitDecision{
+		Limiter: LimiterProvisionCooldown,
+		Key:     userID.String() + "/" + serverID.String(),
+		Allowed: unchanged || remaining <= 0,
+	}
+	if !decision.Allowed {
+		decision.RetryAfter = time.Duration(remaining * float64(time.Second))
+	}
+	s.observeRateLimit(ctx, decision)
+
+	if decision.Allowed {
+		return nil
+	}
+	return &CooldownError{RetryAfter: decision.RetryAfter}
+}
+
+// SetRejectReusedKeys makes AddUserKey refuse a public key the user previously had revoked on the
+// same server, so a key that may have been compromised has to be replaced rather than resubmitted
+func (s *WireguardService) SetRejectReusedKeys(reject bool) {
+	s.rejectReusedKeys = reject
+}
+
+// checkKeyReuse fails with ErrKeyReused when reused keys are rejected and publicKey is one the user
+// had deactivated on the server. Revoked keys are looked up in revoked_keys rather than user_keys,
+// whose row is overwritten by the user's next key; the user's current active key is not reuse.
+func (s *WireguardService) checkKeyReuse(ctx context.Context, userID, serverID uuid.UUID, publicKey string) error {
+	if !s.rejectReusedKeys {
+		return nil
+	}
+
+	var revoked bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM revoked_keys
+			WHERE user_id = $1 AND server_id = $2 AND key_lookup = $3
+		) AND NOT EXISTS (
+			SELECT 1 FROM user_keys
+			WHERE user_id = $1 AND server_id = $2 AND COALESCE(public_key_hash, public_key) = $3 AND is_active = true
+		)
+	`
+	if err := s.db.QueryRow(ctx, query, userID, serverID, s.keyLookup(publicKey)).Scan(&revoked); err != nil {
+		return fmt.Errorf("failed to check key reuse: %w", err)
+	}
+
+	if revoked {
+		return ErrKeyReused
+	}
+	return nil
+}
+
+// SetDeviceConcurrency limits how many device configurations run at once; further calls wait up to
+// wait for a slot. A limit of zero or less removes the bound. Reading the device is never limited.
+func (s *WireguardService) SetDeviceConcurrency(limit int, wait time.Duration) {
+	if limit <= 0 {
+		s.deviceSlots = nil
+		return
+	}
+	s.deviceSlots = semaphore.NewWeighted(int64(limit))
+	s.deviceWait = wait
+}
+
+// configureDevice applies a configuration to the device once a concurrency slot is free. It fails
+// with ErrDeviceBusy when no slot frees up within the configured wait.
+func (s *WireguardService) configureDevice(ctx context.Context, cfg wgtypes.Config) error {
+	if s.deviceSlots != nil {
+		waitCtx := ctx
+		if s.deviceWait > 0 {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(ctx, s.deviceWait)
+			defer cancel()
+		}
+
+		if err := s.deviceSlots.Acquire(waitCtx, 1); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("%w: no slot within %s", ErrDeviceBusy, s.deviceWait)
+		}
+		defer s.deviceSlots.Release(1)
+	}
+
+	return s.wgClient.ConfigureDevice(s.deviceName, cfg)
+}
+
+// SetServerProvisionRate limits each server to rate provisionings per second with bursts of up to
+// burst, independently of which clients ask; a rate of zero removes the limit
+func (s *WireguardService) SetServerProvisionRate(rate, burst int) {
+	if rate <= 0 {
+		s.provisionLimit = nil
+		return
+	}
+	s.provisionLimit = newProvisionLimiter(rate, burst)
+}
+
+// checkServerProvisionRate fails with a ServerRateLimitError when the server is provisioning peers
+// faster than its rate limit allows
+func (s *WireguardService) checkServerProvisionRate(ctx context.Context, serverID uuid.UUID) error {
+	if s.provisionLimit == nil {
+		return nil
+	}
+
+	wait, remaining := s.provisionLimit.take(serverID)
+	s.observeRateLimit(ctx, RateLimitDecision{
+		Limiter:    LimiterServerProvision,
+		Key:        serverID.String(),
+		Allowed:    wait == 0,
+		Remaining:  remaining,
+		RetryAfter: wait,
+	})
+	if wait > 0 {
+		return &ServerRateLimitError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// SetRateLimitObserver sets the observer told about every provisioning rate limit and cooldown decision
+func (s *WireguardService) SetRateLimitObserver(observer RateLimitObserver) {
+	s.rateLimitObserver = observer
+}
+
+// observeRateLimit reports a decision to the rate limit observer, if there is one
+func (s *WireguardService) observeRateLimit(ctx context.Context, decision RateLimitDecision) {
+	if s.rateLimitObserver != nil {
+		s.rateLimitObserver(ctx, decision)
+	}
+}
+
+// SetGeoLocator sets the locator used to pick a server endpoint for a client's address
+func (s *WireguardService) SetGeoLocator(locator GeoLocator) {
+	s.geoLocator = locator
+}
+
+// SetIdleTimeout sets how long a peer may go without a handshake before DisconnectIdlePeers takes it
+// off the device; zero disables idle disconnects
+func (s *WireguardService) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
+}
+
+// SetSplitTunnelGateway sets whether split-tunnel configs also route the server's gateway address and
+// the DNS servers through the tunnel, so internal name resolution keeps working. It is on by default.
+func (s *WireguardService) SetSplitTunnelGateway(include bool) {
+	s.splitTunnelGateway = include
+}
+
+// SetPeerFirewall sets the firewall that holds peers to their users' allowed networks. Policies are
+// applied before a peer is programmed, and a peer whose policy cannot be applied is not programmed.
+func (s *WireguardService) SetPeerFirewall(firewall PeerFirewall) {
+	s.firewall = firewall
+}
+
+// SetRotationGrace sets how long RotateUserKey leaves the old peer programmed, on its own address, before
+// RemoveExpiredPeers removes it; zero (the default) removes it immediately
+func (s *WireguardService) SetRotationGrace(grace time.Duration) {
+	s.rotationGrace = grace
+}
+
+// SetLocalServerID sets the server whose peers the device carries
+func (s *WireguardService) SetLocalServerID(serverID uuid.UUID) {
+	s.localServerID = serverID
+}
+
+// checkLocalServer fails with ErrServerNotFound for any server other than the one the device carries,
+// so another server's settings and keys are never applied to it
+func (s *WireguardService) checkLocalServer(serverID uuid.UUID) error {
+	if serverID == uuid.Nil || serverID != s.localServerID {
+		return ErrServerNotFound
+	}
+	return nil
+}
+
+// SetServerKeyFile sets where ImportServerKey persists the device's private key
+func (s *WireguardService) SetServerKeyFile(path string) {
+	s.serverKeyFile = path
+}
+
 // GenerateKeyPair generates a WireGuard key pair
 func (s *WireguardService) GenerateKeyPair() (privateKey, publicKey string, err error) {
 	// Generate private key (32 random bytes)
@@ -87,55 +595,260 @@ func (s *WireguardService) ValidatePublicKey(publicKey string) error {
 	return nil
 }
 
-// AddUserKey adds a user's public key to a server and authorizes them in WireGuard
+// PublicKeyFromPrivate validates a base64 WireGuard private key and returns the public key it derives
+func PublicKeyFromPrivate(privateKey string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 encoding: %w", err)
+	}
+	if len(decoded) != wgtypes.KeyLen {
+		return "", fmt.Errorf("invalid key length: expected %d bytes, got %d", wgtypes.KeyLen, len(decoded))
+	}
+
+	return wgtypes.Key(decoded).PublicKey().String(), nil
+}
+
+// ImportServerKey adopts an existing private key for the local server, such as one migrated from
+// another host. The key must derive the public key already stored for the server, so clients keep
+// their configs. It is written to the server key file, when one is set, before it is applied to the
+// device, so a failed write leaves the device as it was and the file never lags behind the device.
+// It fails with ErrServerNotFound for an unknown server or one other than the local server, and
+// with ErrServerKeyMismatch when the key belongs to another identity.
+func (s *WireguardService) ImportServerKey(ctx context.Context, serverID uuid.UUID, privateKey string) error {
+	if err := s.checkLocalServer(serverID); err != nil {
+		return err
+	}
+
+	derivedKey, err := PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+
+	var storedKey string
+	err = s.db.QueryRow(ctx, `SELECT COALESCE(public_key, '') FROM servers WHERE id = $1`, serverID).Scan(&storedKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrServerNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get server public key: %w", err)
+	}
+	if storedKey != derivedKey {
+		return ErrServerKeyMismatch
+	}
+
+	key, err := wgtypes.ParseKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+
+	// The file is written first: it then holds the key matching the stored public key even if the
+	// device cannot take it, and the device picks it up on the next start
+	if s.serverKeyFile != "" {
+		if err := writeKeyFile(s.serverKeyFile, privateKey); err != nil {
+			return fmt.Errorf("failed to store private key: %w", err)
+		}
+	}
+
+	if err := s.configureDevice(ctx, wgtypes.Config{PrivateKey: &key}); err != nil {
+		return fmt.Errorf("failed to apply private key to device: %w", err)
+	}
+
+	s.logger.Info("Imported server private key",
+		zap.String("server_id", serverID.String()),
+		zap.String("public_key", derivedKey))
+
+	return nil
+}
+
+// writeKeyFile replaces a key file readable only by its owner, through a rename so a crash never
+// leaves it truncated
+func writeKeyFile(path, key string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(key + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// AddUserKey adds a user's public key to a server and authorizes them in WireGuard. It fails with a
+// CooldownError when the user's key on the server changed within the provisioning cooldown, with
+// a ServerRateLimitError when the server is provisioning faster than its rate limit, with
+// ErrKeyReused when reused keys are rejected and the key was previously revoked, and with a
+// MaintenanceError while the server is in a maintenance window.
 func (s *WireguardService) AddUserKey(ctx context.Context, userID, serverID uuid.UUID, publicKey string) (*models.UserKey, error) {
+	return s.AddUserKeyWithKeepalive(ctx, userID, serverID, publicKey, nil)
+}
+
+// AddUserKeyWithKeepalive is AddUserKey with a keepalive override in seconds for the key; nil uses the default
+func (s *WireguardService) AddUserKeyWithKeepalive(ctx context.Context, userID, serverID uuid.UUID, publicKey string, keepalive *int) (*models.UserKey, error) {
+	if err := s.checkProvisionCooldown(ctx, userID, serverID, publicKey); err != nil {
+		return nil, err
+	}
+	if err := s.checkKeyReuse(ctx, userID, serverID, publicKey); err != nil {
+		return nil, err
+	}
+	// Maintenance goes first so refused requests do not spend the server's rate limit tokens
+	if err := s.checkMaintenance(ctx, serverID); err != nil {
+		return nil, err
+	}
+	if err := s.checkServerProvisionRate(ctx, serverID); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	userKey, err := s.addUserKey(ctx, userID, serverID, publicKey, "", keepalive)
+	s.stats.Record(serverID, time.Since(start), err)
+
+	return userKey, err
+}
+
+// AddUserKeyWithStaticIP is AddUserKeyWithKeepalive with an admin-chosen address instead of an
+// auto-allocated one. The address must be a single host within the server subnet; it fails with
+// ErrInvalidStaticIP otherwise and with ErrConflict when another key already holds it.
+func (s *WireguardService) AddUserKeyWithStaticIP(ctx context.Context, userID, serverID uuid.UUID, publicKey, allowedIPs string, keepalive *int) (*models.UserKey, error) {
+	// Maintenance goes first so refused requests do not spend the server's rate limit tokens
+	if err := s.checkMaintenance(ctx, serverID); err != nil {
+		return nil, err
+	}
+	if err := s.checkServerProvisionRate(ctx, serverID); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	userKey, err := s.addUserKey(ctx, userID, serverID, publicKey, allowedIPs, keepalive)
+	s.stats.Record(serverID, time.Since(start), err)
+
+	return userKey, err
+}
+
+// ProvisioningStats returns per-server provisioning counters and latencies
+func (s *WireguardService) ProvisioningStats() []*models.ProvisioningStats {
+	return s.stats.Snapshot()
+}
+
+// TrafficTotals returns the persisted traffic totals of every server usage has been collected for
+// since startup, sorted by server ID
+func (s *WireguardService) TrafficTotals() []*models.ServerTraffic {
+	return s.traffic.Snapshot()
+}
+
+// addUserKey performs the provisioning for AddUserKey; an empty staticIP auto-allocates the address
+func (s *WireguardService) addUserKey(ctx context.Context, userID, serverID uuid.UUID, publicKey, staticIP string, keepalive *int) (*models.UserKey, error) {
 	// Validate public key
 	if err := s.ValidatePublicKey(publicKey); err != nil {
 		s.logger.Warn("Invalid public key provided", zap.Error(err))
 		return nil, fmt.Errorf("invalid public key: %w", err)
 	}
 
-	// Generate IP address for user (simple allocation)
-	allowedIPs, err := s.allocateUserIP(ctx, serverID)
+	if err := ValidatePersistentKeepalive(keepalive); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to allocate IP: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	if err := s.authorizeUserInWireGuard(publicKey, allowedIPs); err != nil {
-		s.logger.Error("Failed to authorize user in WireGuard engine",
-			zap.Error(err),
-			zap.String("user_id", userID.String()),
-			zap.String("public_key", publicKey))
-		return nil, fmt.Errorf("failed to authorize user in WireGuard: %w", err)
+	if err := lockServerAddresses(ctx, tx, serverID); err != nil {
+		return nil, err
+	}
+
+	if err := checkUserActive(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+
+	var allowedIPs string
+	if staticIP != "" {
+		allowedIPs, err = s.reserveStaticIP(ctx, tx, userID, serverID, staticIP)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		allowedIPs, err = s.allocateUserIP(ctx, tx, serverID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate IP: %w", err)
+		}
+	}
+
+	allowedIPs, err = NormalizeAllowedIPs(allowedIPs)
+	if err != nil {
+		return nil, err
 	}
 
 	userKey := &models.UserKey{}
 	query := `
-		INSERT INTO user_keys (user_id, server_id, public_key, allowed_ips)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO user_keys (user_id, server_id, public_key, allowed_ips, persistent_keepalive, public_key_hash)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		ON CONFLICT (user_id, server_id) 
 		DO UPDATE SET 
 			public_key = EXCLUDED.public_key,
+			public_key_hash = EXCLUDED.public_key_hash,
 			allowed_ips = EXCLUDED.allowed_ips,
+			persistent_keepalive = EXCLUDED.persistent_keepalive,
 			updated_at = NOW(),
-			is_active = true
-		RETURNING id, user_id, server_id, public_key, allowed_ips, created_at, updated_at, is_active
+			is_active = true,
+			idle_removed_at = NULL
+		RETURNING id, user_id, server_id, public_key, allowed_ips, persistent_keepalive, created_at, updated_at, is_active, idle_removed_at
 	`
 
-	err = s.db.QueryRow(ctx, query, userID, serverID, publicKey, allowedIPs).Scan(
+	err = tx.QueryRow(ctx, query, userID, serverID, publicKey, allowedIPs, keepalive, s.keyHash(publicKey)).Scan(
 		&userKey.ID,
 		&userKey.UserID,
 		&userKey.ServerID,
 		&userKey.PublicKey,
 		&userKey.AllowedIPs,
+		&userKey.PersistentKeepalive,
 		&userKey.CreatedAt,
 		&userKey.UpdatedAt,
 		&userKey.IsActive,
+		&userKey.IdleRemovedAt,
 	)
 
 	if err != nil {
-		// If database insert fails, remove the peer from WireGuard
-		s.removeUserFromWireGuard(publicKey)
+		// The unique active address index backs up the lock, e.g. against addresses assigned by hand
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, fmt.Errorf("%w: %s is already allocated", ErrConflict, allowedIPs)
+		}
+		s.logger.Error("Failed to add user key to database", zap.Error(err))
+		return nil, fmt.Errorf("failed to add user key: %w", err)
+	}
+
+	eventQuery := `
+		INSERT INTO user_key_events (user_key_id, user_id, server_id, event, public_key_prefix, allowed_ips)
+		VALUES ($1, $2, $3, 'added', $4, $5)
+	`
+	if _, err := tx.Exec(ctx, eventQuery, userKey.ID, userID, serverID, keyPrefix(publicKey), allowedIPs); err != nil {
+		return nil, fmt.Errorf("failed to record key history: %w", err)
+	}
+
+	// The peer is programmed only once its address is held, since a peer sharing another's address
+	// would take over its traffic
+	if err := s.applyNetworkPolicy(ctx, tx, userID, allowedIPs); err != nil {
+		return nil, err
+	}
+
+	if err := s.authorizeUserInWireGuard(ctx, publicKey, allowedIPs, s.keepaliveFor(keepalive)); err != nil {
+		s.logger.Error("Failed to authorize user in WireGuard engine",
+			zap.Error(err),
+			zap.String("user_id", userID.String()),
+			zap.String("public_key", publicKey))
+		return nil, fmt.Errorf("failed to authorize user in WireGuard: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		// Keep the device consistent with the database
+		s.removeUserFromWireGuard(context.WithoutCancel(ctx), publicKey)
 		s.logger.Error("Failed to add user key to database", zap.Error(err))
 		return nil, fmt.Errorf("failed to add user key: %w", err)
 	}
@@ -149,11 +862,11 @@ func (s *WireguardService) AddUserKey(ctx context.Context, userID, serverID uuid
 	return userKey, nil
 }
 
-// GetUserKey retrieves a user's key for a specific server
+// GetUserKey retrieves a user's active key for a specific server, or ErrUserKeyNotFound when there is none
 func (s *WireguardService) GetUserKey(ctx context.Context, userID, serverID uuid.UUID) (*models.UserKey, error) {
 	userKey := &models.UserKey{}
 	query := `
-		SELECT id, user_id, server_id, public_key, allowed_ips, created_at, updated_at, is_active
+		SELECT id, user_id, server_id, public_key, allowed_ips, persistent_keepalive, created_at, updated_at, is_active, idle_removed_at
 		FROM user_keys
 		WHERE user_id = $1 AND server_id = $2 AND is_active = true
 	`
@@ -164,155 +877,2085 @@ func (s *WireguardService) GetUserKey(ctx context.Context, userID, serverID uuid
 		&userKey.ServerID,
 		&userKey.PublicKey,
 		&userKey.AllowedIPs,
+		&userKey.PersistentKeepalive,
 		&userKey.CreatedAt,
 		&userKey.UpdatedAt,
 		&userKey.IsActive,
+		&userKey.IdleRemovedAt,
 	)
 
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserKeyNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("user key not found")
+		return nil, fmt.Errorf("failed to get user key: %w", err)
 	}
 
 	return userKey, nil
 }
 
-// allocateUserIP allocates an IP address for a user on a server
-func (s *WireguardService) allocateUserIP(ctx context.Context, serverID uuid.UUID) (string, error) {
+// RemoveExpiredPeers removes rotated-out peers whose grace period has ended and returns how many were
+// removed. A key that has since become active again is left on the device. A removal is only
+// forgotten once the peer is off the device, so a failed one is retried on the next run.
+func (s *WireguardService) RemoveExpiredPeers(ctx context.Context) (int, error) {
+	query := `
+		SELECT public_key, remove_after, EXISTS (
+			SELECT 1 FROM user_keys k WHERE k.public_key = p.public_key AND k.is_active = true
+		)
+		FROM pending_peer_removals p
+		WHERE remove_after <= NOW()
+	`
+
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query expired peers: %w", err)
+	}
+	defer rows.Close()
+
+	type expiredPeer struct {
+		publicKey   string
+		removeAfter time.Time
+		active      bool
+	}
+	var expired []expiredPeer
+	for rows.Next() {
+		var peer expiredPeer
+		if err := rows.Scan(&peer.publicKey, &peer.removeAfter, &peer.active); err != nil {
+			return 0, fmt.Errorf("failed to scan expired peer: %w", err)
+		}
+		expired = append(expired, peer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate expired peers: %w", err)
+	}
+	rows.Close()
+
+	removed := 0
+	for _, peer := range expired {
+		if !peer.active {
+			if err := s.removeUserFromWireGuard(ctx, peer.publicKey); err != nil {
+				s.logger.Error("Failed to remove expired peer from WireGuard engine", zap.Error(err))
+				continue
+			}
+			removed++
+		}
+
+		// A removal rescheduled since it was read is left for its new time
+		deleteQuery := `DELETE FROM pending_peer_removals WHERE public_key = $1 AND remove_after = $2`
+		if _, err := s.db.Exec(ctx, deleteQuery, peer.publicKey, peer.removeAfter); err != nil {
+			s.logger.Error("Failed to clear expired peer removal", zap.Error(err))
+		}
+	}
+
+	return removed, nil
+}
+
+// DisconnectIdlePeers takes peers without a handshake within the idle timeout off the device and
+// returns how many were removed. Unlike revocation the keys stay active: they are marked idle and
+// the next config request for them re-adds the peer. A peer that has never completed a handshake
+// is judged by when its key was last provisioned.
+func (s *WireguardService) DisconnectIdlePeers(ctx context.Context, serverID uuid.UUID) (int, error) {
+	if s.idleTimeout <= 0 {
+		return 0, nil
+	}
+
+	devicePeers, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-s.idleTimeout)
+	var candidates []string
+	for _, peer := range devicePeers {
+		if peer.LastHandshakeTime.Before(cutoff) {
+			candidates = append(candidates, peer.PublicKey.String())
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	// Keys provisioned since the cutoff are left alone, which also skips keys re-added meanwhile
+	query := `
+		UPDATE user_keys SET idle_removed_at = NOW()
+		WHERE server_id = $1 AND public_key = ANY($2) AND is_active = true
+			AND idle_removed_at IS NULL AND updated_at < $3
+		RETURNING public_key
+	`
+	rows, err := s.db.Query(ctx, query, serverID, candidates, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark idle keys: %w", err)
+	}
+	defer rows.Close()
+
+	var peers []wgtypes.PeerConfig
+	for rows.Next() {
+		var publicKey string
+		if err := rows.Scan(&publicKey); err != nil {
+			return 0, fmt.Errorf("failed to scan idle key: %w", err)
+		}
+		key, err := wgtypes.ParseKey(publicKey)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate idle keys: %w", err)
+	}
+
+	if len(peers) == 0 {
+		return 0, nil
+	}
+
+	// A peer that stays on the device is harmless: restoring it on the next request is a no-op
+	removed, failures, err := s.configurePeers(ctx, peers)
+	for _, failure := range failures {
+		s.logger.Warn("Failed to remove idle peer",
+			zap.String("public_key", MaskPublicKey(failure.publicKey.String())),
+			zap.Error(failure.err))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to configure WireGuard device: %w", err)
+	}
+
+	s.logger.Info("Disconnected idle WireGuard peers",
+		zap.String("server_id", serverID.String()),
+		zap.Int("removed_count", removed))
+
+	return removed, nil
+}
+
+// restoreIdlePeer re-adds the peer of a key that was disconnected for being idle. Restoring counts
+// as provisioning, so the peer gets a full idle timeout to complete its first handshake.
+func (s *WireguardService) restoreIdlePeer(ctx context.Context, current *models.UserKey) (*models.UserKey, error) {
+	if err := s.applyNetworkPolicy(ctx, s.db, current.UserID, current.AllowedIPs); err != nil {
+		return nil, err
+	}
+
+	if err := s.authorizeUserInWireGuard(ctx, current.PublicKey, current.AllowedIPs, s.keepaliveFor(current.PersistentKeepalive)); err != nil {
+		return nil, fmt.Errorf("failed to authorize user in WireGuard: %w", err)
+	}
+
+	userKey := &models.UserKey{}
+	query := `
+		UPDATE user_keys SET idle_removed_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND is_active = true
+		RETURNING id, user_id, server_id, public_key, allowed_ips, persistent_keepalive, created_at, updated_at, is_active, idle_removed_at
+	`
+
+	err := s.db.QueryRow(ctx, query, current.ID).Scan(
+		&userKey.ID,
+		&userKey.UserID,
+		&userKey.ServerID,
+		&userKey.PublicKey,
+		&userKey.AllowedIPs,
+		&userKey.PersistentKeepalive,
+		&userKey.CreatedAt,
+		&userKey.UpdatedAt,
+		&userKey.IsActive,
+		&userKey.IdleRemovedAt,
+	)
+
+	if err != nil {
+		// The key was revoked meanwhile, so its peer must not stay on the device
+		s.removeUserFromWireGuard(context.WithoutCancel(ctx), current.PublicKey)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserKeyNotFound
+		}
+		return nil, fmt.Errorf("failed to restore idle key: %w", err)
+	}
+
+	s.logger.Info("Idle peer restored",
+		zap.String("user_id", userKey.UserID.String()),
+		zap.String("server_id", userKey.ServerID.String()))
+
+	return userKey, nil
+}
+
+// CleanupStaleKeys deactivates active keys that have not been used for maxAge and removes their
+// peers, optionally only on one server. A key's last use is the later of its persisted last
+// handshake and its current handshake on the device; a key that has never completed a handshake
+// is judged by when it was last provisioned.
+func (s *WireguardService) CleanupStaleKeys(ctx context.Context, maxAge time.Duration, serverID *uuid.UUID) (*models.KeyCleanupResponse, error) {
+	if maxAge <= 0 {
+		return nil, fmt.Errorf("max age must be positive")
+	}
+
+	// Handshakes since the last usage collection are only on the device, so it must be readable
+	peers, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard peers: %w", err)
+	}
+	handshakes := make(map[string]time.Time, len(peers))
+	for _, peer := range peers {
+		handshakes[peer.PublicKey.String()] = peer.LastHandshakeTime
+	}
+
+	query := `
+		SELECT id, public_key
+		FROM user_keys
+		WHERE is_active = true
+			AND ($2::uuid IS NULL OR server_id = $2)
+			AND COALESCE(last_used_at, updated_at) < NOW() - make_interval(secs => $1)
+	`
+	rows, err := s.db.Query(ctx, query, maxAge.Seconds(), serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stale keys: %w", err)
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var staleIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		var publicKey string
+		if err := rows.Scan(&id, &publicKey); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan stale key: %w", err)
+		}
+		if handshake, ok := handshakes[publicKey]; ok && handshake.After(cutoff) {
+			continue
+		}
+		staleIDs = append(staleIDs, id)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate stale keys: %w", err)
+	}
+
+	result := &models.KeyCleanupResponse{}
+	if len(staleIDs) == 0 {
+		return result, nil
+	}
+
+	// Re-check staleness so a key provisioned again since the query is kept
+	// Hashed keys drop their raw value, so the peer to remove is taken from before the update
+	deactivateQuery := `
+		WITH previous AS (
+			SELECT id, public_key FROM user_keys
+			WHERE id = ANY($1) AND is_active = true
+			FOR UPDATE
+		), deactivated AS (
+			UPDATE user_keys k SET is_active = false, updated_at = NOW(),
+				public_key = CASE WHEN k.public_key_hash IS NULL THEN k.public_key END
+			FROM previous
+			WHERE k.id = previous.id
+				AND COALESCE(k.last_used_at, k.updated_at) < NOW() - make_interval(secs => $2)
+			RETURNING k.id, k.user_id, k.server_id, k.allowed_ips, COALESCE(k.public_key_hash, k.public_key) AS key_lookup, previous.public_key
+		), recorded AS (
+			INSERT INTO revoked_keys (user_id, server_id, key_lookup)
+			SELECT user_id, server_id, key_lookup FROM deactivated WHERE key_lookup IS NOT NULL
+			ON CONFLICT (user_id, server_id, key_lookup) DO UPDATE SET revoked_at = NOW()
+		), history AS (
+			INSERT INTO user_key_events (user_key_id, user_id, server_id, event, public_key_prefix, allowed_ips)
+			SELECT id, user_id, server_id, 'revoked', COALESCE(LEFT(public_key, 8), ''), allowed_ips FROM deactivated
+		)
+		SELECT public_key FROM deactivated
+	`
+	rows, err = s.db.Query(ctx, deactivateQuery, staleIDs, maxAge.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to deactivate stale keys: %w", err)
+	}
+
+	var removals []wgtypes.PeerConfig
+	for rows.Next() {
+		var publicKey string
+		if err := rows.Scan(&publicKey); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan deactivated key: %w", err)
+		}
+		result.Deactivated++
+
+		key, err := wgtypes.ParseKey(publicKey)
+		if err != nil {
+			s.logger.Warn("Deactivated key has an invalid public key", zap.Error(err))
+			continue
+		}
+		removals = append(removals, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate deactivated keys: %w", err)
+	}
+
+	// The keys are already inactive, so a peer that could not be removed is only logged
+	if len(removals) > 0 {
+		applied, failures, err := s.configurePeers(ctx, removals)
+		for _, failure := range failures {
+			s.logger.Warn("Failed to remove stale peer",
+				zap.String("public_key", MaskPublicKey(failure.publicKey.String())),
+				zap.Error(failure.err))
+		}
+		if err != nil {
+			s.logger.Error("Failed to remove stale peers from WireGuard engine", zap.Error(err))
+		}
+		result.PeersRemoved = applied
+	}
+
+	s.logger.Info("Stale keys cleaned up",
+		zap.Duration("max_age", maxAge),
+		zap.Int("deactivated", result.Deactivated),
+		zap.Int("peers_removed", result.PeersRemoved))
+
+	return result, nil
+}
+
+// ListUserKeys returns a user's active keys on every server
+func (s *WireguardService) ListUserKeys(ctx context.Context, userID uuid.UUID) ([]*models.UserKey, error) {
+	query := `
+		SELECT id, user_id, server_id, public_key, allowed_ips, persistent_keepalive, created_at, updated_at, is_active, idle_removed_at
+		FROM user_keys
+		WHERE user_id = $1 AND is_active = true
+		ORDER BY created_at
+	`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*models.UserKey
+	for rows.Next() {
+		userKey := &models.UserKey{}
+		if err := rows.Scan(
+			&userKey.ID,
+			&userKey.UserID,
+			&userKey.ServerID,
+			&userKey.PublicKey,
+			&userKey.AllowedIPs,
+			&userKey.PersistentKeepalive,
+			&userKey.CreatedAt,
+			&userKey.UpdatedAt,
+			&userKey.IsActive,
+			&userKey.IdleRemovedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan user key: %w", err)
+		}
+		keys = append(keys, userKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate user keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// ListUserKeyHistory returns every addition, rotation and revocation of a user's keys, newest first,
+// from the append-only key history, with public keys masked; events recorded without the key have an
+// empty public key. When serverID is non-nil only events on that server are returned.
+func (s *WireguardService) ListUserKeyHistory(ctx context.Context, userID uuid.UUID, serverID *uuid.UUID) ([]*models.KeyHistoryEntry, error) {
+	query := `
+		SELECT e.id, e.user_key_id, e.server_id, s.name, e.event, e.public_key_prefix, e.allowed_ips, e.created_at
+		FROM user_key_events e
+		JOIN servers s ON s.id = e.server_id
+		WHERE e.user_id = $1 AND ($2::uuid IS NULL OR e.server_id = $2)
+		ORDER BY e.created_at DESC, e.id
+	`
+
+	rows, err := s.db.Query(ctx, query, userID, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query key history: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*models.KeyHistoryEntry{}
+	for rows.Next() {
+		entry := &models.KeyHistoryEntry{}
+		var prefix string
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.KeyID,
+			&entry.ServerID,
+			&entry.ServerName,
+			&entry.Event,
+			&prefix,
+			&entry.AllowedIPs,
+			&entry.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan key history: %w", err)
+		}
+		if prefix != "" {
+			entry.PublicKey = prefix + "..."
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate key history: %w", err)
+	}
+
+	return entries, nil
+}
+
+// maskedKeyPrefix is how many characters of a public key MaskPublicKey keeps
+const maskedKeyPrefix = 8
+
+// keyPrefix returns the part of a public key MaskPublicKey keeps, as stored in the key history
+func keyPrefix(publicKey string) string {
+	return publicKey[:min(len(publicKey), maskedKeyPrefix)]
+}
+
+// MaskPublicKey shortens a public key to a prefix that identifies it to its owner without
+// reproducing it
+func MaskPublicKey(publicKey string) string {
+	if len(publicKey) <= maskedKeyPrefix {
+		return strings.Repeat("*", len(publicKey))
+	}
+	return publicKey[:maskedKeyPrefix] + "..."
+}
+
+// GetUserKeyByPublicKey retrieves the user's active key with the given public key; keys of other users
+// are reported as ErrUserKeyNotFound
+func (s *WireguardService) GetUserKeyByPublicKey(ctx context.Context, userID uuid.UUID, publicKey string) (*models.UserKey, error) {
+	userKey := &models.UserKey{}
+	query := `
+		SELECT id, user_id, server_id, public_key, allowed_ips, persistent_keepalive, created_at, updated_at, is_active, idle_removed_at
+		FROM user_keys
+		WHERE user_id = $1 AND COALESCE(public_key_hash, public_key) = $2 AND is_active = true
+	`
+
+	err := s.db.QueryRow(ctx, query, userID, s.keyLookup(publicKey)).Scan(
+		&userKey.ID,
+		&userKey.UserID,
+		&userKey.ServerID,
+		&userKey.PublicKey,
+		&userKey.AllowedIPs,
+		&userKey.PersistentKeepalive,
+		&userKey.CreatedAt,
+		&userKey.UpdatedAt,
+		&userKey.IsActive,
+		&userKey.IdleRemovedAt,
+	)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user key: %w", err)
+	}
+
+	return userKey, nil
+}
+
+// RotateUserKey replaces the public key of a user's active key on a server. The new peer is programmed
+// before the old one is removed so the client can switch over. Without a grace period the new key takes
+// over the allocated IP and the old peer is removed at once. With one, WireGuard can route an address to
+// a single peer only, so the new key gets a fresh address and the old peer keeps its own, working until
+// RemoveExpiredPeers removes it; if the pool has no address free, the IP is handed over at once instead.
+// Like AddUserKey it fails with ErrKeyReused, a MaintenanceError or a ServerRateLimitError.
+func (s *WireguardService) RotateUserKey(ctx context.Context, userID, serverID uuid.UUID, newPublicKey string) (*models.UserKey, error) {
+	if err := s.ValidatePublicKey(newPublicKey); err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	current, err := s.GetUserKey(ctx, userID, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	if current.PublicKey == newPublicKey {
+		if current.IdleRemovedAt != nil {
+			return s.restoreIdlePeer(ctx, current)
+		}
+		return current, nil
+	}
+
+	// A new key is provisioning like any other, so it gets the same checks as AddUserKey
+	if err := s.checkProvisionCooldown(ctx, userID, serverID, newPublicKey); err != nil {
+		return nil, err
+	}
+	if err := s.checkKeyReuse(ctx, userID, serverID, newPublicKey); err != nil {
+		return nil, err
+	}
+	if err := s.checkMaintenance(ctx, serverID); err != nil {
+		return nil, err
+	}
+	if err := s.checkServerProvisionRate(ctx, serverID); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockServerAddresses(ctx, tx, serverID); err != nil {
+		return nil, err
+	}
+
+	// An idle-removed peer is off the device already, so there is nothing to keep working
+	allowedIPs := current.AllowedIPs
+	graceful := s.rotationGrace > 0 && current.IdleRemovedAt == nil
+	if graceful {
+		fresh, err := s.allocateUserIP(ctx, tx, serverID)
+		switch {
+		case errors.Is(err, ErrAddressPoolExhausted):
+			s.logger.Warn("No address free for the rotation grace period, handing the IP over now",
+				zap.String("server_id", serverID.String()))
+			graceful = false
+		case err != nil:
+			return nil, fmt.Errorf("failed to allocate IP: %w", err)
+		default:
+			if allowedIPs, err = NormalizeAllowedIPs(fresh); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	userKey := &models.UserKey{}
+	query := `
+		WITH rotated AS (
+			UPDATE user_keys SET public_key = $1, public_key_hash = $3, allowed_ips = $5, updated_at = NOW(), idle_removed_at = NULL
+			WHERE id = $2 AND is_active = true
+			RETURNING id, user_id, server_id, public_key, allowed_ips, persistent_keepalive, created_at, updated_at, is_active, idle_removed_at
+		), recorded AS (
+			INSERT INTO user_key_events (user_key_id, user_id, server_id, event, public_key_prefix, allowed_ips)
+			SELECT id, user_id, server_id, 'rotated', $4, allowed_ips FROM rotated
+		)
+		SELECT id, user_id, server_id, public_key, allowed_ips, persistent_keepalive, created_at, updated_at, is_active, idle_removed_at
+		FROM rotated
+	`
+
+	err = tx.QueryRow(ctx, query, newPublicKey, current.ID, s.keyHash(newPublicKey), keyPrefix(newPublicKey), allowedIPs).Scan(
+		&userKey.ID,
+		&userKey.UserID,
+		&userKey.ServerID,
+		&userKey.PublicKey,
+		&userKey.AllowedIPs,
+		&userKey.PersistentKeepalive,
+		&userKey.CreatedAt,
+		&userKey.UpdatedAt,
+		&userKey.IsActive,
+		&userKey.IdleRemovedAt,
+	)
+	if err != nil {
+		s.logger.Error("Failed to rotate user key in database", zap.Error(err))
+		return nil, fmt.Errorf("failed to rotate user key: %w", err)
+	}
+
+	if graceful {
+		// The old peer's address stays taken until the worker removes it
+		query := `
+			INSERT INTO pending_peer_removals (public_key, server_id, remove_after, allowed_ips)
+			VALUES ($1, $2, NOW() + make_interval(secs => $3), $4)
+			ON CONFLICT (public_key) DO UPDATE SET remove_after = EXCLUDED.remove_after, allowed_ips = EXCLUDED.allowed_ips
+		`
+		if _, err := tx.Exec(ctx, query, current.PublicKey, serverID, s.rotationGrace.Seconds(), current.AllowedIPs); err != nil {
+			return nil, fmt.Errorf("failed to schedule rotated peer removal: %w", err)
+		}
+	}
+
+	if err := s.applyNetworkPolicy(ctx, tx, userID, userKey.AllowedIPs); err != nil {
+		return nil, err
+	}
+
+	if err := s.authorizeUserInWireGuard(ctx, newPublicKey, userKey.AllowedIPs, s.keepaliveFor(current.PersistentKeepalive)); err != nil {
+		return nil, fmt.Errorf("failed to authorize user in WireGuard: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		// Keep the device consistent with the database
+		s.removeUserFromWireGuard(context.WithoutCancel(ctx), newPublicKey)
+		return nil, fmt.Errorf("failed to rotate user key: %w", err)
+	}
+
+	if !graceful {
+		if err := s.removeUserFromWireGuard(ctx, current.PublicKey); err != nil {
+			s.logger.Error("Failed to remove rotated peer from WireGuard engine", zap.Error(err))
+		}
+	}
+
+	s.logger.Info("User key rotated",
+		zap.String("user_id", userID.String()),
+		zap.String("server_id", serverID.String()))
+
+	return userKey, nil
+}
+
+// GenerateConfig builds the client WireGuard configuration for a provisioned key on a server
+func (s *WireguardService) GenerateConfig(userKey *models.UserKey, server *models.Server, opts ConfigOptions) *models.WireGuardConfig {
+	privateKey := opts.PrivateKey
+	if privateKey == "" {
+		privateKey = ClientPrivateKeyPlaceholder // Client should replace this
+	}
+
+	// Clients on an IPv6-only server have no IPv4 connectivity through the tunnel
+	dns := DefaultClientDNS
+	fullTunnel := DefaultClientAllowedIPs
+	if isIPv6Address(userKey.AllowedIPs) {
+		dns = DefaultClientDNSV6
+		fullTunnel = DefaultClientAllowedIPsV6
+	}
+
+	allowedNetworks := opts.AllowedNetworks
+	var table string
+	if lp := opts.LeakProtection; lp != nil {
+		table = lp.Table
+		// A split tunnel would send resolver traffic outside the tunnel; route the DNS servers through it
+		if lp.RouteDNS && len(allowedNetworks) > 0 {
+			allowedNetworks = append(append([]string(nil), allowedNetworks...), dnsRoutes(dns)...)
+		}
+	}
+
+	// Without the gateway and resolvers a split tunnel cannot reach the VPN's own DNS
+	if s.splitTunnelGateway && len(allowedNetworks) > 0 {
+		allowedNetworks = mergeRoutes(allowedNetworks, append(gatewayRoutes(server, userKey.AllowedIPs), dnsRoutes(dns)...))
+	}
+
+	allowedIPs := fullTunnel
+	if len(allowedNetworks) > 0 {
+		allowedIPs = ClientAllowedIPs(allowedNetworks)
+	}
+
+	dnsSearch := opts.DNSSearch
+	if dnsSearch == "" {
+		dnsSearch = server.DNSSearch
+	}
+	// Stored and requested domains were validated; anything malformed is left out rather than emitted
+	searchDomains, err := parseDNSSearch(dnsSearch)
+	if err != nil {
+		s.logger.Warn("Ignoring invalid DNS search domains", zap.Error(err))
+		searchDomains = nil
+	}
+
+	// The template is written into the config verbatim, so one that fails validation is left out
+	var dohTemplate string
+	if opts.DoHHint && server.DoHTemplate != "" {
+		if err := ValidateDoHTemplate(server.DoHTemplate); err != nil {
+			s.logger.Warn("Ignoring invalid DoH template", zap.String("server_id", server.ID.String()), zap.Error(err))
+		} else {
+			dohTemplate = server.DoHTemplate
+		}
+	}
+
+	return &models.WireGuardConfig{
+		Interface: models.WireGuardInterface{
+			PrivateKey:  privateKey,
+			Address:     userKey.AllowedIPs,
+			DNS:         dns,
+			DNSSearch:   searchDomains,
+			Table:       table,
+			Obfuscation: opts.Obfuscation,
+			DoHTemplate: dohTemplate,
+		},
+		Peer: models.WireGuardPeer{
+			PublicKey:           server.PublicKey,
+			Endpoint:            net.JoinHostPort(s.selectEndpoint(server, opts.ClientAddr), strconv.Itoa(server.Port)),
+			AllowedIPs:          allowedIPs,
+			PersistentKeepalive: int(s.keepaliveFor(userKey.PersistentKeepalive).Seconds()),
+		},
+	}
+}
+
+// selectEndpoint returns the server endpoint best suited to a client address: the alternative whose
+// selectors all match the client's location, preferring an ASN match over a region match over a
+// country match, or the primary endpoint when none matches or the client cannot be located
+func (s *WireguardService) selectEndpoint(server *models.Server, clientAddr netip.Addr) string {
+	if len(server.Endpoints) == 0 || s.geoLocator == nil || !clientAddr.IsValid() {
+		return server.Endpoint
+	}
+
+	location, err := s.geoLocator.Locate(clientAddr)
+	if err != nil {
+		return server.Endpoint
+	}
+
+	best, bestScore := server.Endpoint, 0
+	for _, endpoint := range server.Endpoints {
+		if score := endpointScore(endpoint, location); score > bestScore {
+			best, bestScore = endpoint.Endpoint, score
+		}
+	}
+
+	return best
+}
+
+// endpointScore rates how specifically an endpoint's selectors match a location; zero is no match
+func endpointScore(endpoint models.ServerEndpoint, location *models.GeoLocation) int {
+	score := 0
+	if endpoint.Country != "" {
+		if !strings.EqualFold(endpoint.Country, location.Country) {
+			return 0
+		}
+		score++
+	}
+	if endpoint.Region != "" {
+		if !strings.EqualFold(endpoint.Region, location.Region) {
+			return 0
+		}
+		score += 2
+	}
+	if endpoint.ASN != 0 {
+		if endpoint.ASN != location.ASN {
+			return 0
+		}
+		score += 4
+	}
+	return score
+}
+
+// maxDNSNameLength is the longest domain name DNS allows, in presentation form without the root dot
+const maxDNSNameLength = 253
+
+// ValidateDoHTemplate checks that a DNS-over-HTTPS template is an absolute https URL with a host and
+// no credentials. Whitespace and control characters are rejected so it cannot break out of a comment.
+func ValidateDoHTemplate(template string) error {
+	if strings.ContainsFunc(template, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) {
+		return fmt.Errorf("DoH template must not contain whitespace or control characters")
+	}
+	u, err := url.Parse(template)
+	if err != nil {
+		return fmt.Errorf("invalid DoH template: %w", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("DoH template %q must be an https URL with a host", template)
+	}
+	if u.User != nil {
+		return fmt.Errorf("DoH template must not contain credentials")
+	}
+	return nil
+}
+
+// parseDNSSearch splits a comma-separated list of search domains, lower-casing them and dropping a
+// trailing root dot. Every domain must be a valid host name that is not an IP address.
+func parseDNSSearch(dnsSearch string) ([]string, error) {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(dnsSearch, ",") {
+		domain := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), ".")
+		if domain == "" {
+			continue
+		}
+		if err := validateDomainName(domain); err != nil {
+			return nil, err
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
+
+// validateDomainName checks that a lower-case name is a valid DNS host name
+func validateDomainName(domain string) error {
+	if len(domain) > maxDNSNameLength {
+		return fmt.Errorf("search domain %q is longer than %d characters", domain, maxDNSNameLength)
+	}
+	if net.ParseIP(domain) != nil {
+		return fmt.Errorf("search domain %q is an IP address", domain)
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid search domain %q: labels must be 1 to 63 characters", domain)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid search domain %q: labels cannot start or end with a hyphen", domain)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return fmt.Errorf("invalid search domain %q: unexpected character %q", domain, c)
+			}
+		}
+	}
+	return nil
+}
+
+// NormalizeDNSSearch validates a comma-separated list of DNS search domains and returns it in
+// canonical form: lower case, without duplicates, joined by ", "
+func NormalizeDNSSearch(dnsSearch string) (string, error) {
+	domains, err := parseDNSSearch(dnsSearch)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(domains, ", "), nil
+}
+
+// isIPv6Address reports whether an address or CIDR is IPv6
+func isIPv6Address(address string) bool {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		ip = net.ParseIP(address)
+	}
+	return ip != nil && ip.To4() == nil
+}
+
+// ValidateLeakProtection rejects leak protection directives that contradict each other or the
+// user's allowed networks policy
+func ValidateLeakProtection(lp *models.LeakProtection, allowedNetworks []string) error {
+	if lp == nil {
+		return nil
+	}
+
+	switch lp.Table {
+	case "", "auto", "off":
+	default:
+		if table, err := strconv.Atoi(lp.Table); err != nil || table < 1 {
+			return fmt.Errorf("invalid table %q: must be auto, off or a positive routing table number", lp.Table)
+		}
+	}
+
+	if lp.Table == "off" {
+		// With no routes installed neither the full tunnel nor the DNS routes would take effect
+		if len(allowedNetworks) == 0 {
+			return fmt.Errorf("table off cannot be combined with a full tunnel")
+		}
+		if lp.RouteDNS {
+			return fmt.Errorf("table off cannot be combined with routing DNS through the tunnel")
+		}
+	}
+
+	return nil
+}
+
+// dnsRoutes returns host routes for a comma-separated list of DNS servers
+func dnsRoutes(dns string) []string {
+	var routes []string
+	for _, server := range strings.Split(dns, ",") {
+		ip := net.ParseIP(strings.TrimSpace(server))
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			routes = append(routes, ip.String()+"/32")
+		} else {
+			routes = append(routes, ip.String()+"/128")
+		}
+	}
+	return routes
+}
+
+// gatewayRoutes returns a host route to the server's own address in each of its subnets that holds
+// one of the client's addresses
+func gatewayRoutes(server *models.Server, clientAddresses string) []string {
+	var routes []string
+	for _, subnet := range []string{server.Subnet, server.SubnetV6} {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		for _, address := range strings.Split(clientAddresses, ",") {
+			ip, _, err := net.ParseCIDR(strings.TrimSpace(address))
+			if err != nil || !network.Contains(ip) {
+				continue
+			}
+			if gateway, err := hostAddress(network, 1); err == nil {
+				routes = append(routes, hostCIDR(gateway))
+			}
+			break
+		}
+	}
+	return routes
+}
+
+// mergeRoutes returns networks followed by the extra routes it does not already contain
+func mergeRoutes(networks, extra []string) []string {
+	merged := append([]string(nil), networks...)
+	for _, route := range extra {
+		if !slices.Contains(merged, route) {
+			merged = append(merged, route)
+		}
+	}
+	return merged
+}
+
+// RenderConfig renders a WireGuard config in the wg-quick .conf format
+func RenderConfig(config *models.WireGuardConfig) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", config.Interface.PrivateKey)
+	fmt.Fprintf(&b, "Address = %s\n", config.Interface.Address)
+	dns := config.Interface.DNS
+	if len(config.Interface.DNSSearch) > 0 {
+		dns += ", " + strings.Join(config.Interface.DNSSearch, ", ")
+	}
+	fmt.Fprintf(&b, "DNS = %s\n", dns)
+	if config.Interface.DoHTemplate != "" {
+		fmt.Fprintf(&b, "# DoH: %s\n", config.Interface.DoHTemplate)
+	}
+	if config.Interface.Table != "" {
+		fmt.Fprintf(&b, "Table = %s\n", config.Interface.Table)
+	}
+	if o := config.Interface.Obfuscation; o != nil {
+		fmt.Fprintf(&b, "Jc = %d\nJmin = %d\nJmax = %d\n", o.Jc, o.Jmin, o.Jmax)
+		fmt.Fprintf(&b, "S1 = %d\nS2 = %d\n", o.S1, o.S2)
+		fmt.Fprintf(&b, "H1 = %d\nH2 = %d\nH3 = %d\nH4 = %d\n", o.H1, o.H2, o.H3, o.H4)
+	}
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", config.Peer.PublicKey)
+	fmt.Fprintf(&b, "Endpoint = %s\n", config.Peer.Endpoint)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", config.Peer.AllowedIPs)
+	if config.Peer.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", config.Peer.PersistentKeepalive)
+	}
+	return b.String()
+}
+
+// RenderMinimalConfig renders only what a client needs to connect, for constrained devices: the
+// interface key and address and the peer key, endpoint and routes, plus the obfuscation settings an
+// AmneziaWG config cannot connect without. DNS, routing table, keepalive and comments are left out.
+func RenderMinimalConfig(config *models.WireGuardConfig) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", config.Interface.PrivateKey)
+	fmt.Fprintf(&b, "Address = %s\n", config.Interface.Address)
+	if o := config.Interface.Obfuscation; o != nil {
+		fmt.Fprintf(&b, "Jc = %d\nJmin = %d\nJmax = %d\n", o.Jc, o.Jmin, o.Jmax)
+		fmt.Fprintf(&b, "S1 = %d\nS2 = %d\n", o.S1, o.S2)
+		fmt.Fprintf(&b, "H1 = %d\nH2 = %d\nH3 = %d\nH4 = %d\n", o.H1, o.H2, o.H3, o.H4)
+	}
+	b.WriteString("[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", config.Peer.PublicKey)
+	fmt.Fprintf(&b, "Endpoint = %s\n", config.Peer.Endpoint)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", config.Peer.AllowedIPs)
+	return b.String()
+}
+
+// GenerateConfigQR renders the config GenerateConfig builds as a PNG QR code for mobile WireGuard
+// apps to import by scanning. The image is the largest whole-pixel rendering within size pixels a side;
+// when the config does not fit in size pixels at all it fails with ErrConfigQRTooSmall.
+func (s *WireguardService) GenerateConfigQR(userKey *models.UserKey, server *models.Server, opts ConfigOptions, size int) ([]byte, error) {
+	code, err := qrcode.Encode([]byte(RenderConfig(s.GenerateConfig(userKey, server, opts))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config QR code: %w", err)
+	}
+
+	scale := code.ScaleFor(size)
+	if scale == 0 {
+		return nil, fmt.Errorf("%w: the config needs at least %d pixels", ErrConfigQRTooSmall, code.Side(1))
+	}
+	return code.PNG(scale)
+}
+
+// RenderConfigFile renders a config as a file to hand to wg-quick. A config without the client's
+// private key starts with a comment saying where to put it, since wg-quick cannot load it as is.
+func RenderConfigFile(config *models.WireGuardConfig) string {
+	rendered := RenderConfig(config)
+	if config.Interface.PrivateKey != ClientPrivateKeyPlaceholder {
+		return rendered
+	}
+	return fmt.Sprintf("# Replace %s with this device's private key before use\n", ClientPrivateKeyPlaceholder) + rendered
+}
+
+// querier runs queries on the pool or on a transaction, so the address helpers can run on the
+// connection holding lockServerAddresses instead of waiting for a second one
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// serverSubnet returns the pool client addresses are allocated from: the server's IPv4 subnet, or
+// its IPv6 subnet when the server is IPv6-only
+func (s *WireguardService) serverSubnet(ctx context.Context, q querier, serverID uuid.UUID) (*net.IPNet, error) {
+	network, networkV6, err := s.serverSubnets(ctx, q, serverID)
+	if err != nil {
+		return nil, err
+	}
+	if network != nil {
+		return network, nil
+	}
+	if networkV6 != nil {
+		return networkV6, nil
+	}
+	return nil, fmt.Errorf("server has no client subnet")
+}
+
+// serverSubnets returns the server's IPv4 and IPv6 client subnets, nil for a family the server does
+// not have; a server with both is dual-stack
+func (s *WireguardService) serverSubnets(ctx context.Context, q querier, serverID uuid.UUID) (network, networkV6 *net.IPNet, err error) {
+	var subnet, subnetV6 *string
+	subnetQuery := `SELECT subnet, subnet_v6 FROM servers WHERE id = $1`
+	if err := q.QueryRow(ctx, subnetQuery, serverID).Scan(&subnet, &subnetV6); err != nil {
+		return nil, nil, fmt.Errorf("failed to load server subnets: %w", err)
+	}
+
+	if subnet != nil && *subnet != "" {
+		if _, network, err = net.ParseCIDR(*subnet); err != nil {
+			return nil, nil, fmt.Errorf("invalid server subnet %q: %w", *subnet, err)
+		}
+	}
+	if subnetV6 != nil && *subnetV6 != "" {
+		if _, networkV6, err = net.ParseCIDR(*subnetV6); err != nil {
+			return nil, nil, fmt.Errorf("invalid server subnet %q: %w", *subnetV6, err)
+		}
+	}
+	return network, networkV6, nil
+}
+
+// allocatedIPs returns the addresses held by active keys or reserved on a server
+func (s *WireguardService) allocatedIPs(ctx context.Context, q querier, serverID uuid.UUID) (map[string]bool, error) {
+	query := `
+		SELECT allowed_ips FROM user_keys WHERE server_id = $1 AND is_active = true
+		UNION ALL
+		SELECT address FROM ip_reservations WHERE server_id = $1
+		UNION ALL
+		SELECT allowed_ips FROM pending_peer_removals WHERE server_id = $1 AND allowed_ips <> ''
+	`
+	rows, err := q.Query(ctx, query, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load allocated IPs: %w", err)
+	}
+
+	allocated, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to load allocated IPs: %w", err)
+	}
+
+	// Dual-stack keys hold one address per family, each of which is taken
+	taken := make(map[string]bool, len(allocated))
+	for _, allowedIPs := range allocated {
+		for _, entry := range strings.Split(allowedIPs, ",") {
+			taken[strings.TrimSpace(entry)] = true
+		}
+	}
+	return taken, nil
+}
+
+// ActiveKeyCount returns how many active keys a server has, the load measure servers are sorted by
+func (s *WireguardService) ActiveKeyCount(ctx context.Context, serverID uuid.UUID) (int, error) {
 	var count int
-	countQuery := `SELECT COUNT(*) FROM user_keys WHERE server_id = $1 AND is_active = true`
+	query := `SELECT COUNT(*) FROM user_keys WHERE server_id = $1 AND is_active = true`
+	if err := s.db.QueryRow(ctx, query, serverID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count active keys: %w", err)
+	}
+	return count, nil
+}
+
+// PoolUtilization reports how much of a server's client address pool is held by active keys or
+// reserved. The network, server and (IPv4) broadcast addresses are not counted towards the pool size.
+func (s *WireguardService) PoolUtilization(ctx context.Context, serverID uuid.UUID) (*models.PoolUtilization, error) {
+	network, err := s.serverSubnet(ctx, s.db, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	taken, err := s.allocatedIPs(ctx, s.db, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := network.Mask.Size()
+	reserved := uint64(2) // network and server
+	if bits == 32 {
+		reserved++ // broadcast
+	}
+	var size uint64
+	if total := uint64(1) << min(bits-ones, 62); total > reserved {
+		size = total - reserved
+	}
+
+	// Dual-stack keys also hold an address of the other family, which is not from this pool
+	pool := &models.PoolUtilization{Subnet: network.String(), Size: size}
+	for address := range taken {
+		if ip, _, err := net.ParseCIDR(address); err == nil && network.Contains(ip) {
+			pool.Allocated++
+		}
+	}
+	if size > 0 {
+		pool.Utilization = float64(pool.Allocated) / float64(size)
+	}
+
+	return pool, nil
+}
+
+// hostCIDR returns an address as a single-host CIDR
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// allocateUserIP allocates the lowest free address in the server's client subnet, so addresses of
+// removed keys are reused. The first host address is reserved for the server, and addresses already
+// held by active keys or reservations are skipped; it fails with ErrAddressPoolExhausted when none
+// is left. A dual-stack server also allocates the IPv6 address at the same host offset, returning
+// both. Callers hold lockServerAddresses on tx until the key holding the address is committed.
+func (s *WireguardService) allocateUserIP(ctx context.Context, tx pgx.Tx, serverID uuid.UUID) (string, error) {
+	network, networkV6, err := s.serverSubnets(ctx, tx, serverID)
+	if err != nil {
+		return "", err
+	}
+	if network == nil {
+		// IPv6-only servers allocate from their IPv6 subnet alone
+		network, networkV6 = networkV6, nil
+	}
+	if network == nil {
+		return "", fmt.Errorf("server has no client subnet")
+	}
+
+	taken, err := s.allocatedIPs(ctx, tx, serverID)
+	if err != nil {
+		return "", err
+	}
+
+	// Allocate from the second host address onwards (.1 is the server)
+	for offset := 2; ; offset++ {
+		ip, err := hostAddress(network, offset)
+		if err != nil {
+			return "", fmt.Errorf("%w: no free addresses in %s", ErrAddressPoolExhausted, network)
+		}
+		address := hostCIDR(ip)
+		if taken[address] {
+			continue
+		}
+		if networkV6 == nil {
+			return address, nil
+		}
+
+		ipV6, err := hostAddress(networkV6, offset)
+		if err != nil {
+			return "", fmt.Errorf("%w: no free addresses in %s", ErrAddressPoolExhausted, networkV6)
+		}
+		if addressV6 := hostCIDR(ipV6); !taken[addressV6] {
+			return address + ", " + addressV6, nil
+		}
+	}
+}
+
+// lockServerAddresses serializes address allocation on a server until tx ends, so concurrent
+// provisioning and reservations never pick the same free address
+func lockServerAddresses(ctx context.Context, tx pgx.Tx, serverID uuid.UUID) error {
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, serverID.String()); err != nil {
+		return fmt.Errorf("failed to lock server addresses: %w", err)
+	}
+	return nil
+}
+
+// checkUserActive returns ErrUserNotFound for an unknown user and ErrUserInactive for a disabled
+// one, holding the user's row until tx ends so it cannot be disabled while a key is being added
+func checkUserActive(ctx context.Context, tx pgx.Tx, userID uuid.UUID) error {
+	var isActive bool
+	err := tx.QueryRow(ctx, `SELECT is_active FROM users WHERE id = $1 FOR SHARE`, userID).Scan(&isActive)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up user: %w", err)
+	}
+	if !isActive {
+		return ErrUserInactive
+	}
+	return nil
+}
+
+// reserveStaticIP checks that a requested address is a host within the server subnet, other than
+// the server's own address, that no other user's active key holds and that is not reserved, and
+// returns it in canonical form. On a dual-stack server the requested address is the IPv4 one, and
+// the IPv6 address at the same host offset is checked and returned with it, as allocateUserIP
+// pairs them. Callers hold lockServerAddresses on tx.
+func (s *WireguardService) reserveStaticIP(ctx context.Context, tx pgx.Tx, userID, serverID uuid.UUID, requested string) (string, error) {
+	ip := net.ParseIP(requested)
+	if ip == nil {
+		addr, ipNet, err := net.ParseCIDR(requested)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q is not an address", ErrInvalidStaticIP, requested)
+		}
+		if ones, bits := ipNet.Mask.Size(); ones != bits {
+			return "", fmt.Errorf("%w: %q is not a single host", ErrInvalidStaticIP, requested)
+		}
+		ip = addr
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	network, networkV6, err := s.serverSubnets(ctx, tx, serverID)
+	if err != nil {
+		return "", err
+	}
+	if network == nil {
+		// IPv6-only servers allocate from their IPv6 subnet alone
+		network, networkV6 = networkV6, nil
+	}
+	if network == nil {
+		return "", fmt.Errorf("server has no client subnet")
+	}
+	if !network.Contains(ip) || len(ip) != len(network.IP) {
+		return "", fmt.Errorf("%w: %s is outside the server subnet %s", ErrInvalidStaticIP, ip, network)
+	}
+
+	// The network, server and (IPv4) broadcast addresses are never handed to clients
+	serverIP, _ := hostAddress(network, 1)
+	lastIP, _ := hostAddress(network, 0)
+	for i := range lastIP {
+		lastIP[i] |= ^network.Mask[i]
+	}
+	if ip.Equal(network.IP) || ip.Equal(serverIP) || (len(ip) == net.IPv4len && ip.Equal(lastIP)) {
+		return "", fmt.Errorf("%w: %s is reserved", ErrInvalidStaticIP, ip)
+	}
+
+	addresses := []string{hostCIDR(ip)}
+	if networkV6 != nil {
+		ipV6, err := hostAddress(networkV6, hostOffset(network, ip))
+		if err != nil {
+			return "", fmt.Errorf("%w: %s has no IPv6 address in %s", ErrInvalidStaticIP, ip, networkV6)
+		}
+		addresses = append(addresses, hostCIDR(ipV6))
+	}
+
+	var conflict bool
+	conflictQuery := `
+		SELECT EXISTS (
+			SELECT 1 FROM user_keys
+			WHERE server_id = $1 AND is_active = true AND user_id <> $3
+				AND string_to_array(replace(allowed_ips, ' ', ''), ',') && $2::text[]
+		) OR EXISTS (
+			SELECT 1 FROM ip_reservations WHERE server_id = $1 AND address = ANY($2)
+		) OR EXISTS (
+			SELECT 1 FROM pending_peer_removals
+			WHERE server_id = $1 AND string_to_array(replace(allowed_ips, ' ', ''), ',') && $2::text[]
+		)
+	`
+	if err := tx.QueryRow(ctx, conflictQuery, serverID, addresses, userID).Scan(&conflict); err != nil {
+		return "", fmt.Errorf("failed to check IP allocation: %w", err)
+	}
+	if conflict {
+		return "", fmt.Errorf("%w: %s", ErrConflict, strings.Join(addresses, ", "))
+	}
+
+	return strings.Join(addresses, ", "), nil
+}
+
+// hostAddress returns the address at offset within network, rejecting the IPv4 broadcast address
+func hostAddress(network *net.IPNet, offset int) (net.IP, error) {
+	ones, bits := network.Mask.Size()
+	hostBits := bits - ones
+
+	// Offsets beyond the pool size (or beyond what an int can address) are exhausted
+	size := uint64(1) << min(hostBits, 62)
+	if bits == 32 {
+		size-- // broadcast
+	}
+	if uint64(offset) >= size {
+		return nil, fmt.Errorf("no available IP addresses")
+	}
+
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	carry := uint64(offset)
+	for i := len(ip) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(ip[i]) + carry&0xff
+		ip[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	return ip, nil
+}
+
+// hostOffset returns the offset of ip within network, the inverse of hostAddress
+func hostOffset(network *net.IPNet, ip net.IP) int {
+	offset := 0
+	for i := range ip {
+		offset = offset<<8 | int(ip[i]&^network.Mask[i])
+	}
+	return offset
+}
+
+// ClientAllowedIPs returns the AllowedIPs advertised in a client config, restricted to the
+// user's allowed networks policy when one is set
+func ClientAllowedIPs(allowedNetworks []string) string {
+	if len(allowedNetworks) == 0 {
+		return DefaultClientAllowedIPs
+	}
+	return strings.Join(allowedNetworks, ", ")
+}
+
+// IsValidIPAddress validates if a string is a valid IP address
+func (s *WireguardService) IsValidIPAddress(ip string) bool {
+	// Remove CIDR notation if present
+	if strings.Contains(ip, "/") {
+		ip = strings.Split(ip, "/")[0]
+	}
+	return net.ParseIP(ip) != nil
+}
+
+// applyNetworkPolicy holds the peer at allowedIPs to its user's allowed networks
+func (s *WireguardService) applyNetworkPolicy(ctx context.Context, q querier, userID uuid.UUID, allowedIPs string) error {
+	if s.firewall == nil {
+		return nil
+	}
+
+	var allowedNetworks []string
+	if err := q.QueryRow(ctx, `SELECT allowed_networks FROM users WHERE id = $1`, userID).Scan(&allowedNetworks); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("failed to get allowed networks: %w", err)
+	}
+
+	return s.enforceNetworkPolicy(allowedIPs, allowedNetworks)
+}
+
+// enforceNetworkPolicy sets the firewall policy for each of a peer's addresses. Besides the allowed
+// networks, the peer may reach the DNS servers, which split-tunnel configs route through the tunnel;
+// an empty policy lifts any restriction left on the addresses.
+func (s *WireguardService) enforceNetworkPolicy(allowedIPs string, allowedNetworks []string) error {
+	if s.firewall == nil {
+		return nil
+	}
+
+	var networks []string
+	if len(allowedNetworks) > 0 {
+		networks = mergeRoutes(allowedNetworks, dnsRoutes(DefaultClientDNS+", "+DefaultClientDNSV6))
+	}
+
+	for _, address := range strings.Split(allowedIPs, ",") {
+		if err := s.firewall.SetPeerPolicy(strings.TrimSpace(address), networks); err != nil {
+			return fmt.Errorf("failed to enforce allowed networks: %w", err)
+		}
+	}
+	return nil
+}
+
+// ApplyNetworkPolicy enforces a user's current allowed networks on the peers of their active keys on
+// the server the device carries, returning how many were updated. Idle-removed peers get the policy
+// when they are restored.
+func (s *WireguardService) ApplyNetworkPolicy(ctx context.Context, userID uuid.UUID) (int, error) {
+	if s.firewall == nil {
+		return 0, nil
+	}
+
+	query := `
+		SELECT k.allowed_ips, u.allowed_networks
+		FROM user_keys k
+		JOIN users u ON u.id = k.user_id
+		WHERE k.user_id = $1 AND k.server_id = $2 AND k.is_active = true AND k.idle_removed_at IS NULL
+	`
+	rows, err := s.db.Query(ctx, query, userID, s.localServerID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query active keys: %w", err)
+	}
+	defer rows.Close()
+
+	applied := 0
+	for rows.Next() {
+		var allowedIPs string
+		var allowedNetworks []string
+		if err := rows.Scan(&allowedIPs, &allowedNetworks); err != nil {
+			return applied, fmt.Errorf("failed to scan active key: %w", err)
+		}
+		if err := s.enforceNetworkPolicy(allowedIPs, allowedNetworks); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	if err := rows.Err(); err != nil {
+		return applied, fmt.Errorf("failed to iterate active keys: %w", err)
+	}
+
+	return applied, nil
+}
+
+// authorizeUserInWireGuard adds a user's public key to the WireGuard interface as an allowed peer
+func (s *WireguardService) authorizeUserInWireGuard(ctx context.Context, publicKey, allowedIPs string, keepalive time.Duration) error {
+	if s.wgClient == nil {
+		s.logger.Warn("WireGuard client not available - skipping peer authorization")
+		return fmt.Errorf("WireGuard client not available")
+	}
+
+	peerConfig, err := newPeerConfig(publicKey, allowedIPs, keepalive)
+	if err != nil {
+		return err
+	}
+
+	// Configure the WireGuard device to add this peer
+	config := wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peerConfig},
+	}
+
+	err = s.configureDevice(ctx, config)
+	if err != nil {
+		return fmt.Errorf("failed to configure WireGuard device: %w", err)
+	}
+
+	s.logger.Info("User authorized in WireGuard engine",
+		zap.String("device", s.deviceName),
+		zap.String("public_key", publicKey[:16]+"..."),
+		zap.String("allowed_ips", allowedIPs))
+
+	return nil
+}
+
+// newPeerConfig builds the device peer configuration for a user key
+func newPeerConfig(publicKey, allowedIPs string, keepalive time.Duration) (wgtypes.PeerConfig, error) {
+	pubKey, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	// Parse allowed IPs; dual-stack keys hold one CIDR per address family
+	allowedIPNets, err := parseAllowedIPs(allowedIPs)
+	if err != nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("failed to parse allowed IPs: %w", err)
+	}
+
+	return wgtypes.PeerConfig{
+		PublicKey:                   pubKey,
+		AllowedIPs:                  allowedIPNets,
+		ReplaceAllowedIPs:           true,
+		PersistentKeepaliveInterval: &keepalive,
+	}, nil
+}
+
+// parseAllowedIPs parses a comma-separated allowed IPs list. Entries may be CIDRs or bare
+// addresses, which are taken as single hosts.
+func parseAllowedIPs(allowedIPs string) ([]net.IPNet, error) {
+	var networks []net.IPNet
+	for _, entry := range strings.Split(allowedIPs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid allowed IP %q: %w", entry, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefix = prefix.Masked()
+
+		networks = append(networks, net.IPNet{
+			IP:   net.IP(prefix.Addr().AsSlice()),
+			Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+		})
+	}
+
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("no allowed IPs")
+	}
+	return networks, nil
+}
+
+// NormalizeAllowedIPs returns an allowed IPs list in the canonical form stored for keys: masked
+// CIDRs, IPv4 before IPv6, without duplicates, joined by ", "
+func NormalizeAllowedIPs(allowedIPs string) (string, error) {
+	networks, err := parseAllowedIPs(allowedIPs)
+	if err != nil {
+		return "", err
+	}
+
+	sort.SliceStable(networks, func(i, j int) bool {
+		return len(networks[i].IP) < len(networks[j].IP)
+	})
+
+	entries := make([]string, 0, len(networks))
+	seen := make(map[string]bool, len(networks))
+	for _, network := range networks {
+		entry := network.String()
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+
+	return strings.Join(entries, ", "), nil
+}
+
+// removeUserFromWireGuard removes a user's public key from the WireGuard interface
+func (s *WireguardService) removeUserFromWireGuard(ctx context.Context, publicKey string) error {
+	if s.wgClient == nil {
+		s.logger.Warn("WireGuard client not available - skipping peer removal")
+		return nil // Allow operation to continue for development
+	}
+
+	// Parse the public key
+	pubKey, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	// Create peer configuration for removal
+	peerConfig := wgtypes.PeerConfig{
+		PublicKey: pubKey,
+		Remove:    true,
+	}
+
+	// Configure the WireGuard device to remove this peer
+	config := wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peerConfig},
+	}
+
+	// Apply configuration to WireGuard interface
+	err = s.configureDevice(ctx, config)
+	if err != nil {
+		return fmt.Errorf("failed to remove peer from WireGuard device: %w", err)
+	}
+
+	s.logger.Info("User removed from WireGuard engine",
+		zap.String("device", s.deviceName),
+		zap.String("public_key", publicKey[:16]+"..."))
+
+	return nil
+}
+
+// RemoveUserKey removes a user's key from both database and WireGuard engine
+func (s *WireguardService) RemoveUserKey(ctx context.Context, userID, serverID uuid.UUID) error {
+	// Get user key first to get public key for WireGuard removal
+	userKey, err := s.GetUserKey(ctx, userID, serverID)
+	if err != nil {
+		return fmt.Errorf("user key not found: %w", err)
+	}
+
+	// Remove from WireGuard engine first
+	if err := s.removeUserFromWireGuard(ctx, userKey.PublicKey); err != nil {
+		s.logger.Error("Failed to remove user from WireGuard engine", zap.Error(err))
+		// Continue with database removal even if WireGuard removal fails
+	}
+
+	// Remove from database, recording the key so it is still known as revoked once the row is reused
+	query := `
+		WITH deactivated AS (
+			UPDATE user_keys SET is_active = false, updated_at = NOW(),
+				public_key = CASE WHEN public_key_hash IS NULL THEN public_key END
+			WHERE user_id = $1 AND server_id = $2 AND is_active = true
+			RETURNING id, user_id, server_id, allowed_ips, COALESCE(public_key_hash, public_key) AS key_lookup
+		), recorded AS (
+			INSERT INTO revoked_keys (user_id, server_id, key_lookup)
+			SELECT user_id, server_id, key_lookup FROM deactivated WHERE key_lookup IS NOT NULL
+			ON CONFLICT (user_id, server_id, key_lookup) DO UPDATE SET revoked_at = NOW()
+		)
+		INSERT INTO user_key_events (user_key_id, user_id, server_id, event, public_key_prefix, allowed_ips)
+		SELECT id, user_id, server_id, 'revoked', $3, allowed_ips FROM deactivated
+	`
+	_, err = s.db.Exec(ctx, query, userID, serverID, keyPrefix(userKey.PublicKey))
+	if err != nil {
+		return fmt.Errorf("failed to deactivate user key: %w", err)
+	}
+
+	s.logger.Info("User key removed from WireGuard and database",
+		zap.String("user_id", userID.String()),
+		zap.String("server_id", serverID.String()))
+
+	return nil
+}
+
+// RevokeUserKeyByPublicKey deactivates the user's active key with the given public key and removes its peer;
+// it returns ErrUserKeyNotFound when the key does not exist or belongs to another user
+func (s *WireguardService) RevokeUserKeyByPublicKey(ctx context.Context, userID uuid.UUID, publicKey string) error {
+	var keyID, serverID uuid.UUID
+	query := `
+		WITH deactivated AS (
+			UPDATE user_keys SET is_active = false, updated_at = NOW(),
+				public_key = CASE WHEN public_key_hash IS NULL THEN public_key END
+			WHERE user_id = $1 AND COALESCE(public_key_hash, public_key) = $2 AND is_active = true
+			RETURNING id, user_id, server_id, allowed_ips
+		), recorded AS (
+			INSERT INTO revoked_keys (user_id, server_id, key_lookup)
+			SELECT user_id, server_id, $2 FROM deactivated
+			ON CONFLICT (user_id, server_id, key_lookup) DO UPDATE SET revoked_at = NOW()
+		), history AS (
+			INSERT INTO user_key_events (user_key_id, user_id, server_id, event, public_key_prefix, allowed_ips)
+			SELECT id, user_id, server_id, 'revoked', $3, allowed_ips FROM deactivated
+		)
+		SELECT id, server_id FROM deactivated
+	`
 
-	err := s.db.QueryRow(ctx, countQuery, serverID).Scan(&count)
+	// The caller's key removes the peer, so a stored raw key is not needed
+	err := s.db.QueryRow(ctx, query, userID, s.keyLookup(publicKey), keyPrefix(publicKey)).Scan(&keyID, &serverID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrUserKeyNotFound
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to count existing users: %w", err)
+		return fmt.Errorf("failed to deactivate user key: %w", err)
 	}
 
-	// Allocate IP in 10.0.0.0/24 range (10.0.0.2 onwards, .1 is server)
-	if count >= 253 {
-		return "", fmt.Errorf("no available IP addresses")
+	if err := s.removeUserFromWireGuard(ctx, publicKey); err != nil {
+		s.logger.Error("Failed to remove revoked key from WireGuard engine", zap.Error(err))
+		// The key is already inactive in the database; reconciliation will not re-add it
 	}
 
-	ip := fmt.Sprintf("10.0.0.%d/32", count+2)
-	return ip, nil
+	s.logger.Info("User key revoked",
+		zap.String("user_id", userID.String()),
+		zap.String("server_id", serverID.String()),
+		zap.String("key_id", keyID.String()))
+
+	return nil
 }
 
-// IsValidIPAddress validates if a string is a valid IP address
-func (s *WireguardService) IsValidIPAddress(ip string) bool {
-	// Remove CIDR notation if present
-	if strings.Contains(ip, "/") {
-		ip = strings.Split(ip, "/")[0]
+// ConfigureListener sets the device's listen port and, when firewallMark is non-nil, its firewall mark
+func (s *WireguardService) ConfigureListener(ctx context.Context, listenPort int, firewallMark *int) error {
+	if s.wgClient == nil {
+		return fmt.Errorf("WireGuard client not available")
 	}
-	return net.ParseIP(ip) != nil
+
+	if listenPort < 1 || listenPort > 65535 {
+		return fmt.Errorf("invalid listen port: %d", listenPort)
+	}
+
+	cfg := wgtypes.Config{
+		ListenPort:   &listenPort,
+		FirewallMark: firewallMark,
+	}
+
+	if err := s.configureDevice(ctx, cfg); err != nil {
+		return fmt.Errorf("failed to configure WireGuard listener: %w", err)
+	}
+
+	return nil
 }
 
-// authorizeUserInWireGuard adds a user's public key to the WireGuard interface as an allowed peer
-func (s *WireguardService) authorizeUserInWireGuard(publicKey, allowedIPs string) error {
+// ReconcilePeers applies the server's listener settings and programs every active key stored
+// for the server onto the WireGuard device. It waits for any other reconciliation to finish.
+func (s *WireguardService) ReconcilePeers(ctx context.Context, serverID uuid.UUID) (int, error) {
+	s.reconcileMu.Lock()
+	defer s.reconcileMu.Unlock()
+
+	return s.reconcilePeers(ctx, serverID)
+}
+
+// reconcilePeers performs ReconcilePeers; callers hold reconcileMu
+func (s *WireguardService) reconcilePeers(ctx context.Context, serverID uuid.UUID) (int, error) {
 	if s.wgClient == nil {
-		s.logger.Warn("WireGuard client not available - skipping peer authorization")
-		return fmt.Errorf("WireGuard client not available")
+		return 0, fmt.Errorf("WireGuard client not available")
 	}
 
-	pubKey, err := wgtypes.ParseKey(publicKey)
-	if err != nil {
-		return fmt.Errorf("failed to parse public key: %w", err)
+	var listenPort int
+	var firewallMark *int
+	serverQuery := `SELECT port, firewall_mark FROM servers WHERE id = $1`
+	if err := s.db.QueryRow(ctx, serverQuery, serverID).Scan(&listenPort, &firewallMark); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrServerNotFound
+		}
+		return 0, fmt.Errorf("failed to load server settings: %w", err)
 	}
 
-	// Parse allowed IPs
-	_, allowedIPNet, err := net.ParseCIDR(allowedIPs)
+	if err := s.ConfigureListener(ctx, listenPort, firewallMark); err != nil {
+		return 0, err
+	}
+
+	// Idle peers stay off the device until their next config request
+	query := `
+		SELECT k.public_key, k.allowed_ips, k.persistent_keepalive, u.allowed_networks
+		FROM user_keys k
+		JOIN users u ON u.id = k.user_id
+		WHERE k.server_id = $1 AND k.is_active = true AND k.idle_removed_at IS NULL
+	`
+	rows, err := s.db.Query(ctx, query, serverID)
 	if err != nil {
-		return fmt.Errorf("failed to parse allowed IPs: %w", err)
+		return 0, fmt.Errorf("failed to query active keys: %w", err)
 	}
+	defer rows.Close()
 
-	// Create peer configuration
-	peerConfig := wgtypes.PeerConfig{
-		PublicKey:                   pubKey,
-		AllowedIPs:                  []net.IPNet{*allowedIPNet},
-		ReplaceAllowedIPs:           true,
-		PersistentKeepaliveInterval: &[]time.Duration{25 * time.Second}[0],
+	var peers []wgtypes.PeerConfig
+	for rows.Next() {
+		var publicKey, allowedIPs string
+		var keepalive *int
+		var allowedNetworks []string
+		if err := rows.Scan(&publicKey, &allowedIPs, &keepalive, &allowedNetworks); err != nil {
+			return 0, fmt.Errorf("failed to scan active key: %w", err)
+		}
+
+		peerConfig, err := newPeerConfig(publicKey, allowedIPs, s.keepaliveFor(keepalive))
+		if err != nil {
+			s.logger.Warn("Skipping invalid stored key during reconciliation", zap.Error(err))
+			continue
+		}
+		// A peer whose policy cannot be enforced is left off the device rather than let through unfiltered
+		if err := s.enforceNetworkPolicy(allowedIPs, allowedNetworks); err != nil {
+			s.logger.Warn("Skipping stored key whose allowed networks cannot be enforced",
+				zap.String("public_key", MaskPublicKey(publicKey)),
+				zap.Error(err))
+			continue
+		}
+		peers = append(peers, peerConfig)
 	}
 
-	// Configure the WireGuard device to add this peer
-	config := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{peerConfig},
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate active keys: %w", err)
+	}
+
+	if len(peers) == 0 {
+		return 0, nil
 	}
 
-	err = s.wgClient.ConfigureDevice(s.deviceName, config)
+	applied, failures, err := s.configurePeers(ctx, peers)
+	for _, failure := range failures {
+		s.logger.Warn("Failed to program stored key during reconciliation",
+			zap.String("public_key", MaskPublicKey(failure.publicKey.String())),
+			zap.Error(failure.err))
+	}
 	if err != nil {
-		return fmt.Errorf("failed to configure WireGuard device: %w", err)
+		return 0, fmt.Errorf("failed to configure WireGuard device: %w", err)
 	}
 
-	s.logger.Info("User authorized in WireGuard engine",
+	s.logger.Info("Reconciled WireGuard peers with database",
 		zap.String("device", s.deviceName),
-		zap.String("public_key", publicKey[:16]+"..."),
-		zap.String("allowed_ips", allowedIPs))
+		zap.String("server_id", serverID.String()),
+		zap.Int("peer_count", applied),
+		zap.Int("failed_count", len(failures)))
 
-	return nil
+	return applied, nil
 }
 
-// removeUserFromWireGuard removes a user's public key from the WireGuard interface
-func (s *WireguardService) removeUserFromWireGuard(publicKey string) error {
-	if s.wgClient == nil {
-		s.logger.Warn("WireGuard client not available - skipping peer removal")
-		return nil // Allow operation to continue for development
+// PruneOrphanPeers removes device peers that have no active key on the server and returns how many
+// were removed. Rotated-out peers still within their grace period are left for RemoveExpiredPeers.
+// Only the server the device carries can be pruned; any other fails with ErrServerNotFound.
+func (s *WireguardService) PruneOrphanPeers(ctx context.Context, serverID uuid.UUID) (int, error) {
+	if err := s.checkLocalServer(serverID); err != nil {
+		return 0, err
 	}
 
-	// Parse the public key
-	pubKey, err := wgtypes.ParseKey(publicKey)
+	devicePeers, err := s.ListAuthorizedPeers()
 	if err != nil {
-		return fmt.Errorf("failed to parse public key: %w", err)
+		return 0, err
 	}
 
-	// Create peer configuration for removal
-	peerConfig := wgtypes.PeerConfig{
-		PublicKey: pubKey,
-		Remove:    true,
+	query := `
+		SELECT public_key FROM user_keys WHERE server_id = $1 AND is_active = true
+		UNION
+		SELECT public_key FROM pending_peer_removals WHERE server_id = $1
+	`
+	rows, err := s.db.Query(ctx, query, serverID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query known keys: %w", err)
 	}
+	defer rows.Close()
 
-	// Configure the WireGuard device to remove this peer
-	config := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{peerConfig},
+	known := make(map[string]bool)
+	for rows.Next() {
+		var publicKey string
+		if err := rows.Scan(&publicKey); err != nil {
+			return 0, fmt.Errorf("failed to scan known key: %w", err)
+		}
+		known[publicKey] = true
 	}
 
-	// Apply configuration to WireGuard interface
-	err = s.wgClient.ConfigureDevice(s.deviceName, config)
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate known keys: %w", err)
+	}
+
+	var orphans []wgtypes.PeerConfig
+	for _, peer := range devicePeers {
+		if !known[peer.PublicKey.String()] {
+			orphans = append(orphans, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		}
+	}
+
+	if len(orphans) == 0 {
+		return 0, nil
+	}
+
+	removed, failures, err := s.configurePeers(ctx, orphans)
+	for _, failure := range failures {
+		s.logger.Warn("Failed to remove orphan peer",
+			zap.String("public_key", MaskPublicKey(failure.publicKey.String())),
+			zap.Error(failure.err))
+	}
 	if err != nil {
-		return fmt.Errorf("failed to remove peer from WireGuard device: %w", err)
+		return 0, fmt.Errorf("failed to configure WireGuard device: %w", err)
 	}
 
-	s.logger.Info("User removed from WireGuard engine",
+	s.logger.Info("Pruned orphan WireGuard peers",
 		zap.String("device", s.deviceName),
-		zap.String("public_key", publicKey[:16]+"..."))
+		zap.String("server_id", serverID.String()),
+		zap.Int("removed_count", removed))
+
+	return removed, nil
+}
+
+// FullReconcile re-applies every active key on the server to the device and prunes orphan peers
+// in one pass. Only the server the device carries can be reconciled; any other fails with
+// ErrServerNotFound. Only one reconciliation runs at a time; a call overlapping another fails with
+// ErrReconcileInProgress rather than waiting.
+func (s *WireguardService) FullReconcile(ctx context.Context, serverID uuid.UUID) (*models.ReconcileResponse, error) {
+	if err := s.checkLocalServer(serverID); err != nil {
+		return nil, err
+	}
+	if !s.reconcileMu.TryLock() {
+		return nil, ErrReconcileInProgress
+	}
+	defer s.reconcileMu.Unlock()
+
+	before, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[wgtypes.Key]bool, len(before))
+	for _, peer := range before {
+		present[peer.PublicKey] = true
+	}
+
+	applied, err := s.reconcilePeers(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := s.PruneOrphanPeers(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return nil, err
+	}
+	added := 0
+	for _, peer := range after {
+		if !present[peer.PublicKey] {
+			added++
+		}
+	}
+
+	return &models.ReconcileResponse{
+		Applied: applied,
+		Added:   added,
+		Removed: removed,
+	}, nil
+}
+
+// peerFailure records a peer left out of a batch configuration and why
+type peerFailure struct {
+	publicKey wgtypes.Key
+	err       error
+}
+
+// configurePeers programs a batch of peers. Peers that fail validation are left out before the
+// device is touched; if the device then rejects the batch, each peer is retried on its own so one
+// bad peer does not keep the others off the device. It returns how many peers were applied and the
+// peers that were not, and an error only when no peer could be applied.
+func (s *WireguardService) configurePeers(ctx context.Context, peers []wgtypes.PeerConfig) (int, []peerFailure, error) {
+	var failures []peerFailure
+	valid := make([]wgtypes.PeerConfig, 0, len(peers))
+	for _, peer := range peers {
+		if err := validatePeerConfig(peer); err != nil {
+			failures = append(failures, peerFailure{publicKey: peer.PublicKey, err: err})
+			continue
+		}
+		valid = append(valid, peer)
+	}
+	if len(valid) == 0 {
+		return 0, failures, fmt.Errorf("no valid peers to configure")
+	}
+
+	batchErr := s.configureDevice(ctx, wgtypes.Config{Peers: valid})
+	if batchErr == nil {
+		return len(valid), failures, nil
+	}
+
+	// Retrying peer by peer cannot help when the device could not be reached at all
+	if len(valid) == 1 || errors.Is(batchErr, ErrDeviceBusy) || ctx.Err() != nil {
+		for _, peer := range valid {
+			failures = append(failures, peerFailure{publicKey: peer.PublicKey, err: batchErr})
+		}
+		return 0, failures, batchErr
+	}
+
+	applied := 0
+	for _, peer := range valid {
+		if err := s.configureDevice(ctx, wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}}); err != nil {
+			failures = append(failures, peerFailure{publicKey: peer.PublicKey, err: err})
+			continue
+		}
+		applied++
+	}
+	if applied == 0 {
+		return 0, failures, batchErr
+	}
+
+	return applied, failures, nil
+}
+
+// validatePeerConfig checks a peer configuration for mistakes the device would reject
+func validatePeerConfig(peer wgtypes.PeerConfig) error {
+	if peer.PublicKey == (wgtypes.Key{}) {
+		return fmt.Errorf("missing public key")
+	}
+	if peer.Remove {
+		return nil
+	}
+
+	if len(peer.AllowedIPs) == 0 {
+		return fmt.Errorf("no allowed IPs")
+	}
+	for _, ipNet := range peer.AllowedIPs {
+		_, bits := ipNet.Mask.Size()
+		switch {
+		case bits == net.IPv4len*8 && ipNet.IP.To4() != nil:
+		case bits == net.IPv6len*8 && len(ipNet.IP) == net.IPv6len:
+		default:
+			return fmt.Errorf("invalid allowed IP %s", ipNet.String())
+		}
+	}
+
+	if peer.PersistentKeepaliveInterval != nil && *peer.PersistentKeepaliveInterval < 0 {
+		return fmt.Errorf("negative persistent keepalive")
+	}
 
 	return nil
 }
 
-// RemoveUserKey removes a user's key from both database and WireGuard engine
-func (s *WireguardService) RemoveUserKey(ctx context.Context, userID, serverID uuid.UUID) error {
-	// Get user key first to get public key for WireGuard removal
-	userKey, err := s.GetUserKey(ctx, userID, serverID)
+// CollectUsage adds the traffic seen on the device since the last collection to the persisted
+// usage totals of every active key on a server and to the server's own totals, which it then
+// reports through TrafficTotals. A successful read of the device also records the server as last
+// seen now.
+func (s *WireguardService) CollectUsage(ctx context.Context, serverID uuid.UUID) error {
+	peers, err := s.ListAuthorizedPeers()
 	if err != nil {
-		return fmt.Errorf("user key not found: %w", err)
+		return err
 	}
 
-	// Remove from WireGuard engine first
-	if err := s.removeUserFromWireGuard(userKey.PublicKey); err != nil {
-		s.logger.Error("Failed to remove user from WireGuard engine", zap.Error(err))
-		// Continue with database removal even if WireGuard removal fails
+	if _, err := s.db.Exec(ctx, `UPDATE servers SET last_seen_at = NOW() WHERE id = $1`, serverID); err != nil {
+		return fmt.Errorf("failed to record server last seen: %w", err)
+	}
+
+	counters := make(map[string]wgtypes.Peer, len(peers))
+	for _, peer := range peers {
+		counters[peer.PublicKey.String()] = peer
 	}
 
-	// Remove from database
-	query := `UPDATE user_keys SET is_active = false, updated_at = NOW() WHERE user_id = $1 AND server_id = $2`
-	_, err = s.db.Exec(ctx, query, userID, serverID)
+	query := `SELECT id, public_key, last_rx_bytes, last_tx_bytes FROM user_keys WHERE server_id = $1 AND is_active = true`
+	rows, err := s.db.Query(ctx, query, serverID)
 	if err != nil {
-		return fmt.Errorf("failed to deactivate user key: %w", err)
+		return fmt.Errorf("failed to query active keys: %w", err)
 	}
 
-	s.logger.Info("User key removed from WireGuard and database",
-		zap.String("user_id", userID.String()),
-		zap.String("server_id", serverID.String()))
+	type usageUpdate struct {
+		id             uuid.UUID
+		rxDelta, rxNow int64
+		txDelta, txNow int64
+		handshake      *time.Time // nil before the peer's first handshake
+	}
+
+	var updates []usageUpdate
+	for rows.Next() {
+		var (
+			id                  uuid.UUID
+			publicKey           string
+			lastRxBytes, lastTx int64
+		)
+		if err := rows.Scan(&id, &publicKey, &lastRxBytes, &lastTx); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan active key: %w", err)
+		}
+
+		peer, ok := counters[publicKey]
+		if !ok {
+			continue
+		}
+
+		update := usageUpdate{
+			id:      id,
+			rxDelta: counterDelta(lastRxBytes, peer.ReceiveBytes),
+			rxNow:   peer.ReceiveBytes,
+			txDelta: counterDelta(lastTx, peer.TransmitBytes),
+			txNow:   peer.TransmitBytes,
+		}
+		if !peer.LastHandshakeTime.IsZero() {
+			handshake := peer.LastHandshakeTime
+			update.handshake = &handshake
+		}
+		updates = append(updates, update)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate active keys: %w", err)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// GREATEST ignores NULL, so a missing handshake keeps the stored time
+	updateQuery := `
+		UPDATE user_keys
+		SET rx_bytes = rx_bytes + $2, tx_bytes = tx_bytes + $3, last_rx_bytes = $4, last_tx_bytes = $5,
+			last_used_at = GREATEST(last_used_at, $6)
+		WHERE id = $1
+	`
+	var rxDelta, txDelta int64
+	for _, update := range updates {
+		if _, err := tx.Exec(ctx, updateQuery, update.id, update.rxDelta, update.txDelta, update.rxNow, update.txNow, update.handshake); err != nil {
+			return fmt.Errorf("failed to update usage totals: %w", err)
+		}
+		rxDelta += update.rxDelta
+		txDelta += update.txDelta
+	}
+
+	// The server's totals are kept apart from its keys' so they never shrink when keys are deleted
+	var rxTotal, txTotal int64
+	serverQuery := `UPDATE servers SET rx_bytes = rx_bytes + $2, tx_bytes = tx_bytes + $3 WHERE id = $1 RETURNING rx_bytes, tx_bytes`
+	if err := tx.QueryRow(ctx, serverQuery, serverID, rxDelta, txDelta).Scan(&rxTotal, &txTotal); err != nil {
+		return fmt.Errorf("failed to update server traffic totals: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit usage totals: %w", err)
+	}
 
+	s.traffic.Set(serverID, rxTotal, txTotal)
 	return nil
 }
 
+// counterDelta returns the growth of a device byte counter, treating a decrease as a counter reset
+func counterDelta(last, current int64) int64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// UserUsage returns a user's persisted data usage on every server with an active key, plus totals
+func (s *WireguardService) UserUsage(ctx context.Context, userID uuid.UUID) (*models.UsageResponse, error) {
+	query := `
+		SELECT uk.server_id, s.name, uk.rx_bytes, uk.tx_bytes
+		FROM user_keys uk
+		JOIN servers s ON s.id = uk.server_id
+		WHERE uk.user_id = $1 AND uk.is_active = true
+		ORDER BY s.name
+	`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	var servers []*models.ServerUsage
+	for rows.Next() {
+		usage := &models.ServerUsage{}
+		if err := rows.Scan(&usage.ServerID, &usage.ServerName, &usage.ReceiveBytes, &usage.TransmitBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		servers = append(servers, usage)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate usage: %w", err)
+	}
+
+	return summarizeUsage(servers), nil
+}
+
+// summarizeUsage builds a usage response with grand totals from per-server usage
+func summarizeUsage(servers []*models.ServerUsage) *models.UsageResponse {
+	response := &models.UsageResponse{Servers: servers}
+	if response.Servers == nil {
+		response.Servers = []*models.ServerUsage{}
+	}
+
+	for _, usage := range servers {
+		response.TotalReceiveBytes += usage.ReceiveBytes
+		response.TotalTransmitBytes += usage.TransmitBytes
+	}
+
+	return response
+}
+
 // ListAuthorizedPeers lists all currently authorized peers in the WireGuard interface
 func (s *WireguardService) ListAuthorizedPeers() ([]wgtypes.Peer, error) {
 	if s.wgClient == nil {
@@ -330,3 +2973,167 @@ func (s *WireguardService) ListAuthorizedPeers() ([]wgtypes.Peer, error) {
 
 	return device.Peers, nil
 }
+
+// DeviceInfo describes the named WireGuard device, without its private key or peers. Only the
+// device this service manages can be read, so the API cannot be used to inspect other interfaces on
+// the host; any other name fails with ErrUnknownDevice.
+func (s *WireguardService) DeviceInfo(name string) (*models.DeviceInfo, error) {
+	if name != s.deviceName {
+		return nil, ErrUnknownDevice
+	}
+	if s.wgClient == nil {
+		return nil, fmt.Errorf("WireGuard client not available")
+	}
+
+	device, err := s.wgClient.Device(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get WireGuard device info: %w", err)
+	}
+
+	return &models.DeviceInfo{
+		Name:         device.Name,
+		Type:         device.Type.String(),
+		PublicKey:    device.PublicKey.String(),
+		ListenPort:   device.ListenPort,
+		FirewallMark: device.FirewallMark,
+		PeerCount:    len(device.Peers),
+	}, nil
+}
+
+// CachedPeers is ListAuthorizedPeers served from a copy at most peerCacheTTL old, for frequently
+// polled views where reading the device on every request would be wasteful
+func (s *WireguardService) CachedPeers() ([]wgtypes.Peer, error) {
+	s.peerCacheMu.Lock()
+	defer s.peerCacheMu.Unlock()
+
+	if s.peerCache != nil && time.Now().Before(s.peerCacheExpires) {
+		return s.peerCache, nil
+	}
+
+	peers, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return nil, err
+	}
+	if peers == nil {
+		peers = []wgtypes.Peer{}
+	}
+
+	s.peerCache = peers
+	s.peerCacheExpires = time.Now().Add(peerCacheTTL)
+	return peers, nil
+}
+
+// IsConnected reports whether a peer has completed a handshake within ConnectedHandshakeWindow
+func IsConnected(peer wgtypes.Peer, now time.Time) bool {
+	return !peer.LastHandshakeTime.IsZero() && now.Sub(peer.LastHandshakeTime) < ConnectedHandshakeWindow
+}
+
+// PeerStatuses reports the device status of each public key, in order, from a single read of the
+// device. Malformed keys get a per-entry error rather than failing the whole call.
+func (s *WireguardService) PeerStatuses(publicKeys []string) ([]*models.PeerStatus, error) {
+	peers, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[wgtypes.Key]*wgtypes.Peer, len(peers))
+	for i := range peers {
+		byKey[peers[i].PublicKey] = &peers[i]
+	}
+
+	now := time.Now()
+	statuses := make([]*models.PeerStatus, 0, len(publicKeys))
+	for _, publicKey := range publicKeys {
+		status := &models.PeerStatus{PublicKey: publicKey}
+		statuses = append(statuses, status)
+
+		key, err := wgtypes.ParseKey(publicKey)
+		if err != nil {
+			status.Error = "invalid public key"
+			continue
+		}
+
+		peer, ok := byKey[key]
+		if !ok {
+			continue
+		}
+		status.Programmed = true
+		status.Connected = IsConnected(*peer, now)
+		if !peer.LastHandshakeTime.IsZero() {
+			handshake := peer.LastHandshakeTime
+			status.LastHandshake = &handshake
+		}
+	}
+
+	return statuses, nil
+}
+
+// GetPeer returns the device-side configuration of the peer with the given public key
+func (s *WireguardService) GetPeer(publicKey string) (*wgtypes.Peer, error) {
+	pubKey, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	peers, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range peers {
+		if peers[i].PublicKey == pubKey {
+			return &peers[i], nil
+		}
+	}
+
+	return nil, ErrPeerNotFound
+}
+
+// ListAuthorizedPeersPage returns a page of authorized peers sorted by public key, along with the total peer count
+func (s *WireguardService) ListAuthorizedPeersPage(limit, offset int) ([]wgtypes.Peer, int, error) {
+	peers, err := s.ListAuthorizedPeers()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Sort by public key so pages are stable between requests
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].PublicKey.String() < peers[j].PublicKey.String()
+	})
+
+	total := len(peers)
+	if offset >= total {
+		return []wgtypes.Peer{}, total, nil
+	}
+
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	return peers[offset:end], total, nil
+}
+
+// ToPeerResponse converts a device peer to PeerResponse (removes the preshared key)
+func (s *WireguardService) ToPeerResponse(peer wgtypes.Peer) *models.PeerResponse {
+	allowedIPs := make([]string, 0, len(peer.AllowedIPs))
+	for _, ipNet := range peer.AllowedIPs {
+		allowedIPs = append(allowedIPs, ipNet.String())
+	}
+
+	response := &models.PeerResponse{
+		PublicKey:           peer.PublicKey.String(),
+		AllowedIPs:          allowedIPs,
+		LastHandshake:       peer.LastHandshakeTime,
+		ReceiveBytes:        peer.ReceiveBytes,
+		TransmitBytes:       peer.TransmitBytes,
+		PersistentKeepalive: int(peer.PersistentKeepaliveInterval.Seconds()),
+		PresharedKeySet:     peer.PresharedKey != wgtypes.Key{},
+	}
+
+	if peer.Endpoint != nil {
+		response.Endpoint = peer.Endpoint.String()
+	}
+
+	return response
+}